@@ -6,20 +6,56 @@ package discovery
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
 )
 
 //go:generate moq -out provider_mock.go -fmt goimports . Provider
 
 // Service implements discovery with multiple providers and url matcher
 type Service struct {
+	HealthCheckTimeout  time.Duration // ping timeout for health checks
+	HealthCheckInterval time.Duration // interval of background health checks, disabled if zero
+	DropConflicts       bool          // drop rules conflicting with rules of higher-priority providers
+	ProviderTimeout     time.Duration // max time of provider's List, defaultProviderTimeout if not set
+	MatchCacheSize      int           // max number of cached match results, the cache disabled if zero
+	StrictRoutes        bool          // drop rules with routes not anchored to the start of the path or too complex
+	RouteComplexity     int           // max size of compiled route, larger ones warned or dropped if strict, unlimited if zero
+	MaxMatchLen         int           // max length of source matched, longer ones never match, unlimited if zero
+	MaxMappers          int           // max number of rules, rules of lower-priority providers over it dropped, unlimited if zero
+	StartupWait         time.Duration // max time Match waits for the first load of rules, not waiting if zero
+	Logger              log.L         // logger of reloads, rules and health changes, nothing logged if not set
+
+	// PingClient makes client of health checks for the mapper, i.e. with TLS options of its route.
+	// Set before Run, http.DefaultClient or client of the unix socket used if not set
+	PingClient func(m URLMapper) *http.Client
+
 	providers []Provider
-	mappers   []URLMapper
-	lock      sync.RWMutex
+	state     atomic.Value         // the current *snapshot of mappers, read without locking
+	health    map[string]bool      // alive status by ping url
+	errs      map[ProviderID]error // the last List error of failing providers
+	loaded    chan struct{}        // closed once rules of any provider loaded, see StartupWait
+	loadOnce  sync.Once
+	lock      sync.RWMutex // protects health and errs, serializes changes of state
+
+	watchers   map[ProviderID][]watcher // watchers of events of providers, by provider id
+	events     chan struct{}            // update events of all providers, nil if Run not active
+	runCtx     context.Context          // context of active Run
+	priorities map[ProviderID]int       // priorities of providers set explicitly, zero by default
+	provLock   sync.Mutex               // protects providers, watchers, events, runCtx and priorities
+	reloads    reloadState              // update events requested and applied by Run, see WaitIdle
 }
 
 // URLMapper contains all info about source and destination routes
@@ -28,13 +64,107 @@ type URLMapper struct {
 	SrcMatch   regexp.Regexp
 	Dst        string
 	ProviderID ProviderID
+	Name       string // optional name of the rule, set by provider
+	MatchID    string // stable id of the rule, hash of server, route and destination, set on load
 	PingURL    string
+	PingStatus int               // expected status of ping response, 200 if zero
+	PingBody   string            // expected substring of ping response body, not checked if empty
+	Resolve    map[string]string // static host->ip overrides for destination dialing
+
+	// DstFunc makes the destination from submatches of SrcMatch, the whole match first, instead of Dst template.
+	// Available for mappers made in code only, i.e. by custom providers
+	DstFunc func(submatches []string) string
+
+	// MatchPrefix swaps the literal path prefix for the upstream base url, instead of expanding Dst template.
+	// Dst, ABDst, CanaryDst and MirrorDst are base urls with the rest of the path and the query appended,
+	// i.e. /shop/cart?id=1 of /shop prefix proxied to http://backend/v2/cart?id=1 with http://backend/v2 dst.
+	// SrcMatch should be made by PrefixRoute
+	MatchPrefix string
+
+	// verification of upstream's certificate. TLSServerName verified instead of destination host, if set.
+	// InsecureSkipVerify turns verification off, i.e. for self-signed certificates, CACert is a path of PEM file
+	// with CAs of upstream's certificate, system's CAs used if empty
+	TLSServerName      string
+	InsecureSkipVerify bool
+	CACert             string
+
+	// Host header of upstream requests is the destination host by default. PreserveHost passes the client's Host,
+	// HostHeader sets the given one and takes precedence over PreserveHost
+	PreserveHost bool
+	HostHeader   string
+
+	// A/B testing, ABWeight percent of users routed to ABDst instead of Dst.
+	// ABKey is a cookie or header name identifying user for the stable assignment.
+	ABDst    string
+	ABWeight int
+	ABKey    string
+
+	// canary release, CanaryPercent percent of requests routed to CanaryDst instead of Dst, picked randomly
+	// for each request. Applied to any mapper of the pool
+	CanaryDst     string
+	CanaryPercent int
+
+	// traffic mirroring, a copy of each proxied request sent to MirrorDst in background, once the response of
+	// the destination served. MirrorDst may refer to matched groups the same way as Dst, mirror's response discarded
+	MirrorDst string
+
+	// session affinity of the pool, requests of the same client routed to the same mapper of the pool.
+	// StickyKey is a cookie or header identifying the client, the proxy's own cookie (see StickyCookie) used if empty
+	Sticky    bool
+	StickyKey string
+
+	Methods []string // allowed http methods, any method matched if empty
+
+	// HeaderMatch requires all headers of the request to match, by canonical header name.
+	// Missing header matched as empty string
+	HeaderMatch map[string]*regexp.Regexp
+
+	Weight int // weight in the pool of mappers with the same server and route, default 1
+
+	Timeout     time.Duration // request timeout, proxy's default used if zero
+	Headers     []string      // "key:value" headers set on the upstream request
+	Cache       bool          // cache GET and HEAD responses, if proxy's cache enabled
+	RewriteBody bool          // replace destination's base url in response bodies with the requested one
+	Retries     int           // retries of idempotent requests failed to connect or with 502, 503 and 504 responses
+	MaxBodySize int64         // max size of request body in bytes, unlimited if zero
+	AllowIPs    []string      // ips and cidrs of clients allowed to access the route, all clients allowed if empty
+
+	// ClientCN requires verified tls client certificate with subject common name matching it,
+	// any client allowed if nil
+	ClientCN *regexp.Regexp
+
+	// pooling of keep-alive connections to the destination host, proxy's defaults used if zero
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// static assets served by the proxy for MTStatic mappers, Dst is a local directory with files
+	MatchType     MatchType
+	AssetsWebRoot string // url prefix of assets, stripped from the path
+	AssetsSPA     bool   // serve index.html for unknown paths, for single page applications
+
+	RedirectCode int // status of MTRedirect mappers, 301, 302, 307 or 308. Dst is the Location of redirect
+
+	Alive bool // health state set by the service, dead mappers skipped by Match
 }
 
-// Provider defines sources of mappers
+// MatchType defines the kind of the mapper
+type MatchType int
+
+// enum of all match types
+const (
+	MTProxy    MatchType = iota // proxy to the destination url
+	MTStatic                    // serve static files from the local directory
+	MTRedirect                  // redirect client to the destination url
+)
+
+// Provider defines sources of mappers. Events sends update event on change of mappers, List returns all of them.
+// The initial event, if provider sends one, should be in the channel once Events returns, i.e. sent to buffered
+// channel, it's skipped by Service loading mappers on start anyway. Events sent later should reflect changes made
+// after Events call
 type Provider interface {
 	Events(ctx context.Context) (res <-chan struct{})
-	List() (res []URLMapper, err error)
+	List(ctx context.Context) (res []URLMapper, err error)
 	ID() ProviderID
 }
 
@@ -46,145 +176,752 @@ const (
 	PIDocker ProviderID = "docker"
 	PIStatic ProviderID = "static"
 	PIFile   ProviderID = "file"
+	PISQL    ProviderID = "sql"
+	PIK8s    ProviderID = "k8s"
+	PIConsul ProviderID = "consul"
+	PINginx  ProviderID = "nginx"
 )
 
+// DefaultRoute is a source route of default mappers in providers, compiled to empty regex
+const DefaultRoute = "*"
+
+// defaultProviderTimeout used if ProviderTimeout not set
+const defaultProviderTimeout = 10 * time.Second
+
 // NewService makes service with given providers
 func NewService(providers []Provider) *Service {
-	return &Service{providers: providers}
+	return &Service{providers: providers, loaded: make(chan struct{})}
 }
 
-// Run runs blocking loop getting events from all providers
-// and updating all mappers on each event
+// Run loads mappers from all providers once and runs blocking loop getting events from all providers
+// and updating all mappers on each event. Providers added or removed while running picked up right away
 func (s *Service) Run(ctx context.Context) error {
 
-	evChs := make([]<-chan struct{}, 0, len(s.providers))
+	s.provLock.Lock()
+	s.events = make(chan struct{}, 1)
+	s.watchers = map[ProviderID][]watcher{}
+	s.runCtx = ctx
 	for _, p := range s.providers {
-		evChs = append(evChs, p.Events(ctx))
+		s.watch(p)
 	}
-	ch := s.mergeEvents(ctx, evChs...)
+	events := s.events
+	s.provLock.Unlock()
+	defer func() {
+		s.provLock.Lock()
+		s.events, s.watchers, s.runCtx = nil, nil, nil
+		s.provLock.Unlock()
+		s.reloads.stop()
+	}()
+
+	req := s.reloads.start()
+	s.reload(ctx)
+	s.reloads.done(req)
+	go s.runHealthChecks(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ch:
-			log.Printf("[DEBUG] new update event received")
-			lst := s.mergeLists()
-			for _, m := range lst {
-				log.Printf("[INFO] match for %s: %s %s %s", m.ProviderID, m.Server, m.SrcMatch.String(), m.Dst)
+		case <-events:
+			s.logf("[DEBUG] new update event received")
+			req = s.reloads.start()
+			s.reload(ctx)
+			s.reloads.done(req)
+		}
+	}
+}
+
+// AddProvider adds provider, the last one among providers of the same priority. If the service is running,
+// rules of all providers reloaded and the provider's events watched from now on
+func (s *Service) AddProvider(p Provider) {
+	s.provLock.Lock()
+	defer s.provLock.Unlock()
+	s.providers = append(s.providers, p)
+	if s.events != nil {
+		s.watch(p)
+		s.notify(s.events)
+	}
+}
+
+// RemoveProvider removes all providers with the id. If the service is running, their events not watched
+// anymore and rules of the remaining providers reloaded
+func (s *Service) RemoveProvider(id ProviderID) {
+	s.provLock.Lock()
+	defer s.provLock.Unlock()
+	res := make([]Provider, 0, len(s.providers))
+	for _, p := range s.providers {
+		if p.ID() != id {
+			res = append(res, p)
+		}
+	}
+	s.providers = res
+	s.setProviderError(id, nil)
+	if s.events != nil {
+		for _, w := range s.watchers[id] {
+			w.cancel()
+		}
+		delete(s.watchers, id)
+		s.notify(s.events)
+	}
+}
+
+// SetPriority sets priority of providers with the id. Rules of providers with higher priority win conflicts and
+// match before equally specific rules of providers with lower priority. Providers of the same priority, zero by default,
+// keep the order they added in. If the service is running, rules of all providers reloaded
+func (s *Service) SetPriority(id ProviderID, p int) {
+	s.provLock.Lock()
+	defer s.provLock.Unlock()
+	if s.priorities == nil {
+		s.priorities = map[ProviderID]int{}
+	}
+	s.priorities[id] = p
+	if s.events != nil {
+		s.notify(s.events)
+	}
+}
+
+// watch passes events of the provider to the events of Run, until the provider removed or Run stopped.
+// The initial event sent by the provider before Events returned skipped, it is covered by the initial load of Run.
+// Should be called under provLock
+func (s *Service) watch(p Provider) {
+	ctx, cancel := context.WithCancel(s.runCtx)
+	id := p.ID()
+	syncs := make(chan chan struct{})
+	s.watchers[id] = append(s.watchers[id], watcher{ctx: ctx, cancel: cancel, syncs: syncs})
+	evCh := p.Events(ctx)
+	select {
+	case <-evCh:
+	default:
+	}
+	go func(events chan struct{}) {
+		defer cancel() // stopped watcher not synced by WaitIdle, i.e. once events of the provider closed
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-evCh:
+				if !ok {
+					return
+				}
+				s.notify(events)
+			case ack := <-syncs:
+				ok := s.drainEvents(evCh, events)
+				close(ack)
+				if !ok {
+					return
+				}
 			}
-			s.lock.Lock()
-			s.mappers = make([]URLMapper, len(lst))
-			copy(s.mappers, lst)
-			s.lock.Unlock()
+		}
+	}(s.events)
+}
+
+// drainEvents passes events buffered by the provider's channel to Run without waiting for more of them.
+// Returns false if the channel closed
+func (s *Service) drainEvents(evCh <-chan struct{}, events chan struct{}) bool {
+	for {
+		select {
+		case _, ok := <-evCh:
+			if !ok {
+				return false
+			}
+			s.notify(events)
+		default:
+			return true
 		}
 	}
 }
 
-// Match url to all mappers
-func (s *Service) Match(srv, src string) (string, bool) {
+// notify sends update event without blocking. Events sent while another one pending merged with it,
+// a single reload is enough for all of them. Each event counted as requested, see WaitIdle
+func (s *Service) notify(events chan struct{}) {
+	s.reloads.request()
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
 
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	for _, m := range s.mappers {
-		if m.Server != "*" && m.Server != "" && m.Server != srv {
-			continue
+// reload gets rules from all providers and replaces current mappers with them
+func (s *Service) reload(ctx context.Context) {
+	lst := s.mergeLists(ctx)
+	loaded := len(s.ProviderErrors()) < len(s.providersList()) // rules of at least one provider loaded
+	for _, m := range lst {
+		s.logf("[INFO] match for %s: %s %s %s", m.ProviderID, m.Server, m.SrcMatch.String(), m.Dst)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.setSnapshot(NewMatcher(lst).withAlive(s.alive), s.snapshot().gen+1)
+	expMappers.Set(int64(len(lst)))
+	if s.loaded != nil && loaded {
+		s.loadOnce.Do(func() { close(s.loaded) }) // release matches waiting for the first load
+	}
+}
+
+// waitLoaded blocks until the first load of rules or StartupWait passed, returns right away once loaded
+func (s *Service) waitLoaded(ctx context.Context) {
+	if s.StartupWait <= 0 || s.loaded == nil {
+		return
+	}
+	select {
+	case <-s.loaded:
+		return
+	default:
+	}
+	tm := time.NewTimer(s.StartupWait)
+	defer tm.Stop()
+	select {
+	case <-s.loaded:
+	case <-tm.C:
+	case <-ctx.Done():
+	}
+}
+
+// Precedence returns ids of providers, from the highest priority to the lowest one.
+// Rules of the higher-priority provider win conflicts, see mergeLists and SetPriority
+func (s *Service) Precedence() []string {
+	providers := s.providersList()
+	res := make([]string, 0, len(providers))
+	for _, p := range providers {
+		res = append(res, string(p.ID()))
+	}
+	return res
+}
+
+// logf logs with Logger, if set
+func (s *Service) logf(format string, args ...interface{}) {
+	if s.Logger == nil {
+		return
+	}
+	s.Logger.Logf(format, args...)
+}
+
+// providersList returns a copy of providers ordered by priority, safe to use while providers added or removed
+func (s *Service) providersList() []Provider {
+	s.provLock.Lock()
+	defer s.provLock.Unlock()
+	res := make([]Provider, len(s.providers))
+	copy(res, s.providers)
+	if len(s.priorities) > 0 {
+		sort.SliceStable(res, func(i, j int) bool { return s.priorities[res[i].ID()] > s.priorities[res[j].ID()] })
+	}
+	return res
+}
+
+// Generation returns generation of mappers, incremented on each reload. Match and Mappers always
+// reflect the latest generation, in-flight requests matched by previous generations complete as is
+func (s *Service) Generation() int {
+	return s.snapshot().gen
+}
+
+// Match url to all mappers. Empty method matches rules with any allowed methods
+func (s *Service) Match(srv, src, method string) (string, bool) {
+	_, dest, ok := s.MatchMapper(srv, src, method)
+	return dest, ok
+}
+
+// MatchURL matches request uri (path with the raw query) to all mappers and returns rewritten destination url
+func (s *Service) MatchURL(srv string, u *url.URL) (string, bool) {
+	return s.Match(srv, u.RequestURI(), "")
+}
+
+// MatchMapper url to all mappers, returns matched mapper along with the destination.
+// Src may have the raw query, see URLMapper.Rewrite for details. MTStatic mappers matched by AssetsWebRoot prefix
+// of the path and return their local assets directory as the destination.
+// Default mappers (see URLMapper.IsDefault) used only if no other mapper matched, the server's default goes
+// before the catch-all one.
+// Server (host) matched case-insensitive. If no match found returns empty mapper and src as destination.
+// Results of the walk cached if MatchCacheSize set, pools of mappers still rotated on each call.
+// With StartupWait calls made before the first load of rules wait for it
+func (s *Service) MatchMapper(srv, src, method string) (URLMapper, string, bool) {
+	s.waitLoaded(context.Background())
+	return s.match(srv, src, method, nil)
+}
+
+// MatchRequest matches the request the same way as MatchMapper with the request's method, src is the request uri
+// (path with the raw query). Mappers with HeaderMatch also require headers of the request to match.
+// Sticky pools route the request to the member it's bound to by the affinity cookie or StickyKey
+func (s *Service) MatchRequest(srv, src string, r *http.Request) (URLMapper, string, bool) {
+	s.waitLoaded(r.Context())
+	return s.match(srv, src, r.Method, r.Header)
+}
+
+func (s *Service) match(srv, src, method string, headers http.Header) (m URLMapper, dest string, ok bool) {
+	defer func() { countMatch(ok) }()
+
+	if s.MaxMatchLen > 0 && len(src) > s.MaxMatchLen {
+		return URLMapper{}, src, false
+	}
+
+	st := s.snapshot()
+	if st.matches == nil {
+		return st.matcher.result(st.matcher.find(srv, src, method, headers), src, headers)
+	}
+	key := strings.ToLower(srv) + " " + method + " " + src
+	for _, h := range st.matcher.matchHdrs {
+		key += "\n" + headers.Get(h)
+	}
+	r, cached := st.matches.get(key, st.version)
+	if !cached {
+		r = st.matcher.find(srv, src, method, headers)
+		st.matches.put(key, st.version, r)
+	}
+	return st.matcher.result(r, src, headers)
+}
+
+// MatchAll returns destinations of all mappers matching server and src with any method, in precedence order,
+// i.e. for mirroring of requests. Mappers matched the same way as Match, but pools of mappers not rotated,
+// each alive member of the pool returned, and canary destinations not picked. Empty if nothing matched
+func (s *Service) MatchAll(srv, src string) []string {
+	s.waitLoaded(context.Background())
+	if s.MaxMatchLen > 0 && len(src) > s.MaxMatchLen {
+		return nil
+	}
+	return s.snapshot().matcher.MatchAll(srv, src)
+}
+
+// TestMatch matches server and path (with optional query) to mappers the same way as Match with any method,
+// for dry runs of rules. Doesn't change the state, the first mapper of a pool returned and match cache not used
+func (s *Service) TestMatch(server, path string) (URLMapper, string, bool) {
+	mt := s.snapshot().matcher
+	r := mt.find(server, path, "", nil)
+	if r.idx < 0 {
+		return URLMapper{}, path, false
+	}
+	return mt.mappers[r.idx], r.dest, true
+}
+
+// IsDefault checks if the mapper is a default one, with empty source route matching all requests.
+// Destination of the default mapper is the base url, the request's path and query appended to it as is
+func (m URLMapper) IsDefault() bool {
+	return m.SrcMatch.String() == "" && m.MatchType == MTProxy
+}
+
+func (m URLMapper) specificServer() bool {
+	return m.Server != "*" && m.Server != ""
+}
+
+// Rewrite matches src against the mapper's source route and expands tmpl with captured groups.
+// Src may have the raw query after "?". Routes referencing the query, i.e. with escaped "\?", matched against
+// the full src, other routes matched against the path only and the query passed to the result as is.
+// For default mappers src appended to tmpl, for mappers with MatchPrefix the prefix swapped for tmpl.
+func (m URLMapper) Rewrite(src, tmpl string) string {
+	if m.IsDefault() {
+		return strings.TrimSuffix(tmpl, "/") + src
+	}
+	if m.MatchPrefix != "" {
+		return m.rewrite(src, func(s string) string { return swapPrefix(s, m.MatchPrefix, tmpl) })
+	}
+	return m.rewrite(src, func(s string) string { return m.SrcMatch.ReplaceAllString(s, tmpl) })
+}
+
+// dest makes the destination for src with DstFunc if defined, with Dst template otherwise.
+// Src returned as is if not matched by the route
+func (m URLMapper) dest(src string) string {
+	if m.DstFunc == nil || m.IsDefault() {
+		return m.Rewrite(src, m.Dst)
+	}
+	return m.rewrite(src, func(s string) string {
+		sm := m.SrcMatch.FindStringSubmatch(s)
+		if sm == nil {
+			return s
 		}
-		dest := m.SrcMatch.ReplaceAllString(src, m.Dst)
-		if src != dest {
-			return dest, true
+		return m.DstFunc(sm)
+	})
+}
+
+// rewrite applies replace to the part of src matched by the route, the full src or the path only,
+// and passes the query of src to the result in the latter case
+func (m URLMapper) rewrite(src string, replace func(string) string) string {
+	path, query := src, ""
+	if i := strings.Index(src, "?"); i >= 0 {
+		path, query = src[:i], src[i+1:]
+	}
+	if query == "" || m.MatchQuery() {
+		return replace(src)
+	}
+	res := replace(path)
+	if strings.Contains(res, "?") {
+		return res + "&" + query
+	}
+	return res + "?" + query
+}
+
+// PrefixRoute makes the source route of mappers with MatchPrefix. The route matches the prefix itself and
+// paths under it, i.e. /shop matches /shop and /shop/cart but not /shopping. Trailing slash of prefix ignored
+func PrefixRoute(prefix string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(prefix, "/") || strings.Contains(prefix, "?") {
+		return nil, errors.Errorf("invalid prefix %q, should be a path starting with /", prefix)
+	}
+	return CompileRegex("^" + regexp.QuoteMeta(strings.TrimSuffix(prefix, "/")) + "(/.*)?$")
+}
+
+// swapPrefix replaces the prefix of path with base url, path returned as is if not under the prefix
+func swapPrefix(path, prefix, base string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + rest
+}
+
+// MatchQuery checks if the source route references the query string
+func (m URLMapper) MatchQuery() bool {
+	return strings.Contains(m.SrcMatch.String(), `\?`)
+}
+
+// MatchMethod checks if the method allowed by the mapper, case-insensitive.
+// Mappers without methods allow all of them, empty method allowed by all mappers.
+func (m URLMapper) MatchMethod(method string) bool {
+	if len(m.Methods) == 0 || method == "" {
+		return true
+	}
+	for _, mt := range m.Methods {
+		if strings.EqualFold(mt, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHeaders checks if headers match all HeaderMatch of the mapper
+func (m URLMapper) MatchHeaders(headers http.Header) bool {
+	for name, rx := range m.HeaderMatch {
+		if !rx.MatchString(headers.Get(name)) {
+			return false
 		}
 	}
-	return src, false
+	return true
 }
 
-// Servers return list of all servers, skips "*" (catch-all/default)
+// Servers return sorted list of unique servers in lower case, skips "*" (catch-all/default)
 func (s *Service) Servers() (servers []string) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	for _, m := range s.mappers {
+	seen := map[string]bool{}
+	for _, m := range s.snapshot().matcher.mappers {
 		if m.Server == "*" || m.Server == "" {
 			continue
 		}
-		servers = append(servers, m.Server)
+		srv := strings.ToLower(m.Server)
+		if seen[srv] {
+			continue
+		}
+		seen[srv] = true
+		servers = append(servers, srv)
 	}
+	sort.Strings(servers)
 	return servers
 }
 
-// Mappers return list of all mappers
+// Mappers return list of all mappers. The list is shared by all callers and replaced as a whole on changes,
+// it should not be modified
 func (s *Service) Mappers() (mappers []URLMapper) {
+	return s.snapshot().matcher.mappers
+}
+
+// ProviderErrors returns the last List error of each failing provider.
+// Providers recovered on the next reload removed from the result
+func (s *Service) ProviderErrors() map[ProviderID]error {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	mappers = append(mappers, s.mappers...)
-	return mappers
+	res := make(map[ProviderID]error, len(s.errs))
+	for k, v := range s.errs {
+		res[k] = v
+	}
+	return res
 }
 
-func (s *Service) mergeLists() (res []URLMapper) {
-	for _, p := range s.providers {
-		lst, err := p.List()
+// SnapshotProviders gets rules of all providers and returns them as listed, by provider id, i.e. for diagnostics.
+// Rules not merged, extended or checked, and state of the service not changed. Each List limited by ProviderTimeout,
+// failing providers reported with a warning and missing in the result
+func (s *Service) SnapshotProviders() map[ProviderID][]URLMapper {
+	res := map[ProviderID][]URLMapper{}
+	for _, p := range s.providersList() {
+		id := p.ID()
+		lst, err := s.list(context.Background(), p)
+		if err != nil {
+			s.logf("[WARN] can't get rules of %s provider for snapshot, %v", id, err)
+			continue
+		}
+		res[id] = append(res[id], lst...)
+	}
+	return res
+}
+
+func (s *Service) setProviderError(id ProviderID, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err == nil {
+		delete(s.errs, id)
+		return
+	}
+	if s.errs == nil {
+		s.errs = map[ProviderID]error{}
+	}
+	s.errs[id] = err
+}
+
+// mergeLists gets rules of all providers, from the highest priority to the lowest one, and resolves conflicts.
+// Rules over MaxMappers dropped, the ones of higher-priority providers kept
+func (s *Service) mergeLists(ctx context.Context) (res []URLMapper) {
+	expReloads.Add(1)
+	counts := map[ProviderID]int{}
+	defer func() { setProviderRules(counts) }()
+	dropped := map[ProviderID]int{}
+	defer func() {
+		for id, n := range dropped {
+			s.logf("[WARN] %d rules of %s provider dropped, total number of rules exceeds %d", n, id, s.MaxMappers)
+		}
+	}()
+	for _, p := range s.providersList() {
+		id := p.ID()
+		lst, err := s.list(ctx, p)
+		s.setProviderError(id, err)
+		counts[id] += len(lst)
 		if err != nil {
+			s.logf("[WARN] can't get rules of %s provider, skipped, %v", id, err)
 			continue
 		}
-		for i := range lst {
-			lst[i] = s.extendRule(lst[i])
-			lst[i].ProviderID = p.ID()
+		for _, m := range lst {
+			m = s.extendRule(s.expandEnv(m))
+			m.ProviderID = id
+			m.MatchID = matchID(m)
+			if !s.checkRoute(m) {
+				continue
+			}
+			if s.MaxMappers > 0 && len(res) >= s.MaxMappers {
+				dropped[id]++
+				continue
+			}
+			res = append(res, m)
 		}
-		res = append(res, lst...)
+	}
+	return s.resolveConflicts(res)
+}
+
+// list gets rules of the provider, limited by ProviderTimeout. Providers ignoring ctx can't stall the merge,
+// result of such provider discarded once the timeout passed
+func (s *Service) list(ctx context.Context, p Provider) ([]URLMapper, error) {
+	timeout := s.ProviderTimeout
+	if timeout <= 0 {
+		timeout = defaultProviderTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		lst []URLMapper
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		lst, err := p.List(ctx)
+		resCh <- result{lst: lst, err: err}
+	}()
+	select {
+	case r := <-resCh:
+		return r.lst, r.err
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "list timed out after %v", timeout)
+	}
+}
+
+// resolveConflicts warns about rules with the same server, route, methods and header matches defined by different
+// providers with different destinations. Such rules make a pool, unless DropConflicts set. In this case only rules
+// of the first (higher-priority) provider kept. Duplicates of the same provider are a pool by design.
+func (s *Service) resolveConflicts(mappers []URLMapper) []URLMapper {
+	type owner struct {
+		provider ProviderID
+		dst      string
+	}
+	owners := map[string]owner{}
+	res := make([]URLMapper, 0, len(mappers))
+	for _, m := range mappers {
+		key := poolKey(m)
+		o, ok := owners[key]
+		if !ok {
+			owners[key] = owner{provider: m.ProviderID, dst: m.Dst}
+			res = append(res, m)
+			continue
+		}
+		if o.provider == m.ProviderID || o.dst == m.Dst {
+			res = append(res, m)
+			continue
+		}
+		if !s.DropConflicts {
+			s.logf("[WARN] conflicting rule %s %s of %s provider, %s and %s (from %s) pooled", m.Server,
+				m.SrcMatch.String(), m.ProviderID, m.Dst, o.dst, o.provider)
+			res = append(res, m)
+			continue
+		}
+		s.logf("[WARN] conflicting rule %s %s of %s provider dropped, %s of %s provider used instead of %s",
+			m.Server, m.SrcMatch.String(), m.ProviderID, o.dst, o.provider, m.Dst)
 	}
 	return res
 }
 
+// literalPrefix returns literal string all matches of the rule start with, ignoring ^ anchor
+func literalPrefix(rx regexp.Regexp) string {
+	src := rx.String()
+	if !strings.HasPrefix(src, "^") {
+		prefix, _ := rx.LiteralPrefix()
+		return prefix
+	}
+	unanchored, err := CompileRegex(strings.TrimPrefix(src, "^"))
+	if err != nil {
+		return ""
+	}
+	prefix, _ := unanchored.LiteralPrefix()
+	return prefix
+}
+
+// reGroupRef matches references to capture groups in destinations, i.e. $1, $2, ${1} or ${name}
+var reGroupRef = regexp.MustCompile(`\$(\d|\{\w+\})`)
+
 // extendRule from /something/blah->http://example.com/api to ^/something/blah/(.*)->http://example.com/api/$1
 func (s *Service) extendRule(m URLMapper) URLMapper {
 
 	src := m.SrcMatch.String()
 
-	// TODO: Probably should be ok in practice but we better figure a nicer way to do it
-	if strings.Contains(m.Dst, "$1") || strings.Contains(src, "(") || !strings.HasSuffix(src, "/") {
+	// rules with groups in the route, references to groups in the destination or DstFunc already defined explicitly
+	if m.MatchType == MTStatic || m.DstFunc != nil || reGroupRef.MatchString(m.Dst) || reGroupRef.MatchString(m.ABDst) ||
+		reGroupRef.MatchString(m.CanaryDst) || reGroupRef.MatchString(m.MirrorDst) || strings.Contains(src, "(") ||
+		!strings.HasSuffix(src, "/") {
 		return m
 	}
-	res := URLMapper{
-		Server:     m.Server,
-		Dst:        strings.TrimSuffix(m.Dst, "/") + "/$1",
-		ProviderID: m.ProviderID,
-		PingURL:    m.PingURL,
+	res := m
+	res.Dst = strings.TrimSuffix(m.Dst, "/") + "/$1"
+	if m.ABDst != "" {
+		res.ABDst = strings.TrimSuffix(m.ABDst, "/") + "/$1"
+	}
+	if m.CanaryDst != "" {
+		res.CanaryDst = strings.TrimSuffix(m.CanaryDst, "/") + "/$1"
+	}
+	if m.MirrorDst != "" {
+		res.MirrorDst = strings.TrimSuffix(m.MirrorDst, "/") + "/$1"
 	}
 
-	rx, err := regexp.Compile("^" + strings.TrimSuffix(src, "/") + "/(.*)")
+	rx, err := CompileRegex("^" + strings.TrimSuffix(src, "/") + "/(.*)")
 	if err != nil {
-		log.Printf("[WARN] can't extend %s, %v", m.SrcMatch.String(), err)
+		s.logf("[WARN] can't extend %s, %v", m.SrcMatch.String(), err)
 		return m
 	}
 	res.SrcMatch = *rx
+	s.logf("[INFO] rule %s -> %s extended to %s -> %s", src, m.Dst, res.SrcMatch.String(), res.Dst)
 	return res
 }
 
-func (s *Service) mergeEvents(ctx context.Context, chs ...<-chan struct{}) <-chan struct{} {
-	var wg sync.WaitGroup
-	out := make(chan struct{})
+// reEnvRef matches references to environment variables in destinations, i.e. ${HOST} or ${HOST:-localhost}.
+// Names can't start with a digit, ${1} is a reference to a capture group
+var reEnvRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
 
-	output := func(ctx context.Context, c <-chan struct{}) {
-		defer wg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case v, ok := <-c:
-				if !ok {
-					return
-				}
-				out <- v
+// expandEnv replaces references to environment variables in destinations with their values,
+// defaults used for unset or empty variables. References matching names of capture groups
+// of the route kept as is, i.e. ${id} with ^/api/(?P<id>\d+) in the route
+func (s *Service) expandEnv(m URLMapper) URLMapper {
+	groups := map[string]bool{}
+	for _, name := range m.SrcMatch.SubexpNames() {
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	expand := func(dst string) string {
+		return reEnvRef.ReplaceAllStringFunc(dst, func(ref string) string {
+			sm := reEnvRef.FindStringSubmatch(ref)
+			if groups[sm[1]] {
+				return ref
+			}
+			if val := os.Getenv(sm[1]); val != "" {
+				return val
 			}
+			if sm[2] == "" {
+				s.logf("[WARN] environment variable %s referenced by %s not set", sm[1], dst)
+			}
+			return sm[3]
+		})
+	}
+	m.Dst = expand(m.Dst)
+	if m.ABDst != "" {
+		m.ABDst = expand(m.ABDst)
+	}
+	if m.CanaryDst != "" {
+		m.CanaryDst = expand(m.CanaryDst)
+	}
+	if m.MirrorDst != "" {
+		m.MirrorDst = expand(m.MirrorDst)
+	}
+	return m
+}
+
+// matchID returns stable id of the rule, the same for rules with the same server, route and destination
+func matchID(m URLMapper) string {
+	hh := fnv.New64a()
+	_, _ = hh.Write([]byte(m.Server + "\n" + m.SrcMatch.String() + "\n" + m.Dst))
+	return fmt.Sprintf("%016x", hh.Sum64())
+}
+
+// checkRoute warns about routes not anchored with ^, too complex (see RouteComplexity) or missing groups
+// referred by destinations. Returns false for such routes in StrictRoutes mode, the rule should be dropped
+func (s *Service) checkRoute(m URLMapper) bool {
+	if unanchoredRoute(m) {
+		if s.StrictRoutes {
+			s.logf("[WARN] rule %s %s of %s provider dropped, route not anchored with ^", m.Server, m.SrcMatch.String(), m.ProviderID)
+			return false
+		}
+		s.logf("[WARN] route %s of %s provider not anchored with ^, matches anywhere in the path", m.SrcMatch.String(), m.ProviderID)
+	}
+	if refs := m.missingGroups(); len(refs) > 0 {
+		if s.StrictRoutes {
+			s.logf("[WARN] rule %s %s of %s provider dropped, destination refers to missing groups %s",
+				m.Server, m.SrcMatch.String(), m.ProviderID, strings.Join(refs, ", "))
+			return false
+		}
+		s.logf("[WARN] route %s of %s provider has no groups %s referred by destination, replaced with empty string",
+			m.SrcMatch.String(), m.ProviderID, strings.Join(refs, ", "))
+	}
+	if s.RouteComplexity <= 0 || m.IsDefault() {
+		return true
+	}
+	if c := routeComplexity(&m.SrcMatch); c > s.RouteComplexity {
+		if s.StrictRoutes {
+			s.logf("[WARN] rule %s %s of %s provider dropped, route complexity %d exceeds %d",
+				m.Server, m.SrcMatch.String(), m.ProviderID, c, s.RouteComplexity)
+			return false
 		}
+		s.logf("[WARN] route %s of %s provider is too complex, complexity %d exceeds %d, slows down matching",
+			m.SrcMatch.String(), m.ProviderID, c, s.RouteComplexity)
 	}
+	return true
+}
 
-	wg.Add(len(chs))
-	for _, c := range chs {
-		go output(ctx, c)
+// missingGroups returns references to groups missing in the route, of all destination templates of the mapper.
+// Default, static and prefix mappers, as well as mappers with DstFunc, have no templates
+func (m URLMapper) missingGroups() (res []string) {
+	if m.MatchType == MTStatic || m.IsDefault() || m.MatchPrefix != "" {
+		return nil
+	}
+	var tmpls []string
+	if m.DstFunc == nil {
+		tmpls = append(tmpls, m.Dst)
+	}
+	seen := map[string]bool{}
+	for _, tmpl := range append(tmpls, m.ABDst, m.CanaryDst, m.MirrorDst) {
+		for _, ref := range missingGroups(&m.SrcMatch, tmpl) {
+			if !seen[ref] {
+				seen[ref] = true
+				res = append(res, ref)
+			}
+		}
 	}
+	return res
+}
 
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-	return out
+// unanchoredRoute checks if the route of proxy mapper may match in the middle of the path.
+// Default mappers with empty route match everything by design and static mappers matched by prefix
+func unanchoredRoute(m URLMapper) bool {
+	if m.MatchType == MTStatic || m.IsDefault() {
+		return false
+	}
+	return !strings.HasPrefix(m.SrcMatch.String(), "^")
 }
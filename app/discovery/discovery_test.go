@@ -1,12 +1,23 @@
 package discovery
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	log "github.com/go-pkgz/lgr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -18,7 +29,7 @@ func TestService_Do(t *testing.T) {
 			res <- struct{}{}
 			return res
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
 				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/blah1/$1"},
 				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/blah2/$1/abc"},
@@ -32,7 +43,7 @@ func TestService_Do(t *testing.T) {
 		EventsFunc: func(ctx context.Context) <-chan struct{} {
 			return make(chan struct{}, 1)
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
 				{Server: "localhost", SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
 			}, nil
@@ -51,81 +62,1460 @@ func TestService_Do(t *testing.T) {
 	assert.Equal(t, context.DeadlineExceeded, err)
 	mappers := svc.Mappers()
 	assert.Equal(t, 3, len(mappers))
-	assert.Equal(t, PIFile, mappers[0].ProviderID)
-	assert.Equal(t, "*", mappers[0].Server)
-	assert.Equal(t, "^/api/svc1/(.*)", mappers[0].SrcMatch.String())
-	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", mappers[0].Dst)
+	assert.Equal(t, PIDocker, mappers[0].ProviderID, "longer literal prefix goes first")
+	assert.Equal(t, "localhost", mappers[0].Server)
+	assert.Equal(t, "/api/svc3/xyz", mappers[0].SrcMatch.String())
+
+	assert.Equal(t, PIFile, mappers[1].ProviderID)
+	assert.Equal(t, "*", mappers[1].Server)
+	assert.Equal(t, "^/api/svc1/(.*)", mappers[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", mappers[1].Dst)
+	assert.Equal(t, "^/api/svc2/(.*)", mappers[2].SrcMatch.String(), "same prefix length keeps providers order")
 
 	assert.Equal(t, 1, len(p1.EventsCalls()))
 	assert.Equal(t, 1, len(p2.EventsCalls()))
 
-	assert.Equal(t, 1, len(p1.ListCalls()))
-	assert.Equal(t, 1, len(p2.ListCalls()))
+	assert.Equal(t, 1, len(p1.ListCalls()))
+	assert.Equal(t, 1, len(p2.ListCalls()))
+
+	assert.Equal(t, 2, len(p1.IDCalls()), "one to watch events and one per reload")
+	assert.Equal(t, 2, len(p2.IDCalls()))
+}
+
+func TestService_Generation(t *testing.T) {
+	events := make(chan struct{})
+	var lock sync.Mutex
+	dst := "http://127.0.0.1:8080/blah1/$1"
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: dst}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	assert.Equal(t, 0, svc.Generation())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+
+	waitIdle(t, svc)
+	assert.Equal(t, 1, svc.Generation(), "initial load")
+	require.Equal(t, 1, len(svc.Mappers()))
+	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", svc.Mappers()[0].Dst)
+
+	lock.Lock()
+	dst = "http://127.0.0.2:8080/blah2/$1"
+	lock.Unlock()
+	events <- struct{}{}
+	waitIdle(t, svc)
+	assert.Equal(t, 2, svc.Generation())
+	require.Equal(t, 1, len(svc.Mappers()))
+	assert.Equal(t, "http://127.0.0.2:8080/blah2/$1", svc.Mappers()[0].Dst, "mappers swapped")
+	res, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/blah2/xyz", res)
+}
+
+func TestService_WaitIdle(t *testing.T) {
+	events := make(chan struct{})
+	var calls int32
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			time.Sleep(20 * time.Millisecond) // reload takes longer than delivery of the event
+			dst := fmt.Sprintf("http://127.0.0.%d:8080/$1", atomic.AddInt32(&calls, 1))
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: dst}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	assert.Equal(t, context.DeadlineExceeded, svc.WaitIdle(waitCtx), "run not active")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	waitIdle(t, svc)
+	assert.Equal(t, 1, svc.Generation(), "initial load")
+
+	events <- struct{}{}
+	waitIdle(t, svc)
+	assert.Equal(t, 2, svc.Generation(), "reloaded by the event")
+	require.Equal(t, 1, len(svc.Mappers()))
+	assert.Equal(t, "http://127.0.0.2:8080/$1", svc.Mappers()[0].Dst)
+
+	svc.SetPriority(PIFile, 10)
+	waitIdle(t, svc)
+	assert.Equal(t, 3, svc.Generation(), "reloaded by change of priority")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// waitIdle waits for reloads of the service, fails the test if not done in time
+func waitIdle(t *testing.T, svc *Service) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, svc.WaitIdle(ctx))
+}
+
+func TestService_RunInitialLoad(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			return make(chan struct{}) // never fires
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	p2 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{} // initial event
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+	svc := NewService([]Provider{p1, p2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	waitIdle(t, svc)
+
+	assert.Equal(t, 2, len(svc.Mappers()), "loaded without events")
+	assert.Equal(t, 1, svc.Generation())
+	assert.Equal(t, 1, len(p1.ListCalls()))
+	assert.Equal(t, 1, len(p2.ListCalls()), "initial event not loading rules again")
+}
+
+func TestService_AddRemoveProvider(t *testing.T) {
+	var p1Ctx context.Context
+	var lock sync.Mutex
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			lock.Lock()
+			p1Ctx = ctx
+			lock.Unlock()
+			return make(chan struct{})
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	p2Events := make(chan struct{})
+	p2 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return p2Events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+	svc := NewService([]Provider{p1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	waitIdle(t, svc)
+	require.Equal(t, 1, len(svc.Mappers()))
+
+	svc.AddProvider(p2)
+	waitIdle(t, svc)
+	mappers := svc.Mappers()
+	require.Equal(t, 2, len(mappers), "rules of added provider loaded")
+	assert.Equal(t, PIDocker, mappers[1].ProviderID)
+	assert.Equal(t, []string{"file", "docker"}, svc.Precedence())
+	assert.Equal(t, 1, len(p2.EventsCalls()))
+	assert.Equal(t, 1, len(p2.ListCalls()))
+
+	p2Events <- struct{}{}
+	waitIdle(t, svc)
+	assert.Equal(t, 2, len(p2.ListCalls()), "events of added provider watched")
+
+	svc.RemoveProvider(PIFile)
+	waitIdle(t, svc)
+	mappers = svc.Mappers()
+	require.Equal(t, 1, len(mappers), "rules of removed provider dropped")
+	assert.Equal(t, PIDocker, mappers[0].ProviderID)
+	assert.Equal(t, []string{"docker"}, svc.Precedence())
+	assert.Equal(t, 3, len(p1.ListCalls()), "removed provider not listed")
+	lock.Lock()
+	assert.Error(t, p1Ctx.Err(), "events of removed provider not watched")
+	lock.Unlock()
+}
+
+func TestService_Logger(t *testing.T) {
+	events := make(chan struct{})
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc2/"), Dst: "http://127.0.0.2:8080"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	var lock sync.Mutex
+	var lines []string
+	svc := NewService([]Provider{p})
+	svc.Logger = log.Func(func(format string, args ...interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	waitIdle(t, svc)
+	events <- struct{}{}
+	waitIdle(t, svc)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{
+		"[INFO] rule /api/svc2/ -> http://127.0.0.2:8080 extended to ^/api/svc2/(.*) -> http://127.0.0.2:8080/$1",
+		"[INFO] match for file: * ^/api/svc1/(.*) http://127.0.0.1:8080/$1",
+		"[INFO] match for file: * ^/api/svc2/(.*) http://127.0.0.2:8080/$1",
+		"[DEBUG] new update event received",
+		"[INFO] rule /api/svc2/ -> http://127.0.0.2:8080 extended to ^/api/svc2/(.*) -> http://127.0.0.2:8080/$1",
+		"[INFO] match for file: * ^/api/svc1/(.*) http://127.0.0.1:8080/$1",
+		"[INFO] match for file: * ^/api/svc2/(.*) http://127.0.0.2:8080/$1",
+	}, lines)
+}
+
+func TestService_Match(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/blah1/$1"},
+				{Server: "m.example.com", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"),
+					Dst: "http://127.0.0.2:8080/blah2/$1/abc"},
+			}, nil
+		},
+		IDFunc: func() ProviderID {
+			return PIFile
+		},
+	}
+	p2 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			return make(chan struct{}, 1)
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+			}, nil
+		},
+		IDFunc: func() ProviderID {
+			return PIDocker
+		},
+	}
+	svc := NewService([]Provider{p1, p2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := svc.Run(ctx)
+	require.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 3, len(svc.snapshot().matcher.mappers))
+
+	tbl := []struct {
+		server, src string
+		dest        string
+		ok          bool
+	}{
+		{"example.com", "/api/svc3/xyz", "http://127.0.0.3:8080/blah3/xyz", true},
+		{"abc.example.com", "/api/svc1/1234", "http://127.0.0.1:8080/blah1/1234", true},
+		{"zzz.example.com", "/aaa/api/svc1/1234", "/aaa/api/svc1/1234", false},
+		{"m.example.com", "/api/svc2/1234", "http://127.0.0.2:8080/blah2/1234/abc", true},
+		{"m1.example.com", "/api/svc2/1234", "/api/svc2/1234", false},
+		{"M.Example.com", "/api/svc2/1234", "http://127.0.0.2:8080/blah2/1234/abc", true},
+		{"M.EXAMPLE.COM", "/api/svc2/1234", "http://127.0.0.2:8080/blah2/1234/abc", true},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, ok := svc.Match(tt.server, tt.src, "")
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.dest, res)
+		})
+	}
+}
+
+func TestService_MatchURL(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile(`^/api/v1/items\?id=(\d+)$`), Dst: "/items?item_id=$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/v2/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/v3/(.*)"), Dst: "http://127.0.0.3:8080/$1?v=3"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	tbl := []struct {
+		src, dest string
+		ok        bool
+	}{
+		{"/api/v1/items?id=5", "/items?item_id=5", true},
+		{"/api/v1/items?id=abc", "/api/v1/items?id=abc", false},
+		{"/api/v1/items", "/api/v1/items", false},
+		{"/api/v2/items?id=5", "http://127.0.0.2:8080/items?id=5", true},
+		{"/api/v2/items", "http://127.0.0.2:8080/items", true},
+		{"/api/v3/items?id=5", "http://127.0.0.3:8080/items?v=3&id=5", true},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.src, func(t *testing.T) {
+			u, err := url.Parse(tt.src)
+			require.NoError(t, err)
+			res, ok := svc.MatchURL("example.com", u)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.dest, res)
+		})
+	}
+}
+
+func TestService_MatchStatic(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/"), Dst: "/var/www", MatchType: MTStatic, AssetsWebRoot: "/"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	m, dest, ok := svc.MatchMapper("example.com", "/api/something", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, MTProxy, m.MatchType, "api route goes first")
+	assert.Equal(t, "http://127.0.0.1:8080/something", dest)
+
+	m, dest, ok = svc.MatchMapper("example.com", "/index.html?k=v", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, MTStatic, m.MatchType)
+	assert.Equal(t, "/var/www", dest)
+}
+
+func TestService_MatchDstFunc(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile(`^/users/(\w+)/(\d+)$`), Dst: "http://127.0.0.1:8080/ignored",
+					DstFunc: func(sm []string) string {
+						return fmt.Sprintf("http://%s.example.com:8080/id/%s", strings.ToLower(sm[1]), sm[2])
+					}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/pool/"), DstFunc: func(sm []string) string {
+					return "http://127.0.0.2:8080" + sm[0]
+				}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIStatic },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	tbl := []struct {
+		src, dest string
+		ok        bool
+	}{
+		{"/users/Bob/123", "http://bob.example.com:8080/id/123", true},
+		{"/users/Bob/123?k=v", "http://bob.example.com:8080/id/123?k=v", true},
+		{"/users/Bob/abc", "/users/Bob/abc", false},
+		{"/pool/something", "http://127.0.0.2:8080/pool/", true},
+		{"/api/something", "http://127.0.0.3:8080/something", true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.src, func(t *testing.T) {
+			dest, ok := svc.Match("example.com", tt.src, "GET")
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.dest, dest)
+		})
+	}
+}
+
+func TestService_MatchPrefix(t *testing.T) {
+	prefixRoute, err := PrefixRoute("/shop/")
+	require.NoError(t, err)
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "prefix.example.com", SrcMatch: *prefixRoute, MatchPrefix: "/shop/", Dst: "http://127.0.0.1:8080/v2"},
+				{Server: "regex.example.com", SrcMatch: *regexp.MustCompile(`^/shop(/.*)?$`), Dst: "http://127.0.0.1:8080/v2$1"},
+				{Server: "literal.example.com", SrcMatch: *prefixRoute, MatchPrefix: "/shop",
+					Dst: "http://127.0.0.2:8080/$price/"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIStatic },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	tbl := []struct {
+		src, dest string
+		ok        bool
+	}{
+		{"/shop", "http://127.0.0.1:8080/v2", true},
+		{"/shop/", "http://127.0.0.1:8080/v2/", true},
+		{"/shop/cart", "http://127.0.0.1:8080/v2/cart", true},
+		{"/shop/cart/items?id=1&k=v", "http://127.0.0.1:8080/v2/cart/items?id=1&k=v", true},
+		{"/shopping", "/shopping", false},
+		{"/api/shop/cart", "/api/shop/cart", false},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.src, func(t *testing.T) {
+			dest, ok := svc.Match("prefix.example.com", tt.src, "GET")
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.dest, dest)
+
+			dest, ok = svc.Match("regex.example.com", tt.src, "GET")
+			assert.Equal(t, tt.ok, ok, "same as equivalent regex rule")
+			assert.Equal(t, tt.dest, dest, "same as equivalent regex rule")
+		})
+	}
+
+	dest, ok := svc.Match("literal.example.com", "/shop/cart", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/$price/cart", dest, "base url not expanded")
+}
+
+func TestPrefixRoute(t *testing.T) {
+	tbl := []struct {
+		prefix, route string
+		err           bool
+	}{
+		{"/shop", "^/shop(/.*)?$", false},
+		{"/shop/", "^/shop(/.*)?$", false},
+		{"/api/v1.0+", `^/api/v1\.0\+(/.*)?$`, false},
+		{"/", "^(/.*)?$", false},
+		{"shop", "", true},
+		{"/shop?id=1", "", true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.prefix, func(t *testing.T) {
+			rx, err := PrefixRoute(tt.prefix)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.route, rx.String())
+		})
+	}
+
+	m := URLMapper{SrcMatch: *regexp.MustCompile("^(/.*)?$"), MatchPrefix: "/"}
+	assert.Equal(t, "http://127.0.0.1:8080/app/x?k=v", m.Rewrite("/x?k=v", "http://127.0.0.1:8080/app/"))
+}
+
+func TestService_MatchRequest(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					HeaderMatch: map[string]*regexp.Regexp{"X-Api-Version": regexp.MustCompile("^2$")}},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	for _, cacheSize := range []int{0, 10} {
+		t.Run(strconv.Itoa(cacheSize), func(t *testing.T) {
+			svc := NewService([]Provider{p})
+			svc.MatchCacheSize = cacheSize
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_ = svc.Run(ctx)
+
+			tbl := []struct {
+				version, dest string
+			}{
+				{"2", "http://127.0.0.2:8080/something"},
+				{"1", "http://127.0.0.1:8080/something"},
+				{"", "http://127.0.0.1:8080/something"},
+				{"2", "http://127.0.0.2:8080/something"},
+			}
+			for _, tt := range tbl {
+				req, err := http.NewRequest("GET", "http://example.com/api/something", nil)
+				require.NoError(t, err)
+				if tt.version != "" {
+					req.Header.Set("X-Api-Version", tt.version)
+				}
+				_, dest, ok := svc.MatchRequest("example.com", "/api/something", req)
+				assert.True(t, ok)
+				assert.Equal(t, tt.dest, dest, "version %q", tt.version)
+			}
+
+			_, dest, ok := svc.MatchMapper("example.com", "/api/something", "GET")
+			assert.True(t, ok)
+			assert.Equal(t, "http://127.0.0.1:8080/something", dest, "no headers to match")
+		})
+	}
+}
+
+func TestService_MatchDefault(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.1:8080/"},
+				{Server: "srv.example.com", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.2:8080"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	tbl := []struct {
+		server, src, dest string
+		def               bool
+	}{
+		{"example.com", "/api/x", "http://127.0.0.3:8080/x", false},
+		{"example.com", "/unknown/path", "http://127.0.0.1:8080/unknown/path", true},
+		{"example.com", "/unknown/path?k=v", "http://127.0.0.1:8080/unknown/path?k=v", true},
+		{"srv.example.com", "/unknown/path", "http://127.0.0.2:8080/unknown/path", true},
+		{"srv.example.com", "/api/x", "http://127.0.0.3:8080/x", false},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.server+tt.src, func(t *testing.T) {
+			m, dest, ok := svc.MatchMapper(tt.server, tt.src, "GET")
+			assert.True(t, ok)
+			assert.Equal(t, tt.dest, dest)
+			assert.Equal(t, tt.def, m.IsDefault())
+		})
+	}
+}
+
+func TestService_MatchMapper(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "m.example.com", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"),
+					Dst: "http://127.0.0.2:8080/blah2/$1/abc"},
+			}, nil
+		},
+		IDFunc: func() ProviderID {
+			return PIFile
+		},
+	}
+	p2 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			return make(chan struct{}, 1)
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+			}, nil
+		},
+		IDFunc: func() ProviderID {
+			return PIDocker
+		},
+	}
+	svc := NewService([]Provider{p1, p2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	m, dest, ok := svc.MatchMapper("m.example.com", "/api/svc2/1234", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/blah2/1234/abc", dest)
+	assert.Equal(t, PIFile, m.ProviderID)
+	assert.Equal(t, "m.example.com", m.Server)
+	assert.Equal(t, "^/api/svc2/(.*)", m.SrcMatch.String())
+
+	m, dest, ok = svc.MatchMapper("m.example.com", "/api/svc3/xyz", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.3:8080/blah3/xyz", dest)
+	assert.Equal(t, PIDocker, m.ProviderID)
+
+	m, dest, ok = svc.MatchMapper("m.example.com", "/bad/path", "GET")
+	assert.False(t, ok)
+	assert.Equal(t, "/bad/path", dest)
+	assert.Equal(t, URLMapper{}, m)
+}
+
+func TestService_MatchMostSpecific(t *testing.T) {
+	p1 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/api/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)/blah"), Dst: "http://127.0.0.3:8080/blah/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	p2 := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			return make(chan struct{}, 1)
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/users/(.*)"), Dst: "http://127.0.0.2:8080/users/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+
+	for _, providers := range [][]Provider{{p1, p2}, {p2, p1}} {
+		svc := NewService(providers)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := svc.Run(ctx)
+		cancel()
+		require.Error(t, err)
+
+		tbl := []struct {
+			src, dest string
+		}{
+			{"/api/users/123", "http://127.0.0.2:8080/users/123"},
+			{"/api/something", "http://127.0.0.1:8080/api/something"},
+			{"/api/xyz/blah", "http://127.0.0.1:8080/api/xyz/blah"}, // same literal prefix, first rule wins
+		}
+		for i, tt := range tbl {
+			tt := tt
+			t.Run(strconv.Itoa(i), func(t *testing.T) {
+				res, ok := svc.Match("example.com", tt.src, "GET")
+				assert.True(t, ok)
+				assert.Equal(t, tt.dest, res)
+			})
+		}
+	}
+}
+
+func TestService_MatchMethods(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/write/$1",
+					Methods: []string{"POST", "put"}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/read/$1",
+					Methods: []string{"GET"}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/any/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	tbl := []struct {
+		method, dest string
+	}{
+		{"POST", "http://127.0.0.1:8080/write/something"},
+		{"put", "http://127.0.0.1:8080/write/something"},
+		{"GET", "http://127.0.0.2:8080/read/something"},
+		{"get", "http://127.0.0.2:8080/read/something"},
+		{"DELETE", "http://127.0.0.3:8080/any/something"},
+		{"", "http://127.0.0.1:8080/write/something"},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, ok := svc.Match("example.com", "/api/something", tt.method)
+			assert.True(t, ok)
+			assert.Equal(t, tt.dest, res)
+		})
+	}
+}
+
+func TestService_MatchWeighted(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", Weight: 1},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", Weight: 3},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/other/(.*)"), Dst: "http://127.0.0.4:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		res, ok := svc.Match("example.com", "/api/something", "GET")
+		require.True(t, ok)
+		hits[res]++
+	}
+	t.Logf("%+v", hits)
+	assert.Equal(t, 3, len(hits))
+	assert.InDelta(t, 200, hits["http://127.0.0.1:8080/something"], 10)
+	assert.InDelta(t, 600, hits["http://127.0.0.2:8080/something"], 10)
+	assert.InDelta(t, 200, hits["http://127.0.0.3:8080/something"], 10, "default weight 1")
 
-	assert.Equal(t, 2, len(p1.IDCalls()))
-	assert.Equal(t, 1, len(p2.IDCalls()))
+	for i := 0; i < 10; i++ {
+		res, ok := svc.Match("example.com", "/other/something", "GET")
+		require.True(t, ok)
+		assert.Equal(t, "http://127.0.0.4:8080/something", res, "single destination not balanced")
+	}
 }
 
-func TestService_Match(t *testing.T) {
-	p1 := &ProviderMock{
+func TestService_MatchCanary(t *testing.T) {
+	p := &ProviderMock{
 		EventsFunc: func(ctx context.Context) <-chan struct{} {
 			res := make(chan struct{}, 1)
 			res <- struct{}{}
 			return res
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
-				{SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/blah1/$1"},
-				{Server: "m.example.com", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"),
-					Dst: "http://127.0.0.2:8080/blah2/$1/abc"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					CanaryDst: "http://127.0.0.9:8080/$1", CanaryPercent: 20},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/web/"), Dst: "http://127.0.0.3:8080/",
+					CanaryDst: "http://127.0.0.8:8080", CanaryPercent: 50},
 			}, nil
 		},
-		IDFunc: func() ProviderID {
-			return PIFile
-		},
+		IDFunc: func() ProviderID { return PIFile },
 	}
-	p2 := &ProviderMock{
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	hits := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		res, ok := svc.Match("example.com", "/api/something", "GET")
+		require.True(t, ok)
+		hits[res]++
+	}
+	t.Logf("%+v", hits)
+	assert.Equal(t, 3, len(hits))
+	assert.InDelta(t, 4000, hits["http://127.0.0.1:8080/something"], 300)
+	assert.InDelta(t, 1000, hits["http://127.0.0.9:8080/something"], 300, "20% of the pool member's requests")
+	assert.Equal(t, 5000, hits["http://127.0.0.2:8080/something"], "member without canary")
+
+	hits = map[string]int{}
+	for i := 0; i < 10000; i++ {
+		res, ok := svc.Match("example.com", "/web/index.html", "GET")
+		require.True(t, ok)
+		hits[res]++
+	}
+	t.Logf("%+v", hits)
+	assert.InDelta(t, 5000, hits["http://127.0.0.8:8080/index.html"], 300, "extended canary destination")
+	assert.InDelta(t, 5000, hits["http://127.0.0.3:8080/index.html"], 300)
+}
+
+func TestService_MatchSticky(t *testing.T) {
+	p := &ProviderMock{
 		EventsFunc: func(ctx context.Context) <-chan struct{} {
-			return make(chan struct{}, 1)
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
-				{SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1", Sticky: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1", Sticky: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1", Sticky: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/user/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					Sticky: true, StickyKey: "X-User"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/user/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					Sticky: true, StickyKey: "X-User"},
 			}, nil
 		},
-		IDFunc: func() ProviderID {
-			return PIDocker
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+	mappers := svc.Mappers()
+	require.Equal(t, 5, len(mappers))
+
+	req := func(path string, cookie *http.Cookie, user string) *http.Request {
+		r := httptest.NewRequest("GET", "http://example.com"+path, http.NoBody)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		return r
+	}
+
+	hits := map[string]int{}
+	for i := 0; i < 9; i++ {
+		_, dest, ok := svc.MatchRequest("example.com", "/api/something", req("/api/something", nil, ""))
+		require.True(t, ok)
+		hits[dest]++
+	}
+	assert.Equal(t, 3, len(hits), "balanced without affinity cookie")
+
+	m, _, ok := svc.MatchRequest("example.com", "/api/something", req("/api/something", nil, ""))
+	require.True(t, ok)
+	cookie := &http.Cookie{Name: m.StickyCookie(), Value: m.StickyID()}
+	for i := 0; i < 10; i++ {
+		mp, dest, ok := svc.MatchRequest("example.com", "/api/something", req("/api/something", cookie, ""))
+		require.True(t, ok)
+		assert.Equal(t, m.Dst, mp.Dst)
+		assert.Equal(t, strings.Replace(m.Dst, "$1", "something", 1), dest, "the same destination for the cookie")
+	}
+
+	svc.lock.Lock()
+	st := svc.snapshot()
+	svc.setSnapshot(st.matcher.withAlive(func(mp URLMapper) bool { return mp.Dst != m.Dst || mp.StickyKey != "" }), st.gen)
+	svc.lock.Unlock()
+	mp, _, ok := svc.MatchRequest("example.com", "/api/something", req("/api/something", cookie, ""))
+	require.True(t, ok)
+	assert.NotEqual(t, m.Dst, mp.Dst, "dead destination of the cookie replaced")
+
+	users := map[string]string{}
+	for i := 0; i < 5; i++ {
+		for _, user := range []string{"u1", "u2", "u3", "u4", "u5", "u6"} {
+			_, dest, ok := svc.MatchRequest("example.com", "/user/something", req("/user/something", nil, user))
+			require.True(t, ok)
+			if prev, found := users[user]; found {
+				assert.Equal(t, prev, dest, "the same destination for user %s", user)
+			}
+			users[user] = dest
+		}
+	}
+	dests := map[string]bool{}
+	for _, dest := range users {
+		dests[dest] = true
+	}
+	assert.Equal(t, 2, len(dests), "users spread across the pool")
+}
+
+func TestService_MatchAll(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/mirror/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/mirror/(.*)"), Dst: "http://127.0.0.3:8080/$1",
+					PingURL: "http://127.0.0.3:8080/ping"},
+			}, nil
 		},
+		IDFunc: func() ProviderID { return PIFile },
 	}
-	svc := NewService([]Provider{p1, p2})
 
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	svc := NewService([]Provider{p})
+	svc.MatchCacheSize = 10
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
 	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	res, ok := svc.Match("example.com", "/api/mirror/xyz", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/xyz", res)
+	assert.Equal(t, []string{"http://127.0.0.2:8080/xyz", "http://127.0.0.3:8080/xyz", "http://127.0.0.1:8080/mirror/xyz"},
+		svc.MatchAll("example.com", "/api/mirror/xyz"), "all rules matched, in precedence order")
+	assert.Equal(t, []string{"http://127.0.0.1:8080/other"}, svc.MatchAll("example.com", "/api/other"))
+	assert.Empty(t, svc.MatchAll("example.com", "/other"))
+
+	svc.lock.Lock()
+	svc.health = map[string]bool{"http://127.0.0.3:8080/ping": false}
+	svc.updateAlive()
+	svc.lock.Unlock()
+	assert.Equal(t, []string{"http://127.0.0.2:8080/xyz", "http://127.0.0.1:8080/mirror/xyz"},
+		svc.MatchAll("example.com", "/api/mirror/xyz"), "dead mapper skipped")
+}
+
+func TestService_TestMatch(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+				{Server: "example.com", SrcMatch: *regexp.MustCompile("^/post/(.*)"), Dst: "http://127.0.0.3:8080/$1",
+					Methods: []string{"POST"}},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
 
+	svc := NewService([]Provider{p})
+	svc.MatchCacheSize = 10
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
 	err := svc.Run(ctx)
 	require.Error(t, err)
-	assert.Equal(t, context.DeadlineExceeded, err)
-	assert.Equal(t, 3, len(svc.mappers))
 
-	tbl := []struct {
-		server, src string
-		dest        string
-		ok          bool
-	}{
-		{"example.com", "/api/svc3/xyz", "http://127.0.0.3:8080/blah3/xyz", true},
-		{"abc.example.com", "/api/svc1/1234", "http://127.0.0.1:8080/blah1/1234", true},
-		{"zzz.example.com", "/aaa/api/svc1/1234", "/aaa/api/svc1/1234", false},
-		{"m.example.com", "/api/svc2/1234", "http://127.0.0.2:8080/blah2/1234/abc", true},
-		{"m1.example.com", "/api/svc2/1234", "/api/svc2/1234", false},
+	for i := 0; i < 3; i++ {
+		m, dest, ok := svc.TestMatch("example.com", "/api/something?k=v")
+		require.True(t, ok)
+		assert.Equal(t, "http://127.0.0.1:8080/something?k=v", dest, "pool not rotated")
+		assert.Equal(t, "^/api/(.*)", m.SrcMatch.String())
 	}
+	_, dest, ok := svc.TestMatch("example.com", "/post/something")
+	assert.True(t, ok, "any method matched")
+	assert.Equal(t, "http://127.0.0.3:8080/something", dest)
 
-	for i, tt := range tbl {
-		tt := tt
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			res, ok := svc.Match(tt.server, tt.src)
-			assert.Equal(t, tt.ok, ok)
-			assert.Equal(t, tt.dest, res)
-		})
+	m, dest, ok := svc.TestMatch("other.com", "/post/something")
+	assert.False(t, ok)
+	assert.Equal(t, "/post/something", dest)
+	assert.Equal(t, URLMapper{}, m)
+	assert.Equal(t, 0, svc.snapshot().matches.lru.Len(), "match cache not used")
+}
+
+func TestService_mergeListsConflicts(t *testing.T) {
+	file := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	docker := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://172.17.0.2:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/other/(.*)"), Dst: "http://172.17.0.3:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{file, docker})
+	svc.Logger = log.New(log.Out(&buf))
+	assert.Equal(t, []string{"file", "docker"}, svc.Precedence())
+
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 4, len(res), "conflicting rules pooled by default")
+	assert.Contains(t, buf.String(), "WARN  conflicting rule * ^/api/svc/(.*) of docker provider, "+
+		"http://172.17.0.2:8080/$1 and http://127.0.0.1:8080/$1 (from file) pooled")
+	assert.NotContains(t, buf.String(), "/api/other/")
+
+	buf.Reset()
+	svc.DropConflicts = true
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 3, len(res))
+	res = NewMatcher(res).mappers
+	assert.Equal(t, "http://172.17.0.3:8080/$1", res[0].Dst, "longer prefix goes first")
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[1].Dst)
+	assert.Equal(t, PIFile, res[1].ProviderID)
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[2].Dst, "pool of the same provider kept")
+	assert.Contains(t, buf.String(), "WARN  conflicting rule * ^/api/svc/(.*) of docker provider dropped, "+
+		"http://127.0.0.1:8080/$1 of file provider used instead of http://172.17.0.2:8080/$1")
+}
+
+func TestService_SetPriority(t *testing.T) {
+	file := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/api/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	docker := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://172.17.0.2:8080/$1"},
+				{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://172.17.0.2:8080/api/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+	static := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc:   func(context.Context) ([]URLMapper, error) { return nil, nil },
+		IDFunc:     func() ProviderID { return PIStatic },
+	}
+
+	svc := NewService([]Provider{file, docker, static})
+	svc.DropConflicts = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	waitIdle(t, svc)
+
+	res, ok := svc.Match("example.com", "/api/svc/xyz", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/xyz", res, "file wins by default")
+	res, ok = svc.Match("example.com", "/api/other", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/api/other", res)
+
+	svc.SetPriority(PIDocker, 10)
+	waitIdle(t, svc)
+	assert.Equal(t, []string{"docker", "file", "static"}, svc.Precedence())
+	res, ok = svc.Match("example.com", "/api/svc/xyz", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://172.17.0.2:8080/xyz", res, "conflicting rule of higher priority provider wins")
+	res, ok = svc.Match("example.com", "/api/other", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://172.17.0.2:8080/api/other", res, "equally specific rule of higher priority provider first")
+	res, ok = svc.Match("other.com", "/api/other", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/api/other", res)
+
+	svc.SetPriority(PIStatic, 20)
+	svc.SetPriority(PIFile, -1)
+	assert.Equal(t, []string{"static", "docker", "file"}, svc.Precedence())
+}
+
+func TestService_SnapshotProviders(t *testing.T) {
+	fileRules := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc/"), Dst: "http://127.0.0.1:8080/"},
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/web/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+	}
+	dockerRules := []URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://172.17.0.2:8080/$1"},
+	}
+	file := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) { return fileRules, nil },
+		IDFunc:   func() ProviderID { return PIFile },
+	}
+	docker := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) { return dockerRules, nil },
+		IDFunc:   func() ProviderID { return PIDocker },
+	}
+	failed := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) { return nil, errors.New("failed") },
+		IDFunc:   func() ProviderID { return PIConsul },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{file, docker, failed})
+	svc.Logger = log.New(log.Out(&buf))
+	res := svc.SnapshotProviders()
+	assert.Equal(t, map[ProviderID][]URLMapper{PIFile: fileRules, PIDocker: dockerRules}, res, "rules as listed")
+	assert.Equal(t, "/api/svc/", res[PIFile][0].SrcMatch.String(), "not extended")
+	assert.Equal(t, ProviderID(""), res[PIFile][0].ProviderID, "not merged")
+	assert.Contains(t, buf.String(), "WARN  can't get rules of consul provider for snapshot, failed")
+	assert.Equal(t, 0, svc.Generation(), "state not changed")
+	assert.Empty(t, svc.ProviderErrors())
+}
+
+func TestService_mergeListsProviderError(t *testing.T) {
+	var failed int32 = 1
+	docker := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			if atomic.LoadInt32(&failed) == 1 {
+				return nil, errors.New("can't connect to docker socket")
+			}
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/docker/(.*)"), Dst: "http://172.17.0.2:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+	file := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{docker, file})
+	svc.Logger = log.New(log.Out(&buf))
+	assert.Empty(t, svc.ProviderErrors())
+
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 1, len(res), "rules of other provider loaded")
+	assert.Equal(t, PIFile, res[0].ProviderID)
+	errs := svc.ProviderErrors()
+	require.Equal(t, 1, len(errs))
+	assert.EqualError(t, errs[PIDocker], "can't connect to docker socket")
+	assert.Contains(t, buf.String(), "WARN  can't get rules of docker provider, skipped, can't connect to docker socket")
+
+	atomic.StoreInt32(&failed, 0)
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 2, len(res))
+	assert.Empty(t, svc.ProviderErrors(), "recovered provider removed")
+}
+
+func TestService_mergeListsSlowProvider(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			<-release // ignores ctx
+			return nil, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+	var canceled int32
+	honoring := &ProviderMock{
+		ListFunc: func(ctx context.Context) ([]URLMapper, error) {
+			<-ctx.Done()
+			atomic.StoreInt32(&canceled, 1)
+			return nil, ctx.Err()
+		},
+		IDFunc: func() ProviderID { return PIK8s },
+	}
+	file := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{slow, honoring, file})
+	svc.ProviderTimeout = 50 * time.Millisecond
+	st := time.Now()
+	res := svc.mergeLists(context.Background())
+	assert.Less(t, int64(time.Since(st)), int64(time.Second), "merge not stalled")
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, PIFile, res[0].ProviderID)
+
+	errs := svc.ProviderErrors()
+	require.Equal(t, 2, len(errs))
+	assert.EqualError(t, errs[PIDocker], "list timed out after 50ms: context deadline exceeded")
+	assert.Error(t, errs[PIK8s])
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&canceled), "ctx of provider canceled")
+}
+
+func TestService_mergeListsUnanchored(t *testing.T) {
+	p := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc2"), Dst: "http://127.0.0.2:8080/svc2"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc3/"), Dst: "http://127.0.0.3:8080/"},
+				{Server: "*", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.4:8080"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/static/"), Dst: "/var/www", MatchType: MTStatic},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{p})
+	svc.Logger = log.New(log.Out(&buf))
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 5, len(res), "unanchored rules kept by default")
+	assert.Contains(t, buf.String(), "WARN  route /api/svc2 of file provider not anchored with ^, matches anywhere in the path")
+	assert.Contains(t, buf.String(), "INFO  rule /api/svc3/ -> http://127.0.0.3:8080/ extended to ^/api/svc3/(.*) -> http://127.0.0.3:8080/$1")
+	assert.Equal(t, 1, strings.Count(buf.String(), "not anchored"), "only /api/svc2 reported")
+
+	buf.Reset()
+	svc.StrictRoutes = true
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 4, len(res))
+	for _, m := range res {
+		assert.NotEqual(t, "/api/svc2", m.SrcMatch.String())
+	}
+	assert.Contains(t, buf.String(), "WARN  rule * /api/svc2 of file provider dropped, route not anchored with ^")
+}
+
+func TestService_mergeListsComplex(t *testing.T) {
+	p := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile(`^/api/([a-z0-9]{1,64}\.){1,10}`), Dst: "http://127.0.0.2:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{p})
+	svc.Logger = log.New(log.Out(&buf))
+	svc.RouteComplexity = 1000
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 2, len(res), "complex rules kept by default")
+	assert.Contains(t, buf.String(), `WARN  route ^/api/([a-z0-9]{1,64}\.){1,10} of file provider is too complex, complexity 1317`)
+
+	buf.Reset()
+	svc.StrictRoutes = true
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Contains(t, buf.String(),
+		`WARN  rule * ^/api/([a-z0-9]{1,64}\.){1,10} of file provider dropped, route complexity 1317 exceeds 1000`)
+
+	buf.Reset()
+	svc.RouteComplexity = 0
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 2, len(res), "unlimited")
+	assert.NotContains(t, buf.String(), "complexity")
+}
+
+func TestService_mergeListsMissingGroups(t *testing.T) {
+	p := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$2/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(?P<svc>svc3)/(.*)"), Dst: "http://127.0.0.3:8080/${svc}/$2",
+					CanaryDst: "http://127.0.0.4:8080/$name/$2", CanaryPercent: 10},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc4/"), Dst: "http://127.0.0.4:8080/"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{p})
+	svc.Logger = log.New(log.Out(&buf))
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 4, len(res), "rules with missing groups kept by default")
+	assert.Contains(t, buf.String(),
+		"WARN  route ^/api/svc2/(.*) of file provider has no groups $2 referred by destination, replaced with empty string")
+	assert.Contains(t, buf.String(),
+		"WARN  route ^/api/(?P<svc>svc3)/(.*) of file provider has no groups $name referred by destination")
+	assert.NotContains(t, buf.String(), "svc1/(.*) of file provider has no groups")
+	assert.NotContains(t, buf.String(), "svc4/(.*) of file provider has no groups", "extended rule has the group")
+
+	buf.Reset()
+	svc.StrictRoutes = true
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "^/api/svc4/(.*)", res[1].SrcMatch.String())
+	assert.Contains(t, buf.String(),
+		"WARN  rule * ^/api/svc2/(.*) of file provider dropped, destination refers to missing groups $2")
+}
+
+func TestService_mergeListsMaxMappers(t *testing.T) {
+	file := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	docker := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			res := []URLMapper{}
+			for i := 0; i < 5; i++ {
+				res = append(res, URLMapper{Server: "*", SrcMatch: *regexp.MustCompile(fmt.Sprintf("^/api/c%d/(.*)", i)),
+					Dst: "http://172.17.0.2:8080/$1"})
+			}
+			return res, nil
+		},
+		IDFunc: func() ProviderID { return PIDocker },
+	}
+
+	buf := bytes.Buffer{}
+	svc := NewService([]Provider{docker, file})
+	svc.Logger = log.New(log.Out(&buf))
+	svc.MaxMappers = 3
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 3, len(res))
+	for _, m := range res {
+		assert.Equal(t, PIDocker, m.ProviderID, "rules of the first provider kept")
+	}
+	assert.Contains(t, buf.String(), "WARN  2 rules of docker provider dropped, total number of rules exceeds 3")
+	assert.Contains(t, buf.String(), "WARN  2 rules of file provider dropped, total number of rules exceeds 3")
+
+	buf.Reset()
+	svc.SetPriority(PIFile, 10)
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 3, len(res))
+	routes := []string{}
+	for _, m := range res {
+		routes = append(routes, string(m.ProviderID)+" "+m.SrcMatch.String())
+	}
+	assert.Equal(t, []string{"file ^/api/svc1/(.*)", "file ^/api/svc2/(.*)", "docker ^/api/c0/(.*)"}, routes,
+		"rules of higher-priority provider kept")
+	assert.Contains(t, buf.String(), "WARN  4 rules of docker provider dropped, total number of rules exceeds 3")
+	assert.NotContains(t, buf.String(), "file provider dropped")
+
+	buf.Reset()
+	svc.MaxMappers = 0
+	res = svc.mergeLists(context.Background())
+	require.Equal(t, 7, len(res), "unlimited")
+	assert.NotContains(t, buf.String(), "dropped")
+}
+
+func TestService_MatchMaxLen(t *testing.T) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	svc.MaxMatchLen = 20
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	res, ok := svc.Match("example.com", "/api/svc1/short", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/short", res)
+	_, ok = svc.Match("example.com", "/api/svc1/"+strings.Repeat("x", 20), "GET")
+	assert.False(t, ok, "too long, not matched")
+}
+
+func TestService_MatchStartupWait(t *testing.T) {
+	var failing int32
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			time.Sleep(50 * time.Millisecond)
+			if atomic.LoadInt32(&failing) == 1 {
+				return nil, errors.New("failed")
+			}
+			return []URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"}}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	run := func(svc *Service) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() { _ = svc.Run(ctx) }()
+		time.Sleep(time.Millisecond)
+		return cancel
+	}
+
+	{ // not waiting by default
+		svc := NewService([]Provider{p})
+		defer run(svc)()
+		_, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+		assert.False(t, ok)
+	}
+
+	{ // waits for the first load
+		svc := NewService([]Provider{p})
+		svc.StartupWait = time.Second
+		defer run(svc)()
+		st := time.Now()
+		res, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+		assert.True(t, ok)
+		assert.Equal(t, "http://127.0.0.1:8080/xyz", res)
+		assert.Less(t, int64(time.Since(st)), int64(time.Second))
+
+		st = time.Now()
+		_, ok = svc.Match("example.com", "/api/svc2/xyz", "GET")
+		assert.False(t, ok)
+		assert.Less(t, int64(time.Since(st)), int64(10*time.Millisecond), "not waiting once loaded")
+	}
+
+	{ // waits up to StartupWait if rules failed to load
+		atomic.StoreInt32(&failing, 1)
+		svc := NewService([]Provider{p})
+		svc.StartupWait = 100 * time.Millisecond
+		defer run(svc)()
+		st := time.Now()
+		_, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+		assert.False(t, ok)
+		assert.GreaterOrEqual(t, int64(time.Since(st)), int64(100*time.Millisecond))
 	}
 }
 
@@ -136,7 +1526,7 @@ func TestService_Servers(t *testing.T) {
 			res <- struct{}{}
 			return res
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
 				{SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/blah1/$1"},
 				{Server: "m.example.com", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"),
@@ -151,9 +1541,13 @@ func TestService_Servers(t *testing.T) {
 		EventsFunc: func(ctx context.Context) <-chan struct{} {
 			return make(chan struct{}, 1)
 		},
-		ListFunc: func() ([]URLMapper, error) {
+		ListFunc: func(context.Context) ([]URLMapper, error) {
 			return []URLMapper{
-				{Server: "xx.reproxy.io", SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+				{Server: "XX.reproxy.io", SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+				{Server: "m.example.com", SrcMatch: *regexp.MustCompile("/api/svc4/xyz"), Dst: "http://127.0.0.4:8080/blah4/xyz"},
+				{Server: "a.reproxy.io", SrcMatch: *regexp.MustCompile("/api/svc5/xyz"), Dst: "http://127.0.0.5:8080/blah5/xyz"},
+				{Server: "xx.reproxy.io", SrcMatch: *regexp.MustCompile("/api/svc6/xyz"), Dst: "http://127.0.0.6:8080/blah6/xyz"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc7/xyz"), Dst: "http://127.0.0.7:8080/blah7/xyz"},
 			}, nil
 		},
 		IDFunc: func() ProviderID {
@@ -167,11 +1561,11 @@ func TestService_Servers(t *testing.T) {
 	err := svc.Run(ctx)
 	require.Error(t, err)
 	assert.Equal(t, context.DeadlineExceeded, err)
-	assert.Equal(t, 3, len(svc.mappers))
+	assert.Equal(t, 7, len(svc.snapshot().matcher.mappers))
 
 	servers := svc.Servers()
-	assert.Equal(t, []string{"m.example.com", "xx.reproxy.io"}, servers)
-
+	assert.Equal(t, []string{"a.reproxy.io", "m.example.com", "xx.reproxy.io"}, servers)
+	assert.Equal(t, servers, svc.Servers(), "stable across calls")
 }
 
 func TestService_extendRule(t *testing.T) {
@@ -202,6 +1596,26 @@ func TestService_extendRule(t *testing.T) {
 			URLMapper{Server: "m.example.com", PingURL: "http://example.com/ping", ProviderID: "docker",
 				SrcMatch: *regexp.MustCompile("/api/blah"), Dst: "http://localhost:8080/xxx"},
 		},
+		{
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/$2"},
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/$2"},
+		},
+		{
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/${id}"},
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/${id}"},
+		},
+		{
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/", ABDst: "http://localhost:8081/${1}"},
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/", ABDst: "http://localhost:8081/${1}"},
+		},
+		{
+			URLMapper{SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: "http://localhost:8080/", MirrorDst: "http://localhost:8082"},
+			URLMapper{SrcMatch: *regexp.MustCompile("^/api/blah/(.*)"), Dst: "http://localhost:8080/$1", MirrorDst: "http://localhost:8082/$1"},
+		},
+		{
+			URLMapper{SrcMatch: *regexp.MustCompile("^/api/(?P<svc>\\w+)/(?P<id>\\d+)/"), Dst: "http://localhost:8080/${svc}/items/${id}"},
+			URLMapper{SrcMatch: *regexp.MustCompile("^/api/(?P<svc>\\w+)/(?P<id>\\d+)/"), Dst: "http://localhost:8080/${svc}/items/${id}"},
+		},
 	}
 
 	svc := &Service{}
@@ -214,3 +1628,110 @@ func TestService_extendRule(t *testing.T) {
 	}
 
 }
+
+func TestService_extendRuleGroupRefs(t *testing.T) {
+	svc := &Service{}
+	tbl := []struct {
+		route, dst, src, res string
+	}{
+		{"^/api/(\\w+)/(\\d+)/", "http://localhost:8080/$2/$1", "/api/svc/12/", "http://localhost:8080/12/svc"},
+		{"^/api/(?P<svc>\\w+)/(?P<id>\\d+)", "http://localhost:8080/${id}/${svc}", "/api/svc/12", "http://localhost:8080/12/svc"},
+	}
+	for _, tt := range tbl {
+		m := svc.extendRule(URLMapper{Server: "*", SrcMatch: *regexp.MustCompile(tt.route), Dst: tt.dst})
+		assert.Equal(t, tt.dst, m.Dst, "not extended")
+		assert.Equal(t, tt.res, m.Rewrite(tt.src, m.Dst), tt.route)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("BACKEND_HOST", "10.0.0.1"))
+	defer os.Unsetenv("BACKEND_HOST")
+	require.NoError(t, os.Unsetenv("BACKEND_PORT"))
+
+	tbl := []struct {
+		route, dst, res string
+	}{
+		{"^/api/(.*)", "http://${BACKEND_HOST}:8080/$1", "http://10.0.0.1:8080/$1"},
+		{"^/api/(.*)", "http://${BACKEND_HOST}:${BACKEND_PORT:-9090}/${1}", "http://10.0.0.1:9090/${1}"},
+		{"^/api/(.*)", "http://${BACKEND_HOST:-localhost}/$1", "http://10.0.0.1/$1"},
+		{"^/api/(.*)", "http://localhost:${BACKEND_PORT}/$1", "http://localhost:/$1"},
+		{"^/api/(?P<BACKEND_HOST>.*)", "http://localhost/${BACKEND_HOST}", "http://localhost/${BACKEND_HOST}"},
+		{"^/api/(.*)", "http://$BACKEND_HOST/$1", "http://$BACKEND_HOST/$1"},
+	}
+	for _, tt := range tbl {
+		m := (&Service{}).expandEnv(URLMapper{SrcMatch: *regexp.MustCompile(tt.route), Dst: tt.dst, ABDst: tt.dst,
+			CanaryDst: tt.dst, MirrorDst: tt.dst})
+		assert.Equal(t, tt.res, m.Dst, tt.dst)
+		assert.Equal(t, tt.res, m.ABDst, tt.dst)
+		assert.Equal(t, tt.res, m.CanaryDst, tt.dst)
+		assert.Equal(t, tt.res, m.MirrorDst, tt.dst)
+	}
+}
+
+func TestService_mergeListsMatchID(t *testing.T) {
+	rules := func() ([]URLMapper, error) {
+		return []URLMapper{
+			{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1", Name: "svc1"},
+			{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+			{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+		}, nil
+	}
+	p1 := &ProviderMock{ListFunc: func(context.Context) ([]URLMapper, error) { return rules() },
+		IDFunc: func() ProviderID { return PIFile }}
+	p2 := &ProviderMock{ListFunc: func(context.Context) ([]URLMapper, error) { return rules() },
+		IDFunc: func() ProviderID { return PIDocker }}
+
+	svc := NewService([]Provider{p1, p2})
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 6, len(res))
+	assert.Equal(t, "f0fc784b2b0cce63", res[0].MatchID, "stable across restarts")
+	assert.Equal(t, "svc1", res[0].Name)
+	assert.NotEqual(t, res[0].MatchID, res[1].MatchID, "other destination")
+	assert.NotEqual(t, res[0].MatchID, res[2].MatchID, "other server")
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, res[i].MatchID, res[i+3].MatchID, "identical rules of other provider")
+	}
+
+	again := svc.mergeLists(context.Background())
+	for i := range res {
+		assert.Equal(t, res[i].MatchID, again[i].MatchID, "stable across reloads")
+	}
+}
+
+func TestService_mergeListsEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("BACKEND_HOST", "10.0.0.1"))
+	defer os.Unsetenv("BACKEND_HOST")
+
+	p := &ProviderMock{
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://${BACKEND_HOST}:8080/blah1/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("/api/svc2/"), Dst: "http://${BACKEND_HOST}:8080/blah2"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	res := svc.mergeLists(context.Background())
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "http://10.0.0.1:8080/blah1/$1", res[0].Dst)
+	assert.Equal(t, "^/api/svc2/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.1:8080/blah2/$1", res[1].Dst, "extended after expansion")
+	assert.Equal(t, "http://10.0.0.1:8080/blah1/abc", res[0].Rewrite("/api/svc1/abc", res[0].Dst))
+}
+
+func TestService_extendRuleStripsPrefix(t *testing.T) {
+	svc := &Service{}
+	tbl := []struct {
+		dst, res string
+	}{
+		{"http://localhost:8080/", "http://localhost:8080/x"},
+		{"http://localhost:8080/svc", "http://localhost:8080/svc/x"},
+		{"http://localhost:8080/api/blah/", "http://localhost:8080/api/blah/x"}, // prefix kept by destination only
+	}
+	for _, tt := range tbl {
+		m := svc.extendRule(URLMapper{Server: "*", SrcMatch: *regexp.MustCompile("/api/blah/"), Dst: tt.dst})
+		assert.Equal(t, tt.res, m.Rewrite("/api/blah/x", m.Dst), tt.dst)
+	}
+}
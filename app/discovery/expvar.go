@@ -0,0 +1,32 @@
+package discovery
+
+import (
+	"expvar"
+)
+
+// counters of all services published with expvar, i.e. on /debug/vars of management server
+var (
+	expReloads       = expvar.NewInt("reproxy_reloads")        // total reloads of rules
+	expMappers       = expvar.NewInt("reproxy_mappers")        // number of active mappers
+	expProviderRules = expvar.NewMap("reproxy_provider_rules") // number of rules loaded by provider id
+	expMatches       = expvar.NewMap("reproxy_matches")        // total "hits" and "misses" of Match
+)
+
+// countMatch counts result of Match as hit or miss
+func countMatch(ok bool) {
+	if ok {
+		expMatches.Add("hits", 1)
+		return
+	}
+	expMatches.Add("misses", 1)
+}
+
+// setProviderRules replaces numbers of rules loaded by providers
+func setProviderRules(counts map[ProviderID]int) {
+	expProviderRules.Init()
+	for id, n := range counts {
+		v := new(expvar.Int)
+		v.Set(int64(n))
+		expProviderRules.Set(string(id), v)
+	}
+}
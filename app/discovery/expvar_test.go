@@ -0,0 +1,77 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Expvar(t *testing.T) {
+	events := make(chan struct{}, 1)
+	events <- struct{}{}
+	file := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	docker := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc:   func(context.Context) ([]URLMapper, error) { return nil, errors.New("docker failed") },
+		IDFunc:     func() ProviderID { return PIDocker },
+	}
+
+	reloads := expReloads.Value()
+	hits, misses := expMatchesValue(t, "hits"), expMatchesValue(t, "misses")
+
+	svc := NewService([]Provider{file, docker})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, reloads+1, expReloads.Value())
+	assert.Equal(t, int64(2), expMappers.Value())
+	assert.Equal(t, "2", expProviderRules.Get("file").String())
+	assert.Equal(t, "0", expProviderRules.Get("docker").String(), "failed provider has no rules")
+
+	for i := 0; i < 3; i++ {
+		_, ok := svc.Match("example.com", "/api/svc1/something", "GET")
+		assert.True(t, ok)
+	}
+	_, ok := svc.Match("example.com", "/other", "GET")
+	assert.False(t, ok)
+	assert.Equal(t, hits+3, expMatchesValue(t, "hits"))
+	assert.Equal(t, misses+1, expMatchesValue(t, "misses"))
+
+	events <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, reloads+2, expReloads.Value(), "reload counted")
+
+	svc.RemoveProvider(PIDocker)
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, expProviderRules.Get("docker"), "removed provider dropped")
+	assert.Equal(t, "2", expProviderRules.Get("file").String())
+	assert.NotNil(t, expvar.Get("reproxy_matches"), "published")
+}
+
+func expMatchesValue(t *testing.T, key string) int64 {
+	v := expMatches.Get(key)
+	if v == nil {
+		return 0
+	}
+	res, err := strconv.ParseInt(v.String(), 10, 64)
+	require.NoError(t, err)
+	return res
+}
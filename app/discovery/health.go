@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPingTimeout used if HealthCheckTimeout not set
+const defaultPingTimeout = 100 * time.Millisecond
+
+// maxPingBodySize is the max size of ping response body checked for PingBody
+const maxPingBodySize = 64 * 1024
+
+// HealthResult is a result of the destination's ping
+type HealthResult struct {
+	Server  string `json:"server"`
+	PingURL string `json:"ping_url"`
+	Alive   bool   `json:"alive"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CheckHealth pings all destinations with PingURL right away and updates their health state.
+// If server defined only destinations of this server checked. Returns results sorted by ping url.
+// Mappers with the same ping url pinged once, expected response of one of them checked
+func (s *Service) CheckHealth(ctx context.Context, server string) []HealthResult {
+	// collect unique ping urls to check
+	pings := map[string]URLMapper{}
+	for _, m := range s.Mappers() {
+		if m.PingURL == "" || (server != "" && !strings.EqualFold(m.Server, server)) {
+			continue
+		}
+		pings[m.PingURL] = m
+	}
+
+	timeout := s.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+
+	var wg sync.WaitGroup
+	resCh := make(chan HealthResult, len(pings))
+	for _, m := range pings {
+		wg.Add(1)
+		go func(m URLMapper) {
+			defer wg.Done()
+			r := HealthResult{Server: m.Server, PingURL: m.PingURL, Alive: true}
+			if err := Ping(ctx, s.pingClient(m), m, timeout); err != nil {
+				s.logf("[DEBUG] failed to ping %s, %v", m.PingURL, err)
+				r.Alive, r.Error = false, err.Error()
+			}
+			resCh <- r
+		}(m)
+	}
+	wg.Wait()
+	close(resCh)
+
+	res := make([]HealthResult, 0, len(pings))
+	s.lock.Lock()
+	prev := s.health
+	if s.health == nil || server == "" {
+		s.health = map[string]bool{} // full check drops stale destinations
+	}
+	for r := range resCh {
+		if alive, ok := prev[r.PingURL]; (!ok || alive) && !r.Alive {
+			s.logf("[WARN] destination %s is dead, %s", r.PingURL, r.Error)
+		}
+		if alive, ok := prev[r.PingURL]; ok && !alive && r.Alive {
+			s.logf("[INFO] destination %s is alive again", r.PingURL)
+		}
+		s.health[r.PingURL] = r.Alive
+		res = append(res, r)
+	}
+	s.updateAlive()
+	s.lock.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].PingURL < res[j].PingURL })
+	return res
+}
+
+// pingClient returns client of the mapper's pings made by PingClient, nil if not set
+func (s *Service) pingClient(m URLMapper) *http.Client {
+	if s.PingClient == nil {
+		return nil
+	}
+	return s.PingClient(m)
+}
+
+// Ping makes GET request to the mapper's ping url and expects PingStatus (200 by default) and PingBody in the
+// response, if set. Urls with unix scheme pinged via the socket. The client made for the mapper's route used
+// if passed, http.DefaultClient or client of the unix socket otherwise
+func Ping(ctx context.Context, client *http.Client, m URLMapper, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	pingURL := m.PingURL
+	if socket, uri, ok := UnixSocket(pingURL); ok {
+		pingURL = "http://localhost" + uri
+		if client == nil {
+			client = unixSocketClient(socket)
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", pingURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't make ping request")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint gosec
+	status := m.PingStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if resp.StatusCode != status {
+		return errors.Errorf("bad status %s", resp.Status)
+	}
+	if m.PingBody == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPingBodySize))
+	if err != nil {
+		return errors.Wrap(err, "can't read ping response")
+	}
+	if !strings.Contains(string(body), m.PingBody) {
+		return errors.Errorf("response doesn't contain %q", m.PingBody)
+	}
+	return nil
+}
+
+// runHealthChecks checks health of all destinations every HealthCheckInterval, blocks until ctx done
+func (s *Service) runHealthChecks(ctx context.Context) {
+	if s.HealthCheckInterval <= 0 {
+		return
+	}
+	tk := time.NewTicker(s.HealthCheckInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+			s.CheckHealth(ctx, "")
+		}
+	}
+}
+
+// updateAlive sets Alive state of all mappers by the last health check results, the snapshot of mappers
+// replaced with the updated one. Should be called under the lock
+func (s *Service) updateAlive() {
+	st := s.snapshot()
+	s.setSnapshot(st.matcher.withAlive(s.alive), st.gen)
+}
+
+// alive checks the mapper's health by the last health check results. Mappers without ping url
+// or not checked yet treated as alive. Should be called under the lock
+func (s *Service) alive(m URLMapper) bool {
+	alive, ok := s.health[m.PingURL]
+	return !ok || alive
+}
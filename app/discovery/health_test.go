@@ -0,0 +1,207 @@
+package discovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_CheckHealth(t *testing.T) {
+	var down int32 = 1
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/svc2/ping" && atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer ps.Close()
+
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "srv1", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					PingURL: ps.URL + "/svc1/ping"},
+				{Server: "srv2", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					PingURL: ps.URL + "/svc2/ping"},
+				{Server: "srv2", SrcMatch: *regexp.MustCompile("^/api/svc3/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := svc.Run(ctx)
+	require.Error(t, err)
+
+	res := svc.CheckHealth(context.Background(), "")
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, HealthResult{Server: "srv1", PingURL: ps.URL + "/svc1/ping", Alive: true}, res[0])
+	assert.Equal(t, "srv2", res[1].Server)
+	assert.False(t, res[1].Alive)
+	assert.Contains(t, res[1].Error, "503 Service Unavailable")
+	assert.Equal(t, map[string]bool{ps.URL + "/svc1/ping": true, ps.URL + "/svc2/ping": false}, svc.health)
+
+	atomic.StoreInt32(&down, 0)
+	res = svc.CheckHealth(context.Background(), "SRV2")
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, HealthResult{Server: "srv2", PingURL: ps.URL + "/svc2/ping", Alive: true}, res[0])
+	assert.Equal(t, map[string]bool{ps.URL + "/svc1/ping": true, ps.URL + "/svc2/ping": true}, svc.health)
+
+	res = svc.CheckHealth(context.Background(), "unknown")
+	assert.Equal(t, 0, len(res))
+}
+
+func TestPing_Expected(t *testing.T) {
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/json":
+			_, _ = w.Write([]byte(`{"status":"ok"}`))
+		}
+	}))
+	defer ps.Close()
+
+	tbl := []struct {
+		m   URLMapper
+		err string
+	}{
+		{URLMapper{PingURL: ps.URL + "/no-content"}, "bad status 204 No Content"},
+		{URLMapper{PingURL: ps.URL + "/no-content", PingStatus: 204}, ""},
+		{URLMapper{PingURL: ps.URL + "/json", PingStatus: 204}, "bad status 200 OK"},
+		{URLMapper{PingURL: ps.URL + "/json", PingBody: `"status":"ok"`}, ""},
+		{URLMapper{PingURL: ps.URL + "/json", PingStatus: 200, PingBody: `"status":"ok"`}, ""},
+		{URLMapper{PingURL: ps.URL + "/json", PingBody: `"status":"failed"`}, `response doesn't contain "\"status\":\"failed\""`},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.m.PingURL, func(t *testing.T) {
+			err := Ping(context.Background(), nil, tt.m, time.Second)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestService_CheckHealthExpected(t *testing.T) {
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ps.Close()
+
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "srv1", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					PingURL: ps.URL + "/svc1/ping", PingStatus: http.StatusNoContent},
+				{Server: "srv2", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					PingURL: ps.URL + "/svc2/ping"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	res := svc.CheckHealth(context.Background(), "")
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, HealthResult{Server: "srv1", PingURL: ps.URL + "/svc1/ping", Alive: true}, res[0], "204 expected")
+	assert.Equal(t, HealthResult{Server: "srv2", PingURL: ps.URL + "/svc2/ping", Alive: false,
+		Error: "bad status 204 No Content"}, res[1], "200 expected by default")
+}
+
+func TestService_HealthChecks(t *testing.T) {
+	var down int32
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/svc2/ping" && atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}))
+	defer ps.Close()
+
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					PingURL: ps.URL + "/svc1/ping"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					PingURL: ps.URL + "/svc2/ping"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/single/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+					PingURL: ps.URL + "/svc2/ping"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+
+	svc := NewService([]Provider{p})
+	svc.HealthCheckInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = svc.Run(ctx)
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	dests := func() map[string]bool {
+		res := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			dest, ok := svc.Match("example.com", "/api/something", "GET")
+			require.True(t, ok)
+			res[dest] = true
+		}
+		return res
+	}
+
+	assert.Equal(t, map[string]bool{"http://127.0.0.1:8080/something": true, "http://127.0.0.2:8080/something": true},
+		dests(), "both alive")
+	_, ok := svc.Match("example.com", "/single/something", "GET")
+	assert.True(t, ok)
+
+	atomic.StoreInt32(&down, 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]bool{"http://127.0.0.1:8080/something": true}, dests(), "dead destination skipped")
+	dest, ok := svc.Match("example.com", "/single/something", "GET")
+	assert.False(t, ok, "the only destination is dead")
+	assert.Equal(t, "/single/something", dest)
+	for _, m := range svc.Mappers() {
+		assert.Equal(t, m.PingURL == ps.URL+"/svc1/ping", m.Alive, m.PingURL)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]bool{"http://127.0.0.1:8080/something": true, "http://127.0.0.2:8080/something": true},
+		dests(), "destination restored")
+	_, ok = svc.Match("example.com", "/single/something", "GET")
+	assert.True(t, ok)
+}
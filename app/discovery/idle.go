@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+)
+
+// reloadState tracks update events requested from Run and applied by its reloads, see WaitIdle
+type reloadState struct {
+	lock      sync.Mutex
+	requested int64         // number of update events requested, by providers and changes of providers
+	applied   int64         // requested events covered by the last reload of Run
+	active    bool          // Run active and its initial load done
+	changed   chan struct{} // closed and replaced on each reload, wakes up WaitIdle
+}
+
+// watcher passes events of the provider to Run, see Service.watch
+type watcher struct {
+	ctx    context.Context    // done once the watcher stopped
+	cancel context.CancelFunc // stops the watcher
+	syncs  chan chan struct{} // sync requests of WaitIdle, closed by the watcher once events sent so far passed to Run
+}
+
+// WaitIdle blocks until Run applied all update events sent by providers so far, as well as changes of providers,
+// i.e. AddProvider or SetPriority. Match and Mappers reflect the rules loaded by these events once it returned,
+// this way the caller can hold briefly until the reload done. Blocks until the initial load if Run just started,
+// and until ctx done if Run not active
+func (s *Service) WaitIdle(ctx context.Context) error {
+	s.provLock.Lock()
+	var watchers []watcher
+	for _, ww := range s.watchers {
+		watchers = append(watchers, ww...)
+	}
+	s.provLock.Unlock()
+
+	for _, w := range watchers {
+		if err := w.sync(ctx); err != nil {
+			return err
+		}
+	}
+
+	for {
+		idle, changed := s.reloads.idle()
+		if idle {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sync waits for the watcher to pass events received from the provider so far to Run, including ones buffered
+// by the provider's channel. Returns right away if the watcher stopped
+func (w watcher) sync(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case w.syncs <- ack:
+	case <-w.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// request counts update event requested from Run, should be called before the event sent
+func (r *reloadState) request() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requested++
+}
+
+// start returns number of update events covered by the reload about to start
+func (r *reloadState) start() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requested
+}
+
+// done marks update events counted by start as applied and wakes up WaitIdle
+func (r *reloadState) done(req int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.applied, r.active = req, true
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// stop marks Run as not active, WaitIdle blocks until the next Run's initial load
+func (r *reloadState) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.active = false
+}
+
+// idle returns true if all requested update events applied, or the channel closed on the next reload otherwise
+func (r *reloadState) idle() (bool, <-chan struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.active && r.applied >= r.requested {
+		return true, nil
+	}
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return false, r.changed
+}
@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"container/list"
+	"sync"
+)
+
+// matchCache keeps results of the mappers walk by server, method and source, including misses.
+// Results valid for the generation (version of snapshot) of mappers they made with only, the whole cache dropped
+// once a newer generation used. Results of older generations, i.e. by in-flight matches, neither returned nor cached.
+// The least recently used results evicted above maxSize entries
+type matchCache struct {
+	maxSize int
+
+	lock    sync.Mutex
+	gen     int
+	lru     *list.List // of *matchEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+// matchResult is a result of the mappers walk, idx is -1 if nothing matched.
+// Dest is the destination of the matched mapper, before picking a member of its pool
+type matchResult struct {
+	idx  int
+	dest string
+}
+
+type matchEntry struct {
+	key string
+	res matchResult
+}
+
+func newMatchCache(maxSize int) *matchCache {
+	return &matchCache{maxSize: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *matchCache) get(key string, gen int) (matchResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen != c.gen {
+		if gen > c.gen {
+			c.resetGen(gen)
+		}
+		return matchResult{}, false
+	}
+	el, ok := c.entries[key]
+	if !ok {
+		return matchResult{}, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*matchEntry).res, true
+}
+
+func (c *matchCache) put(key string, gen int, res matchResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if gen < c.gen {
+		return
+	}
+	if gen > c.gen {
+		c.resetGen(gen)
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*matchEntry).res = res
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&matchEntry{key: key, res: res})
+	for c.lru.Len() > c.maxSize {
+		e := c.lru.Remove(c.lru.Back()).(*matchEntry)
+		delete(c.entries, e.key)
+	}
+}
+
+func (c *matchCache) resetGen(gen int) {
+	c.gen = gen
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
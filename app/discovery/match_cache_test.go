@@ -0,0 +1,228 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_MatchCached(t *testing.T) {
+	events := make(chan struct{})
+	var lock sync.Mutex
+	dst := "http://127.0.0.1:8080/blah1/$1"
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: dst},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/pool/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/pool/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	svc.MatchCacheSize = 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		res, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+		assert.True(t, ok)
+		assert.Equal(t, "http://127.0.0.1:8080/blah1/xyz", res)
+		_, ok = svc.Match("example.com", "/api/svc2/xyz", "GET")
+		assert.False(t, ok, "miss cached as miss")
+	}
+	assert.Equal(t, 2, svc.snapshot().matches.lru.Len())
+
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		res, ok := svc.Match("example.com", "/api/pool/xyz", "GET")
+		require.True(t, ok)
+		hits[res]++
+	}
+	assert.Equal(t, map[string]int{"http://127.0.0.1:8080/xyz": 5, "http://127.0.0.2:8080/xyz": 5}, hits,
+		"pool rotated for cached match")
+
+	lock.Lock()
+	dst = "http://127.0.0.2:8080/blah2/$1"
+	lock.Unlock()
+	events <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+
+	res, ok := svc.Match("example.com", "/api/svc1/xyz", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/blah2/xyz", res, "cache invalidated on reload")
+	assert.Equal(t, 1, svc.snapshot().matches.lru.Len())
+
+	svc.lock.Lock()
+	svc.health = map[string]bool{"": false} // all mappers without ping url, mark them dead
+	svc.updateAlive()
+	svc.lock.Unlock()
+	_, ok = svc.Match("example.com", "/api/svc1/xyz", "GET")
+	assert.False(t, ok, "cache invalidated on health change")
+}
+
+func TestMatchCache_evict(t *testing.T) {
+	c := newMatchCache(2)
+	c.put("k1", 1, matchResult{idx: 1, dest: "d1"})
+	c.put("k2", 1, matchResult{idx: 2, dest: "d2"})
+	_, ok := c.get("k1", 1) // k1 used recently, k2 evicted first
+	assert.True(t, ok)
+	c.put("k3", 1, matchResult{idx: -1})
+
+	_, ok = c.get("k2", 1)
+	assert.False(t, ok)
+	r, ok := c.get("k1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, matchResult{idx: 1, dest: "d1"}, r)
+	r, ok = c.get("k3", 1)
+	assert.True(t, ok)
+	assert.Equal(t, -1, r.idx)
+
+	_, ok = c.get("k1", 2)
+	assert.False(t, ok, "other generation")
+	assert.Equal(t, 0, c.lru.Len())
+
+	c.put("k1", 2, matchResult{idx: 1, dest: "d1"})
+	c.put("k2", 1, matchResult{idx: 2, dest: "d2"})
+	_, ok = c.get("k2", 1)
+	assert.False(t, ok, "older generation not cached")
+	_, ok = c.get("k1", 1)
+	assert.False(t, ok, "older generation not returned")
+	_, ok = c.get("k1", 2)
+	assert.True(t, ok, "newer generation not dropped by older one")
+}
+
+func TestService_MatchConcurrentReload(t *testing.T) {
+	var n int32
+	events := make(chan struct{}, 1)
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			dst := fmt.Sprintf("http://127.0.0.%d:8080/$1", atomic.AddInt32(&n, 1)%2+1)
+			return []URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: dst, PingURL: "http://127.0.0.1:8080/ping"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"), Dst: dst},
+			}, nil
+		},
+		IDFunc: func() ProviderID { return PIFile },
+	}
+	svc := NewService([]Provider{p})
+	svc.MatchCacheSize = 10
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				res, ok := svc.Match("example.com", "/api/svc2/xyz", "GET")
+				assert.True(t, ok)
+				assert.Contains(t, []string{"http://127.0.0.1:8080/xyz", "http://127.0.0.2:8080/xyz"}, res)
+				assert.Equal(t, 2, len(svc.Mappers()))
+				svc.Servers()
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+		svc.lock.Lock()
+		svc.health = map[string]bool{"http://127.0.0.1:8080/ping": i%2 == 0}
+		svc.updateAlive()
+		svc.lock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	assert.Greater(t, svc.Generation(), 1, "reloaded while matching")
+}
+
+func BenchmarkService_Match(b *testing.B) {
+	makeService := func(cacheSize int) *Service {
+		p := &ProviderMock{
+			EventsFunc: func(ctx context.Context) <-chan struct{} {
+				res := make(chan struct{}, 1)
+				res <- struct{}{}
+				return res
+			},
+			ListFunc: func(context.Context) ([]URLMapper, error) {
+				res := make([]URLMapper, 0, 500)
+				for i := 0; i < 500; i++ {
+					res = append(res, URLMapper{Server: fmt.Sprintf("srv%d.example.com", i%10),
+						SrcMatch: *regexp.MustCompile(fmt.Sprintf("^/api/svc%d/(.*)", i)), Dst: "http://127.0.0.1:8080/$1"})
+				}
+				return res, nil
+			},
+			IDFunc: func() ProviderID { return PIStatic },
+		}
+		svc := NewService([]Provider{p})
+		svc.MatchCacheSize = cacheSize
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_ = svc.Run(ctx)
+		return svc
+	}
+
+	for _, tt := range []struct {
+		name string
+		size int
+	}{{"cached", 1000}, {"uncached", 0}} {
+		svc := makeService(tt.size)
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				svc.Match("srv9.example.com", fmt.Sprintf("/api/svc%d/something", 400+i%100), "GET")
+			}
+		})
+	}
+}
+
+func BenchmarkService_Mappers(b *testing.B) {
+	p := &ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]URLMapper, error) {
+			res := make([]URLMapper, 0, 500)
+			for i := 0; i < 500; i++ {
+				res = append(res, URLMapper{Server: fmt.Sprintf("srv%d.example.com", i%10),
+					SrcMatch: *regexp.MustCompile(fmt.Sprintf("^/api/svc%d/(.*)", i)), Dst: "http://127.0.0.1:8080/$1"})
+			}
+			return res, nil
+		},
+		IDFunc: func() ProviderID { return PIStatic },
+	}
+	svc := NewService([]Provider{p})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(svc.Mappers()) != 500 {
+			b.Fatal("unexpected mappers")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Matcher matches requests to the list of mappers, the same way as Service does, without providers, health checks
+// and caching of results. Mappers can't be changed once matcher made, safe for concurrent use
+type Matcher struct {
+	mappers   []URLMapper
+	pools     map[string]*mapperPool // pools of mappers sharing server and route
+	matchHdrs []string               // names of headers matched by any mapper
+}
+
+// NewMatcher makes matcher of mappers, all of them alive. Mappers ordered by precedence, the most specific
+// route (longer literal prefix, then more header matches) goes first, ties keep the order of mappers
+func NewMatcher(mappers []URLMapper) *Matcher {
+	res := &Matcher{mappers: make([]URLMapper, len(mappers))}
+	copy(res.mappers, mappers)
+	for i := range res.mappers {
+		res.mappers[i].Alive = true
+	}
+
+	prefixes := make(map[string]int, len(res.mappers))
+	for _, m := range res.mappers {
+		prefixes[m.SrcMatch.String()] = len(literalPrefix(m.SrcMatch))
+	}
+	sort.SliceStable(res.mappers, func(i, j int) bool {
+		mi, mj := res.mappers[i], res.mappers[j]
+		pi, pj := prefixes[mi.SrcMatch.String()], prefixes[mj.SrcMatch.String()]
+		if pi != pj {
+			return pi > pj
+		}
+		return len(mi.HeaderMatch) > len(mj.HeaderMatch)
+	})
+
+	res.pools = makePools(res.mappers)
+	res.matchHdrs = matchHeaders(res.mappers)
+	return res
+}
+
+// withAlive makes copy of the matcher with Alive state of mappers set by alive func.
+// Pools shared with the copy, rotation of pools continues across changes of health
+func (m *Matcher) withAlive(alive func(mp URLMapper) bool) *Matcher {
+	res := &Matcher{mappers: make([]URLMapper, len(m.mappers)), pools: m.pools, matchHdrs: m.matchHdrs}
+	copy(res.mappers, m.mappers)
+	for i := range res.mappers {
+		res.mappers[i].Alive = alive(res.mappers[i])
+	}
+	return res
+}
+
+// Match url to all mappers. Empty method matches rules with any allowed methods
+func (m *Matcher) Match(srv, src, method string) (string, bool) {
+	_, dest, ok := m.MatchMapper(srv, src, method)
+	return dest, ok
+}
+
+// MatchMapper url to all mappers, returns matched mapper along with the destination, see Service.MatchMapper
+func (m *Matcher) MatchMapper(srv, src, method string) (URLMapper, string, bool) {
+	return m.result(m.find(srv, src, method, nil), src, nil)
+}
+
+// MatchRequest matches the request with the request's method and headers, see Service.MatchRequest
+func (m *Matcher) MatchRequest(srv, src string, r *http.Request) (URLMapper, string, bool) {
+	return m.result(m.find(srv, src, r.Method, r.Header), src, r.Header)
+}
+
+// MatchAll returns destinations of all mappers matching url with any method, in precedence order, see Service.MatchAll
+func (m *Matcher) MatchAll(srv, src string) []string {
+	var res []string
+	m.walk(srv, src, "", nil, func(r matchResult) bool {
+		res = append(res, r.dest)
+		return true
+	})
+	return res
+}
+
+// find walks all mappers and returns the matched one
+func (m *Matcher) find(srv, src, method string, headers http.Header) matchResult {
+	res := matchResult{idx: -1}
+	m.walk(srv, src, method, headers, func(r matchResult) bool {
+		res = r
+		return false
+	})
+	return res
+}
+
+// walk calls fn for each mapper matched, in precedence order, until fn returns false.
+// The default mapper passed only if no other mapper matched
+func (m *Matcher) walk(srv, src, method string, headers http.Header, fn func(r matchResult) bool) {
+	defIdx, matched := -1, false
+	for i, mp := range m.mappers {
+		if mp.Server != "*" && mp.Server != "" && !strings.EqualFold(mp.Server, srv) {
+			continue
+		}
+		if !mp.Alive || !mp.MatchMethod(method) || !mp.MatchHeaders(headers) {
+			continue
+		}
+		if mp.IsDefault() {
+			if defIdx < 0 || (!m.mappers[defIdx].specificServer() && mp.specificServer()) {
+				defIdx = i
+			}
+			continue
+		}
+		dest := mp.Dst
+		if mp.MatchType == MTStatic {
+			if !strings.HasPrefix(strings.SplitN(src, "?", 2)[0], mp.AssetsWebRoot) {
+				continue
+			}
+		} else if dest = mp.dest(src); src == dest {
+			continue
+		}
+		matched = true
+		if !fn(matchResult{idx: i, dest: dest}) {
+			return
+		}
+	}
+
+	if !matched && defIdx >= 0 {
+		fn(matchResult{idx: defIdx, dest: m.mappers[defIdx].dest(src)})
+	}
+}
+
+// result makes the result of MatchMapper, picks the next mapper of the pool and canary destination for proxy mappers
+func (m *Matcher) result(r matchResult, src string, headers http.Header) (URLMapper, string, bool) {
+	if r.idx < 0 {
+		return URLMapper{}, src, false
+	}
+	mp := m.mappers[r.idx]
+	if mp.MatchType == MTStatic {
+		return mp, r.dest, true
+	}
+	mp, dest := m.pick(mp, src, r.dest, headers)
+	return mp, mp.canary(src, dest), true
+}
+
+// pick returns the next mapper of the pool if the same server and route defined multiple times,
+// to spread requests across all of them. Sticky pools pick the member bound to the client by headers, if any
+func (m *Matcher) pick(mp URLMapper, src, dest string, headers http.Header) (URLMapper, string) {
+	p, ok := m.pools[poolKey(mp)]
+	if !ok {
+		return mp, dest
+	}
+	idx := -1
+	if mp.Sticky {
+		idx = p.pickSticky(m.mappers, mp, headers)
+	}
+	if idx < 0 {
+		idx = p.pick(m.mappers)
+	}
+	if idx < 0 {
+		return mp, dest
+	}
+	return m.mappers[idx], m.mappers[idx].dest(src)
+}
+
+// matchHeaders returns sorted names of headers matched by mappers
+func matchHeaders(mappers []URLMapper) []string {
+	names := map[string]bool{}
+	for _, m := range mappers {
+		for name := range m.HeaderMatch {
+			names[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	res := make([]string, 0, len(names))
+	for name := range names {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	m := NewMatcher([]URLMapper{
+		{SrcMatch: *regexp.MustCompile("^/api/svc1/(.*)"), Dst: "http://127.0.0.1:8080/blah1/$1"},
+		{Server: "m.example.com", SrcMatch: *regexp.MustCompile("^/api/svc2/(.*)"),
+			Dst: "http://127.0.0.2:8080/blah2/$1/abc"},
+		{SrcMatch: *regexp.MustCompile("/api/svc3/xyz"), Dst: "http://127.0.0.3:8080/blah3/xyz"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/post/(.*)"), Dst: "http://127.0.0.4:8080/$1",
+			Methods: []string{"POST"}},
+	})
+
+	tbl := []struct {
+		server, src, method string
+		dest                string
+		ok                  bool
+	}{
+		{"example.com", "/api/svc3/xyz", "", "http://127.0.0.3:8080/blah3/xyz", true},
+		{"abc.example.com", "/api/svc1/1234", "", "http://127.0.0.1:8080/blah1/1234", true},
+		{"zzz.example.com", "/aaa/api/svc1/1234", "", "/aaa/api/svc1/1234", false},
+		{"m.example.com", "/api/svc2/1234", "", "http://127.0.0.2:8080/blah2/1234/abc", true},
+		{"m1.example.com", "/api/svc2/1234", "", "/api/svc2/1234", false},
+		{"M.EXAMPLE.COM", "/api/svc2/1234", "", "http://127.0.0.2:8080/blah2/1234/abc", true},
+		{"example.com", "/api/post/1234", "POST", "http://127.0.0.4:8080/1234", true},
+		{"example.com", "/api/post/1234", "GET", "/api/post/1234", false},
+	}
+
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, ok := m.Match(tt.server, tt.src, tt.method)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.dest, res)
+		})
+	}
+}
+
+func TestMatcher_MatchMapper(t *testing.T) {
+	m := NewMatcher([]URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.1:8080/root/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/static/(.*)"), Dst: "/var/www", MatchType: MTStatic,
+			AssetsWebRoot: "/static"},
+	})
+
+	mp, dest, ok := m.MatchMapper("example.com", "/static/index.html", "GET")
+	require.True(t, ok)
+	assert.Equal(t, MTStatic, mp.MatchType)
+	assert.Equal(t, "/var/www", dest)
+
+	mp, dest, ok = m.MatchMapper("example.com", "/something", "GET")
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/root/something", dest, "shorter prefix matched last")
+	assert.True(t, mp.Alive)
+
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		_, dest, ok = m.MatchMapper("example.com", "/api/xyz", "GET")
+		require.True(t, ok)
+		hits[dest]++
+	}
+	assert.Equal(t, map[string]int{"http://127.0.0.2:8080/xyz": 5, "http://127.0.0.3:8080/xyz": 5}, hits,
+		"pool rotated")
+}
+
+func TestMatcher_MatchRequest(t *testing.T) {
+	m := NewMatcher([]URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1",
+			HeaderMatch: map[string]*regexp.Regexp{"X-Version": regexp.MustCompile("^v2$")}},
+	})
+	assert.Equal(t, []string{"X-Version"}, m.matchHdrs)
+
+	req, err := http.NewRequest("GET", "http://example.com/api/xyz", http.NoBody)
+	require.NoError(t, err)
+	_, dest, ok := m.MatchRequest("example.com", "/api/xyz", req)
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/xyz", dest)
+
+	req.Header.Set("X-Version", "v2")
+	_, dest, ok = m.MatchRequest("example.com", "/api/xyz", req)
+	require.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/xyz", dest, "rule with header match goes first")
+}
+
+func TestMatcher_MatchAll(t *testing.T) {
+	m := NewMatcher([]URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.1:8080/root/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+		{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/svc/(.*)"), Dst: "http://127.0.0.3:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.4:8080"},
+	})
+
+	assert.Equal(t, []string{"http://127.0.0.3:8080/xyz", "http://127.0.0.2:8080/svc/xyz",
+		"http://127.0.0.1:8080/root/api/svc/xyz"}, m.MatchAll("example.com", "/api/svc/xyz"), "overlapping rules")
+	assert.Equal(t, []string{"http://127.0.0.2:8080/svc/xyz", "http://127.0.0.1:8080/root/api/svc/xyz"},
+		m.MatchAll("other.com", "/api/svc/xyz"))
+	for i := 0; i < 3; i++ {
+		res, ok := m.Match("example.com", "/api/svc/xyz", "GET")
+		require.True(t, ok)
+		assert.Equal(t, "http://127.0.0.3:8080/xyz", res, "the first one matched by Match")
+	}
+
+	m = NewMatcher([]URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.4:8080"},
+	})
+	assert.Equal(t, []string{"http://127.0.0.2:8080/xyz"}, m.MatchAll("example.com", "/api/xyz"), "default skipped")
+	assert.Equal(t, []string{"http://127.0.0.4:8080/other"}, m.MatchAll("example.com", "/other"),
+		"default used if nothing else matched")
+	assert.Empty(t, NewMatcher(m.mappers[:1]).MatchAll("example.com", "/other"))
+}
+
+func TestMatcher_Default(t *testing.T) {
+	m := NewMatcher([]URLMapper{
+		{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.1:8080/$1"},
+		{Server: "*", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.2:8080"},
+		{Server: "example.com", SrcMatch: *regexp.MustCompile(""), Dst: "http://127.0.0.3:8080/"},
+	})
+
+	res, ok := m.Match("example.com", "/other", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.3:8080/other", res, "default of the server preferred")
+	res, ok = m.Match("abc.example.com", "/other", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.2:8080/other", res)
+	res, ok = m.Match("abc.example.com", "/api/xyz", "GET")
+	assert.True(t, ok)
+	assert.Equal(t, "http://127.0.0.1:8080/xyz", res)
+
+	res, ok = NewMatcher(nil).Match("example.com", "/other", "GET")
+	assert.False(t, ok)
+	assert.Equal(t, "/other", res)
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// mapperPool is a group of mappers with the same server, source route, methods and header matches.
+// Requests spread across pool members by weighted round-robin.
+type mapperPool struct {
+	members []int  // indexes of mappers
+	counter uint64 // requests handled by the pool, updated atomically
+}
+
+// poolKey identifies pool of the mapper
+func poolKey(m URLMapper) string {
+	methods := make([]string, 0, len(m.Methods))
+	for _, mt := range m.Methods {
+		methods = append(methods, strings.ToUpper(mt))
+	}
+	sort.Strings(methods)
+	headers := make([]string, 0, len(m.HeaderMatch))
+	for name, rx := range m.HeaderMatch {
+		headers = append(headers, http.CanonicalHeaderKey(name)+":"+rx.String())
+	}
+	sort.Strings(headers)
+	return strings.ToLower(m.Server) + " " + m.SrcMatch.String() + " " + strings.Join(methods, ",") + " " +
+		strings.Join(headers, ",")
+}
+
+// makePools groups mappers with the same server, source route, methods and header matches. Single-member pools skipped
+func makePools(mappers []URLMapper) map[string]*mapperPool {
+	res := map[string]*mapperPool{}
+	for i, m := range mappers {
+		key := poolKey(m)
+		if _, ok := res[key]; !ok {
+			res[key] = &mapperPool{}
+		}
+		res[key].members = append(res[key].members, i)
+	}
+	for k, p := range res {
+		if len(p.members) < 2 {
+			delete(res, k)
+		}
+	}
+	return res
+}
+
+// pick returns index of the next alive mapper by weighted round-robin, -1 if all members dead
+func (p *mapperPool) pick(mappers []URLMapper) int {
+	total := p.aliveWeight(mappers)
+	if total == 0 {
+		return -1
+	}
+	return p.member(mappers, int((atomic.AddUint64(&p.counter, 1)-1)%uint64(total)))
+}
+
+// pickSticky returns index of the alive mapper bound to the client, -1 if the client not bound yet.
+// With StickyKey of the mapper the client's key hashed to the member, consistent while the pool's alive members
+// not changed. Otherwise the member picked by StickyID stored in the proxy's cookie
+func (p *mapperPool) pickSticky(mappers []URLMapper, m URLMapper, headers http.Header) int {
+	r := http.Request{Header: headers}
+	if m.StickyKey == "" {
+		c, err := r.Cookie(m.StickyCookie())
+		if err != nil || c.Value == "" {
+			return -1
+		}
+		for _, idx := range p.members {
+			if mappers[idx].Alive && mappers[idx].StickyID() == c.Value {
+				return idx
+			}
+		}
+		return -1
+	}
+
+	key := headers.Get(m.StickyKey)
+	if c, err := r.Cookie(m.StickyKey); err == nil && c.Value != "" {
+		key = c.Value
+	}
+	if key == "" {
+		return -1
+	}
+	total := p.aliveWeight(mappers)
+	if total == 0 {
+		return -1
+	}
+	hh := fnv.New32a()
+	_, _ = hh.Write([]byte(key))
+	return p.member(mappers, int(hh.Sum32()%uint32(total)))
+}
+
+// aliveWeight returns total weight of alive members
+func (p *mapperPool) aliveWeight(mappers []URLMapper) (res int) {
+	for _, idx := range p.members {
+		if mappers[idx].Alive {
+			res += mappers[idx].weight()
+		}
+	}
+	return res
+}
+
+// member returns index of the alive member at position n of the weighted sequence of alive members
+func (p *mapperPool) member(mappers []URLMapper, n int) int {
+	for _, idx := range p.members {
+		if !mappers[idx].Alive {
+			continue
+		}
+		if n < mappers[idx].weight() {
+			return idx
+		}
+		n -= mappers[idx].weight()
+	}
+	return -1
+}
+
+// StickyCookie returns name of the proxy's affinity cookie of the mapper's route, unique for server and route
+func (m URLMapper) StickyCookie() string {
+	hh := fnv.New32a()
+	_, _ = hh.Write([]byte(strings.ToLower(m.Server) + m.SrcMatch.String()))
+	return fmt.Sprintf("reproxy-sticky-%08x", hh.Sum32())
+}
+
+// StickyID returns id of the mapper in the pool, stored in the affinity cookie
+func (m URLMapper) StickyID() string {
+	hh := fnv.New32a()
+	_, _ = hh.Write([]byte(m.Dst))
+	return fmt.Sprintf("%08x", hh.Sum32())
+}
+
+// weight returns mapper's weight in the pool, default 1
+func (m URLMapper) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+// canary returns canary destination for CanaryPercent percent of requests, picked randomly, dest otherwise
+func (m URLMapper) canary(src, dest string) string {
+	if m.CanaryDst == "" || m.CanaryPercent <= 0 {
+		return dest
+	}
+	if rand.Intn(100) >= m.CanaryPercent { //nolint gosec
+		return dest
+	}
+	return m.Rewrite(src, m.CanaryDst)
+}
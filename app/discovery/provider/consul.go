@@ -0,0 +1,214 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Consul provider makes rules from healthy instances of services registered in consul catalog.
+// By default it maps ^/api/%s/(.*) to http://%s:%d/$1 with service name, instance address and port,
+// the same way as docker provider does. Service tags like reproxy.route=/api/foo/ alter it with the same
+// keys as docker labels: reproxy.route, reproxy.dest, reproxy.server and reproxy.ping.
+type Consul struct {
+	Address    string        // consul http api address, i.e. http://127.0.0.1:8500
+	Datacenter string        // datacenter, default agent's datacenter if empty
+	WaitTime   time.Duration // max wait time for blocking queries, default 1m
+	Client     *http.Client
+}
+
+// consulInstance is a healthy instance of the service
+type consulInstance struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string   `json:"ID"`
+		Service string   `json:"Service"`
+		Address string   `json:"Address"`
+		Port    int      `json:"Port"`
+		Tags    []string `json:"Tags"`
+	} `json:"Service"`
+}
+
+// Events sends event on start, right away, and on each catalog change detected by blocking queries
+func (c *Consul) Events(ctx context.Context) (res <-chan struct{}) {
+	eventsCh := make(chan struct{}, 1)
+	eventsCh <- struct{}{} // initial event
+	go func() {
+		defer close(eventsCh)
+		var index uint64
+		initial := true // the first query gets the current index, covered by the initial event
+		for {
+			newIndex, err := c.waitCatalog(ctx, index)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("[WARN] consul catalog query failed, %v", err)
+				time.Sleep(1 * time.Second) // prevent busy loop on failed queries
+				initial = false             // catalog may change before the next successful query
+				continue
+			}
+			if newIndex < index {
+				newIndex = 0 // index went backwards, reset as consul recommends
+			}
+			if index != 0 && newIndex == index {
+				continue // wait timed out with no changes
+			}
+			index = newIndex
+			if initial {
+				initial = false
+				continue
+			}
+			select {
+			case eventsCh <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventsCh
+}
+
+// List all healthy service instances and make url mappers
+func (c *Consul) List(ctx context.Context) ([]discovery.URLMapper, error) {
+	var services map[string][]string
+	if _, err := c.get(ctx, "/v1/catalog/services", nil, &services); err != nil {
+		return nil, errors.Wrap(err, "can't list services")
+	}
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		if name == "consul" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var res []discovery.URLMapper
+	for _, name := range names {
+		var instances []consulInstance
+		if _, err := c.get(ctx, "/v1/health/service/"+url.PathEscape(name), url.Values{"passing": {"1"}},
+			&instances); err != nil {
+			return nil, errors.Wrapf(err, "can't get instances of %s", name)
+		}
+		for _, inst := range instances {
+			m, err := c.mapper(inst)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// ID returns providers id
+func (c *Consul) ID() discovery.ProviderID { return discovery.PIConsul }
+
+// mapper makes url mapper for the service instance, with defaults altered by reproxy.* tags
+func (c *Consul) mapper(inst consulInstance) (discovery.URLMapper, error) {
+	tags := map[string]string{}
+	for _, t := range inst.Service.Tags {
+		if kv := strings.SplitN(t, "=", 2); len(kv) == 2 && strings.HasPrefix(kv[0], "reproxy.") {
+			tags[kv[0]] = kv[1]
+		}
+	}
+
+	addr := inst.Service.Address
+	if addr == "" {
+		addr = inst.Node.Address
+	}
+	srcURL := fmt.Sprintf("^/api/%s/(.*)", inst.Service.Service)
+	destURL := fmt.Sprintf("http://%s:%d/$1", addr, inst.Service.Port)
+	pingURL := fmt.Sprintf("http://%s:%d/ping", addr, inst.Service.Port)
+	server := "*"
+
+	if v, ok := tags["reproxy.route"]; ok {
+		srcURL = v
+	}
+	if v, ok := tags["reproxy.dest"]; ok {
+		destURL = fmt.Sprintf("http://%s:%d%s", addr, inst.Service.Port, v)
+	}
+	if v, ok := tags["reproxy.server"]; ok {
+		server = v
+	}
+	if v, ok := tags["reproxy.ping"]; ok {
+		pingURL = fmt.Sprintf("http://%s:%d%s", addr, inst.Service.Port, v)
+	}
+
+	rx, err := compileRoute(srcURL)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrapf(err, "invalid src regex %s for %s", srcURL, inst.Service.ID)
+	}
+	return discovery.URLMapper{Server: server, SrcMatch: *rx, Dst: destURL, PingURL: pingURL}, nil
+}
+
+// waitCatalog makes blocking query for the catalog services and returns the new catalog index
+func (c *Consul) waitCatalog(ctx context.Context, index uint64) (uint64, error) {
+	wait := c.WaitTime
+	if wait == 0 {
+		wait = time.Minute
+	}
+	params := url.Values{"wait": {fmt.Sprintf("%ds", int(wait.Seconds()))}}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+	}
+	var services map[string][]string
+	res, err := c.get(ctx, "/v1/catalog/services", params, &services)
+	if err != nil {
+		return 0, err
+	}
+	if res == 0 {
+		return 0, errors.New("no catalog index in response")
+	}
+	return res, nil
+}
+
+// get makes request to consul api and decodes the response, returns X-Consul-Index
+func (c *Consul) get(ctx context.Context, path string, params url.Values, res interface{}) (uint64, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+	if c.Datacenter != "" {
+		params.Set("dc", c.Datacenter)
+	}
+	u := strings.TrimSuffix(c.Address, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't make request for %s", path)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't get %s", path)
+	}
+	defer resp.Body.Close() //nolint gosec
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("can't get %s, status %s", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return 0, errors.Wrapf(err, "can't decode %s", path)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return index, nil
+}
@@ -0,0 +1,126 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsul_List(t *testing.T) {
+	cs := newFakeConsul(t)
+	defer cs.ts.Close()
+
+	c := Consul{Address: cs.ts.URL, Datacenter: "dc1"}
+	res, err := c.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.1:8080/$1", res[0].Dst)
+	assert.Equal(t, "http://10.0.0.1:8080/ping", res[0].PingURL)
+
+	assert.Equal(t, "http://10.0.0.2:8080/$1", res[1].Dst, "node address used if service address not set")
+
+	assert.Equal(t, "example.com", res[2].Server)
+	assert.Equal(t, "^/api/foo/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.3:9090/blah/$1", res[2].Dst)
+	assert.Equal(t, "http://10.0.0.3:9090/health", res[2].PingURL)
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	assert.Equal(t, "dc1", cs.dc)
+	assert.Equal(t, "1", cs.passing)
+}
+
+func TestConsul_Events(t *testing.T) {
+	cs := newFakeConsul(t)
+	defer cs.ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cs.change()
+		time.Sleep(50 * time.Millisecond)
+		cs.change()
+	}()
+
+	c := Consul{Address: cs.ts.URL}
+	ch := c.Events(ctx)
+	events := 0
+	for range ch {
+		t.Log("event")
+		events++
+	}
+	assert.Equal(t, 3, events, "initial event plus two changes")
+}
+
+// fakeConsul emulates consul catalog and health api with blocking queries
+type fakeConsul struct {
+	ts      *httptest.Server
+	lock    sync.Mutex
+	index   uint64
+	changed chan struct{}
+	dc      string
+	passing string
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	res := &fakeConsul{index: 10, changed: make(chan struct{})}
+	instances := map[string]string{
+		"svc1": `[{"Node":{"Address":"10.0.0.100"},"Service":{"ID":"svc1-1","Service":"svc1","Address":"10.0.0.1","Port":8080}},
+			{"Node":{"Address":"10.0.0.2"},"Service":{"ID":"svc1-2","Service":"svc1","Port":8080}}]`,
+		"svc2": `[{"Node":{"Address":"10.0.0.3"},"Service":{"ID":"svc2-1","Service":"svc2","Port":9090,
+			"Tags":["reproxy.route=^/api/foo/(.*)","reproxy.dest=/blah/$1","reproxy.server=example.com",
+			"reproxy.ping=/health","other"]}}]`,
+	}
+	res.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("req: %s", r.URL)
+		res.lock.Lock()
+		res.dc = r.URL.Query().Get("dc")
+		index, changed := res.index, res.changed
+		res.lock.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+				select { // block until changed or wait time passed
+				case <-changed:
+				case <-time.After(30 * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			res.lock.Lock()
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(res.index, 10))
+			res.lock.Unlock()
+			_ = json.NewEncoder(w).Encode(map[string][]string{"consul": {}, "svc1": {}, "svc2": {"reproxy.route=^/api/foo/(.*)"}})
+		case "/v1/health/service/svc1", "/v1/health/service/svc2":
+			res.lock.Lock()
+			res.passing = r.URL.Query().Get("passing")
+			res.lock.Unlock()
+			_, _ = w.Write([]byte(instances[r.URL.Path[len("/v1/health/service/"):]]))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return res
+}
+
+func (f *fakeConsul) change() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
@@ -3,7 +3,9 @@ package provider
 import (
 	"context"
 	"fmt"
-	"regexp"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,13 +23,48 @@ import (
 // will be mapped to http://172.17.42.1:8080/something. Ip will be the internal ip of the container and port exposed
 // in the Dockerfile.
 // Alternatively labels can alter this. reproxy.route sets source route, and reproxy.dest sets the destination.
-// Optional reproxy.server enforces match by server name (hostname) and reproxy.ping sets the health check url
+// Optional reproxy.server enforces match by server name (hostname) and reproxy.ping sets the health check url.
+// reproxy.ping-status sets expected status of ping response, 200 by default, and reproxy.ping-body its expected substring.
+// reproxy.resolve sets comma-separated host:ip overrides used to dial the destination.
+// reproxy.scheme sets the scheme (http or https) of destination and ping urls, default http.
+// reproxy.tls-servername switches the destination to https and verifies container's certificate
+// against the given name instead of the container's ip.
+// reproxy.insecure=true switches the destination to https and skips verification of container's certificate,
+// reproxy.ca-cert does the same but verifies the certificate with CAs of the given PEM file.
+// reproxy.methods limits the route to comma-separated list of http methods, i.e. GET,HEAD.
+// reproxy.weight sets container's weight for load balancing across containers with the same server and route.
+// reproxy.timeout sets request timeout for the route, i.e. 30s
+// reproxy.name sets name of the rule, shown along with the rule's id by management server.
+// reproxy.port selects one of exposed ports, the first exposed port used by default.
+// reproxy.mirror sets url receiving copies of the container's requests, responses of the mirror discarded.
+// reproxy.client-cn requires tls client certificate with subject common name matching the regex.
+// reproxy.socket routes to unix socket shared by the container instead of its ip and port, i.e. /var/run/app.sock
+// The "reproxy" prefix of all labels can be changed with LabelPrefix.
+// With HealthyOnly containers with HEALTHCHECK routed only once they are healthy.
+// reproxy.enabled=false excludes the container. With RequireEnabled only containers with reproxy.enabled=true routed.
 type Docker struct {
-	DockerClient DockerClient
-	Excludes     []string
-	Network      string
+	DockerClient   DockerClient
+	Excludes       []string
+	Network        string // comma-separated list of preferred networks
+	LabelPrefix    string // prefix of container labels, "reproxy" if empty
+	HealthyOnly    bool   // skip running containers with health check not reported healthy yet
+	RequireEnabled bool   // route only containers opted in with enabled label
+
+	retryDelay, maxRetryDelay time.Duration // backoff of events re-subscription, defaults used if not set
 }
 
+// defaultLabelPrefix used if Docker.LabelPrefix not set
+const defaultLabelPrefix = "reproxy"
+
+// default backoff of events re-subscription, the delay doubled on each failed attempt up to the max
+const (
+	defaultRetryDelay    = 1 * time.Second
+	defaultMaxRetryDelay = 30 * time.Second
+)
+
+// errEventsClosed returned by events listener closed by docker client, i.e. on restart of docker daemon
+var errEventsClosed = errors.New("events closed")
+
 // DockerClient defines interface listing containers and subscribing to events
 type DockerClient interface {
 	ListContainers(opts dc.ListContainersOptions) ([]dc.APIContainers, error)
@@ -44,60 +81,279 @@ type containerInfo struct {
 	Port   int
 }
 
-// Events gets eventsCh with all containers-related docker events events
+// Events gets eventsCh with all containers-related docker events events. The initial event sent right away
 func (d *Docker) Events(ctx context.Context) (res <-chan struct{}) {
-	eventsCh := make(chan struct{})
+	eventsCh := make(chan struct{}, 1)
+	eventsCh <- struct{}{} // initial event
 	go func() {
 		defer close(eventsCh)
-		// loop over to recover from failed events call
-		for {
-			err := d.events(ctx, d.DockerClient, eventsCh) // publish events to eventsCh in a blocking loop
+		retryDelay, maxRetryDelay := d.retryDelay, d.maxRetryDelay
+		if retryDelay <= 0 {
+			retryDelay = defaultRetryDelay
+		}
+		if maxRetryDelay <= 0 {
+			maxRetryDelay = defaultMaxRetryDelay
+		}
+		// loop over to recover from failed events call, re-subscribing with backoff
+		delay := retryDelay
+		for resync := false; ; resync = true {
+			err := d.events(ctx, d.DockerClient, eventsCh, resync) // publish events to eventsCh in a blocking loop
 			if err == context.Canceled || err == context.DeadlineExceeded {
 				return
 			}
-			log.Printf("[WARN] docker events listener failed (restarted), %v", err)
-			time.Sleep(1 * time.Second) // prevent busy loop on restart of event listener
+			if err == errEventsClosed {
+				delay = retryDelay // listener was subscribed, start backoff over
+			}
+			log.Printf("[WARN] docker events listener failed, %v, restarting in %v", err, delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
 		}
 	}()
 	return eventsCh
 }
 
-// List all containers and make url mappers
-func (d *Docker) List() ([]discovery.URLMapper, error) {
-	containers, err := d.listContainers()
+// List all containers and make url mappers. Containers with invalid labels skipped
+func (d *Docker) List(ctx context.Context) ([]discovery.URLMapper, error) {
+	containers, err := d.listContainers(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	res := make([]discovery.URLMapper, 0, len(containers))
 	for _, c := range containers {
-		srcURL := fmt.Sprintf("^/api/%s/(.*)", c.Name)
-		destURL := fmt.Sprintf("http://%s:%d/$1", c.IP, c.Port)
-		pingURL := fmt.Sprintf("http://%s:%d/ping", c.IP, c.Port)
-		server := "*"
-
-		if v, ok := c.Labels["reproxy.route"]; ok {
-			srcURL = v
+		m, merr := d.mapper(c)
+		if merr != nil {
+			log.Printf("[WARN] skip container %s, %v", c.Name, merr)
+			continue
 		}
-		if v, ok := c.Labels["reproxy.dest"]; ok {
-			destURL = fmt.Sprintf("http://%s:%d%s", c.IP, c.Port, v)
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// mapper makes url mapper of the container from its labels
+func (d *Docker) mapper(c containerInfo) (discovery.URLMapper, error) {
+	l := &containerLabels{prefix: d.labelPrefix(), values: c.Labels}
+	res := discovery.URLMapper{
+		Server:              "*",
+		Name:                l.str("name"),
+		PingStatus:          l.integer("ping-status", 0, 100, 599),
+		PingBody:            l.raw("ping-body"),
+		TLSServerName:       l.str("tls-servername"),
+		InsecureSkipVerify:  l.boolean("insecure"),
+		CACert:              l.str("ca-cert"),
+		Methods:             parseMethods(strings.Split(l.raw("methods"), ",")),
+		Weight:              l.integer("weight", 1, 1, math.MaxInt32),
+		Timeout:             l.duration("timeout"),
+		Retries:             l.integer("retries", 0, 0, math.MaxInt32),
+		MaxIdleConnsPerHost: l.integer("max-idle-conns", 0, 0, math.MaxInt32),
+		MaxConnsPerHost:     l.integer("max-conns", 0, 0, math.MaxInt32),
+		IdleConnTimeout:     l.duration("idle-timeout"),
+		Cache:               l.boolean("cache"),
+		RewriteBody:         l.boolean("rewrite-body"),
+		PreserveHost:        l.boolean("preserve-host"),
+		HostHeader:          l.str("host-header"),
+		CanaryPercent:       l.integer("canary-percent", 0, 0, 100),
+		CanaryDst:           l.str("canary-dest"),
+		StickyKey:           l.str("sticky-key"),
+		MirrorDst:           l.str("mirror"),
+	}
+	res.Sticky = l.boolean("sticky") || res.StickyKey != ""
+
+	l.parse("resolve", func(v string) (err error) {
+		res.Resolve, err = parseResolve(strings.Split(v, ","))
+		return err
+	})
+	l.parse("max-body", func(v string) (err error) {
+		res.MaxBodySize, err = parseSize(v)
+		return err
+	})
+	l.parse("allow-ip", func(v string) (err error) {
+		res.AllowIPs, err = parseAllowIPs(strings.Split(v, ","))
+		return err
+	})
+	l.parse("client-cn", func(v string) (err error) {
+		res.ClientCN, err = parseClientCN(v)
+		return err
+	})
+	l.parseRepeated("header", d.repeatedLabels(c, "header"), func(v []string) (err error) {
+		res.Headers, err = parseHeaders(v)
+		return err
+	})
+	l.parseRepeated("header-match", d.repeatedLabels(c, "header-match"), func(v []string) (err error) {
+		res.HeaderMatch, err = parseHeaderMatch(v)
+		return err
+	})
+	if l.err != nil {
+		return discovery.URLMapper{}, l.err
+	}
+
+	baseURL, err := d.baseURL(c, l, res.TLSServerName != "" || res.InsecureSkipVerify || res.CACert != "")
+	if err != nil {
+		return discovery.URLMapper{}, err
+	}
+	res.Dst, res.PingURL = baseURL+"/$1", baseURL+"/ping"
+	if v, ok := l.get("dest"); ok {
+		res.Dst = baseURL + v
+	}
+	if v, ok := l.get("server"); ok {
+		res.Server = v
+	}
+	if v, ok := l.get("ping"); ok {
+		res.PingURL = baseURL + v
+	}
+
+	srcURL := fmt.Sprintf("^/api/%s/(.*)", c.Name)
+	if v, ok := l.get("route"); ok {
+		srcURL = v
+	}
+	srcRegex, err := compileRoute(srcURL)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrapf(err, "invalid src regex %s", srcURL)
+	}
+	res.SrcMatch = *srcRegex
+
+	if v, ok := l.get("redirect"); ok {
+		if res.RedirectCode, err = parseRedirect(v); err != nil {
+			return discovery.URLMapper{}, errors.Wrap(err, "invalid redirect label")
 		}
-		if v, ok := c.Labels["reproxy.server"]; ok {
-			server = v
+		// location of redirect is not the container, dest label used as is and nothing to ping
+		if res.Dst, ok = l.get("dest"); !ok {
+			return discovery.URLMapper{}, errors.New("redirect label requires dest label")
 		}
-		srcRegex, err := regexp.Compile(srcURL)
+		res.MatchType, res.PingURL = discovery.MTRedirect, ""
+	}
+	return res, nil
+}
 
-		if v, ok := c.Labels["reproxy.ping"]; ok {
-			pingURL = fmt.Sprintf("http://%s:%d%s", c.IP, c.Port, v)
+// baseURL makes base url of destination and ping urls, the container's ip and port with scheme label,
+// https if tls set and http otherwise. Containers with socket label routed to the unix socket
+func (d *Docker) baseURL(c containerInfo, l *containerLabels, tls bool) (string, error) {
+	if v, ok := l.get("socket"); ok {
+		if v = strings.TrimSpace(v); !strings.HasPrefix(v, "/") || !strings.HasSuffix(v, ".sock") {
+			return "", errors.Errorf("invalid socket label %q, should be absolute path ending with .sock", v)
 		}
-
-		if err != nil {
-			return nil, errors.Wrapf(err, "invalid src regex %s", srcURL)
+		return "unix:" + v, nil
+	}
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	if v, ok := l.get("scheme"); ok {
+		scheme = strings.ToLower(strings.TrimSpace(v))
+		if scheme != "http" && scheme != "https" {
+			return "", errors.Errorf("invalid scheme label %q", v)
 		}
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, c.IP, c.Port), nil
+}
 
-		res = append(res, discovery.URLMapper{Server: server, SrcMatch: *srcRegex, Dst: destURL, PingURL: pingURL})
+// containerLabels reads values of container's labels with the given prefix. Parsing stops on the first invalid label,
+// its error kept in err and all subsequent reads return zero values
+type containerLabels struct {
+	prefix string
+	values map[string]string
+	err    error
+}
+
+// get returns value of the label, ok is false if the label not set or previous label invalid
+func (l *containerLabels) get(name string) (string, bool) {
+	if l.err != nil {
+		return "", false
 	}
-	return res, nil
+	v, ok := l.values[l.prefix+"."+name]
+	return v, ok
+}
+
+// raw returns value of the label as is, empty if not set
+func (l *containerLabels) raw(name string) string {
+	v, _ := l.get(name)
+	return v
+}
+
+// str returns trimmed value of the label, empty if not set
+func (l *containerLabels) str(name string) string {
+	return strings.TrimSpace(l.raw(name))
+}
+
+func (l *containerLabels) boolean(name string) bool {
+	v, ok := l.get(name)
+	if !ok {
+		return false
+	}
+	res, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		l.err = errors.Errorf("invalid %s label %q", name, v)
+	}
+	return res
+}
+
+// integer returns value of the label in min..max range, def if not set
+func (l *containerLabels) integer(name string, def, min, max int) int {
+	v, ok := l.get(name)
+	if !ok {
+		return def
+	}
+	res, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || res < min || res > max {
+		l.err = errors.Errorf("invalid %s label %q", name, v)
+	}
+	return res
+}
+
+func (l *containerLabels) duration(name string) time.Duration {
+	var res time.Duration
+	l.parse(name, func(v string) (err error) {
+		res, err = time.ParseDuration(strings.TrimSpace(v))
+		return err
+	})
+	return res
+}
+
+// parse calls fn with value of the label if set, error of fn kept as the label's error
+func (l *containerLabels) parse(name string, fn func(v string) error) {
+	v, ok := l.get(name)
+	if !ok {
+		return
+	}
+	if err := fn(v); err != nil {
+		l.err = errors.Wrapf(err, "invalid %s label", name)
+	}
+}
+
+// parseRepeated calls fn with values of the repeated label, error of fn kept as the label's error
+func (l *containerLabels) parseRepeated(name string, vals []string, fn func(v []string) error) {
+	if l.err != nil {
+		return
+	}
+	if err := fn(vals); err != nil {
+		l.err = errors.Wrapf(err, "invalid %s label", name)
+	}
+}
+
+// repeatedLabels returns values of repeated labels with the given name, i.e. "header". Labels can't be repeated,
+// so reproxy.header label can be followed by any number of suffixed ones, i.e. reproxy.header.1, reproxy.header.auth.
+// Ordered by label name.
+func (d *Docker) repeatedLabels(c containerInfo, name string) []string {
+	label := d.labelPrefix() + "." + name
+	keys := []string{}
+	for k := range c.Labels {
+		if k == label || strings.HasPrefix(k, label+".") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, c.Labels[k])
+	}
+	return res
 }
 
 // ID returns providers id
@@ -105,23 +361,33 @@ func (d *Docker) ID() discovery.ProviderID { return discovery.PIDocker }
 
 // activate starts blocking listener for all docker events
 // filters everything except "container" type, detects stop/start events and publishes signals to eventsCh
-func (d *Docker) events(ctx context.Context, client DockerClient, eventsCh chan struct{}) error {
+func (d *Docker) events(ctx context.Context, client DockerClient, eventsCh chan struct{}, resync bool) error {
 	dockerEventsCh := make(chan *dc.APIEvents)
+	events := []string{"start", "die", "destroy", "restart", "pause"}
+	if d.HealthyOnly {
+		events = append(events, "health_status") // containers become healthy after start
+	}
 	err := client.AddEventListenerWithOptions(dc.EventsOptions{
-		Filters: map[string][]string{"type": {"container"}, "event": {"start", "die", "destroy", "restart", "pause"}}},
-		dockerEventsCh)
+		Filters: map[string][]string{"type": {"container"}, "event": events}}, dockerEventsCh)
 	if err != nil {
 		return errors.Wrap(err, "can't add even listener")
 	}
 
-	eventsCh <- struct{}{} // initial emmit
+	// emit on re-subscription forces resync of containers changed while listener was down
+	if resync {
+		select {
+		case eventsCh <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case ev, ok := <-dockerEventsCh:
 			if !ok {
-				return errors.New("events closed")
+				return errEventsClosed
 			}
 			log.Printf("[DEBUG] api event %+v", ev)
 			containerName := strings.TrimPrefix(ev.Actor.Attributes["name"], "/")
@@ -136,7 +402,7 @@ func (d *Docker) events(ctx context.Context, client DockerClient, eventsCh chan
 	}
 }
 
-func (d *Docker) listContainers() (res []containerInfo, err error) {
+func (d *Docker) listContainers(ctx context.Context) (res []containerInfo, err error) {
 
 	portExposed := func(c dc.APIContainers) (int, bool) {
 		if len(c.Ports) == 0 {
@@ -145,7 +411,21 @@ func (d *Docker) listContainers() (res []containerInfo, err error) {
 		return int(c.Ports[0].PrivatePort), true
 	}
 
-	containers, err := d.DockerClient.ListContainers(dc.ListContainersOptions{All: false})
+	// portLabeled returns port set by port label if it is exposed by the container
+	portLabeled := func(c dc.APIContainers, v string) (int, bool) {
+		port, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, false
+		}
+		for _, p := range c.Ports {
+			if int(p.PrivatePort) == port {
+				return port, true
+			}
+		}
+		return 0, false
+	}
+
+	containers, err := d.DockerClient.ListContainers(dc.ListContainersOptions{All: false, Context: ctx})
 	if err != nil {
 		return nil, errors.Wrap(err, "can't list containers")
 	}
@@ -156,19 +436,35 @@ func (d *Docker) listContainers() (res []containerInfo, err error) {
 			log.Printf("[DEBUG] skip container %s due to state %s", c.Names[0], c.State)
 			continue
 		}
+		if d.HealthyOnly && !healthy(c.Status) {
+			log.Printf("[DEBUG] skip container %s due to status %s", c.Names[0], c.Status)
+			continue
+		}
 		containerName := strings.TrimPrefix(c.Names[0], "/")
 		if contains(containerName, d.Excludes) {
 			log.Printf("[DEBUG] container %s excluded", containerName)
 			continue
 		}
+		if !d.enabled(c) {
+			log.Printf("[DEBUG] container %s not enabled", containerName)
+			continue
+		}
 
-		var ip string
-		for k, v := range c.Networks.Networks {
-			if d.Network == "" || k == d.Network { // match on network name if defined
-				ip = v.IPAddress
-				break
-			}
+		ci := containerInfo{
+			Name:   containerName,
+			ID:     c.ID,
+			TS:     time.Unix(c.Created/1000, 0),
+			Labels: c.Labels,
 		}
+
+		// containers serving unix socket routed with no ip and exposed ports
+		if _, socket := c.Labels[d.labelPrefix()+".socket"]; socket {
+			log.Printf("[DEBUG] running container added, %+v", ci)
+			res = append(res, ci)
+			continue
+		}
+
+		ip := d.containerIP(c)
 		if ip == "" {
 			log.Printf("[DEBUG] skip container %s, no ip on %+v", c.Names[0], c.Networks.Networks)
 			continue
@@ -179,16 +475,14 @@ func (d *Docker) listContainers() (res []containerInfo, err error) {
 			log.Printf("[DEBUG] skip container %s, no exposed ports", c.Names[0])
 			continue
 		}
-
-		ci := containerInfo{
-			Name:   containerName,
-			ID:     c.ID,
-			TS:     time.Unix(c.Created/1000, 0),
-			Labels: c.Labels,
-			IP:     ip,
-			Port:   port,
+		if v, found := c.Labels[d.labelPrefix()+".port"]; found {
+			if port, ok = portLabeled(c, v); !ok {
+				log.Printf("[WARN] skip container %s, port %q not exposed", c.Names[0], v)
+				continue
+			}
 		}
 
+		ci.IP, ci.Port = ip, port
 		log.Printf("[DEBUG] running container added, %+v", ci)
 		res = append(res, ci)
 	}
@@ -196,6 +490,53 @@ func (d *Docker) listContainers() (res []containerInfo, err error) {
 	return res, nil
 }
 
+// containerIP returns ip of the container on the first network from comma-separated Network list.
+// Falls back to the ip on any other network (in alphabetical order) if container has none of them
+func (d *Docker) containerIP(c dc.APIContainers) string {
+	for _, n := range strings.Split(d.Network, ",") {
+		if v, ok := c.Networks.Networks[strings.TrimSpace(n)]; ok && v.IPAddress != "" {
+			return v.IPAddress
+		}
+	}
+
+	names := make([]string, 0, len(c.Networks.Networks))
+	for k := range c.Networks.Networks {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if ip := c.Networks.Networks[n].IPAddress; ip != "" {
+			if d.Network != "" {
+				log.Printf("[INFO] container %s not on %s, network %s used", c.Names[0], d.Network, n)
+			}
+			return ip
+		}
+	}
+	return ""
+}
+
+// enabled checks enabled label of the container, containers without the label enabled unless RequireEnabled set.
+// Containers with invalid label value skipped
+func (d *Docker) enabled(c dc.APIContainers) bool {
+	v, ok := c.Labels[d.labelPrefix()+".enabled"]
+	if !ok {
+		return !d.RequireEnabled
+	}
+	enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		log.Printf("[WARN] skip container %s, invalid enabled label %q", c.Names[0], v)
+		return false
+	}
+	return enabled
+}
+
+func (d *Docker) labelPrefix() string {
+	if d.LabelPrefix == "" {
+		return defaultLabelPrefix
+	}
+	return d.LabelPrefix
+}
+
 func contains(e string, s []string) bool {
 	for _, a := range s {
 		if a == e {
@@ -204,3 +545,9 @@ func contains(e string, s []string) bool {
 	}
 	return false
 }
+
+// healthy checks health of the container by its status, i.e. "Up 5 minutes (healthy)".
+// Containers without health check have no health in status and treated as healthy
+func healthy(status string) bool {
+	return !strings.Contains(status, "(unhealthy)") && !strings.Contains(status, "(health: starting)")
+}
@@ -2,12 +2,16 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	dc "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 func TestDocker_List(t *testing.T) {
@@ -22,7 +26,9 @@ func TestDocker_List(t *testing.T) {
 						{PrivatePort: 12345},
 					},
 					Labels: map[string]string{"reproxy.route": "^/api/123/(.*)", "reproxy.dest": "/blah/$1",
-						"reproxy.server": "example.com", "reproxy.ping": "/ping"},
+						"reproxy.server": "example.com", "reproxy.ping": "/ping",
+						"reproxy.resolve": "backend.local:10.0.0.5, other.local:10.0.0.6", "reproxy.methods": "get, Post",
+						"reproxy.weight": "5", "reproxy.timeout": "250ms", "reproxy.name": " api 123 "},
 				},
 				{Names: []string{"c2"}, State: "running",
 					Networks: dc.NetworkList{
@@ -32,6 +38,20 @@ func TestDocker_List(t *testing.T) {
 						{PrivatePort: 12346},
 					},
 				},
+				{Names: []string{"c5"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.4"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 8443}},
+					Labels: map[string]string{"reproxy.tls-servername": "c5.example.com", "reproxy.route": "^/c5/(.*)"},
+				},
+				{Names: []string{"c6"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.5"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 443}},
+					Labels: map[string]string{"reproxy.scheme": "HTTPS", "reproxy.ping": "/health"},
+				},
 				{Names: []string{"c3"}, State: "stopped"},
 				{Names: []string{"c4"}, State: "running",
 					Networks: dc.NetworkList{
@@ -46,20 +66,392 @@ func TestDocker_List(t *testing.T) {
 	}
 
 	d := Docker{DockerClient: dclient, Network: "bridge"}
-	res, err := d.List()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := d.List(ctx)
 	require.NoError(t, err)
-	require.Equal(t, 2, len(res))
+	require.Equal(t, 5, len(res))
+	assert.Equal(t, ctx, dclient.ListContainersCalls()[0].Opts.Context, "ctx passed to docker client")
 
 	assert.Equal(t, "^/api/123/(.*)", res[0].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.2:12345/blah/$1", res[0].Dst)
 	assert.Equal(t, "example.com", res[0].Server)
+	assert.Equal(t, "api 123", res[0].Name)
 	assert.Equal(t, "http://127.0.0.2:12345/ping", res[0].PingURL)
+	assert.Equal(t, map[string]string{"backend.local": "10.0.0.5", "other.local": "10.0.0.6"}, res[0].Resolve)
+	assert.Equal(t, []string{"GET", "POST"}, res[0].Methods)
+	assert.Equal(t, 5, res[0].Weight)
+	assert.Equal(t, 250*time.Millisecond, res[0].Timeout)
 
 	assert.Equal(t, "^/api/c2/(.*)", res[1].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.3:12346/$1", res[1].Dst)
 	assert.Equal(t, "http://127.0.0.3:12346/ping", res[1].PingURL)
 	assert.Equal(t, "*", res[1].Server)
+	assert.Equal(t, "", res[1].Name)
+	assert.Nil(t, res[1].Resolve)
+	assert.Nil(t, res[1].Methods)
+	assert.Equal(t, 1, res[1].Weight)
+	assert.Equal(t, "", res[1].TLSServerName)
+
+	assert.Equal(t, "^/c5/(.*)", res[2].SrcMatch.String())
+	assert.Equal(t, "https://127.0.0.4:8443/$1", res[2].Dst)
+	assert.Equal(t, "https://127.0.0.4:8443/ping", res[2].PingURL)
+	assert.Equal(t, "c5.example.com", res[2].TLSServerName)
+
+	assert.Equal(t, "^/api/c6/(.*)", res[3].SrcMatch.String())
+	assert.Equal(t, "https://127.0.0.5:443/$1", res[3].Dst)
+	assert.Equal(t, "https://127.0.0.5:443/health", res[3].PingURL)
+	assert.Equal(t, "", res[3].TLSServerName)
+
+	assert.Equal(t, "^/api/c4/(.*)", res[4].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345/$1", res[4].Dst, "not on bridge, other network used")
+}
+
+func TestDocker_ListWithNetworks(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"},
+							"internal": {IPAddress: "10.0.0.2"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+				},
+				{Names: []string{"c2"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.3"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+				},
+				{Names: []string{"c3"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"zzz": {IPAddress: "192.168.0.4"},
+							"other": {IPAddress: "172.16.0.4"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, Network: "internal, bridge"}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "http://10.0.0.2:8080/$1", res[0].Dst, "internal preferred")
+	assert.Equal(t, "http://127.0.0.3:8080/$1", res[1].Dst, "bridge as second choice")
+	assert.Equal(t, "http://172.16.0.4:8080/$1", res[2].Dst, "fallback to the first available network")
+
+	d = Docker{DockerClient: dclient, Network: "bridge,internal"}
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "http://127.0.0.2:8080/$1", res[0].Dst)
+}
+
+func TestDocker_ListWithBadScheme(t *testing.T) {
+	d := Docker{}
+	_, err := d.mapper(containerInfo{Name: "c1", IP: "127.0.0.2", Port: 12345, Labels: map[string]string{"reproxy.scheme": "ftp"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid scheme label "ftp"`)
+}
+
+func TestDocker_ListWithRetriesLabel(t *testing.T) {
+	labels := map[string]string{"reproxy.retries": "3"}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 3, res[0].Retries)
+
+	labels["reproxy.retries"] = "-1"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid retries label "-1"`)
+}
+
+func TestDocker_ListHealthyOnly(t *testing.T) {
+	container := func(name, status string) dc.APIContainers {
+		return dc.APIContainers{Names: []string{name}, State: "running", Status: status,
+			Networks: dc.NetworkList{
+				Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+			},
+			Ports: []dc.APIPort{{PrivatePort: 12345}},
+		}
+	}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				container("healthy", "Up 5 minutes (healthy)"),
+				container("unhealthy", "Up 5 minutes (unhealthy)"),
+				container("starting", "Up 2 seconds (health: starting)"),
+				container("no-check", "Up 5 minutes"),
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(res), "health ignored by default")
+
+	d.HealthyOnly = true
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "^/api/healthy/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "^/api/no-check/(.*)", res[1].SrcMatch.String())
+}
+
+func TestDocker_ListEnabledLabel(t *testing.T) {
+	container := func(name string, labels map[string]string) dc.APIContainers {
+		return dc.APIContainers{Names: []string{name}, State: "running", Labels: labels,
+			Networks: dc.NetworkList{
+				Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+			},
+			Ports: []dc.APIPort{{PrivatePort: 12345}},
+		}
+	}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				container("on", map[string]string{"reproxy.enabled": "true"}),
+				container("off", map[string]string{"reproxy.enabled": "false"}),
+				container("bad", map[string]string{"reproxy.enabled": "maybe"}),
+				container("no-label", nil),
+				container("custom", map[string]string{"custom.enabled": "1", "custom.route": "^/custom/(.*)"}),
+			}, nil
+		},
+	}
+
+	names := func(res []discovery.URLMapper) (names []string) {
+		for _, m := range res {
+			names = append(names, m.SrcMatch.String())
+		}
+		return names
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"^/api/on/(.*)", "^/api/no-label/(.*)", "^/api/custom/(.*)"}, names(res),
+		"disabled and invalid excluded")
+
+	d.RequireEnabled = true
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"^/api/on/(.*)"}, names(res), "only opted in")
+
+	d.LabelPrefix = "custom"
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"^/custom/(.*)"}, names(res), "label with custom prefix")
+}
+
+func TestDocker_ListWithMaxBodyLabel(t *testing.T) {
+	labels := map[string]string{"reproxy.max-body": "10M"}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, int64(10*1024*1024), res[0].MaxBodySize)
+
+	labels["reproxy.max-body"] = "big"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid max-body label: invalid size "big"`)
+}
+
+func TestDocker_ListWithTransportLabels(t *testing.T) {
+	labels := map[string]string{"reproxy.max-idle-conns": "20", "reproxy.max-conns": "50", "reproxy.idle-timeout": "30s"}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 20, res[0].MaxIdleConnsPerHost)
+	assert.Equal(t, 50, res[0].MaxConnsPerHost)
+	assert.Equal(t, 30*time.Second, res[0].IdleConnTimeout)
+
+	labels["reproxy.max-conns"] = "-1"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid max-conns label "-1"`)
+
+	labels["reproxy.max-conns"] = "50"
+	labels["reproxy.idle-timeout"] = "soon"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid idle-timeout label: time: invalid duration "soon"`)
+}
+
+func TestDocker_ListWithAllowIPLabel(t *testing.T) {
+	labels := map[string]string{"reproxy.allow-ip": "10.0.0.0/8, 192.168.1.1"}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, res[0].AllowIPs)
+
+	labels["reproxy.allow-ip"] = "10.0.0.0/33"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid allow-ip label: invalid allowed ip "10.0.0.0/33", should be ip or cidr`)
+}
+
+func TestDocker_ListWithClientCNLabel(t *testing.T) {
+	labels := map[string]string{"reproxy.client-cn": `^client\d+\.example\.com$`}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	require.NotNil(t, res[0].ClientCN)
+	assert.Equal(t, `^client\d+\.example\.com$`, res[0].ClientCN.String())
+
+	labels["reproxy.client-cn"] = "((client"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid client-cn label: can't parse regex of client cn "((client"`)
+}
+
+func TestDocker_ListWithRedirectLabel(t *testing.T) {
+	labels := map[string]string{"reproxy.redirect": "308", "reproxy.route": "^/old/(.*)",
+		"reproxy.dest": "https://example.com/new/$1"}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: labels,
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, discovery.MTRedirect, res[0].MatchType)
+	assert.Equal(t, 308, res[0].RedirectCode)
+	assert.Equal(t, "https://example.com/new/$1", res[0].Dst, "location used as is")
+	assert.Equal(t, "", res[0].PingURL)
+
+	labels["reproxy.redirect"] = "200"
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, `invalid redirect label: invalid redirect status "200", should be 301, 302, 307 or 308`)
+
+	labels["reproxy.redirect"] = "301"
+	delete(labels, "reproxy.dest")
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: labels})
+	assert.EqualError(t, err, "redirect label requires dest label")
+}
+
+func TestDocker_ListSkipsInvalidContainer(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12345}},
+					Labels: map[string]string{"reproxy.weight": "bad"},
+				},
+				{Names: []string{"c2"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.3"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 12346}},
+					Labels: map[string]string{"reproxy.weight": "2"},
+				},
+			}, nil
+		},
+	}
 
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "container with invalid label skipped")
+	assert.Equal(t, "^/api/c2/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:12346/$1", res[0].Dst)
+	assert.Equal(t, 2, res[0].Weight)
+}
+
+func TestDocker_ListWithBadResolve(t *testing.T) {
+	d := Docker{}
+	_, err := d.mapper(containerInfo{Name: "c1", IP: "127.0.0.2", Port: 12345,
+		Labels: map[string]string{"reproxy.resolve": "backend.local:bad-ip"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid resolve label")
 }
 
 func TestDocker_Events(t *testing.T) {
@@ -90,3 +482,317 @@ func TestDocker_Events(t *testing.T) {
 	}
 	assert.Equal(t, 2+1, events, "initial event plus 2 more")
 }
+
+func TestDocker_EventsReconnect(t *testing.T) {
+	var calls int32
+	dclient := &DockerClientMock{
+		AddEventListenerWithOptionsFunc: func(options dc.EventsOptions, listener chan<- *dc.APIEvents) error {
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				return errors.New("docker daemon is down")
+			case 2:
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					listener <- &dc.APIEvents{Type: "container", Status: "start",
+						Actor: dc.APIActor{Attributes: map[string]string{"name": "/c1"}}}
+					close(listener) // daemon restarted
+				}()
+			}
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	d := Docker{DockerClient: dclient, retryDelay: 10 * time.Millisecond, maxRetryDelay: 20 * time.Millisecond}
+	ch := d.Events(ctx)
+
+	events := 0
+	for range ch {
+		events++
+	}
+	assert.Equal(t, 1+2+1, events, "initial event, resync event on each re-subscription plus one more")
+	assert.Equal(t, 3, len(dclient.AddEventListenerWithOptionsCalls()), "re-subscribed after failure and close")
+}
+
+func TestDocker_ServiceInitialLoad(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}}},
+					Ports:    []dc.APIPort{{PrivatePort: 12345}}, Labels: map[string]string{"reproxy.route": "^/api/(.*)"}},
+			}, nil
+		},
+		AddEventListenerWithOptionsFunc: func(options dc.EventsOptions, listener chan<- *dc.APIEvents) error {
+			return nil
+		},
+	}
+	svc := discovery.NewService([]discovery.Provider{&Docker{DockerClient: dclient}})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	assert.Equal(t, 1, len(svc.Mappers()))
+	assert.Equal(t, 1, svc.Generation(), "initial event of provider not loading rules again")
+	assert.Equal(t, 1, len(dclient.ListContainersCalls()))
+	assert.Equal(t, 1, len(dclient.AddEventListenerWithOptionsCalls()))
+}
+
+func TestDocker_ListWithLabelPrefix(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 12345}},
+					Labels: map[string]string{"myproxy.route": "^/my/(.*)", "myproxy.dest": "/blah/$1",
+						"myproxy.server": "example.com", "reproxy.route": "^/other/(.*)"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient, LabelPrefix: "myproxy"}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/my/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:12345/blah/$1", res[0].Dst)
+	assert.Equal(t, "example.com", res[0].Server)
+
+	d = Docker{DockerClient: dclient}
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/other/(.*)", res[0].SrcMatch.String(), "default prefix")
+	assert.Equal(t, "http://127.0.0.2:12345/$1", res[0].Dst)
+	assert.Equal(t, "*", res[0].Server)
+}
+
+func TestDocker_ListWithHeaderLabels(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+					Labels: map[string]string{"reproxy.header": "X-Auth-Token: secret",
+						"reproxy.header.2": "X-Backend:c1", "reproxy.headers": "ignored:1", "reproxy.cache": "true",
+						"reproxy.rewrite-body": "true", "reproxy.preserve-host": "true", "reproxy.host-header": " c1.internal ",
+						"reproxy.canary-dest": "http://canary.local:8080/$1", "reproxy.canary-percent": "10",
+						"reproxy.sticky": "true", "reproxy.max-conns": "5", "reproxy.mirror": " http://mirror.local:8080/$1 ",
+						"reproxy.header-match": "x-api-version:^2$", "reproxy.header-match.1": "X-Client: ^mobile"},
+				},
+				{Names: []string{"c2"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.3"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, []string{"X-Auth-Token:secret", "X-Backend:c1"}, res[0].Headers)
+	assert.True(t, res[0].Cache)
+	assert.True(t, res[0].RewriteBody)
+	assert.True(t, res[0].PreserveHost)
+	assert.Equal(t, "c1.internal", res[0].HostHeader)
+	assert.Equal(t, "http://canary.local:8080/$1", res[0].CanaryDst)
+	assert.Equal(t, 10, res[0].CanaryPercent)
+	assert.Equal(t, "http://mirror.local:8080/$1", res[0].MirrorDst)
+	assert.True(t, res[0].Sticky)
+	assert.Equal(t, "", res[0].StickyKey)
+	assert.Equal(t, 5, res[0].MaxConnsPerHost)
+	require.Equal(t, 2, len(res[0].HeaderMatch))
+	assert.Equal(t, "^2$", res[0].HeaderMatch["X-Api-Version"].String())
+	assert.Equal(t, "^mobile", res[0].HeaderMatch["X-Client"].String())
+	assert.Nil(t, res[1].Headers)
+	assert.Nil(t, res[1].HeaderMatch)
+	assert.False(t, res[1].Cache)
+	assert.False(t, res[1].RewriteBody)
+	assert.False(t, res[1].PreserveHost)
+	assert.Equal(t, "", res[1].HostHeader)
+	assert.Equal(t, "", res[1].CanaryDst)
+	assert.Equal(t, 0, res[1].CanaryPercent)
+	assert.Equal(t, "", res[1].MirrorDst)
+	assert.False(t, res[1].Sticky)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.header": "bad"}})
+	assert.EqualError(t, err, `invalid header label: invalid header "bad", should be key:value`)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.header-match": "X-Api-Version"}})
+	assert.EqualError(t, err, `invalid header-match label: invalid header match "X-Api-Version", should be key:regex`)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.canary-percent": "101"}})
+	assert.EqualError(t, err, `invalid canary-percent label "101"`)
+
+	dclient.ListContainersFunc = func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+		return []dc.APIContainers{
+			{Names: []string{"c1"}, State: "running",
+				Networks: dc.NetworkList{
+					Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+				},
+				Ports:  []dc.APIPort{{PrivatePort: 8080}},
+				Labels: map[string]string{"reproxy.sticky-key": "session"},
+			},
+		}, nil
+	}
+	res, err = d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.True(t, res[0].Sticky, "sticky by key")
+	assert.Equal(t, "session", res[0].StickyKey)
+}
+
+func TestDocker_ListWithPortLabel(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 8080}, {PrivatePort: 9090}},
+					Labels: map[string]string{"reproxy.port": "9090"},
+				},
+				{Names: []string{"c2"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.3"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}, {PrivatePort: 9090}},
+				},
+				{Names: []string{"c3"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.4"}},
+					},
+					Ports:  []dc.APIPort{{PrivatePort: 8080}},
+					Labels: map[string]string{"reproxy.port": "9090"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "c3 skipped, labeled port not exposed")
+
+	assert.Equal(t, "^/api/c1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:9090/$1", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.2:9090/ping", res[0].PingURL)
+
+	assert.Equal(t, "^/api/c2/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.3:8080/$1", res[1].Dst, "first port by default")
+}
+
+func TestDocker_ListWithSocketLabel(t *testing.T) {
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				{Names: []string{"c1"}, State: "running", // no network and ports, served by socket only
+					Labels: map[string]string{"reproxy.socket": "/var/run/c1/app.sock"},
+				},
+				{Names: []string{"c2"}, State: "running",
+					Networks: dc.NetworkList{
+						Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.3"}},
+					},
+					Ports: []dc.APIPort{{PrivatePort: 8080}},
+					Labels: map[string]string{"reproxy.socket": "/var/run/c2/app.sock", "reproxy.dest": "/blah/$1",
+						"reproxy.ping": "/health"},
+				},
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+
+	assert.Equal(t, "^/api/c1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "unix:/var/run/c1/app.sock/$1", res[0].Dst)
+	assert.Equal(t, "unix:/var/run/c1/app.sock/ping", res[0].PingURL)
+
+	assert.Equal(t, "unix:/var/run/c2/app.sock/blah/$1", res[1].Dst)
+	assert.Equal(t, "unix:/var/run/c2/app.sock/health", res[1].PingURL)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.socket": "var/run/app.socket"}})
+	assert.EqualError(t, err, `invalid socket label "var/run/app.socket", should be absolute path ending with .sock`)
+}
+
+func TestDocker_ListWithVerificationLabels(t *testing.T) {
+	container := func(name string, labels map[string]string) dc.APIContainers {
+		return dc.APIContainers{Names: []string{name}, State: "running",
+			Networks: dc.NetworkList{Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}}},
+			Ports:    []dc.APIPort{{PrivatePort: 8443}}, Labels: labels}
+	}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				container("c1", map[string]string{"reproxy.insecure": "true"}),
+				container("c2", map[string]string{"reproxy.ca-cert": "/etc/ssl/c2.pem", "reproxy.tls-servername": "c2.example.com"}),
+				container("c3", map[string]string{"reproxy.insecure": "false"}),
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+
+	assert.Equal(t, "https://127.0.0.2:8443/$1", res[0].Dst, "switched to https")
+	assert.True(t, res[0].InsecureSkipVerify)
+	assert.Equal(t, "", res[0].CACert)
+
+	assert.Equal(t, "https://127.0.0.2:8443/$1", res[1].Dst)
+	assert.False(t, res[1].InsecureSkipVerify)
+	assert.Equal(t, "/etc/ssl/c2.pem", res[1].CACert)
+	assert.Equal(t, "c2.example.com", res[1].TLSServerName)
+
+	assert.Equal(t, "http://127.0.0.2:8443/$1", res[2].Dst)
+	assert.False(t, res[2].InsecureSkipVerify)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.insecure": "blah"}})
+	assert.EqualError(t, err, `invalid insecure label "blah"`)
+}
+
+func TestDocker_ListWithPingLabels(t *testing.T) {
+	container := func(name string, labels map[string]string) dc.APIContainers {
+		return dc.APIContainers{Names: []string{name}, State: "running",
+			Networks: dc.NetworkList{Networks: map[string]dc.ContainerNetwork{"bridge": {IPAddress: "127.0.0.2"}}},
+			Ports:    []dc.APIPort{{PrivatePort: 8080}}, Labels: labels}
+	}
+	dclient := &DockerClientMock{
+		ListContainersFunc: func(opts dc.ListContainersOptions) ([]dc.APIContainers, error) {
+			return []dc.APIContainers{
+				container("c1", map[string]string{"reproxy.ping": "/health", "reproxy.ping-status": "204"}),
+				container("c2", map[string]string{"reproxy.ping-body": `"status":"ok"`}),
+			}, nil
+		},
+	}
+
+	d := Docker{DockerClient: dclient}
+	res, err := d.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "http://127.0.0.2:8080/health", res[0].PingURL)
+	assert.Equal(t, 204, res[0].PingStatus)
+	assert.Equal(t, "", res[0].PingBody)
+	assert.Equal(t, 0, res[1].PingStatus)
+	assert.Equal(t, `"status":"ok"`, res[1].PingBody)
+
+	_, err = d.mapper(containerInfo{Name: "c1", Labels: map[string]string{"reproxy.ping-status": "600"}})
+	assert.EqualError(t, err, `invalid ping-status label "600"`)
+}
@@ -2,9 +2,14 @@ package provider
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -14,16 +19,49 @@ import (
 	"github.com/umputun/reproxy/app/discovery"
 )
 
-// File implements file-based provider, defined with yaml file
+// defaultFileDelay is a debounce window used if File.Delay not set
+const defaultFileDelay = 500 * time.Millisecond
+
+// File implements file-based provider, defined with yaml file.
+// Changes made within Delay window collapse into a single event sent after the file stops changing.
+// Malformed file, i.e. in the middle of editing, doesn't drop routes, the last good rules served until fixed.
 type File struct {
 	FileName      string
 	CheckInterval time.Duration
 	Delay         time.Duration
+	NoDefaultPing bool // don't derive ping url of rules without ping from their dest, see defaultPingURL
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+	hasGood  bool
+	included []string // files included by the last load, watched for changes along with FileName
+	hasIncl  bool     // included set, by load or by the initial Events call
 }
 
-// Events returns channel updating on file change only
+// Events returns channel updating on change of the file or files included by it only. The initial event sent right away
 func (d *File) Events(ctx context.Context) <-chan struct{} {
-	res := make(chan struct{})
+	return watchFile(ctx, d.watched, d.CheckInterval, d.Delay)
+}
+
+// watched returns the file and files included by it. Included files found on the first call if not loaded yet,
+// so the initial state of files is complete and the first load doesn't look like a change
+func (d *File) watched() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.hasIncl {
+		files, _ := loadFile(d.FileName, nil, map[string][]fileRule{})
+		d.included, d.hasIncl = files[1:], true
+	}
+	return append([]string{d.FileName}, d.included...)
+}
+
+// watchFile returns channel updating on change of the files, checked every interval. The list of files is
+// requested on each check, the first one is the main file and checks skipped while it's missing. The initial
+// event sent right away, changes detected against the state of files on the call. Changes made within delay
+// window (defaultFileDelay if zero) collapse into a single event sent after the files stop changing
+func watchFile(ctx context.Context, files func() []string, interval, delay time.Duration) <-chan struct{} {
+	res := make(chan struct{}, 1)
+	res <- struct{}{} // initial event
 
 	// no need to queue multiple events
 	trySubmit := func(ch chan struct{}) {
@@ -33,29 +71,36 @@ func (d *File) Events(ctx context.Context) <-chan struct{} {
 		}
 	}
 
+	if delay == 0 {
+		delay = defaultFileDelay
+	}
+
+	lastModif, _ := modState(files()) // modification state of files of the last reported change
+	pending := ""                     // modification state of the change waiting for the burst to settle
 	go func() {
-		tk := time.NewTicker(d.CheckInterval)
-		lastModif := time.Time{}
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		changedAt := time.Time{}
 		for {
 			select {
 			case <-tk.C:
-				fi, err := os.Stat(d.FileName)
-				if err != nil {
+				modif, ok := modState(files())
+				if !ok {
+					continue
+				}
+				if modif != lastModif && modif != pending {
+					// files changed, restart debounce window
+					pending, changedAt = modif, time.Now()
 					continue
 				}
-				if fi.ModTime() != lastModif {
-					// don't react on modification right away
-					if fi.ModTime().Sub(lastModif) < d.Delay {
-						continue
-					}
-					log.Printf("[DEBUG] file %s changed, %s -> %s", d.FileName,
-						lastModif.Format(time.RFC3339Nano), fi.ModTime().Format(time.RFC3339Nano))
-					lastModif = fi.ModTime()
-					trySubmit(res)
+				if pending == "" || time.Since(changedAt) < delay {
+					continue
 				}
+				log.Printf("[DEBUG] files %s changed", strings.Join(files(), ", "))
+				lastModif, pending = pending, ""
+				trySubmit(res)
 			case <-ctx.Done():
 				close(res)
-				tk.Stop()
 				return
 			}
 		}
@@ -63,36 +108,116 @@ func (d *File) Events(ctx context.Context) <-chan struct{} {
 	return res
 }
 
-// List all src dst pairs
-func (d *File) List() (res []discovery.URLMapper, err error) {
-
-	var fileConf map[string][]struct {
-		SourceRoute string `yaml:"route"`
-		Dest        string `yaml:"dest"`
-		Ping        string `yaml:"ping"`
+// modState returns modification state of files, changed on change, addition or removal of any of them.
+// False returned if the first file can't be accessed
+func modState(files []string) (string, bool) {
+	var res strings.Builder
+	for i, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if i == 0 {
+				return "", false
+			}
+			res.WriteString(f + ":missing;")
+			continue
+		}
+		res.WriteString(f + ":" + fi.ModTime().Format(time.RFC3339Nano) + ";")
 	}
-	fh, err := os.Open(d.FileName)
+	return res.String(), true
+}
+
+// List all src dst pairs. Returns the last good set of rules if the file can't be loaded
+func (d *File) List(_ context.Context) (res []discovery.URLMapper, err error) {
+	res, err = d.list()
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	if err != nil {
-		return nil, errors.Wrapf(err, "can't open %s", d.FileName)
+		if !d.hasGood {
+			return nil, err
+		}
+		log.Printf("[WARN] file provider failed, last good rules used, %v", err)
+		return d.lastGood, nil
 	}
-	defer fh.Close() //nolint gosec
+	d.lastGood, d.hasGood = res, true
+	return res, nil
+}
+
+// fileRule is a rule of the file provider
+type fileRule struct {
+	Name        string        `yaml:"name"`
+	SourceRoute string        `yaml:"route"`
+	Prefix      string        `yaml:"prefix"`
+	Dest        string        `yaml:"dest"`
+	Ping        string        `yaml:"ping"`
+	PingStatus  int           `yaml:"ping-status"`
+	PingBody    string        `yaml:"ping-body"`
+	Resolve     []string      `yaml:"resolve"`
+	TLSSrvName  string        `yaml:"tls-servername"`
+	Insecure    bool          `yaml:"insecure"`
+	CACert      string        `yaml:"ca-cert"`
+	Methods     []string      `yaml:"methods"`
+	HeaderMatch []string      `yaml:"header-match"`
+	Weight      *int          `yaml:"weight"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Headers     []string      `yaml:"headers"`
+	Cache       bool          `yaml:"cache"`
+	RewriteBody bool          `yaml:"rewrite-body"`
+	KeepHost    bool          `yaml:"preserve-host"`
+	HostHeader  string        `yaml:"host-header"`
+	Sticky      bool          `yaml:"sticky"`
+	StickyKey   string        `yaml:"sticky-key"`
+	Retries     int           `yaml:"retries"`
+	MaxBody     string        `yaml:"max-body"`
+	AllowIPs    []string      `yaml:"allow-ip"`
+	ClientCN    string        `yaml:"client-cn"`
+	MaxIdle     int           `yaml:"max-idle-conns"`
+	MaxConns    int           `yaml:"max-conns"`
+	IdleTimeout time.Duration `yaml:"idle-timeout"`
+	Redirect    string        `yaml:"redirect"`
+	Mirror      string        `yaml:"mirror"`
+	Assets      string        `yaml:"assets"`
+	SPA         bool          `yaml:"spa"`
+	AB          struct {
+		Dest   string `yaml:"dest"`
+		Weight int    `yaml:"weight"`
+		Key    string `yaml:"key"`
+	} `yaml:"ab"`
+	Canary struct {
+		Dest    string `yaml:"dest"`
+		Percent int    `yaml:"percent"`
+	} `yaml:"canary"`
+}
+
+// list loads rules from the file and files included by it. The file is a map of server name to the list of routes,
+// errors of malformed routes refer to the server and the route
+func (d *File) list() (res []discovery.URLMapper, err error) {
 
-	if err = yaml.NewDecoder(fh).Decode(&fileConf); err != nil {
-		return nil, errors.Wrapf(err, "can't parse %s", d.FileName)
+	fileConf := map[string][]fileRule{}
+	files, err := loadFile(d.FileName, nil, fileConf)
+	d.lock.Lock()
+	d.included, d.hasIncl = files[1:], true
+	d.lock.Unlock()
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("[DEBUG] file provider %+v", res)
+	log.Printf("[DEBUG] file provider, files %v", files)
 
 	for srv, fl := range fileConf {
-		for _, f := range fl {
-			rx, e := regexp.Compile(f.SourceRoute)
-			if e != nil {
-				return nil, errors.Wrapf(e, "can't parse regex %s", f.SourceRoute)
+		for i, f := range fl {
+			if f.SourceRoute == "" && f.Prefix == "" {
+				return nil, errors.Errorf("server %s, rule #%d: empty route", srv, i)
+			}
+			if f.SourceRoute != "" && f.Prefix != "" {
+				return nil, errors.Errorf("server %s, route %s: route and prefix are mutually exclusive", srv, f.SourceRoute)
 			}
-			if srv == "default" {
-				srv = "*"
+			if f.Prefix != "" {
+				f.SourceRoute = f.Prefix // errors refer to the prefix as the route
 			}
-			mapper := discovery.URLMapper{Server: srv, SrcMatch: *rx, Dst: f.Dest, PingURL: f.Ping}
-			res = append(res, mapper)
+			m, e := d.mapper(srv, f)
+			if e != nil {
+				return nil, errors.Wrapf(e, "server %s, route %s", srv, f.SourceRoute)
+			}
+			res = append(res, m)
 		}
 	}
 	sort.Slice(res, func(i, j int) bool {
@@ -102,8 +227,177 @@ func (d *File) List() (res []discovery.URLMapper, err error) {
 		return res[i].Server < res[j].Server
 	})
 
-	err = fh.Close()
-	return res, err
+	return res, nil
+}
+
+// mapper makes url mapper of the server's rule
+func (d *File) mapper(srv string, f fileRule) (discovery.URLMapper, error) {
+	if srv == "default" {
+		srv = "*"
+	}
+	allowIPs, err := parseAllowIPs(f.AllowIPs)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse allow-ip")
+	}
+	clientCN, err := parseClientCN(f.ClientCN)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse client-cn")
+	}
+	if f.Assets != "" {
+		m, e := d.assetsMapper(srv, f.SourceRoute, f.Assets, f.SPA)
+		if e != nil {
+			return discovery.URLMapper{}, errors.Wrap(e, "can't make assets route")
+		}
+		m.AllowIPs, m.ClientCN = allowIPs, clientCN
+		return m, nil
+	}
+	if f.Dest == "" {
+		return discovery.URLMapper{}, errors.New("empty dest")
+	}
+	if err = validateRule(f); err != nil {
+		return discovery.URLMapper{}, err
+	}
+	rx, err := compileRoute(f.SourceRoute)
+	if f.Prefix != "" {
+		if rx, err = discovery.PrefixRoute(f.Prefix); err != nil {
+			return discovery.URLMapper{}, errors.Wrap(err, "can't parse prefix")
+		}
+	}
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse regex")
+	}
+	resolve, err := parseResolve(f.Resolve)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse resolve")
+	}
+	headers, err := parseHeaders(f.Headers)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse headers")
+	}
+	headerMatch, err := parseHeaderMatch(f.HeaderMatch)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse header-match")
+	}
+	maxBody, err := parseSize(f.MaxBody)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse max-body")
+	}
+	redirect, err := parseRedirect(f.Redirect)
+	if err != nil {
+		return discovery.URLMapper{}, errors.Wrap(err, "can't parse redirect")
+	}
+	weight := 1
+	if f.Weight != nil {
+		weight = *f.Weight
+	}
+	mapper := discovery.URLMapper{Server: srv, Name: f.Name, SrcMatch: *rx, Dst: f.Dest, PingURL: f.Ping,
+		PingStatus: f.PingStatus, PingBody: f.PingBody, Resolve: resolve,
+		TLSServerName: f.TLSSrvName, InsecureSkipVerify: f.Insecure, CACert: f.CACert,
+		ABDst: f.AB.Dest, ABWeight: f.AB.Weight, ABKey: f.AB.Key,
+		Methods: parseMethods(f.Methods), HeaderMatch: headerMatch, Weight: weight, Timeout: f.Timeout, Headers: headers,
+		Cache: f.Cache, RewriteBody: f.RewriteBody, Retries: f.Retries, MaxBodySize: maxBody, MaxIdleConnsPerHost: f.MaxIdle,
+		MaxConnsPerHost: f.MaxConns, IdleConnTimeout: f.IdleTimeout, AllowIPs: allowIPs, ClientCN: clientCN,
+		PreserveHost: f.KeepHost, HostHeader: f.HostHeader, CanaryDst: f.Canary.Dest, CanaryPercent: f.Canary.Percent,
+		MirrorDst: f.Mirror, Sticky: f.Sticky || f.StickyKey != "", StickyKey: f.StickyKey, MatchPrefix: f.Prefix}
+	if redirect != 0 {
+		mapper.MatchType, mapper.RedirectCode = discovery.MTRedirect, redirect
+	}
+	if mapper.PingURL == "" && mapper.MatchType == discovery.MTProxy && !d.NoDefaultPing {
+		mapper.PingURL = defaultPingURL(f.Dest)
+	}
+	return mapper, nil
+}
+
+// validateRule checks numeric fields of the rule are in allowed ranges
+func validateRule(f fileRule) error {
+	if f.AB.Weight < 0 || f.AB.Weight > 100 {
+		return errors.Errorf("invalid ab weight %d, should be 0..100", f.AB.Weight)
+	}
+	if f.Canary.Percent < 0 || f.Canary.Percent > 100 {
+		return errors.Errorf("invalid canary percent %d, should be 0..100", f.Canary.Percent)
+	}
+	if f.PingStatus != 0 && (f.PingStatus < 100 || f.PingStatus > 599) {
+		return errors.Errorf("invalid ping-status %d, should be 100..599", f.PingStatus)
+	}
+	if f.Retries < 0 {
+		return errors.Errorf("invalid retries %d, should be 0 or more", f.Retries)
+	}
+	if f.MaxIdle < 0 || f.MaxConns < 0 {
+		return errors.Errorf("invalid max-idle-conns %d or max-conns %d, should be 0 or more", f.MaxIdle, f.MaxConns)
+	}
+	if f.Weight != nil && *f.Weight < 1 {
+		return errors.Errorf("invalid weight %d, should be positive", *f.Weight)
+	}
+	return nil
+}
+
+// reInclude matches include directive, the line "include <path>" with optionally quoted path and trailing comment
+var reInclude = regexp.MustCompile(`^include\s+("[^"]+"|[^\s#]+)\s*(#.*)?$`)
+
+// loadFile decodes rules of the file into conf, following include directives. Paths of included files relative
+// to the directory of the including file. Chain is the list of files including this one, for cycle detection.
+// Returns all files loaded, the file itself first, even on error, to watch them for changes
+func loadFile(fileName string, chain []string, conf map[string][]fileRule) (files []string, err error) {
+	files = []string{fileName}
+	absName, err := filepath.Abs(fileName)
+	if err != nil {
+		return files, errors.Wrapf(err, "can't get absolute path of %s", fileName)
+	}
+	for _, f := range chain {
+		if f == absName {
+			return files, errors.Errorf("include cycle %s", strings.Join(append(chain, absName), " -> "))
+		}
+	}
+
+	data, err := ioutil.ReadFile(fileName) //nolint gosec
+	if err != nil {
+		return files, errors.Wrapf(err, "can't open %s", fileName)
+	}
+	lines := strings.Split(string(data), "\n")
+	var includes []string
+	for i, l := range lines {
+		sm := reInclude.FindStringSubmatch(strings.TrimRight(l, "\r"))
+		if sm == nil {
+			continue
+		}
+		inc := strings.Trim(sm[1], `"`)
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(fileName), inc)
+		}
+		includes = append(includes, inc)
+		lines[i] = "" // not a yaml, blank line keeps line numbers of yaml errors
+	}
+
+	var fileConf map[string][]fileRule
+	err = yaml.NewDecoder(strings.NewReader(strings.Join(lines, "\n"))).Decode(&fileConf)
+	if err != nil && !(err == io.EOF && len(includes) > 0) { // file may have includes only
+		return files, errors.Wrapf(err, "can't parse %s", fileName)
+	}
+	for srv, rules := range fileConf {
+		conf[srv] = append(conf[srv], rules...)
+	}
+
+	for _, inc := range includes {
+		incFiles, e := loadFile(inc, append(chain, absName), conf)
+		files = append(files, incFiles...)
+		if e != nil {
+			return files, e
+		}
+	}
+	return files, nil
+}
+
+// assetsMapper makes mapper serving static files from the assets directory, route is a literal url prefix
+func (d *File) assetsMapper(srv, route, assets string, spa bool) (discovery.URLMapper, error) {
+	if srv == "default" {
+		srv = "*"
+	}
+	rx, err := discovery.CompileRegex("^" + regexp.QuoteMeta(route))
+	if err != nil {
+		return discovery.URLMapper{}, err
+	}
+	return discovery.URLMapper{Server: srv, SrcMatch: *rx, Dst: assets, MatchType: discovery.MTStatic,
+		AssetsWebRoot: route, AssetsSPA: spa, Weight: 1}, nil
 }
 
 // ID returns providers id
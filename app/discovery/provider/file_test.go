@@ -4,15 +4,18 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 func TestFile_Events(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
 	defer cancel()
 
 	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-events")
@@ -23,23 +26,16 @@ func TestFile_Events(t *testing.T) {
 	f := File{
 		FileName:      tmp.Name(),
 		CheckInterval: 10 * time.Millisecond,
-		Delay:         20 * time.Millisecond,
+		Delay:         50 * time.Millisecond,
 	}
 
 	go func() {
-		time.Sleep(30 * time.Millisecond)
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		time.Sleep(30 * time.Millisecond)
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		time.Sleep(30 * time.Millisecond)
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-
-		// all those event will be ignored, submitted too fast
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
-		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
+		time.Sleep(100 * time.Millisecond)
+		// burst of writes collapsed into a single event
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
+			time.Sleep(15 * time.Millisecond)
+		}
 	}()
 
 	ch := f.Events(ctx)
@@ -48,29 +44,450 @@ func TestFile_Events(t *testing.T) {
 		t.Log("event")
 		events++
 	}
-	assert.Equal(t, 4, events)
+	assert.Equal(t, 2, events, "initial event plus one for the burst")
+}
+
+func TestFile_EventsDebounce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-events")
+	require.NoError(t, err)
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	f := File{FileName: tmp.Name(), CheckInterval: 10 * time.Millisecond, Delay: 50 * time.Millisecond}
+
+	go func() {
+		// keeps changing longer than delay, event sent only after changes settled
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("something"), 0600))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	st := time.Now()
+	ch := f.Events(ctx)
+	events := 0
+	for range ch {
+		t.Logf("event after %v", time.Since(st))
+		if events > 0 { // initial event sent right away
+			assert.True(t, time.Since(st) >= 200*time.Millisecond, "event sent before changes settled")
+		}
+		events++
+	}
+	assert.Equal(t, 2, events, "initial event plus one for all changes")
 }
 
 func TestFile_List(t *testing.T) {
 	f := File{FileName: "testdata/config.yml"}
 
-	res, err := f.List()
+	res, err := f.List(context.Background())
 	require.NoError(t, err)
 	t.Logf("%+v", res)
-	assert.Equal(t, 3, len(res))
+	assert.Equal(t, 4, len(res))
 
 	assert.Equal(t, "/api/svc3/xyz", res[0].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.3:8080/blah3/xyz", res[0].Dst)
 	assert.Equal(t, "http://127.0.0.3:8080/ping", res[0].PingURL)
+	assert.Equal(t, 204, res[0].PingStatus)
+	assert.Equal(t, "ok", res[0].PingBody)
 	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "", res[0].Name)
+	assert.Equal(t, []string{"GET", "HEAD"}, res[0].Methods)
+	assert.Equal(t, 3, res[0].Weight)
+	assert.Equal(t, 90*time.Second, res[0].Timeout)
+	assert.True(t, res[0].Cache)
+	assert.True(t, res[0].RewriteBody)
+	assert.True(t, res[0].PreserveHost)
+	assert.True(t, res[0].InsecureSkipVerify)
+	assert.Equal(t, "", res[0].CACert)
+	assert.Equal(t, "", res[0].CanaryDst)
+	assert.Equal(t, 0, res[0].CanaryPercent)
+	assert.Equal(t, "", res[0].MirrorDst)
+	assert.True(t, res[0].Sticky)
+	assert.Equal(t, "", res[0].StickyKey)
+	assert.Equal(t, 0, res[0].Retries)
 
 	assert.Equal(t, "^/api/svc1/(.*)", res[1].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", res[1].Dst)
-	assert.Equal(t, "", res[1].PingURL)
+	assert.Equal(t, "svc1 api", res[1].Name)
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[1].PingURL, "derived from dest")
 	assert.Equal(t, "*", res[1].Server)
+	assert.Nil(t, res[1].Resolve)
+	assert.Equal(t, "http://127.0.0.4:8080/blah1/$1", res[1].ABDst)
+	assert.Equal(t, 20, res[1].ABWeight)
+	assert.Equal(t, "X-User-ID", res[1].ABKey)
+	assert.Equal(t, "http://127.0.0.5:8080/blah1/$1", res[1].CanaryDst)
+	assert.Equal(t, 5, res[1].CanaryPercent)
+	assert.Equal(t, "http://127.0.0.6:8080/blah1/$1", res[1].MirrorDst)
+	assert.True(t, res[1].Sticky, "sticky by key")
+	assert.Equal(t, "X-User-ID", res[1].StickyKey)
+	assert.Nil(t, res[1].Methods)
+	assert.Equal(t, 1, res[1].Weight, "default weight")
+	assert.Equal(t, time.Duration(0), res[1].Timeout)
+	assert.Nil(t, res[1].Headers)
+	assert.False(t, res[1].Cache)
+	assert.False(t, res[1].RewriteBody)
+	assert.False(t, res[1].PreserveHost)
+	assert.Equal(t, "", res[1].HostHeader)
+	assert.Equal(t, 2, res[1].Retries)
+	assert.Equal(t, int64(0), res[1].MaxBodySize, "unlimited")
+	assert.Equal(t, 0, res[1].MaxIdleConnsPerHost, "proxy's default")
 
 	assert.Equal(t, "^/api/svc2/(.*)", res[2].SrcMatch.String())
 	assert.Equal(t, "http://127.0.0.2:8080/blah2/$1/abc", res[2].Dst)
-	assert.Equal(t, "", res[2].PingURL)
+	assert.Equal(t, "http://127.0.0.2:8080/ping", res[2].PingURL, "derived from dest")
 	assert.Equal(t, "srv.example.com", res[2].Server)
+	assert.Equal(t, map[string]string{"backend.local": "10.0.0.5"}, res[2].Resolve)
+	assert.Equal(t, "svc2.example.com", res[2].TLSServerName)
+	assert.Equal(t, "/etc/ssl/svc2.pem", res[2].CACert)
+	assert.False(t, res[2].InsecureSkipVerify)
+	assert.Equal(t, "svc2.internal", res[2].HostHeader)
+	assert.Equal(t, []string{"X-Auth-Token:secret", "X-Backend:svc2"}, res[2].Headers)
+	assert.Equal(t, int64(10*1024*1024), res[2].MaxBodySize)
+	assert.Equal(t, 20, res[2].MaxIdleConnsPerHost)
+	assert.Equal(t, 50, res[2].MaxConnsPerHost)
+	assert.Equal(t, 30*time.Second, res[2].IdleConnTimeout)
+	assert.Equal(t, discovery.MTProxy, res[2].MatchType)
+
+	assert.Equal(t, "^/web/", res[3].SrcMatch.String())
+	assert.Equal(t, "/var/www", res[3].Dst)
+	assert.Equal(t, "srv.example.com", res[3].Server)
+	assert.Equal(t, discovery.MTStatic, res[3].MatchType)
+	assert.Equal(t, "/web/", res[3].AssetsWebRoot)
+	assert.True(t, res[3].AssetsSPA)
+}
+
+func TestFile_ListErrors(t *testing.T) {
+	tbl := []struct {
+		yml, err string
+	}{
+		{"srv.example.com:\n  - {route: \"^/api/(.*)\"}\n", "server srv.example.com, route ^/api/(.*): empty dest"},
+		{"default:\n  - {dest: \"http://127.0.0.1/\"}\n", "server default, rule #0: empty route"},
+		{"default:\n  - {route: \"^/api/((.*)\", dest: \"http://127.0.0.1/\"}\n",
+			"server default, route ^/api/((.*): can't parse regex"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", resolve: [\"bad\"]}\n",
+			"server default, route /api: can't parse resolve"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", weight: 0}\n",
+			"server default, route /api: invalid weight 0"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", ab: {weight: 101}}\n",
+			"server default, route /api: invalid ab weight 101"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", canary: {percent: -1}}\n",
+			"server default, route /api: invalid canary percent -1"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", headers: [\"bad\"]}\n",
+			"server default, route /api: can't parse headers"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", ping-status: 99}\n",
+			"server default, route /api: invalid ping-status 99, should be 100..599"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", retries: -1}\n",
+			"server default, route /api: invalid retries -1"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", max-body: 10X}\n",
+			"server default, route /api: can't parse max-body"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", max-conns: -1}\n",
+			"server default, route /api: invalid max-idle-conns 0 or max-conns -1"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", redirect: 303}\n",
+			"server default, route /api: can't parse redirect"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", allow-ip: [bad]}\n",
+			"server default, route /api: can't parse allow-ip"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", client-cn: \"((client\"}\n",
+			"server default, route /api: can't parse client-cn"},
+		{"default:\n  - {route: \"/api\", dest: \"http://127.0.0.1/\", header-match: [\"X-Api-Version\"]}\n",
+			"server default, route /api: can't parse header-match"},
+		{"default:\n  - {prefix: \"api\", dest: \"http://127.0.0.1/\"}\n",
+			"server default, route api: can't parse prefix"},
+		{"default:\n  - {route: \"/api\", prefix: \"/api\", dest: \"http://127.0.0.1/\"}\n",
+			"server default, route /api: route and prefix are mutually exclusive"},
+		{"default: [route: /api\n", "can't parse"},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.err, func(t *testing.T) {
+			tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+			require.NoError(t, err)
+			defer os.Remove(tmp.Name())
+			_, err = tmp.WriteString(tt.yml)
+			require.NoError(t, err)
+			require.NoError(t, tmp.Close())
+
+			f := File{FileName: tmp.Name()}
+			_, err = f.List(context.Background())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestFile_ListLastGood(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	defer os.Remove(tmp.Name())
+
+	write := func(yml string) {
+		require.NoError(t, ioutil.WriteFile(tmp.Name(), []byte(yml), 0600))
+	}
+
+	f := File{FileName: tmp.Name()}
+	write("default: [route: /api\n")
+	_, err = f.List(context.Background())
+	require.Error(t, err, "no good rules yet")
+
+	write("default:\n  - {route: \"^/api/svc1/(.*)\", dest: \"http://127.0.0.1:8080/$1\"}\n")
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+
+	write("default:\n  - {route: \"^/api/svc2/(.*)\", dest: \"http://127.0.0.2:8080/$1\"\n") // mid-edit
+	res, err = f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "last good rules kept on parse error")
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+
+	write("default:\n  - {route: \"^/api/svc2/(.*)\"}\n") // parsed, but invalid rule
+	res, err = f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "last good rules kept on invalid rule")
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+
+	write("default:\n  - {route: \"^/api/svc2/(.*)\", dest: \"http://127.0.0.2:8080/$1\"}\n")
+	res, err = f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/svc2/(.*)", res[0].SrcMatch.String(), "fixed rules loaded")
+}
+
+func TestFile_ListRedirect(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n  - {route: \"^/old/(.*)\", dest: \"https://example.com/new/$1\", redirect: 301}\n" +
+		"  - {route: \"^/api/(.*)\", dest: \"http://127.0.0.1:8080/$1\"}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name()}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "^/api/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, discovery.MTProxy, res[0].MatchType)
+	assert.Equal(t, 0, res[0].RedirectCode)
+	assert.Equal(t, "^/old/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "https://example.com/new/$1", res[1].Dst)
+	assert.Equal(t, discovery.MTRedirect, res[1].MatchType)
+	assert.Equal(t, 301, res[1].RedirectCode)
+}
+
+func TestFile_ListAllowIPs(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n  - {route: \"^/internal/(.*)\", dest: \"http://127.0.0.1:8080/$1\", " +
+		"allow-ip: [10.0.0.0/8, 192.168.1.1]}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name()}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, res[0].AllowIPs)
+}
+
+func TestFile_ListClientCN(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n  - {route: \"^/secure/(.*)\", dest: \"http://127.0.0.1:8080/$1\", " +
+		"client-cn: \"^client\\\\d+$\"}\n  - {route: \"^/api/(.*)\", dest: \"http://127.0.0.1:8080/$1\"}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name()}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Nil(t, res[0].ClientCN)
+	require.NotNil(t, res[1].ClientCN)
+	assert.Equal(t, `^client\d+$`, res[1].ClientCN.String())
+}
+
+func TestFile_ListDefaultPing(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n" +
+		"  - {route: \"^/api/svc1/(.*)\", dest: \"https://127.0.0.1:8443/blah1/$1\"}\n" +
+		"  - {route: \"^/api/svc2/(.*)\", dest: \"http://127.0.0.2:8080/$1\", ping: \"http://127.0.0.2:8080/health\"}\n" +
+		"  - {route: \"^/api/svc3/(.*)\", dest: \"/local/$1\"}\n" +
+		"  - {route: \"^/old/(.*)\", dest: \"https://example.com/new/$1\", redirect: 301}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name()}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 4, len(res))
+	assert.Equal(t, "https://127.0.0.1:8443/ping", res[0].PingURL, "derived from dest")
+	assert.Equal(t, "http://127.0.0.2:8080/health", res[1].PingURL, "explicit ping kept")
+	assert.Equal(t, "", res[2].PingURL, "dest without host")
+	assert.Equal(t, "", res[3].PingURL, "redirect not pinged")
+
+	f = File{FileName: tmp.Name(), NoDefaultPing: true}
+	res, err = f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 4, len(res))
+	assert.Equal(t, "", res[0].PingURL, "default ping disabled")
+	assert.Equal(t, "http://127.0.0.2:8080/health", res[1].PingURL)
+}
+
+func TestFile_ListPrefix(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n" +
+		"  - {prefix: \"/shop/\", dest: \"http://127.0.0.1:8080/v2\", mirror: \"http://127.0.0.2:8080/v2\"}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name(), NoDefaultPing: true}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/shop(/.*)?$", res[0].SrcMatch.String())
+	assert.Equal(t, "/shop/", res[0].MatchPrefix)
+	assert.Equal(t, "http://127.0.0.1:8080/v2", res[0].Dst)
+	assert.Equal(t, "http://127.0.0.2:8080/v2", res[0].MirrorDst)
+	assert.Equal(t, "http://127.0.0.1:8080/v2/cart?id=1", res[0].Rewrite("/shop/cart?id=1", res[0].Dst))
+}
+
+func TestFile_ListInclude(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "reproxy-include")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "rules"), 0700))
+
+	mainConf := "# main rules\n" +
+		"include rules/svc.yml # rules of services\n" +
+		"default:\n" +
+		"  # svc1, the old one\n" +
+		"  - {route: \"^/api/svc1/(.*)\", dest: \"http://127.0.0.1:8080/$1\"} # trailing comment\n" +
+		"#  - {route: \"^/api/disabled/(.*)\", dest: \"http://127.0.0.9:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.yml"), []byte(mainConf), 0600))
+	svc := "include \"more.yml\"\n" +
+		"default:\n  - {route: \"^/api/svc2/(.*)\", dest: \"http://127.0.0.2:8080/$1\"}\n" +
+		"srv.example.com:\n  - {route: \"^/api/svc3/(.*)\", dest: \"http://127.0.0.3:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules", "svc.yml"), []byte(svc), 0600))
+	more := "# include only rules of this file\n" +
+		"default:\n  - {route: \"^/api/svc4/(.*)\", dest: \"http://127.0.0.4:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules", "more.yml"), []byte(more), 0600))
+
+	f := File{FileName: filepath.Join(dir, "main.yml"), NoDefaultPing: true}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 4, len(res))
+	routes := []string{}
+	for _, m := range res {
+		routes = append(routes, m.Server+" "+m.SrcMatch.String()+" "+m.Dst)
+	}
+	assert.Equal(t, []string{
+		"* ^/api/svc1/(.*) http://127.0.0.1:8080/$1",
+		"* ^/api/svc2/(.*) http://127.0.0.2:8080/$1",
+		"* ^/api/svc4/(.*) http://127.0.0.4:8080/$1",
+		"srv.example.com ^/api/svc3/(.*) http://127.0.0.3:8080/$1",
+	}, routes)
+	assert.Equal(t, []string{f.FileName, filepath.Join(dir, "rules", "svc.yml"), filepath.Join(dir, "rules", "more.yml")},
+		f.watched())
+
+	// file with includes only
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.yml"), []byte("include rules/more.yml\n"), 0600))
+	res, err = f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/svc4/(.*)", res[0].SrcMatch.String())
+
+	// include cycle of more.yml -> main.yml -> rules/more.yml
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "rules", "more.yml"), []byte("include ../main.yml\n"+more), 0600))
+	_, err = loadFile(f.FileName, nil, map[string][]fileRule{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "include cycle")
+	assert.Contains(t, err.Error(), filepath.Join(dir, "main.yml")+" -> "+filepath.Join(dir, "rules", "more.yml")+
+		" -> "+filepath.Join(dir, "main.yml"))
+	res, err = f.List(context.Background())
+	require.NoError(t, err, "last good rules used")
+	assert.Equal(t, 1, len(res))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.yml"), []byte("include missing.yml\n"), 0600))
+	_, err = loadFile(f.FileName, nil, map[string][]fileRule{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't open "+filepath.Join(dir, "missing.yml"))
+}
+
+func TestFile_EventsInclude(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "reproxy-include")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.yml"), []byte("include inc.yml\n"), 0600))
+	inc := "default:\n  - {route: \"^/api/svc1/(.*)\", dest: \"http://127.0.0.1:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inc.yml"), []byte(inc), 0600))
+
+	f := File{FileName: filepath.Join(dir, "main.yml"), CheckInterval: 10 * time.Millisecond, Delay: 30 * time.Millisecond}
+	_, err = f.List(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inc.yml"), []byte(inc+"# changed\n"), 0600))
+	}()
+	events := 0
+	for range f.Events(ctx) {
+		events++
+	}
+	assert.Equal(t, 2, events, "initial event plus one for the change of included file")
+}
+
+func TestFile_ServiceInitialLoad(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "reproxy-initial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(fname, []byte("include inc.yml\n"), 0600))
+	inc := "default:\n  - {route: \"^/api/svc1/(.*)\", dest: \"http://127.0.0.1:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inc.yml"), []byte(inc), 0600))
+
+	f := &File{FileName: fname, CheckInterval: 10 * time.Millisecond, Delay: 20 * time.Millisecond}
+	svc := discovery.NewService([]discovery.Provider{f})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 1, len(svc.Mappers()))
+	assert.Equal(t, 1, svc.Generation(), "initial event of provider not loading rules again")
+
+	inc += "  - {route: \"^/api/svc2/(.*)\", dest: \"http://127.0.0.2:8080/$1\"}\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "inc.yml"), []byte(inc), 0600))
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 2, len(svc.Mappers()), "reloaded on change")
+	assert.Equal(t, 2, svc.Generation())
+}
+
+func TestFile_ListHeaderMatch(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-list")
+	require.NoError(t, err)
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString("default:\n  - {route: \"^/api/(.*)\", dest: \"http://127.0.0.2:8080/$1\", " +
+		"header-match: [\"X-Api-Version: ^2$\"]}\n")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	f := File{FileName: tmp.Name()}
+	res, err := f.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	require.Equal(t, 1, len(res[0].HeaderMatch))
+	assert.Equal(t, "^2$", res[0].HeaderMatch["X-Api-Version"].String())
 }
@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+//go:generate moq -out k8s_client_mock.go -skip-ensure -fmt goimports . K8sClient
+
+// K8s provider watches kubernetes ingress resources and maps ingress rules to the backing services.
+// Server set from the rule's host, "*" if not defined. Source route made from the path, i.e. "/api" path with
+// Prefix type matches /api and /api/*, and destination is the service's ClusterIP and port with the original path.
+type K8s struct {
+	K8sClient K8sClient
+	Namespace string // watch all namespaces if empty
+}
+
+// K8sClient defines interface listing ingresses and services and watching ingresses changes
+type K8sClient interface {
+	ListIngresses(ctx context.Context, namespace string) ([]K8sIngress, error)
+	GetService(ctx context.Context, namespace, name string) (K8sService, error)
+	WatchIngresses(ctx context.Context, namespace string, events chan<- struct{}) error
+}
+
+// K8sIngress is simplified ingress resource
+type K8sIngress struct {
+	Namespace string
+	Name      string
+	Rules     []K8sIngressRule
+}
+
+// K8sIngressRule is a single host rule of the ingress
+type K8sIngressRule struct {
+	Host  string
+	Paths []K8sIngressPath
+}
+
+// K8sIngressPath maps path to the backend service
+type K8sIngressPath struct {
+	Path        string
+	PathType    string // Prefix, Exact or ImplementationSpecific (treated as Prefix)
+	ServiceName string
+	ServicePort int    // port number, used if defined
+	PortName    string // port name, used if ServicePort not defined
+}
+
+// K8sService is simplified service resource
+type K8sService struct {
+	ClusterIP string
+	Ports     map[string]int // port number by name
+}
+
+// Events gets eventsCh with ingress changes. The initial event sent right away
+func (k *K8s) Events(ctx context.Context) (res <-chan struct{}) {
+	eventsCh := make(chan struct{}, 1)
+	eventsCh <- struct{}{} // initial event
+	go func() {
+		defer close(eventsCh)
+		// loop over to recover from failed or closed watch
+		for restart := false; ; restart = true {
+			if restart {
+				select {
+				case eventsCh <- struct{}{}: // refresh after restart of the watch
+				case <-ctx.Done():
+					return
+				}
+			}
+			err := k.K8sClient.WatchIngresses(ctx, k.Namespace, eventsCh) // publish events to eventsCh in a blocking loop
+			if err == context.Canceled || err == context.DeadlineExceeded || ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] k8s ingress watch failed (restarted), %v", err)
+			time.Sleep(1 * time.Second) // prevent busy loop on restart of the watch
+		}
+	}()
+	return eventsCh
+}
+
+// List all ingress rules and make url mappers
+func (k *K8s) List(ctx context.Context) ([]discovery.URLMapper, error) {
+	ingresses, err := k.K8sClient.ListIngresses(ctx, k.Namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list ingresses")
+	}
+
+	var res []discovery.URLMapper
+	services := map[string]K8sService{} // cache services by namespace/name
+	for _, ing := range ingresses {
+		for _, rule := range ing.Rules {
+			server := rule.Host
+			if server == "" {
+				server = "*"
+			}
+			for _, p := range rule.Paths {
+				key := ing.Namespace + "/" + p.ServiceName
+				svc, ok := services[key]
+				if !ok {
+					if svc, err = k.K8sClient.GetService(ctx, ing.Namespace, p.ServiceName); err != nil {
+						log.Printf("[WARN] skip ingress %s/%s path %s, %v", ing.Namespace, ing.Name, p.Path, err)
+						continue
+					}
+					services[key] = svc
+				}
+
+				port := p.ServicePort
+				if port == 0 {
+					port = svc.Ports[p.PortName]
+				}
+				if svc.ClusterIP == "" || strings.EqualFold(svc.ClusterIP, "none") || port == 0 {
+					log.Printf("[WARN] skip ingress %s/%s path %s, no cluster ip or port for service %s",
+						ing.Namespace, ing.Name, p.Path, p.ServiceName)
+					continue
+				}
+
+				srcMatch, dest := k8sRoute(p, fmt.Sprintf("http://%s:%d", svc.ClusterIP, port))
+				rx, err := discovery.CompileRegex(srcMatch)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid path %s in ingress %s/%s", p.Path, ing.Namespace, ing.Name)
+				}
+				res = append(res, discovery.URLMapper{Server: server, SrcMatch: *rx, Dst: dest})
+			}
+		}
+	}
+	return res, nil
+}
+
+// ID returns providers id
+func (k *K8s) ID() discovery.ProviderID { return discovery.PIK8s }
+
+// k8sRoute makes source regex and destination for the ingress path, keeping the original path
+func k8sRoute(p K8sIngressPath, svcURL string) (srcMatch, dest string) {
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	if p.PathType == "Exact" {
+		return "^" + regexp.QuoteMeta(path) + "$", svcURL + path
+	}
+	prefix := strings.TrimSuffix(path, "/")
+	return "^" + regexp.QuoteMeta(prefix) + "(/.*)?$", svcURL + prefix + "$1"
+}
@@ -0,0 +1,206 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// K8sAPI implements K8sClient with kubernetes REST API, networking.k8s.io/v1 ingresses
+type K8sAPI struct {
+	URL    string // api server url, i.e. https://kubernetes.default.svc
+	Token  string // bearer token, optional
+	Client *http.Client
+}
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// NewK8sInClusterAPI makes K8sAPI for the api server of the cluster reproxy runs in, with the pod's service account
+func NewK8sInClusterAPI() (*K8sAPI, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not in kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not defined")
+	}
+	token, err := ioutil.ReadFile(k8sServiceAccountDir + "/token")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read service account token")
+	}
+	ca, err := ioutil.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read service account ca")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("can't parse service account ca")
+	}
+	return &K8sAPI{
+		URL:    "https://" + net.JoinHostPort(host, port),
+		Token:  strings.TrimSpace(string(token)),
+		Client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}, //nolint gosec
+	}, nil
+}
+
+// k8sIngressObject is a subset of networking.k8s.io/v1 Ingress
+type k8sIngressObject struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Rules []struct {
+			Host string `json:"host"`
+			HTTP struct {
+				Paths []struct {
+					Path     string `json:"path"`
+					PathType string `json:"pathType"`
+					Backend  struct {
+						Service struct {
+							Name string `json:"name"`
+							Port struct {
+								Number int    `json:"number"`
+								Name   string `json:"name"`
+							} `json:"port"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// ListIngresses returns all ingresses of the namespace, or of all namespaces if namespace empty
+func (k *K8sAPI) ListIngresses(ctx context.Context, namespace string) ([]K8sIngress, error) {
+	var list struct {
+		Items []k8sIngressObject `json:"items"`
+	}
+	if err := k.get(ctx, k.ingressesPath(namespace), &list); err != nil {
+		return nil, err
+	}
+
+	res := make([]K8sIngress, 0, len(list.Items))
+	for _, item := range list.Items {
+		ing := K8sIngress{Namespace: item.Metadata.Namespace, Name: item.Metadata.Name}
+		for _, r := range item.Spec.Rules {
+			rule := K8sIngressRule{Host: r.Host}
+			for _, p := range r.HTTP.Paths {
+				rule.Paths = append(rule.Paths, K8sIngressPath{
+					Path:        p.Path,
+					PathType:    p.PathType,
+					ServiceName: p.Backend.Service.Name,
+					ServicePort: p.Backend.Service.Port.Number,
+					PortName:    p.Backend.Service.Port.Name,
+				})
+			}
+			ing.Rules = append(ing.Rules, rule)
+		}
+		res = append(res, ing)
+	}
+	return res, nil
+}
+
+// GetService returns cluster ip and ports of the service
+func (k *K8sAPI) GetService(ctx context.Context, namespace, name string) (K8sService, error) {
+	var svc struct {
+		Spec struct {
+			ClusterIP string `json:"clusterIP"`
+			Ports     []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if err := k.get(ctx, path, &svc); err != nil {
+		return K8sService{}, err
+	}
+	res := K8sService{ClusterIP: svc.Spec.ClusterIP, Ports: map[string]int{}}
+	for _, p := range svc.Spec.Ports {
+		res.Ports[p.Name] = p.Port
+	}
+	return res, nil
+}
+
+// WatchIngresses sends event to the events channel on each ingress change. Blocks until watch closed or ctx done
+func (k *K8sAPI) WatchIngresses(ctx context.Context, namespace string, events chan<- struct{}) error {
+	resp, err := k.do(ctx, k.ingressesPath(namespace)+"?watch=true")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint gosec
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type string `json:"type"`
+		}
+		if err = dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "ingress watch closed")
+		}
+		if ev.Type == "BOOKMARK" {
+			continue
+		}
+		if ev.Type == "ERROR" {
+			return errors.New("ingress watch error event")
+		}
+		select {
+		case events <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (k *K8sAPI) ingressesPath(namespace string) string {
+	if namespace == "" {
+		return "/apis/networking.k8s.io/v1/ingresses"
+	}
+	return fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/ingresses", url.PathEscape(namespace))
+}
+
+func (k *K8sAPI) get(ctx context.Context, path string, res interface{}) error {
+	resp, err := k.do(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint gosec
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return errors.Wrapf(err, "can't decode %s", path)
+	}
+	return nil
+}
+
+func (k *K8sAPI) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(k.URL, "/")+path, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't make request for %s", path)
+	}
+	if k.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.Token)
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get %s", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, errors.Errorf("can't get %s, status %s", path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,67 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestK8sAPI(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("req: %s", r.URL)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/apis/networking.k8s.io/v1/namespaces/default/ingresses" && r.URL.Query().Get("watch") == "":
+			fmt.Fprint(w, `{"items":[{"metadata":{"name":"web","namespace":"default"},
+				"spec":{"rules":[{"host":"example.com","http":{"paths":[
+				{"path":"/api","pathType":"Prefix","backend":{"service":{"name":"api","port":{"number":8080}}}}]}}]}}]}`)
+		case r.URL.Path == "/apis/networking.k8s.io/v1/namespaces/default/ingresses":
+			fmt.Fprint(w, `{"type":"ADDED","object":{}}`+"\n")
+			fmt.Fprint(w, `{"type":"BOOKMARK","object":{}}`+"\n")
+			fmt.Fprint(w, `{"type":"MODIFIED","object":{}}`+"\n")
+		case r.URL.Path == "/api/v1/namespaces/default/services/api":
+			fmt.Fprint(w, `{"spec":{"clusterIP":"10.0.0.5","ports":[{"name":"http","port":8080}]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	k := K8sAPI{URL: ts.URL, Token: "secret"}
+
+	ings, err := k.ListIngresses(context.Background(), "default")
+	require.NoError(t, err)
+	assert.Equal(t, []K8sIngress{{Namespace: "default", Name: "web", Rules: []K8sIngressRule{
+		{Host: "example.com", Paths: []K8sIngressPath{{Path: "/api", PathType: "Prefix", ServiceName: "api",
+			ServicePort: 8080}}}}}}, ings)
+
+	svc, err := k.GetService(context.Background(), "default", "api")
+	require.NoError(t, err)
+	assert.Equal(t, K8sService{ClusterIP: "10.0.0.5", Ports: map[string]int{"http": 8080}}, svc)
+
+	_, err = k.GetService(context.Background(), "default", "missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404 Not Found")
+
+	events := make(chan struct{}, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = k.WatchIngresses(ctx, "default", events)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ingress watch closed")
+	assert.Equal(t, 2, len(events), "bookmark ignored")
+
+	k.Token = "bad"
+	_, err = k.ListIngresses(context.Background(), "default")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
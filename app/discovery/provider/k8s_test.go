@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestK8s_List(t *testing.T) {
+	kclient := &K8sClientMock{
+		ListIngressesFunc: func(ctx context.Context, namespace string) ([]K8sIngress, error) {
+			return []K8sIngress{
+				{Namespace: "default", Name: "web", Rules: []K8sIngressRule{
+					{Host: "example.com", Paths: []K8sIngressPath{
+						{Path: "/api", PathType: "Prefix", ServiceName: "api", ServicePort: 8080},
+						{Path: "/ping", PathType: "Exact", ServiceName: "api", PortName: "http"},
+						{Path: "/", PathType: "Prefix", ServiceName: "missing", ServicePort: 80},
+					}},
+					{Paths: []K8sIngressPath{
+						{Path: "/", PathType: "ImplementationSpecific", ServiceName: "web", PortName: "http"},
+					}},
+				}},
+			}, nil
+		},
+		GetServiceFunc: func(ctx context.Context, namespace, name string) (K8sService, error) {
+			switch name {
+			case "api":
+				return K8sService{ClusterIP: "10.0.0.5", Ports: map[string]int{"http": 8081}}, nil
+			case "web":
+				return K8sService{ClusterIP: "10.0.0.6", Ports: map[string]int{"http": 80}}, nil
+			}
+			return K8sService{}, errors.New("not found")
+		},
+	}
+
+	k := K8s{K8sClient: kclient, Namespace: "default"}
+	res, err := k.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+
+	assert.Equal(t, "example.com", res[0].Server)
+	assert.Equal(t, "^/api(/.*)?$", res[0].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.5:8080/api$1", res[0].Dst)
+	assert.Equal(t, "http://10.0.0.5:8080/api/users/1", res[0].SrcMatch.ReplaceAllString("/api/users/1", res[0].Dst))
+	assert.False(t, res[0].SrcMatch.MatchString("/apiv2"))
+
+	assert.Equal(t, "example.com", res[1].Server)
+	assert.Equal(t, `^/ping$`, res[1].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.5:8081/ping", res[1].Dst)
+
+	assert.Equal(t, "*", res[2].Server)
+	assert.Equal(t, "^(/.*)?$", res[2].SrcMatch.String())
+	assert.Equal(t, "http://10.0.0.6:80/blah", res[2].SrcMatch.ReplaceAllString("/blah", res[2].Dst))
+
+	require.Equal(t, 1, len(kclient.ListIngressesCalls()))
+	assert.Equal(t, "default", kclient.ListIngressesCalls()[0].Namespace)
+	assert.Equal(t, 3, len(kclient.GetServiceCalls()), "services cached")
+}
+
+func TestK8s_ListFailed(t *testing.T) {
+	kclient := &K8sClientMock{
+		ListIngressesFunc: func(ctx context.Context, namespace string) ([]K8sIngress, error) {
+			return nil, errors.New("forbidden")
+		},
+	}
+	k := K8s{K8sClient: kclient}
+	_, err := k.List(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't list ingresses")
+}
+
+func TestK8s_Events(t *testing.T) {
+	kclient := &K8sClientMock{
+		WatchIngressesFunc: func(ctx context.Context, namespace string, events chan<- struct{}) error {
+			time.Sleep(30 * time.Millisecond)
+			events <- struct{}{}
+			time.Sleep(30 * time.Millisecond)
+			events <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	k := K8s{K8sClient: kclient}
+	ch := k.Events(ctx)
+	events := 0
+	for range ch {
+		t.Log("event")
+		events++
+	}
+	assert.Equal(t, 3, events, "initial event plus two changes")
+	assert.Equal(t, 1, len(kclient.WatchIngressesCalls()))
+}
@@ -0,0 +1,421 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Nginx implements provider reading a subset of nginx config, for migration from nginx.
+// Supported are upstream blocks with their servers and server blocks with server_name and prefix (optionally
+// with ^~) or exact (=) locations passed to upstream or url by proxy_pass. Each server of upstream makes a rule,
+// all of them pooled and weighted by weight parameter. Unsupported directives ignored with a warning.
+// The file watched the same way as File does, the last good rules served if the file can't be loaded.
+type Nginx struct {
+	FileName      string
+	CheckInterval time.Duration
+	Delay         time.Duration
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+	hasGood  bool
+}
+
+// nginxDirective is a simple or block directive of nginx config
+type nginxDirective struct {
+	name  string
+	args  []string
+	line  int
+	block []nginxDirective // nil for simple directives
+}
+
+// nginxUpstream is a server of upstream block
+type nginxUpstream struct {
+	addr   string
+	weight int
+}
+
+// Events returns channel updating on file change only
+func (n *Nginx) Events(ctx context.Context) <-chan struct{} {
+	return watchFile(ctx, func() []string { return []string{n.FileName} }, n.CheckInterval, n.Delay)
+}
+
+// List all src dst pairs. Returns the last good set of rules if the file can't be loaded
+func (n *Nginx) List(_ context.Context) (res []discovery.URLMapper, err error) {
+	res, err = n.list()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if err != nil {
+		if !n.hasGood {
+			return nil, err
+		}
+		log.Printf("[WARN] nginx provider failed, last good rules used, %v", err)
+		return n.lastGood, nil
+	}
+	n.lastGood, n.hasGood = res, true
+	return res, nil
+}
+
+// ID returns providers id
+func (n *Nginx) ID() discovery.ProviderID { return discovery.PINginx }
+
+func (n *Nginx) list() ([]discovery.URLMapper, error) {
+	data, err := os.ReadFile(n.FileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read %s", n.FileName)
+	}
+	conf, err := parseNginxConf(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse %s", n.FileName)
+	}
+
+	// upstreams can be defined after servers referencing them, collect both first
+	upstreams := map[string][]nginxUpstream{}
+	var servers []nginxDirective
+	var collect func(dirs []nginxDirective) error
+	collect = func(dirs []nginxDirective) error {
+		for _, d := range dirs {
+			switch {
+			case d.name == "http" && d.block != nil:
+				if e := collect(d.block); e != nil {
+					return e
+				}
+			case d.name == "upstream" && d.block != nil:
+				if len(d.args) != 1 {
+					return errors.Errorf("line %d: upstream should have a name", d.line)
+				}
+				srvs, e := n.upstream(d)
+				if e != nil {
+					return e
+				}
+				upstreams[d.args[0]] = srvs
+			case d.name == "server" && d.block != nil:
+				servers = append(servers, d)
+			default:
+				n.warnUnsupported(d)
+			}
+		}
+		return nil
+	}
+	if err = collect(conf); err != nil {
+		return nil, err
+	}
+
+	res := []discovery.URLMapper{}
+	for _, srv := range servers {
+		names, locations := []string{}, []nginxDirective{}
+		hasNames := false
+		for _, d := range srv.block {
+			switch {
+			case d.name == "server_name" && d.block == nil:
+				hasNames = true
+				names = append(names, n.serverNames(d)...)
+			case d.name == "location" && d.block != nil:
+				locations = append(locations, d)
+			default:
+				n.warnUnsupported(d)
+			}
+		}
+		if !hasNames {
+			names = []string{"*"}
+		}
+		if len(names) == 0 {
+			log.Printf("[WARN] nginx %s:%d, server without supported names skipped", n.FileName, srv.line)
+			continue
+		}
+		for len(locations) > 0 {
+			loc := locations[0]
+			locations = locations[1:]
+			mappers, nested, e := n.location(loc, upstreams)
+			if e != nil {
+				return nil, e
+			}
+			locations = append(locations, nested...)
+			for _, name := range names {
+				for _, m := range mappers {
+					m.Server = name
+					res = append(res, m)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Server == res[j].Server {
+			return res[i].SrcMatch.String() < res[j].SrcMatch.String()
+		}
+		return res[i].Server < res[j].Server
+	})
+	return res, nil
+}
+
+// upstream makes list of servers of upstream block, skipping down and backup ones
+func (n *Nginx) upstream(d nginxDirective) ([]nginxUpstream, error) {
+	res := []nginxUpstream{}
+	for _, s := range d.block {
+		if s.name != "server" || s.block != nil {
+			n.warnUnsupported(s)
+			continue
+		}
+		if len(s.args) == 0 {
+			return nil, errors.Errorf("line %d: upstream %s server without address", s.line, d.args[0])
+		}
+		if strings.HasPrefix(s.args[0], "unix:") {
+			log.Printf("[WARN] nginx %s:%d, unix socket server %s of upstream %s skipped", n.FileName, s.line,
+				s.args[0], d.args[0])
+			continue
+		}
+		srv := nginxUpstream{addr: s.args[0], weight: 1}
+		if _, _, err := net.SplitHostPort(srv.addr); err != nil {
+			srv.addr += ":80"
+		}
+		skip := false
+		for _, p := range s.args[1:] {
+			switch {
+			case strings.HasPrefix(p, "weight="):
+				w, err := strconv.Atoi(strings.TrimPrefix(p, "weight="))
+				if err != nil || w < 1 {
+					return nil, errors.Errorf("line %d: invalid %s of upstream %s server %s", s.line, p, d.args[0], s.args[0])
+				}
+				srv.weight = w
+			case p == "down", p == "backup":
+				log.Printf("[WARN] nginx %s:%d, %s server %s of upstream %s skipped", n.FileName, s.line, p,
+					s.args[0], d.args[0])
+				skip = true
+			default:
+				log.Printf("[WARN] nginx %s:%d, unsupported parameter %s of upstream %s server ignored", n.FileName,
+					s.line, p, d.args[0])
+			}
+		}
+		if !skip {
+			res = append(res, srv)
+		}
+	}
+	return res, nil
+}
+
+// serverNames returns names of server_name directive, "_" and empty name make catch-all server.
+// Wildcard and regex names not supported and skipped
+func (n *Nginx) serverNames(d nginxDirective) []string {
+	res := []string{}
+	for _, name := range d.args {
+		switch {
+		case name == "_" || name == "":
+			res = append(res, "*")
+		case strings.Contains(name, "*") || strings.HasPrefix(name, "~") || strings.HasPrefix(name, "."):
+			log.Printf("[WARN] nginx %s:%d, unsupported server name %s ignored", n.FileName, d.line, name)
+		default:
+			res = append(res, strings.ToLower(name))
+		}
+	}
+	return res
+}
+
+// location makes mappers of location block, without server set. Returns nested locations as well.
+// Location without uri in proxy_pass passes the path as is, otherwise the location's prefix replaced by the uri
+func (n *Nginx) location(d nginxDirective, upstreams map[string][]nginxUpstream) (res []discovery.URLMapper,
+	nested []nginxDirective, err error) {
+
+	var pass *nginxDirective
+	for i, ld := range d.block {
+		switch {
+		case ld.name == "proxy_pass" && ld.block == nil && len(ld.args) == 1:
+			pass = &d.block[i]
+		case ld.name == "location" && ld.block != nil:
+			nested = append(nested, ld)
+		default:
+			n.warnUnsupported(ld)
+		}
+	}
+
+	var modifier, path string
+	switch len(d.args) {
+	case 1:
+		path = d.args[0]
+	case 2:
+		modifier, path = d.args[0], d.args[1]
+	default:
+		return nil, nil, errors.Errorf("line %d: invalid location %s", d.line, strings.Join(d.args, " "))
+	}
+	if modifier != "" && modifier != "=" && modifier != "^~" || strings.HasPrefix(path, "@") {
+		log.Printf("[WARN] nginx %s:%d, unsupported location %s skipped", n.FileName, d.line, strings.Join(d.args, " "))
+		return nil, nested, nil
+	}
+	if pass == nil {
+		if len(nested) == 0 {
+			log.Printf("[WARN] nginx %s:%d, location %s without proxy_pass skipped", n.FileName, d.line, path)
+		}
+		return nil, nested, nil
+	}
+	if strings.Contains(pass.args[0], "$") {
+		log.Printf("[WARN] nginx %s:%d, proxy_pass with variables %s skipped", n.FileName, pass.line, pass.args[0])
+		return nil, nested, nil
+	}
+	u, err := url.Parse(pass.args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, nil, errors.Errorf("line %d: invalid proxy_pass %s", pass.line, pass.args[0])
+	}
+
+	uri := u.Path
+	if uri == "" {
+		uri = path
+	}
+	route, dest := "^"+regexp.QuoteMeta(path)+"(.*)", uri+"$1"
+	if modifier == "=" {
+		route, dest = "^"+regexp.QuoteMeta(path)+"$", uri
+	}
+	rx, err := discovery.CompileRegex(route)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "line %d: can't make route of location %s", d.line, path)
+	}
+
+	dests := upstreams[u.Host]
+	if _, ok := upstreams[u.Host]; !ok {
+		dests = []nginxUpstream{{addr: u.Host, weight: 1}}
+	}
+	for _, ds := range dests {
+		res = append(res, discovery.URLMapper{SrcMatch: *rx, Dst: fmt.Sprintf("%s://%s%s", u.Scheme, ds.addr, dest),
+			Weight: ds.weight})
+	}
+	return res, nested, nil
+}
+
+func (n *Nginx) warnUnsupported(d nginxDirective) {
+	log.Printf("[WARN] nginx %s:%d, unsupported directive %s ignored", n.FileName, d.line, d.name)
+}
+
+// nginxToken is a word, quoted string or one of ";", "{" and "}" of nginx config
+type nginxToken struct {
+	val    string
+	line   int
+	quoted bool
+}
+
+// parseNginxConf parses nginx config to the list of directives. Includes not followed
+func parseNginxConf(data string) ([]nginxDirective, error) {
+	tokens, err := nginxTokens(data)
+	if err != nil {
+		return nil, err
+	}
+	pos := 0
+	return parseNginxBlock(tokens, &pos, 0)
+}
+
+// parseNginxBlock parses directives from the pos till the end of the block, started at the line if not zero
+func parseNginxBlock(tokens []nginxToken, pos *int, line int) ([]nginxDirective, error) {
+	res := []nginxDirective{}
+	for *pos < len(tokens) {
+		t := tokens[*pos]
+		*pos++
+		if !t.quoted && t.val == "}" {
+			if line == 0 {
+				return nil, errors.Errorf("line %d: unexpected }", t.line)
+			}
+			return res, nil
+		}
+		if !t.quoted && (t.val == ";" || t.val == "{") {
+			return nil, errors.Errorf("line %d: unexpected %s", t.line, t.val)
+		}
+		d, err := parseNginxDirective(t, tokens, pos)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	if line != 0 {
+		return nil, errors.Errorf("line %d: unexpected end of file, block not closed", line)
+	}
+	return res, nil
+}
+
+// parseNginxDirective parses arguments and block of directive named by t
+func parseNginxDirective(t nginxToken, tokens []nginxToken, pos *int) (nginxDirective, error) {
+	d := nginxDirective{name: t.val, line: t.line}
+	for *pos < len(tokens) {
+		a := tokens[*pos]
+		*pos++
+		switch {
+		case a.quoted:
+			d.args = append(d.args, a.val)
+		case a.val == ";":
+			return d, nil
+		case a.val == "{":
+			block, err := parseNginxBlock(tokens, pos, a.line)
+			if err != nil {
+				return d, err
+			}
+			d.block = block
+			return d, nil
+		case a.val == "}":
+			return d, errors.Errorf("line %d: unexpected }, directive %s not terminated with ;", a.line, d.name)
+		default:
+			d.args = append(d.args, a.val)
+		}
+	}
+	return d, errors.Errorf("line %d: unexpected end of file, directive %s not terminated", d.line, d.name)
+}
+
+// nginxTokens splits nginx config to tokens, skipping comments
+func nginxTokens(data string) ([]nginxToken, error) {
+	res := []nginxToken{}
+	line := 1
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			res = append(res, nginxToken{val: word.String(), line: line})
+			word.Reset()
+		}
+	}
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\n':
+			flush()
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		case c == '#' && word.Len() == 0:
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i-- // newline handled by the loop
+		case c == ';' || c == '{' || c == '}':
+			flush()
+			res = append(res, nginxToken{val: string(c), line: line})
+		case (c == '"' || c == '\'') && word.Len() == 0:
+			start := line
+			val := strings.Builder{}
+			i++
+			for ; i < len(data) && data[i] != c; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				val.WriteByte(data[i])
+			}
+			if i >= len(data) {
+				return nil, errors.Errorf("line %d: unterminated quoted string", start)
+			}
+			res = append(res, nginxToken{val: val.String(), line: start, quoted: true})
+		default:
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return res, nil
+}
@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNginx_Events(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-nginx")
+	require.NoError(t, err)
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	n := Nginx{FileName: tmp.Name(), CheckInterval: 10 * time.Millisecond, Delay: 50 * time.Millisecond}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("events {}"), 0600))
+	}()
+
+	events := 0
+	for range n.Events(ctx) {
+		events++
+	}
+	assert.Equal(t, 2, events, "initial event plus one for the change")
+}
+
+func TestNginx_List(t *testing.T) {
+	n := Nginx{FileName: "testdata/nginx.conf"}
+	res, err := n.List(context.Background())
+	require.NoError(t, err)
+
+	type rule struct {
+		server, route, dest string
+		weight              int
+	}
+	rules := make([]rule, 0, len(res))
+	for _, m := range res {
+		rules = append(rules, rule{server: m.Server, route: m.SrcMatch.String(), dest: m.Dst, weight: m.Weight})
+	}
+	assert.Equal(t, []rule{
+		{"*", "^/static/(.*)", "https://cdn.example.com/static/$1", 1},
+		{"*", "^/static/images/(.*)", "http://127.0.0.1:8080/static/images/$1", 2},
+		{"*", "^/static/images/(.*)", "http://127.0.0.2:8080/static/images/$1", 1},
+		{"example.com", "^/api/(.*)", "http://127.0.0.1:8080/v1/$1", 2},
+		{"example.com", "^/api/(.*)", "http://127.0.0.2:8080/v1/$1", 1},
+		{"example.com", "^/health$", "http://127.0.0.4:8081/health", 1},
+		{"www.example.com", "^/api/(.*)", "http://127.0.0.1:8080/v1/$1", 2},
+		{"www.example.com", "^/api/(.*)", "http://127.0.0.2:8080/v1/$1", 1},
+		{"www.example.com", "^/health$", "http://127.0.0.4:8081/health", 1},
+	}, rules)
+
+	for _, m := range res {
+		if m.Server == "example.com" && m.SrcMatch.String() == "^/api/(.*)" {
+			assert.Equal(t, "http://127.0.0.1:8080/v1/something", m.Rewrite("/api/something", m.Dst))
+			break
+		}
+	}
+}
+
+func TestNginx_ListErrors(t *testing.T) {
+	tbl := []struct {
+		conf, err string
+	}{
+		{"server { location /api/ { proxy_pass http://127.0.0.1:8080 } }", "line 1: unexpected }, directive proxy_pass not terminated with ;"},
+		{"server {\n location /api/ { proxy_pass http://127.0.0.1:8080; }\n", "line 1: unexpected end of file, block not closed"},
+		{"server { }\n}", "line 2: unexpected }"},
+		{"server { server_name \"example.com; }", "line 1: unterminated quoted string"},
+		{"upstream { server 127.0.0.1; }", "line 1: upstream should have a name"},
+		{"upstream b {\n server 127.0.0.1 weight=0; }", "line 2: invalid weight=0 of upstream b server 127.0.0.1"},
+		{"server { location /api/ { proxy_pass 127.0.0.1:8080; } }", "line 1: invalid proxy_pass 127.0.0.1:8080"},
+		{"server { location = /a /b { proxy_pass http://127.0.0.1; } }", "line 1: invalid location = /a /b"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.err, func(t *testing.T) {
+			tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-nginx")
+			require.NoError(t, err)
+			defer os.Remove(tmp.Name())
+			_, err = tmp.WriteString(tt.conf)
+			require.NoError(t, err)
+			require.NoError(t, tmp.Close())
+
+			n := Nginx{FileName: tmp.Name()}
+			_, err = n.List(context.Background())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestNginx_ListLastGood(t *testing.T) {
+	tmp, err := ioutil.TempFile(os.TempDir(), "reproxy-nginx")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	defer os.Remove(tmp.Name())
+
+	require.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("server { location / { proxy_pass http://127.0.0.1:8080; } }"), 0600))
+	n := Nginx{FileName: tmp.Name()}
+	res, err := n.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+
+	require.NoError(t, ioutil.WriteFile(tmp.Name(), []byte("server { location / { proxy_pass"), 0600))
+	res, err = n.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "last good rules kept on parse error")
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[0].Dst)
+}
@@ -0,0 +1,165 @@
+package provider
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// compileRoute compiles source route, discovery.DefaultRoute makes the route of default mapper
+func compileRoute(route string) (*regexp.Regexp, error) {
+	if route == discovery.DefaultRoute {
+		return discovery.CompileRegex("")
+	}
+	return discovery.CompileRegex(route)
+}
+
+// parseResolve makes host->ip overrides from the list of "host:ip" pairs
+func parseResolve(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		elems := strings.SplitN(p, ":", 2)
+		if len(elems) != 2 || net.ParseIP(strings.TrimSpace(elems[1])) == nil {
+			return nil, errors.Errorf("invalid resolve override %q, should be host:ip", p)
+		}
+		res[strings.TrimSpace(elems[0])] = strings.TrimSpace(elems[1])
+	}
+	return res, nil
+}
+
+// parseMethods makes upper-cased list of http methods, skipping empty elements
+func parseMethods(methods []string) []string {
+	var res []string
+	for _, m := range methods {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// parseSize parses size in bytes with optional K, M or G suffix (1024 based), i.e. 512, 64K or 10M.
+// Empty size is zero
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for suffix, m := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(s, suffix) || strings.HasSuffix(s, suffix+"B") {
+			s, mult = strings.TrimSuffix(strings.TrimSuffix(s, "B"), suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
+}
+
+// parseRedirect parses status code of redirect rules, one of 301, 302, 307 or 308.
+// Empty code is zero, i.e. not a redirect
+func parseRedirect(code string) (int, error) {
+	c := strings.TrimSpace(code)
+	if c == "" {
+		return 0, nil
+	}
+	switch c {
+	case "301", "302", "307", "308":
+		return strconv.Atoi(c)
+	}
+	return 0, errors.Errorf("invalid redirect status %q, should be 301, 302, 307 or 308", code)
+}
+
+// parseAllowIPs makes list of allowed ips and cidrs, i.e. 10.0.0.1 or 192.168.1.0/24, skipping empty elements
+func parseAllowIPs(ips []string) ([]string, error) {
+	var res []string
+	for _, ip := range ips {
+		if ip = strings.TrimSpace(ip); ip == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return nil, errors.Errorf("invalid allowed ip %q, should be ip or cidr", ip)
+		}
+		res = append(res, ip)
+	}
+	return res, nil
+}
+
+// parseHeaders makes list of "key:value" headers, skipping empty elements
+func parseHeaders(headers []string) ([]string, error) {
+	var res []string
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		elems := strings.SplitN(h, ":", 2)
+		if len(elems) != 2 || strings.TrimSpace(elems[0]) == "" {
+			return nil, errors.Errorf("invalid header %q, should be key:value", h)
+		}
+		res = append(res, strings.TrimSpace(elems[0])+":"+strings.TrimSpace(elems[1]))
+	}
+	return res, nil
+}
+
+// parseHeaderMatch makes header matches from the list of "key:regex" pairs, by canonical header name.
+// Empty elements skipped, nil returned if nothing to match
+func parseHeaderMatch(pairs []string) (map[string]*regexp.Regexp, error) {
+	var res map[string]*regexp.Regexp
+	for _, p := range pairs {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		elems := strings.SplitN(p, ":", 2)
+		if len(elems) != 2 || strings.TrimSpace(elems[0]) == "" {
+			return nil, errors.Errorf("invalid header match %q, should be key:regex", p)
+		}
+		rx, err := discovery.CompileRegex(strings.TrimSpace(elems[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse regex of header match %q", p)
+		}
+		if res == nil {
+			res = map[string]*regexp.Regexp{}
+		}
+		res[http.CanonicalHeaderKey(strings.TrimSpace(elems[0]))] = rx
+	}
+	return res, nil
+}
+
+// parseClientCN makes regex of client certificate's common name, nil returned if empty
+func parseClientCN(cn string) (*regexp.Regexp, error) {
+	if cn = strings.TrimSpace(cn); cn == "" {
+		return nil, nil
+	}
+	rx, err := discovery.CompileRegex(cn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse regex of client cn %q", cn)
+	}
+	return rx, nil
+}
+
+// defaultPingURL makes the default ping url of dest, /ping of dest's scheme and host, the same way as docker
+// provider does for containers. Empty if dest is not an absolute http(s) url or its host refers to matched groups
+func defaultPingURL(dest string) string {
+	u, err := url.Parse(strings.TrimSpace(dest))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Contains(u.Host, "$") {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/ping"
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res int64
+		err bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"64K", 64 * 1024, false},
+		{"64kb", 64 * 1024, false},
+		{" 10M ", 10 * 1024 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{"10X", 0, true},
+		{"M", 0, true},
+		{"-1", 0, true},
+	}
+	for _, tt := range tbl {
+		res, err := parseSize(tt.inp)
+		if tt.err {
+			require.Error(t, err, tt.inp)
+			continue
+		}
+		require.NoError(t, err, tt.inp)
+		assert.Equal(t, tt.res, res, tt.inp)
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res int
+		err bool
+	}{
+		{"", 0, false},
+		{"301", 301, false},
+		{" 302 ", 302, false},
+		{"307", 307, false},
+		{"308", 308, false},
+		{"303", 0, true},
+		{"permanent", 0, true},
+	}
+	for _, tt := range tbl {
+		res, err := parseRedirect(tt.inp)
+		if tt.err {
+			require.Error(t, err, tt.inp)
+			continue
+		}
+		require.NoError(t, err, tt.inp)
+		assert.Equal(t, tt.res, res, tt.inp)
+	}
+}
+
+func TestParseAllowIPs(t *testing.T) {
+	res, err := parseAllowIPs([]string{" 10.0.0.0/8", "", "192.168.1.1 ", "::1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.1", "::1"}, res)
+
+	res, err = parseAllowIPs([]string{""})
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = parseAllowIPs([]string{"10.0.0.0/8", "10.0.0.300"})
+	assert.EqualError(t, err, `invalid allowed ip "10.0.0.300", should be ip or cidr`)
+}
+
+func TestParseHeaderMatch(t *testing.T) {
+	res, err := parseHeaderMatch([]string{"x-api-version: ^2$", "", "X-Client:^mobile"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "^2$", res["X-Api-Version"].String())
+	assert.Equal(t, "^mobile", res["X-Client"].String())
+
+	res, err = parseHeaderMatch(nil)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = parseHeaderMatch([]string{":^2$"})
+	assert.EqualError(t, err, `invalid header match ":^2$", should be key:regex`)
+	_, err = parseHeaderMatch([]string{"X-Api-Version:((2"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `can't parse regex of header match "X-Api-Version:((2"`)
+}
+
+func TestParseClientCN(t *testing.T) {
+	res, err := parseClientCN(" ^client\\d+\\.example\\.com$ ")
+	require.NoError(t, err)
+	assert.Equal(t, `^client\d+\.example\.com$`, res.String())
+
+	res, err = parseClientCN("")
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	_, err = parseClientCN("((client")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `can't parse regex of client cn "((client"`)
+}
+
+func TestDefaultPingURL(t *testing.T) {
+	tbl := []struct {
+		dest, res string
+	}{
+		{"http://127.0.0.1:8080/blah1/$1", "http://127.0.0.1:8080/ping"},
+		{" https://api.example.com/$1 ", "https://api.example.com/ping"},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080/ping"},
+		{"/local/$1", ""},
+		{"unix:/var/run/app.sock/$1", ""},
+		{"http://$1.example.com/", ""},
+		{"", ""},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, defaultPingURL(tt.dest), tt.dest)
+	}
+}
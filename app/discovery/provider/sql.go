@@ -0,0 +1,220 @@
+package provider
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// defaultSQLCheckInterval is an interval of query checks used if SQL.CheckInterval not set
+const defaultSQLCheckInterval = 10 * time.Second
+
+// SQL provider loads rules with a query to the database and polls it for changes.
+// The query should return server, route, dest and (optional) ping columns, actual column names
+// can be changed with Columns. Rows with "default" or empty server are treated as "*" (catch-all).
+// Failed query or invalid rules don't drop routes, the last good set of rules is served instead.
+type SQL struct {
+	DB            *sql.DB
+	Query         string
+	Columns       SQLColumns
+	CheckInterval time.Duration
+
+	lock     sync.Mutex
+	lastGood []discovery.URLMapper
+	hasGood  bool
+}
+
+// SQLColumns defines names of columns in the query result
+type SQLColumns struct {
+	Server string
+	Route  string
+	Dest   string
+	Ping   string
+}
+
+// sqlRule is a single row of the query result
+type sqlRule struct {
+	server, route, dest, ping string
+}
+
+// Events returns channel updating on changes in the query result. Initial event sent right away,
+// the result of the first check is the state changes detected against
+func (s *SQL) Events(ctx context.Context) <-chan struct{} {
+	res := make(chan struct{}, 1)
+	res <- struct{}{} // initial event
+
+	// no need to queue multiple events
+	trySubmit := func(ch chan struct{}) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	var lastRules []sqlRule
+	checked := false
+	initial := true // the first check covered by the initial event
+	check := func() {
+		rules, err := s.rules(ctx)
+		if err != nil {
+			log.Printf("[WARN] sql provider failed to check rules, %v", err)
+			initial = false // rules may change before the next successful check
+			return
+		}
+		if initial {
+			lastRules, checked, initial = rules, true, false
+			return
+		}
+		if checked && equalRules(lastRules, rules) {
+			return
+		}
+		log.Printf("[DEBUG] sql rules changed, %d rules", len(rules))
+		lastRules, checked = rules, true
+		trySubmit(res)
+	}
+
+	interval := s.CheckInterval
+	if interval <= 0 {
+		interval = defaultSQLCheckInterval
+	}
+
+	go func() {
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		check()
+		for {
+			select {
+			case <-tk.C:
+				check()
+			case <-ctx.Done():
+				close(res)
+				return
+			}
+		}
+	}()
+	return res
+}
+
+// List all src dst pairs. Returns the last good set of rules if rules can't be loaded
+func (s *SQL) List(ctx context.Context) (res []discovery.URLMapper, err error) {
+	res, err = s.list(ctx)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		if !s.hasGood {
+			return nil, err
+		}
+		log.Printf("[WARN] sql provider failed, last good rules used, %v", err)
+		return s.lastGood, nil
+	}
+	s.lastGood, s.hasGood = res, true
+	return res, nil
+}
+
+// ID returns providers id
+func (s *SQL) ID() discovery.ProviderID { return discovery.PISQL }
+
+func (s *SQL) list(ctx context.Context) (res []discovery.URLMapper, err error) {
+	rules, err := s.rules(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		rx, e := compileRoute(r.route)
+		if e != nil {
+			return nil, errors.Wrapf(e, "can't parse regex %s", r.route)
+		}
+		if r.dest == "" {
+			return nil, errors.Errorf("empty destination for %s", r.route)
+		}
+		server := r.server
+		if server == "" || server == "default" {
+			server = "*"
+		}
+		res = append(res, discovery.URLMapper{Server: server, SrcMatch: *rx, Dst: r.dest, PingURL: r.ping})
+	}
+	return res, nil
+}
+
+// rules runs the query and gets rules from the result by column names
+func (s *SQL) rules(ctx context.Context) (res []sqlRule, err error) {
+	rows, err := s.DB.QueryContext(ctx, s.Query)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't query rules")
+	}
+	defer rows.Close() //nolint
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get columns")
+	}
+
+	names := s.columns()
+	idx := map[string]int{}
+	for i, c := range cols {
+		idx[strings.ToLower(c)] = i
+	}
+	for _, c := range []string{names.Server, names.Route, names.Dest} {
+		if _, ok := idx[strings.ToLower(c)]; !ok {
+			return nil, errors.Errorf("column %q not found in %v", c, cols)
+		}
+	}
+
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, errors.Wrap(err, "can't scan rule")
+		}
+		get := func(col string) string {
+			if i, ok := idx[strings.ToLower(col)]; ok {
+				return strings.TrimSpace(vals[i].String)
+			}
+			return ""
+		}
+		res = append(res, sqlRule{server: get(names.Server), route: get(names.Route), dest: get(names.Dest),
+			ping: get(names.Ping)})
+	}
+	return res, errors.Wrap(rows.Err(), "can't read rules")
+}
+
+// columns returns column names with defaults
+func (s *SQL) columns() SQLColumns {
+	res := s.Columns
+	if res.Server == "" {
+		res.Server = "server"
+	}
+	if res.Route == "" {
+		res.Route = "route"
+	}
+	if res.Dest == "" {
+		res.Dest = "dest"
+	}
+	if res.Ping == "" {
+		res.Ping = "ping"
+	}
+	return res
+}
+
+func equalRules(a, b []sqlRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
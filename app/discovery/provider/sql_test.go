@@ -0,0 +1,244 @@
+package provider
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQL_List(t *testing.T) {
+	db := newFakeDB(t, []string{"server", "route", "dest", "ping"}, [][]string{
+		{"default", "^/api/svc1/(.*)", "http://127.0.0.1:8080/blah1/$1", ""},
+		{"srv.example.com", "^/api/svc2/(.*)", "http://127.0.0.2:8080/blah2/$1/abc", "http://127.0.0.2:8080/ping"},
+	})
+	s := SQL{DB: db.db, Query: "select server, route, dest, ping from routes"}
+
+	res, err := s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "select server, route, dest, ping from routes", db.lastQuery())
+
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", res[0].Dst)
+	assert.Equal(t, "", res[0].PingURL)
+
+	assert.Equal(t, "srv.example.com", res[1].Server)
+	assert.Equal(t, "^/api/svc2/(.*)", res[1].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.2:8080/blah2/$1/abc", res[1].Dst)
+	assert.Equal(t, "http://127.0.0.2:8080/ping", res[1].PingURL)
+}
+
+func TestSQL_ListCustomColumns(t *testing.T) {
+	db := newFakeDB(t, []string{"host", "src", "target"}, [][]string{
+		{"", "^/api/svc1/(.*)", "http://127.0.0.1:8080/blah1/$1"},
+	})
+	s := SQL{DB: db.db, Query: "select host, src, target from rules",
+		Columns: SQLColumns{Server: "host", Route: "src", Dest: "target"}}
+
+	res, err := s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "*", res[0].Server)
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+	assert.Equal(t, "http://127.0.0.1:8080/blah1/$1", res[0].Dst)
+
+	s.Columns = SQLColumns{}
+	_, err = s.List(context.Background())
+	assert.NoError(t, err, "last good rules returned")
+
+	s = SQL{DB: db.db, Query: "select host, src, target from rules"}
+	_, err = s.List(context.Background())
+	require.Error(t, err, "no default columns and no good rules")
+	assert.Contains(t, err.Error(), `column "server" not found`)
+}
+
+func TestSQL_ListLastGood(t *testing.T) {
+	db := newFakeDB(t, []string{"server", "route", "dest", "ping"}, [][]string{
+		{"*", "^/api/svc1/(.*)", "http://127.0.0.1:8080/blah1/$1", ""},
+	})
+	s := SQL{DB: db.db, Query: "select * from routes"}
+
+	res, err := s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+
+	db.setErr(errors.New("connection refused"))
+	res, err = s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "last good rules kept on query error")
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+
+	db.setErr(nil)
+	db.setRows([][]string{{"*", "^/api/svc1/((.*)", "http://127.0.0.1:8080/blah1/$1", ""}})
+	res, err = s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "last good rules kept on bad regex")
+	assert.Equal(t, "^/api/svc1/(.*)", res[0].SrcMatch.String())
+
+	db.setRows([][]string{{"*", "^/api/svc2/(.*)", "http://127.0.0.2:8080/blah2/$1", ""}})
+	res, err = s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "^/api/svc2/(.*)", res[0].SrcMatch.String(), "new rules loaded")
+
+	s2 := SQL{DB: db.db, Query: "select * from routes"}
+	db.setRows([][]string{{"*", "^/api/svc1/(.*)", "", ""}})
+	_, err = s2.List(context.Background())
+	require.Error(t, err, "no good rules")
+	assert.Contains(t, err.Error(), "empty destination")
+}
+
+func TestSQL_Events(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	db := newFakeDB(t, []string{"server", "route", "dest", "ping"}, [][]string{
+		{"*", "^/api/svc1/(.*)", "http://127.0.0.1:8080/blah1/$1", ""},
+	})
+	s := SQL{DB: db.db, Query: "select * from routes", CheckInterval: 10 * time.Millisecond}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.setRows([][]string{{"*", "^/api/svc2/(.*)", "http://127.0.0.2:8080/blah2/$1", ""}})
+		time.Sleep(50 * time.Millisecond)
+		db.setErr(errors.New("connection refused")) // errors ignored, no events
+	}()
+
+	ch := s.Events(ctx)
+	events := 0
+	for range ch {
+		t.Log("event")
+		events++
+	}
+	assert.Equal(t, 2, events, "initial event plus one change")
+}
+
+func TestSQL_EventsDefaultInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	db := newFakeDB(t, []string{"server", "route", "dest", "ping"}, [][]string{
+		{"*", "^/api/svc1/(.*)", "http://127.0.0.1:8080/blah1/$1", ""},
+	})
+	s := SQL{DB: db.db, Query: "select * from routes"} // no interval, used as a library
+	events := 0
+	for range s.Events(ctx) {
+		events++
+	}
+	assert.Equal(t, 1, events, "initial event")
+}
+
+// fakeDB is a database/sql driver returning predefined rows for any query
+type fakeDB struct {
+	db    *sql.DB
+	lock  sync.Mutex
+	cols  []string
+	rows  [][]string
+	err   error
+	query string
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	dbs map[string]*fakeDB
+}{dbs: map[string]*fakeDB{}}
+
+func init() {
+	sql.Register("reproxy-fake", fakeDriver{})
+}
+
+func newFakeDB(t *testing.T, cols []string, rows [][]string) *fakeDB {
+	res := &fakeDB{cols: cols, rows: rows}
+	fakeDBs.Lock()
+	fakeDBs.dbs[t.Name()] = res
+	fakeDBs.Unlock()
+	db, err := sql.Open("reproxy-fake", t.Name())
+	require.NoError(t, err)
+	res.db = db
+	t.Cleanup(func() { _ = db.Close() })
+	return res
+}
+
+func (f *fakeDB) setRows(rows [][]string) {
+	f.lock.Lock()
+	f.rows = rows
+	f.lock.Unlock()
+}
+
+func (f *fakeDB) setErr(err error) {
+	f.lock.Lock()
+	f.err = err
+	f.lock.Unlock()
+}
+
+func (f *fakeDB) lastQuery() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.query
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	return &fakeConn{db: fakeDBs.dbs[name]}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 0 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	s.db.query = s.query
+	if s.db.err != nil {
+		return nil, s.db.err
+	}
+	rows := make([][]string, len(s.db.rows))
+	copy(rows, s.db.rows)
+	return &fakeRows{cols: s.db.cols, rows: rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]string
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rows[r.pos] {
+		dest[i] = v
+	}
+	r.pos++
+	return nil
+}
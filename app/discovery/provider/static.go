@@ -2,7 +2,6 @@ package provider
 
 import (
 	"context"
-	"regexp"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -12,7 +11,8 @@ import (
 
 // Static provider, rules are server,from,to
 type Static struct {
-	Rules []string // each rule is 4 elements comma separated - server,source_url,destination,ping
+	Rules         []string // each rule is 4 elements comma separated - server,source_url,destination,ping
+	NoDefaultPing bool     // don't derive ping url of rules with empty ping from their destination
 }
 
 // Events returns channel updating once
@@ -22,34 +22,43 @@ func (s *Static) Events(_ context.Context) <-chan struct{} {
 	return res
 }
 
-// List all src dst pairs
-func (s *Static) List() (res []discovery.URLMapper, err error) {
+// List all src dst pairs. All rules validated, errors of malformed rules reported together
+func (s *Static) List(_ context.Context) (res []discovery.URLMapper, err error) {
 
 	parse := func(inp string) (discovery.URLMapper, error) {
 		elems := strings.Split(inp, ",")
 		if len(elems) != 4 {
 			return discovery.URLMapper{}, errors.Errorf("invalid rule %q", inp)
 		}
-		rx, err := regexp.Compile(strings.TrimSpace(elems[1]))
+		rx, err := compileRoute(strings.TrimSpace(elems[1]))
 		if err != nil {
 			return discovery.URLMapper{}, errors.Wrapf(err, "can't parse regex %s", elems[1])
 		}
 
-		return discovery.URLMapper{
+		res := discovery.URLMapper{
 			Server:   strings.TrimSpace(elems[0]),
 			SrcMatch: *rx,
 			Dst:      strings.TrimSpace(elems[2]),
 			PingURL:  strings.TrimSpace(elems[3]),
-		}, nil
+		}
+		if res.PingURL == "" && !s.NoDefaultPing {
+			res.PingURL = defaultPingURL(res.Dst)
+		}
+		return res, nil
 	}
 
+	var errs []string
 	for _, r := range s.Rules {
 		um, err := parse(r)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err.Error())
+			continue
 		}
 		res = append(res, um)
 	}
+	if len(errs) > 0 {
+		return nil, errors.Errorf("%d of %d static rules malformed: %s", len(errs), len(s.Rules), strings.Join(errs, "; "))
+	}
 	return res, nil
 }
 
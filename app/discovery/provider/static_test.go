@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"strconv"
 	"testing"
 
@@ -20,13 +21,14 @@ func TestStatic_List(t *testing.T) {
 		{"123,456", "", "", "", "", true},
 		{"123", "", "", "", "", true},
 		{"example.com , 123, 456 ,ping", "example.com", "123", "456", "ping", false},
+		{"*,*,http://127.0.0.1:8080,", "*", "", "http://127.0.0.1:8080", "http://127.0.0.1:8080/ping", false},
 	}
 
 	for i, tt := range tbl {
 		tt := tt
 		t.Run(strconv.Itoa(i), func(t *testing.T) {
 			s := Static{Rules: []string{tt.rule}}
-			res, err := s.List()
+			res, err := s.List(context.Background())
 			if tt.err {
 				require.Error(t, err)
 				return
@@ -40,3 +42,43 @@ func TestStatic_List(t *testing.T) {
 	}
 
 }
+
+func TestStatic_ListMultipleRules(t *testing.T) {
+	s := Static{Rules: []string{
+		"example.com,^/api/(.*),http://127.0.0.1:8080/$1,http://127.0.0.1:8080/ping",
+		"*,^/web/(.*),http://127.0.0.2:8080/$1,",
+	}}
+	res, err := s.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "example.com", res[0].Server)
+	assert.Equal(t, "http://127.0.0.1:8080/$1", res[0].Dst)
+	assert.Equal(t, "*", res[1].Server)
+	assert.Equal(t, "^/web/(.*)", res[1].SrcMatch.String())
+
+	s = Static{Rules: []string{
+		"example.com,^/api/(.*),http://127.0.0.1:8080/$1,",
+		"example.com,^/api/(.*)",
+		"*,^/web/((.*),http://127.0.0.2:8080/$1,",
+	}}
+	_, err = s.List(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 3 static rules malformed")
+	assert.Contains(t, err.Error(), `invalid rule "example.com,^/api/(.*)"`)
+	assert.Contains(t, err.Error(), "can't parse regex ^/web/((.*)")
+}
+
+func TestStatic_ListDefaultPing(t *testing.T) {
+	rules := []string{"*,^/api/(.*),http://127.0.0.1:8080/$1,", "*,^/web/(.*),http://127.0.0.2:8080/$1,http://127.0.0.2:8080/health"}
+	res, err := (&Static{Rules: rules}).List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "http://127.0.0.1:8080/ping", res[0].PingURL, "derived from destination")
+	assert.Equal(t, "http://127.0.0.2:8080/health", res[1].PingURL, "explicit ping kept")
+
+	res, err = (&Static{Rules: rules, NoDefaultPing: true}).List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "", res[0].PingURL, "default ping disabled")
+	assert.Equal(t, "http://127.0.0.2:8080/health", res[1].PingURL)
+}
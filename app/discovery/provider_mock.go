@@ -24,7 +24,7 @@ var _ Provider = &ProviderMock{}
 // 			IDFunc: func() ProviderID {
 // 				panic("mock out the ID method")
 // 			},
-// 			ListFunc: func() ([]URLMapper, error) {
+// 			ListFunc: func(ctx context.Context) ([]URLMapper, error) {
 // 				panic("mock out the List method")
 // 			},
 // 		}
@@ -41,7 +41,7 @@ type ProviderMock struct {
 	IDFunc func() ProviderID
 
 	// ListFunc mocks the List method.
-	ListFunc func() ([]URLMapper, error)
+	ListFunc func(ctx context.Context) ([]URLMapper, error)
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -55,6 +55,8 @@ type ProviderMock struct {
 		}
 		// List holds details about calls to the List method.
 		List []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
 		}
 	}
 	lockEvents sync.RWMutex
@@ -120,24 +122,29 @@ func (mock *ProviderMock) IDCalls() []struct {
 }
 
 // List calls ListFunc.
-func (mock *ProviderMock) List() ([]URLMapper, error) {
+func (mock *ProviderMock) List(ctx context.Context) ([]URLMapper, error) {
 	if mock.ListFunc == nil {
 		panic("ProviderMock.ListFunc: method is nil but Provider.List was just called")
 	}
 	callInfo := struct {
-	}{}
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
 	mock.lockList.Lock()
 	mock.calls.List = append(mock.calls.List, callInfo)
 	mock.lockList.Unlock()
-	return mock.ListFunc()
+	return mock.ListFunc(ctx)
 }
 
 // ListCalls gets all the calls that were made to List.
 // Check the length with:
 //     len(mockedProvider.ListCalls())
 func (mock *ProviderMock) ListCalls() []struct {
+	Ctx context.Context
 } {
 	var calls []struct {
+		Ctx context.Context
 	}
 	mock.lockList.RLock()
 	calls = mock.calls.List
@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"container/list"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// regexCacheSize limits number of compiled patterns kept in the cache
+const regexCacheSize = 1024
+
+// regexCache shared by all providers and extendRule, rules reloaded with the same patterns reuse compiled regexes
+var regexCache = newRxCache(regexCacheSize)
+
+// CompileRegex returns compiled regex for the pattern. Previously compiled patterns returned from the cache.
+// Returned regex shared and should not be modified
+func CompileRegex(pattern string) (*regexp.Regexp, error) {
+	return regexCache.compile(pattern)
+}
+
+// rxCache is a concurrency-safe LRU cache of compiled regexes
+type rxCache struct {
+	lock  sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // most recently used first
+}
+
+type rxCacheEntry struct {
+	pattern string
+	rx      *regexp.Regexp
+}
+
+func newRxCache(size int) *rxCache {
+	return &rxCache{size: size, items: map[string]*list.Element{}, order: list.New()}
+}
+
+// compile returns cached regex or compiles and caches it. Failed patterns not cached
+func (c *rxCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.lock.Lock()
+	if el, ok := c.items[pattern]; ok {
+		c.order.MoveToFront(el)
+		c.lock.Unlock()
+		return el.Value.(*rxCacheEntry).rx, nil
+	}
+	c.lock.Unlock()
+
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[pattern]; ok { // compiled concurrently
+		c.order.MoveToFront(el)
+		return el.Value.(*rxCacheEntry).rx, nil
+	}
+	c.items[pattern] = c.order.PushFront(&rxCacheEntry{pattern: pattern, rx: rx})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*rxCacheEntry).pattern)
+	}
+	return rx, nil
+}
+
+// routeComplexity returns size of the compiled route, number of instructions of the matching program.
+// Regexes matched in linear time with no backtracking, but the time grows with the size of the program,
+// i.e. nested counted repetitions like ([a-z]{1,64}\.){1,10} compiled to thousands of instructions
+func routeComplexity(rx *regexp.Regexp) int {
+	re, err := syntax.Parse(rx.String(), syntax.Perl)
+	if err != nil {
+		return 0
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0
+	}
+	return len(prog.Inst)
+}
+
+// missingGroups returns references of the template to groups missing in the regex, i.e. $2 of the route with one group.
+// References parsed the same way as regexp.Expand does, $name is the longest sequence of letters, digits and
+// underscores, so $1x refers to "1x" group, not to $1. Missing groups silently expanded to empty strings
+func missingGroups(rx *regexp.Regexp, tmpl string) (res []string) {
+	names := map[string]bool{}
+	for _, name := range rx.SubexpNames() {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '$' || i+1 >= len(tmpl) {
+			continue
+		}
+		if tmpl[i+1] == '$' { // escaped $
+			i++
+			continue
+		}
+		ref, name, braced := "", "", tmpl[i+1] == '{'
+		if braced {
+			end := strings.IndexByte(tmpl[i+2:], '}')
+			if end < 0 {
+				continue
+			}
+			name, ref = tmpl[i+2:i+2+end], tmpl[i:i+3+end]
+		} else {
+			end := i + 1
+			for end < len(tmpl) && isGroupNameChar(tmpl[end]) {
+				end++
+			}
+			name, ref = tmpl[i+1:end], tmpl[i:end]
+		}
+		if name == "" || (braced && !isGroupName(name)) {
+			continue // not a reference, copied by Expand as is
+		}
+		i += len(ref) - 1
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > rx.NumSubexp() {
+				res = append(res, ref)
+			}
+			continue
+		}
+		if !names[name] {
+			res = append(res, ref)
+		}
+	}
+	return res
+}
+
+func isGroupName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if !isGroupNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isGroupNameChar(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
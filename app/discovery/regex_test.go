@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileRegex(t *testing.T) {
+	patterns := []string{"^/api/svc1/(.*)", "/api/svc3/xyz", `^/api/(\d+)/(.*)$`, "(?i)^/Static/(.*)"}
+	inputs := []string{"/api/svc1/something", "/api/svc3/xyz", "/api/123/abc/def", "/static/img.png", "/other"}
+
+	for _, p := range patterns {
+		cached, err := CompileRegex(p)
+		require.NoError(t, err)
+		again, err := CompileRegex(p)
+		require.NoError(t, err)
+		assert.True(t, cached == again, "the same compiled regex reused")
+
+		fresh := regexp.MustCompile(p)
+		assert.Equal(t, fresh.String(), cached.String())
+		for _, inp := range inputs {
+			assert.Equal(t, fresh.MatchString(inp), cached.MatchString(inp), "%s %s", p, inp)
+			assert.Equal(t, fresh.ReplaceAllString(inp, "http://example.com/$1/$2"),
+				cached.ReplaceAllString(inp, "http://example.com/$1/$2"), "%s %s", p, inp)
+		}
+	}
+
+	_, err := CompileRegex("^/api/((.*)")
+	assert.Error(t, err)
+	_, err = CompileRegex("^/api/((.*)")
+	assert.Error(t, err, "failed pattern not cached")
+}
+
+func TestRxCache_Bounded(t *testing.T) {
+	c := newRxCache(3)
+	for i := 0; i < 10; i++ {
+		_, err := c.compile("^/api/" + strconv.Itoa(i))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, len(c.items))
+	assert.Equal(t, 3, c.order.Len())
+
+	rx7 := c.items["^/api/7"].Value.(*rxCacheEntry).rx
+	_, err := c.compile("^/api/100") // evicts the least recently used ^/api/7
+	require.NoError(t, err)
+	_, ok := c.items["^/api/7"]
+	assert.False(t, ok)
+	rx, err := c.compile("^/api/7")
+	require.NoError(t, err)
+	assert.False(t, rx == rx7, "evicted pattern compiled again")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := c.compile(fmt.Sprintf("^/api/%d", (i+j)%5))
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 3, len(c.items))
+}
+
+func BenchmarkService_mergeLists(b *testing.B) {
+	makeProvider := func(compile func(string) (*regexp.Regexp, error)) Provider {
+		return &ProviderMock{
+			EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+			ListFunc: func(context.Context) ([]URLMapper, error) {
+				res := make([]URLMapper, 0, 100)
+				for i := 0; i < 100; i++ {
+					rx, err := compile(fmt.Sprintf("^/api/svc%d/(.*)", i))
+					if err != nil {
+						return nil, err
+					}
+					res = append(res, URLMapper{Server: "*", SrcMatch: *rx, Dst: "http://127.0.0.1:8080/$1"})
+				}
+				return res, nil
+			},
+			IDFunc: func() ProviderID { return PIStatic },
+		}
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		svc := NewService([]Provider{makeProvider(CompileRegex)})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			svc.mergeLists(context.Background())
+		}
+	})
+
+	b.Run("uncached", func(b *testing.B) {
+		svc := NewService([]Provider{makeProvider(regexp.Compile)})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			svc.mergeLists(context.Background())
+		}
+	})
+}
+
+func TestMissingGroups(t *testing.T) {
+	rx := regexp.MustCompile(`^/api/(?P<svc>[a-z]+)/(.*)`)
+	tbl := []struct {
+		tmpl string
+		res  []string
+	}{
+		{"http://127.0.0.1:8080/$1/$2", nil},
+		{"http://127.0.0.1:8080/${svc}/$2?q=$0", nil},
+		{"http://127.0.0.1:8080/$svc/${2}", nil},
+		{"http://127.0.0.1:8080/$3", []string{"$3"}},
+		{"http://127.0.0.1:8080/${3}/$1", []string{"${3}"}},
+		{"http://127.0.0.1:8080/$1x", []string{"$1x"}},
+		{"http://127.0.0.1:8080/${1}x/$name", []string{"$name"}},
+		{"http://127.0.0.1:8080/${other}", []string{"${other}"}},
+		{"http://127.0.0.1:8080/$$3/$/${/${a-b}/$", nil},
+		{"", nil},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, missingGroups(rx, tt.tmpl), tt.tmpl)
+	}
+}
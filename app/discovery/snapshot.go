@@ -0,0 +1,32 @@
+package discovery
+
+// snapshot is an immutable state of mappers, replaced as a whole on reloads and changes of health.
+// Read paths (Match, Mappers, Servers) use the snapshot without locking and copying
+type snapshot struct {
+	matcher *Matcher
+	gen     int         // generation of mappers, incremented on each reload
+	version int         // incremented on each change of the snapshot, results of matches cached by version
+	matches *matchCache // results of Match by server, method and source, nil if disabled, shared by snapshots
+}
+
+// emptySnapshot used before the first reload
+var emptySnapshot = &snapshot{matcher: NewMatcher(nil)}
+
+// snapshot returns the current snapshot of mappers
+func (s *Service) snapshot() *snapshot {
+	if st, ok := s.state.Load().(*snapshot); ok {
+		return st
+	}
+	return emptySnapshot
+}
+
+// setSnapshot replaces the current snapshot with the new one made of the matcher.
+// Should be called under the lock, matches of the previous snapshot not reused by the new one
+func (s *Service) setSnapshot(m *Matcher, gen int) {
+	prev := s.snapshot()
+	matches := prev.matches
+	if matches == nil && s.MatchCacheSize > 0 {
+		matches = newMatchCache(s.MatchCacheSize)
+	}
+	s.state.Store(&snapshot{matcher: m, gen: gen, version: prev.version + 1, matches: matches})
+}
@@ -0,0 +1,51 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// unixSocketExt ends paths of unix sockets in destinations, separates socket from the path of request
+const unixSocketExt = ".sock"
+
+// UnixSocket splits destination with unix scheme, i.e. unix:/var/run/app.sock/api/something, to path of the socket
+// and uri of the request, /var/run/app.sock and /api/something. Path of the socket should end with .sock.
+// Returns false for other destinations
+func UnixSocket(dst string) (socket, uri string, ok bool) {
+	if len(dst) < 5 || !strings.EqualFold(dst[:5], "unix:") {
+		return "", "", false
+	}
+	rest := dst[5:]
+	if strings.HasPrefix(rest, "///") { // unix:///var/run/app.sock, empty host
+		rest = rest[2:]
+	}
+	for offset := 0; ; {
+		idx := strings.Index(rest[offset:], unixSocketExt)
+		if idx < 0 {
+			return "", "", false
+		}
+		end := offset + idx + len(unixSocketExt)
+		if end == len(rest) || rest[end] == '/' || rest[end] == '?' {
+			socket, uri = rest[:end], rest[end:]
+			break
+		}
+		offset = end
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return socket, uri, len(socket) > len(unixSocketExt)
+}
+
+// unixSocketClient makes client sending all requests to the unix socket, connections not reused
+func unixSocketClient(socket string) *http.Client {
+	dialer := net.Dialer{}
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket(t *testing.T) {
+	tbl := []struct {
+		dst, socket, uri string
+		ok               bool
+	}{
+		{"unix:/var/run/app.sock/api/something", "/var/run/app.sock", "/api/something", true},
+		{"unix:/var/run/app.sock", "/var/run/app.sock", "/", true},
+		{"unix:/var/run/app.sock?k=v", "/var/run/app.sock", "/?k=v", true},
+		{"UNIX:/var/run/app.sock/$1", "/var/run/app.sock", "/$1", true},
+		{"unix:///var/run/app.sock/api", "/var/run/app.sock", "/api", true},
+		{"unix:/var/run/app.socks/app.sock/api", "/var/run/app.socks/app.sock", "/api", true},
+		{"unix:/var/run/app.socket", "", "", false},
+		{"unix:.sock/api", "", "", false},
+		{"http://example.com/app.sock/api", "", "", false},
+		{"unix", "", "", false},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.dst, func(t *testing.T) {
+			socket, uri, ok := UnixSocket(tt.dst)
+			assert.Equal(t, tt.ok, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, tt.socket, socket)
+			assert.Equal(t, tt.uri, uri)
+		})
+	}
+}
+
+func TestPing_UnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ps := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ps.Listener = l
+	ps.Start()
+	defer ps.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, Ping(ctx, nil, URLMapper{PingURL: "unix:" + socket + "/ping"}, time.Second))
+	assert.EqualError(t, Ping(ctx, nil, URLMapper{PingURL: "unix:" + socket + "/other"}, time.Second), "bad status 404 Not Found")
+	assert.Error(t, Ping(ctx, nil, URLMapper{PingURL: "unix:" + socket + "x.sock/ping"}, time.Second), "no socket")
+}
@@ -2,23 +2,29 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 	log "github.com/go-pkgz/lgr"
+	_ "github.com/lib/pq" // postgres driver for sql provider
 	"github.com/pkg/errors"
 	"github.com/umputun/go-flags"
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/umputun/reproxy/app/discovery"
 	"github.com/umputun/reproxy/app/discovery/provider"
+	"github.com/umputun/reproxy/app/mgmt"
 	"github.com/umputun/reproxy/app/proxy"
 )
 
@@ -28,6 +34,10 @@ var opts struct {
 	MaxSize      int64         `short:"m" long:"max" env:"MAX_SIZE" default:"64000" description:"max response size"`
 	GzipEnabled  bool          `short:"g" long:"gzip" env:"GZIP" description:"enable gz compression"`
 	ProxyHeaders []string      `short:"x" long:"header" env:"HEADER" description:"proxy headers" env-delim:","`
+	MaxHops      int           `long:"max-hops" env:"MAX_HOPS" default:"0" description:"max self-forwards before loop detected, 0 - disabled"`
+	Metrics      bool          `long:"metrics" env:"METRICS" description:"enable metrics on /metrics endpoint"`
+
+	FlushInterval time.Duration `long:"flush-interval" env:"FLUSH_INTERVAL" default:"0s" description:"periodic flush of proxied responses"`
 
 	SSL struct {
 		Type          string   `long:"type" env:"TYPE" description:"ssl (auto) support" choice:"none" choice:"static" choice:"auto" default:"none"` //nolint
@@ -37,11 +47,16 @@ var opts struct {
 		ACMEEmail     string   `long:"acme-email" env:"ACME_EMAIL" description:"admin email for certificate notifications"`
 		RedirHTTPPort int      `long:"http-port" env:"HTTP_PORT" default:"80" description:"http port for redirect to https and acme challenge test"`
 		FQDNs         []string `long:"fqdn" env:"ACME_FQDN" env-delim:"," description:"FQDN(s) for ACME certificates"`
+
+		ExtraCerts []string      `long:"extra-cert" env:"EXTRA_CERT" env-delim:"," description:"additional cert.pem:key.pem picked by SNI"`
+		CertCheck  time.Duration `long:"cert-check" env:"CERT_CHECK" default:"1m" description:"interval of certificate files changes check"`
+		ClientCA   string        `long:"client-ca" env:"CLIENT_CA" description:"path to ca.pem file verifying client certificates"`
 	} `group:"ssl" namespace:"ssl" env-namespace:"SSL"`
 
 	Assets struct {
 		Location string `short:"a" long:"location" env:"LOCATION" default:"" description:"assets location"`
 		WebRoot  string `long:"root" env:"ROOT" default:"/" description:"assets web root"`
+		SPA      bool   `long:"spa" env:"SPA" description:"serve index.html for unknown paths"`
 	} `group:"assets" namespace:"assets" env-namespace:"ASSETS"`
 
 	Logger struct {
@@ -49,20 +64,25 @@ var opts struct {
 		FileName   string `long:"file" env:"FILE"  default:"access.log" description:"location of access log"`
 		MaxSize    int    `long:"max-size" env:"MAX_SIZE" default:"100" description:"maximum size in megabytes before it gets rotated"`
 		MaxBackups int    `long:"max-backups" env:"MAX_BACKUPS" default:"10" description:"maximum number of old log files to retain"`
+		Format     string `long:"format" env:"FORMAT" choice:"combined" choice:"text" choice:"json" default:"combined" description:"access log format"` //nolint
 	} `group:"logger" namespace:"logger" env-namespace:"LOGGER"`
 
 	Docker struct {
 		Enabled  bool     `long:"enabled" env:"ENABLED" description:"enable docker provider"`
 		Host     string   `long:"host" env:"HOST" default:"unix:///var/run/docker.sock" description:"docker host"`
-		Network  string   `long:"network" env:"NETWORK" default:"" description:"docker network"`
+		Network  string   `long:"network" env:"NETWORK" default:"" description:"docker networks in order of preference, comma-separated"`
 		Excluded []string `long:"exclude" env:"EXCLUDE" description:"excluded containers" env-delim:","`
+		Prefix   string   `long:"prefix" env:"PREFIX" default:"reproxy" description:"prefix of container labels"`
+
+		HealthyOnly    bool `long:"healthy-only" env:"HEALTHY_ONLY" description:"skip containers not reported healthy yet"`
+		RequireEnabled bool `long:"require-enabled" env:"REQUIRE_ENABLED" description:"route only containers with enabled label"`
 	} `group:"docker" namespace:"docker" env-namespace:"DOCKER"`
 
 	File struct {
 		Enabled       bool          `long:"enabled" env:"ENABLED" description:"enable file provider"`
 		Name          string        `long:"name" env:"NAME" default:"reproxy.yml" description:"file name"`
 		CheckInterval time.Duration `long:"interval" env:"INTERVAL" default:"3s" description:"file check interval"`
-		Delay         time.Duration `long:"delay" env:"DELAY" default:"500ms" description:"file event delay"`
+		Delay         time.Duration `long:"delay" env:"DELAY" default:"500ms" description:"debounce window for file changes"`
 	} `group:"file" namespace:"file" env-namespace:"FILE"`
 
 	Static struct {
@@ -70,6 +90,122 @@ var opts struct {
 		Rules   []string `long:"rule" env:"RULES" description:"routing rules" env-delim:","`
 	} `group:"static" namespace:"static" env-namespace:"STATIC"`
 
+	SQL struct {
+		Enabled       bool          `long:"enabled" env:"ENABLED" description:"enable sql provider"`
+		Driver        string        `long:"driver" env:"DRIVER" default:"postgres" description:"sql driver"`
+		DSN           string        `long:"dsn" env:"DSN" description:"database connection string"`
+		Query         string        `long:"query" env:"QUERY" default:"select server, route, dest, ping from routes" description:"query returning rules"`
+		ServerColumn  string        `long:"server-col" env:"SERVER_COL" default:"server" description:"server column name"`
+		RouteColumn   string        `long:"route-col" env:"ROUTE_COL" default:"route" description:"route column name"`
+		DestColumn    string        `long:"dest-col" env:"DEST_COL" default:"dest" description:"destination column name"`
+		PingColumn    string        `long:"ping-col" env:"PING_COL" default:"ping" description:"ping column name"`
+		CheckInterval time.Duration `long:"interval" env:"INTERVAL" default:"10s" description:"query check interval"`
+	} `group:"sql" namespace:"sql" env-namespace:"SQL"`
+
+	K8s struct {
+		Enabled   bool   `long:"enabled" env:"ENABLED" description:"enable kubernetes ingress provider"`
+		Namespace string `long:"namespace" env:"NAMESPACE" default:"" description:"ingress namespace, all if not set"`
+		APIURL    string `long:"api" env:"API" default:"" description:"api server url, in-cluster if not set"`
+		Token     string `long:"token" env:"TOKEN" default:"" description:"api server bearer token"`
+	} `group:"k8s" namespace:"k8s" env-namespace:"K8S"`
+
+	Consul struct {
+		Enabled    bool          `long:"enabled" env:"ENABLED" description:"enable consul catalog provider"`
+		Address    string        `long:"address" env:"ADDRESS" default:"http://127.0.0.1:8500" description:"consul http api address"`
+		Datacenter string        `long:"dc" env:"DC" default:"" description:"consul datacenter, agent's datacenter if not set"`
+		WaitTime   time.Duration `long:"wait" env:"WAIT" default:"1m" description:"max wait time for blocking queries"`
+	} `group:"consul" namespace:"consul" env-namespace:"CONSUL"`
+
+	Nginx struct {
+		Enabled       bool          `long:"enabled" env:"ENABLED" description:"enable nginx config provider"`
+		Name          string        `long:"name" env:"NAME" default:"nginx.conf" description:"nginx config file name"`
+		CheckInterval time.Duration `long:"interval" env:"INTERVAL" default:"3s" description:"file check interval"`
+		Delay         time.Duration `long:"delay" env:"DELAY" default:"500ms" description:"debounce window for file changes"`
+	} `group:"nginx" namespace:"nginx" env-namespace:"NGINX"`
+
+	HealthCheck struct {
+		Interval time.Duration `long:"interval" env:"INTERVAL" default:"0s" description:"health check interval, disabled if 0"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"100ms" description:"health check ping timeout"`
+
+		NoDefaultPing bool `long:"no-default-ping" env:"NO_DEFAULT_PING" description:"don't derive ping url of file and static rules from destination"`
+	} `group:"health-check" namespace:"health-check" env-namespace:"HEALTH_CHECK"`
+
+	Cache struct {
+		Enabled bool          `long:"enabled" env:"ENABLED" description:"enable responses cache for routes with cache turned on"`
+		TTL     time.Duration `long:"ttl" env:"TTL" default:"1m" description:"default ttl of cached responses"`
+		MaxSize int64         `long:"max-size" env:"MAX_SIZE" default:"64000000" description:"max total size of cached responses"`
+	} `group:"cache" namespace:"cache" env-namespace:"CACHE"`
+
+	Management struct {
+		Enabled bool   `long:"enabled" env:"ENABLED" description:"enable management server"`
+		Listen  string `long:"listen" env:"LISTEN" default:"127.0.0.1:8081" description:"management server listen on host:port"`
+	} `group:"mgmt" namespace:"mgmt" env-namespace:"MGMT"`
+
+	CORS struct {
+		Enabled     bool          `long:"enabled" env:"ENABLED" description:"enable CORS headers"`
+		Origins     []string      `long:"origin" env:"ORIGIN" env-delim:"," description:"allowed origins, * for all"`
+		Methods     []string      `long:"method" env:"METHOD" env-delim:"," description:"allowed methods"`
+		Headers     []string      `long:"header" env:"HEADER" env-delim:"," description:"allowed headers"`
+		Credentials bool          `long:"credentials" env:"CREDENTIALS" description:"allow credentials"`
+		MaxAge      time.Duration `long:"max-age" env:"MAX_AGE" default:"0s" description:"preflight cache duration"`
+		Servers     []string      `long:"server" env:"SERVER" env-delim:"," description:"servers with CORS, all if not set"`
+	} `group:"cors" namespace:"cors" env-namespace:"CORS"`
+
+	Transport struct {
+		MaxIdleConnsPerHost int           `long:"max-idle-conns" env:"MAX_IDLE_CONNS" default:"2" description:"max idle connections per upstream host"`
+		MaxConnsPerHost     int           `long:"max-conns" env:"MAX_CONNS" default:"0" description:"max connections per upstream host, 0 - unlimited"`
+		IdleConnTimeout     time.Duration `long:"idle-timeout" env:"IDLE_TIMEOUT" default:"90s" description:"idle upstream connection timeout"`
+	} `group:"transport" namespace:"transport" env-namespace:"TRANSPORT"`
+
+	Server struct {
+		ReadHeaderTimeout time.Duration `long:"read-header-timeout" env:"READ_HEADER_TIMEOUT" default:"5s" description:"max time to read request headers"`
+		ReadTimeout       time.Duration `long:"read-timeout" env:"READ_TIMEOUT" default:"0s" description:"max time to read request with body, 0 - unlimited"`
+		WriteTimeout      time.Duration `long:"write-timeout" env:"WRITE_TIMEOUT" default:"30s" description:"max time to write response"`
+		IdleTimeout       time.Duration `long:"idle-timeout" env:"IDLE_TIMEOUT" default:"30s" description:"idle keep-alive client connection timeout"`
+	} `group:"server" namespace:"server" env-namespace:"SERVER"`
+
+	RateLimit struct {
+		Limits  []string `long:"limit" env:"LIMIT" env-delim:"," description:"requests per second by client ip, [server:]rate:burst"`
+		Trusted []string `long:"trusted" env:"TRUSTED" env-delim:"," description:"deprecated, use --trusted-proxy"`
+	} `group:"rate-limit" namespace:"rate-limit" env-namespace:"RATE_LIMIT"`
+
+	ErrorPage struct {
+		Files  []string `long:"file" env:"FILE" env-delim:"," description:"error page files, [server:]status:path"`
+		Inline []string `long:"inline" env:"INLINE" description:"error page templates, [server:]status:template"`
+	} `group:"error-page" namespace:"error-page" env-namespace:"ERROR_PAGE"`
+
+	ResponseHeaders []string `long:"response-header" env:"RESPONSE_HEADER" env-delim:"," description:"response headers, server:key:value"`
+
+	DropHeaders []string `long:"drop-response-header" env:"DROP_RESPONSE_HEADER" env-delim:"," description:"headers removed from responses"`
+
+	ServerHeader string `long:"server-header" env:"SERVER_HEADER" description:"value of Server header of all responses"`
+
+	BasicAuth []string `long:"basic-auth" env:"BASIC_AUTH" env-delim:"," description:"basic auth credentials, server:user:bcrypt-hash"`
+
+	DropConflicts bool `long:"drop-conflicts" env:"DROP_CONFLICTS" description:"drop rules conflicting with higher priority providers"`
+
+	ProviderPriority []string `long:"provider-priority" env:"PROVIDER_PRIORITY" env-delim:"," description:"priority of provider, provider:priority"`
+
+	ProviderTimeout time.Duration `long:"provider-timeout" env:"PROVIDER_TIMEOUT" default:"10s" description:"max time to get rules of a provider"`
+
+	MatchCacheSize int `long:"match-cache" env:"MATCH_CACHE" default:"10000" description:"max cached match results, 0 - disabled"`
+
+	StrictRoutes bool `long:"strict-routes" env:"STRICT_ROUTES" description:"drop rules with routes not anchored with ^, too complex or missing groups of dest"`
+
+	RouteComplexity int `long:"route-complexity" env:"ROUTE_COMPLEXITY" default:"1000" description:"max complexity of routes, 0 - unlimited"`
+
+	StartupWait time.Duration `long:"startup-wait" env:"STARTUP_WAIT" description:"max time requests wait for the first load of rules, 0 - disabled"`
+
+	MaxMatchLen int `long:"max-match-len" env:"MAX_MATCH_LEN" default:"8192" description:"max length of request uri matched to routes, 0 - unlimited"`
+
+	MaxRules int `long:"max-rules" env:"MAX_RULES" default:"10000" description:"max number of rules of all providers, 0 - unlimited"`
+
+	TrustedProxies []string `long:"trusted-proxy" env:"TRUSTED_PROXY" env-delim:"," description:"trusted proxies (ip or cidr) setting X-Forwarded-For"`
+
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"10s" description:"max time to complete in-flight requests on shutdown"`
+
+	RewriteBodyTypes []string `long:"rewrite-body-type" env:"REWRITE_BODY_TYPE" env-delim:"," description:"content types of rewritten responses, text/html and application/json if not set"`
+
 	NoSignature bool `long:"no-signature" env:"NO_SIGNATURE" description:"disable reproxy signature headers"`
 	Dbg         bool `long:"dbg" env:"DEBUG" description:"debug mode"`
 }
@@ -91,17 +227,35 @@ func main() {
 	setupLog(opts.Dbg)
 	catchSignal()
 
+	// graceful shutdown on SIGTERM or SIGINT, cancels discovery and drains proxy and management servers
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		log.Printf("[INFO] shutdown initiated, waiting up to %v for in-flight requests", opts.ShutdownTimeout)
+	}()
+
 	providers, err := makeProviders()
 	if err != nil {
 		log.Fatalf("[ERROR] failed to make providers, %v", err)
 	}
 
 	svc := discovery.NewService(providers)
-	go func() {
-		if e := svc.Run(context.Background()); e != nil {
-			log.Fatalf("[ERROR] discovery failed, %v", e)
-		}
-	}()
+	svc.HealthCheckInterval = opts.HealthCheck.Interval
+	svc.HealthCheckTimeout = opts.HealthCheck.Timeout
+	svc.DropConflicts = opts.DropConflicts
+	svc.ProviderTimeout = opts.ProviderTimeout
+	svc.MatchCacheSize = opts.MatchCacheSize
+	svc.StrictRoutes = opts.StrictRoutes
+	svc.RouteComplexity = opts.RouteComplexity
+	svc.MaxMatchLen = opts.MaxMatchLen
+	svc.MaxMappers = opts.MaxRules
+	svc.StartupWait = opts.StartupWait
+	svc.Logger = log.Default()
+	if err = setPriorities(svc); err != nil {
+		log.Fatalf("[ERROR] failed to set providers priority, %v", err)
+	}
+	log.Printf("[INFO] providers precedence: %s", strings.Join(svc.Precedence(), ", "))
 
 	sslConfig, err := makeSSLConfig()
 	if err != nil {
@@ -115,6 +269,26 @@ func main() {
 		}
 	}()
 
+	responseHeaders, err := makeResponseHeaders()
+	if err != nil {
+		log.Fatalf("[ERROR] failed to make response headers, %v", err)
+	}
+
+	basicAuth, err := makeBasicAuth()
+	if err != nil {
+		log.Fatalf("[ERROR] failed to make basic auth credentials, %v", err)
+	}
+
+	rateLimits, err := makeRateLimits()
+	if err != nil {
+		log.Fatalf("[ERROR] failed to make rate limits, %v", err)
+	}
+
+	errorPages, err := makeErrorPages()
+	if err != nil {
+		log.Fatalf("[ERROR] failed to make error pages, %v", err)
+	}
+
 	accessLog := makeAccessLogWriter()
 	defer func() {
 		if err := accessLog.Close(); err != nil {
@@ -130,15 +304,62 @@ func main() {
 		MaxBodySize:      opts.MaxSize,
 		AssetsLocation:   opts.Assets.Location,
 		AssetsWebRoot:    opts.Assets.WebRoot,
+		AssetsSPA:        opts.Assets.SPA,
 		GzEnabled:        opts.GzipEnabled,
 		SSLConfig:        sslConfig,
 		ProxyHeaders:     opts.ProxyHeaders,
 		AccessLog:        accessLog,
+		AccessLogFormat:  opts.Logger.Format,
 		DisableSignature: opts.NoSignature,
+		MaxHops:          opts.MaxHops,
+		FlushInterval:    opts.FlushInterval,
+		CacheTTL:         opts.Cache.TTL,
+		CacheMaxSize:     cacheMaxSize(),
+		ShutdownTimeout:  opts.ShutdownTimeout,
+		RewriteBodyTypes: opts.RewriteBodyTypes,
+		MetricsEnabled:   opts.Metrics,
+		BasicAuth:        basicAuth,
+		ResponseHeaders:  responseHeaders,
+		DropHeaders:      opts.DropHeaders,
+		ServerHeader:     opts.ServerHeader,
+		RateLimits:       rateLimits,
+		ErrorPages:       errorPages,
+		TrustedProxies:   append(opts.TrustedProxies, opts.RateLimit.Trusted...),
+		Transport: proxy.TransportConfig{MaxIdleConnsPerHost: opts.Transport.MaxIdleConnsPerHost,
+			MaxConnsPerHost: opts.Transport.MaxConnsPerHost, IdleConnTimeout: opts.Transport.IdleConnTimeout},
+		Server: proxy.ServerConfig{ReadHeaderTimeout: opts.Server.ReadHeaderTimeout, ReadTimeout: opts.Server.ReadTimeout,
+			WriteTimeout: opts.Server.WriteTimeout, IdleTimeout: opts.Server.IdleTimeout},
+		CORS: proxy.CORSConfig{Enabled: opts.CORS.Enabled, Origins: opts.CORS.Origins, Methods: opts.CORS.Methods,
+			Headers: opts.CORS.Headers, Credentials: opts.CORS.Credentials, MaxAge: opts.CORS.MaxAge,
+			Servers: opts.CORS.Servers},
 	}
-	if err := px.Run(context.Background()); err != nil {
+
+	// destinations pinged with transport options of their routes, the same way as proxied requests
+	svc.PingClient = px.PingClient
+	go func() {
+		if e := svc.Run(ctx); e != nil && e != context.Canceled {
+			log.Fatalf("[ERROR] discovery failed, %v", e)
+		}
+	}()
+
+	mgmtDone := make(chan struct{})
+	if opts.Management.Enabled {
+		mgSrv := mgmt.Server{Listen: opts.Management.Listen, Informer: svc, ShutdownTimeout: opts.ShutdownTimeout}
+		go func() {
+			defer close(mgmtDone)
+			if e := mgSrv.Run(ctx); e != nil {
+				log.Printf("[WARN] management server failed, %v", e)
+			}
+		}()
+	} else {
+		close(mgmtDone)
+	}
+
+	if err := px.Run(ctx); err != nil {
 		log.Fatalf("[ERROR] proxy server failed, %v", err) //nolint gocritic
 	}
+	<-mgmtDone
+	log.Printf("[INFO] proxy server stopped")
 }
 
 func makeProviders() ([]discovery.Provider, error) {
@@ -149,6 +370,7 @@ func makeProviders() ([]discovery.Provider, error) {
 			FileName:      opts.File.Name,
 			CheckInterval: opts.File.CheckInterval,
 			Delay:         opts.File.Delay,
+			NoDefaultPing: opts.HealthCheck.NoDefaultPing,
 		})
 	}
 
@@ -157,11 +379,55 @@ func makeProviders() ([]discovery.Provider, error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to make docker client %s", err)
 		}
-		res = append(res, &provider.Docker{DockerClient: client, Excludes: opts.Docker.Excluded, Network: opts.Docker.Network})
+		res = append(res, &provider.Docker{DockerClient: client, Excludes: opts.Docker.Excluded, Network: opts.Docker.Network,
+			LabelPrefix: opts.Docker.Prefix, HealthyOnly: opts.Docker.HealthyOnly, RequireEnabled: opts.Docker.RequireEnabled})
 	}
 
 	if opts.Static.Enabled {
-		res = append(res, &provider.Static{Rules: opts.Static.Rules})
+		res = append(res, &provider.Static{Rules: opts.Static.Rules, NoDefaultPing: opts.HealthCheck.NoDefaultPing})
+	}
+
+	if opts.SQL.Enabled {
+		db, err := sql.Open(opts.SQL.Driver, opts.SQL.DSN)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s database", opts.SQL.Driver)
+		}
+		res = append(res, &provider.SQL{
+			DB:    db,
+			Query: opts.SQL.Query,
+			Columns: provider.SQLColumns{
+				Server: opts.SQL.ServerColumn,
+				Route:  opts.SQL.RouteColumn,
+				Dest:   opts.SQL.DestColumn,
+				Ping:   opts.SQL.PingColumn,
+			},
+			CheckInterval: opts.SQL.CheckInterval,
+		})
+	}
+
+	if opts.K8s.Enabled {
+		client := &provider.K8sAPI{URL: opts.K8s.APIURL, Token: opts.K8s.Token}
+		if opts.K8s.APIURL == "" {
+			inCluster, err := provider.NewK8sInClusterAPI()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to make in-cluster k8s client")
+			}
+			client = inCluster
+		}
+		res = append(res, &provider.K8s{K8sClient: client, Namespace: opts.K8s.Namespace})
+	}
+
+	if opts.Consul.Enabled {
+		res = append(res, &provider.Consul{Address: opts.Consul.Address, Datacenter: opts.Consul.Datacenter,
+			WaitTime: opts.Consul.WaitTime})
+	}
+
+	if opts.Nginx.Enabled {
+		res = append(res, &provider.Nginx{
+			FileName:      opts.Nginx.Name,
+			CheckInterval: opts.Nginx.CheckInterval,
+			Delay:         opts.Nginx.Delay,
+		})
 	}
 
 	if len(res) == 0 {
@@ -184,6 +450,15 @@ func makeSSLConfig() (config proxy.SSLConfig, err error) {
 		config.SSLMode = proxy.SSLStatic
 		config.Cert = opts.SSL.Cert
 		config.Key = opts.SSL.Key
+		config.CertsCheckInterval = opts.SSL.CertCheck
+		config.ClientCA = opts.SSL.ClientCA
+		for _, v := range opts.SSL.ExtraCerts {
+			elems := strings.Split(v, ":")
+			if len(elems) != 2 || elems[0] == "" || elems[1] == "" {
+				return config, errors.Errorf("invalid extra certificate %q, should be cert.pem:key.pem", v)
+			}
+			config.Certs = append(config.Certs, proxy.CertPair{Cert: elems[0], Key: elems[1]})
+		}
 		config.RedirHTTPPort = opts.SSL.RedirHTTPPort
 	case "auto":
 		config.SSLMode = proxy.SSLAuto
@@ -191,10 +466,175 @@ func makeSSLConfig() (config proxy.SSLConfig, err error) {
 		config.ACMEEmail = opts.SSL.ACMEEmail
 		config.FQDNs = opts.SSL.FQDNs
 		config.RedirHTTPPort = opts.SSL.RedirHTTPPort
+		config.ClientCA = opts.SSL.ClientCA
 	}
 	return config, err
 }
 
+// cacheMaxSize returns max size of responses cache, zero if cache disabled
+func cacheMaxSize() int64 {
+	if !opts.Cache.Enabled {
+		return 0
+	}
+	return opts.Cache.MaxSize
+}
+
+// setPriorities parses provider:priority pairs and sets priorities of providers, zero if not set
+func setPriorities(svc *discovery.Service) error {
+	known := map[string]bool{}
+	for _, id := range svc.Precedence() {
+		known[id] = true
+	}
+	for _, v := range opts.ProviderPriority {
+		elems := strings.Split(v, ":")
+		if len(elems) != 2 {
+			return errors.Errorf("invalid provider priority %q, should be provider:priority", v)
+		}
+		id := strings.ToLower(strings.TrimSpace(elems[0]))
+		if !known[id] {
+			return errors.Errorf("invalid provider priority %q, provider %s not enabled", v, id)
+		}
+		p, err := strconv.Atoi(strings.TrimSpace(elems[1]))
+		if err != nil {
+			return errors.Wrapf(err, "invalid provider priority %q", v)
+		}
+		svc.SetPriority(discovery.ProviderID(id), p)
+	}
+	return nil
+}
+
+// makeBasicAuth parses server:user:bcrypt-hash credentials to server -> user -> hash map
+func makeBasicAuth() (map[string]map[string]string, error) {
+	if len(opts.BasicAuth) == 0 {
+		return nil, nil
+	}
+	res := map[string]map[string]string{}
+	for _, v := range opts.BasicAuth {
+		elems := strings.SplitN(v, ":", 3)
+		if len(elems) != 3 || elems[0] == "" || elems[1] == "" || !strings.HasPrefix(elems[2], "$2") {
+			return nil, errors.Errorf("invalid basic auth credentials %q, should be server:user:bcrypt-hash", v)
+		}
+		server := strings.ToLower(strings.TrimSpace(elems[0]))
+		if _, ok := res[server]; !ok {
+			res[server] = map[string]string{}
+		}
+		res[server][strings.TrimSpace(elems[1])] = strings.TrimSpace(elems[2])
+		log.Printf("[INFO] basic auth enabled for %s, user %s", server, elems[1])
+	}
+	return res, nil
+}
+
+// makeResponseHeaders parses server:key:value headers to server -> headers map, "*" server for all servers
+func makeResponseHeaders() (map[string][]string, error) {
+	if len(opts.ResponseHeaders) == 0 {
+		return nil, nil
+	}
+	res := map[string][]string{}
+	for _, v := range opts.ResponseHeaders {
+		elems := strings.SplitN(v, ":", 3)
+		if len(elems) != 3 || strings.TrimSpace(elems[0]) == "" || strings.TrimSpace(elems[1]) == "" {
+			return nil, errors.Errorf("invalid response header %q, should be server:key:value", v)
+		}
+		server := strings.ToLower(strings.TrimSpace(elems[0]))
+		res[server] = append(res[server], elems[1]+":"+elems[2])
+	}
+	return res, nil
+}
+
+// makeRateLimits parses [server:]rate:burst limits to server -> limit map, "*" used if server not set
+func makeRateLimits() (map[string]proxy.RateLimit, error) {
+	if len(opts.RateLimit.Limits) == 0 {
+		return nil, nil
+	}
+	res := map[string]proxy.RateLimit{}
+	for _, v := range opts.RateLimit.Limits {
+		elems := strings.Split(v, ":")
+		if len(elems) == 2 {
+			elems = append([]string{"*"}, elems...)
+		}
+		if len(elems) != 3 {
+			return nil, errors.Errorf("invalid rate limit %q, should be [server:]rate:burst", v)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(elems[1]), 64)
+		if err != nil || rate <= 0 {
+			return nil, errors.Errorf("invalid rate %q in %q, should be positive", elems[1], v)
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(elems[2]))
+		if err != nil || burst < 1 {
+			return nil, errors.Errorf("invalid burst %q in %q, should be positive", elems[2], v)
+		}
+		server := strings.ToLower(strings.TrimSpace(elems[0]))
+		res[server] = proxy.RateLimit{Rate: rate, Burst: burst}
+		log.Printf("[INFO] rate limit for %s, %v req/s, burst %d", server, rate, burst)
+	}
+	return res, nil
+}
+
+// makeErrorPages loads error page files and parses inline templates to server -> status -> page map,
+// "*" server for all servers
+func makeErrorPages() (map[string]map[int]proxy.ErrorPage, error) {
+	if len(opts.ErrorPage.Files) == 0 && len(opts.ErrorPage.Inline) == 0 {
+		return nil, nil
+	}
+	res := map[string]map[int]proxy.ErrorPage{}
+	add := func(v string, inline bool) error {
+		server, status, value, err := parseErrorPage(v)
+		if err != nil {
+			return err
+		}
+		name, text := strconv.Itoa(status), value
+		if !inline {
+			data, e := os.ReadFile(value)
+			if e != nil {
+				return errors.Wrapf(e, "can't read error page %q", v)
+			}
+			name, text = filepath.Base(value), string(data)
+		}
+		page, err := proxy.NewErrorPage(name, text)
+		if err != nil {
+			return err
+		}
+		if _, ok := res[server]; !ok {
+			res[server] = map[int]proxy.ErrorPage{}
+		}
+		res[server][status] = page
+		log.Printf("[INFO] error page %d for %s, %s", status, server, page.ContentType)
+		return nil
+	}
+	for _, v := range opts.ErrorPage.Files {
+		if err := add(v, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range opts.ErrorPage.Inline {
+		if err := add(v, true); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// parseErrorPage parses [server:]status:value of error page, "*" used if server not set.
+// The value, path or template, may have ":" in
+func parseErrorPage(v string) (server string, status int, value string, err error) {
+	elems := strings.SplitN(v, ":", 2)
+	if len(elems) == 2 {
+		if _, e := strconv.Atoi(strings.TrimSpace(elems[0])); e != nil {
+			server, elems = strings.ToLower(strings.TrimSpace(elems[0])), strings.SplitN(elems[1], ":", 2)
+		}
+	}
+	if len(elems) != 2 || strings.TrimSpace(elems[1]) == "" {
+		return "", 0, "", errors.Errorf("invalid error page %q, should be [server:]status:value", v)
+	}
+	if status, err = strconv.Atoi(strings.TrimSpace(elems[0])); err != nil || status < 400 || status > 599 {
+		return "", 0, "", errors.Errorf("invalid error page status %q in %q, should be 400..599", elems[0], v)
+	}
+	if server == "" {
+		server = "*"
+	}
+	return server, status, strings.TrimSpace(elems[1]), nil
+}
+
 func makeAccessLogWriter() (accessLog io.WriteCloser) {
 	if !opts.Logger.Enabled {
 		return nopWriteCloser{ioutil.Discard}
@@ -223,7 +663,7 @@ func setupLog(dbg bool) {
 
 func catchSignal() {
 	// catch SIGQUIT and print stack traces
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			log.Print("[INFO] SIGQUIT detected")
@@ -0,0 +1,220 @@
+// Package mgmt provides management server with information about the proxy, i.e. active routes.
+// It runs on its own listener and never exposed to proxied traffic.
+package mgmt
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	R "github.com/go-pkgz/rest"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// Server is a management server
+type Server struct {
+	Listen          string
+	Informer        Informer
+	ShutdownTimeout time.Duration // max time of in-flight requests to complete on shutdown
+}
+
+// Informer provides active mappers, the generation (reload count) of them and the state of providers
+type Informer interface {
+	Mappers() (mappers []discovery.URLMapper)
+	Generation() int
+	Precedence() []string
+	ProviderErrors() map[discovery.ProviderID]error
+	TestMatch(server, path string) (discovery.URLMapper, string, bool)
+	CheckHealth(ctx context.Context, server string) []discovery.HealthResult
+}
+
+// Route is a single active rule of the routing table
+type Route struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Server   string   `json:"server"`
+	Route    string   `json:"route"`
+	Dest     string   `json:"dest"`
+	Provider string   `json:"provider"`
+	Ping     string   `json:"ping,omitempty"`
+	Methods  []string `json:"methods,omitempty"`
+	Alive    bool     `json:"alive"`
+}
+
+// ProviderStatus is the state of a single provider, with the last error of List if the provider failing
+type ProviderStatus struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error,omitempty"`
+}
+
+// MatchResult is the result of the dry run of rules for server and path, Route is set if matched
+type MatchResult struct {
+	Matched bool   `json:"matched"`
+	Dest    string `json:"dest"`
+	Route   *Route `json:"route,omitempty"`
+}
+
+// Health is the summary of proxy's state. Status is "failed" if all providers failing, "ok" otherwise
+type Health struct {
+	Status     string           `json:"status"`
+	Generation int              `json:"generation"`
+	Mappers    int              `json:"mappers"`
+	Unhealthy  int              `json:"unhealthy"` // number of mappers with failed backends
+	Providers  []ProviderStatus `json:"providers"`
+}
+
+// Run the management server, blocking until ctx canceled and in-flight requests completed
+func (s *Server) Run(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", s.routesHandler)
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/match", s.matchHandler)
+	mux.HandleFunc("/health/recheck", s.recheckHandler)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	httpServer := &http.Server{
+		Addr:              s.Listen,
+		Handler:           R.Wrap(mux, R.Recoverer(log.Default())),
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		ErrorLog:          log.ToStdLogger(log.Default(), "WARN"),
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[WARN] management server forced to close, %v", err)
+			_ = httpServer.Close()
+		}
+	}()
+
+	log.Printf("[INFO] activate management server on %s", s.Listen)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// routesHandler responds with active routes and the generation they belong to
+func (s *Server) routesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mappers := s.Informer.Mappers()
+	resp := struct {
+		Generation int     `json:"generation"`
+		Routes     []Route `json:"routes"`
+	}{Generation: s.Informer.Generation(), Routes: make([]Route, 0, len(mappers))}
+
+	for _, m := range mappers {
+		resp.Routes = append(resp.Routes, makeRoute(m))
+	}
+	R.RenderJSON(w, resp)
+}
+
+// matchHandler responds with the rule matched by server and path query params and the destination,
+// nothing proxied. Path may have the query, i.e. /match?server=example.com&path=/api/v1/user%3Fid%3D1
+func (s *Server) matchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return
+	}
+	m, dest, ok := s.Informer.TestMatch(r.URL.Query().Get("server"), path)
+	resp := MatchResult{Matched: ok, Dest: dest}
+	if ok {
+		route := makeRoute(m)
+		resp.Route = &route
+	}
+	R.RenderJSON(w, resp)
+}
+
+func makeRoute(m discovery.URLMapper) Route {
+	return Route{ID: m.MatchID, Name: m.Name, Server: m.Server, Route: m.SrcMatch.String(), Dest: m.Dst, Provider: string(m.ProviderID),
+		Ping: m.PingURL, Methods: m.Methods, Alive: m.Alive}
+}
+
+// healthHandler responds with the summary of providers and backends, 503 returned if all providers failing
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mappers := s.Informer.Mappers()
+	errs := s.Informer.ProviderErrors()
+	resp := Health{Status: "ok", Generation: s.Informer.Generation(), Mappers: len(mappers), Providers: []ProviderStatus{}}
+	for _, m := range mappers {
+		if !m.Alive {
+			resp.Unhealthy++
+		}
+	}
+
+	failed := 0
+	seen := map[string]bool{}
+	for _, id := range s.Informer.Precedence() {
+		if seen[id] {
+			continue // providers of the same id share the error
+		}
+		seen[id] = true
+		st := ProviderStatus{Provider: id}
+		if err, ok := errs[discovery.ProviderID(id)]; ok {
+			st.Error = err.Error()
+			failed++
+		}
+		resp.Providers = append(resp.Providers, st)
+	}
+
+	if failed > 0 && failed == len(resp.Providers) {
+		resp.Status = "failed"
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	R.RenderJSON(w, resp)
+}
+
+// recheckHandler probes destinations right away and updates their health state.
+// Optional "server" query param limits the check to destinations of the given server.
+func (s *Server) recheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := s.Informer.CheckHealth(r.Context(), r.URL.Query().Get("server"))
+
+	passed, failed := 0, 0
+	for _, hr := range res {
+		if hr.Alive {
+			passed++
+			continue
+		}
+		failed++
+	}
+
+	resp := struct {
+		Status  string                   `json:"status"`
+		Passed  int                      `json:"passed"`
+		Failed  int                      `json:"failed"`
+		Results []discovery.HealthResult `json:"results"`
+	}{Status: "ok", Passed: passed, Failed: failed, Results: res}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if failed > 0 {
+		resp.Status = "failed"
+		w.WriteHeader(http.StatusExpectationFailed)
+	}
+	R.RenderJSON(w, resp)
+}
@@ -0,0 +1,284 @@
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestServer_Routes(t *testing.T) {
+	svc := discovery.NewService([]discovery.Provider{&provider.Static{Rules: []string{
+		"*,^/api/(.*),http://127.0.0.1:8080/$1,http://127.0.0.1:8080/ping",
+		"example.com,/web/,http://127.0.0.2:8080,",
+	}, NoDefaultPing: true}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port), Informer: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = srv.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/routes")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res := struct {
+		Generation int     `json:"generation"`
+		Routes     []Route `json:"routes"`
+	}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	t.Logf("%+v", res)
+	assert.Equal(t, 1, res.Generation)
+	require.Equal(t, 2, len(res.Routes))
+	assert.Equal(t, Route{ID: "614e767189f59193", Server: "example.com", Route: "^/web/(.*)", Dest: "http://127.0.0.2:8080/$1",
+		Provider: "static", Alive: true}, res.Routes[1])
+	assert.Equal(t, Route{ID: "b5a3b8660d6dc67b", Server: "*", Route: "^/api/(.*)", Dest: "http://127.0.0.1:8080/$1",
+		Provider: "static", Ping: "http://127.0.0.1:8080/ping", Alive: true}, res.Routes[0])
+
+	resp, err = http.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/routes", "application/json", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestServer_Health(t *testing.T) {
+	failing := func(id discovery.ProviderID) discovery.Provider {
+		return &discovery.ProviderMock{
+			EventsFunc: func(ctx context.Context) <-chan struct{} {
+				res := make(chan struct{}, 1)
+				res <- struct{}{}
+				return res
+			},
+			ListFunc: func(context.Context) ([]discovery.URLMapper, error) { return nil, errors.New("list failed") },
+			IDFunc:   func() discovery.ProviderID { return id },
+		}
+	}
+	static := &provider.Static{Rules: []string{"*,^/api/(.*),http://127.0.0.1:8080/$1,"}}
+
+	tbl := []struct {
+		name      string
+		providers []discovery.Provider
+		status    int
+		health    Health
+	}{
+		{"healthy", []discovery.Provider{static}, http.StatusOK,
+			Health{Status: "ok", Generation: 1, Mappers: 1, Providers: []ProviderStatus{{Provider: "static"}}}},
+		{"degraded", []discovery.Provider{static, failing(discovery.PIFile)}, http.StatusOK,
+			Health{Status: "ok", Generation: 1, Mappers: 1, Providers: []ProviderStatus{{Provider: "static"},
+				{Provider: "file", Error: "list failed"}}}},
+		{"failed", []discovery.Provider{failing(discovery.PIFile), failing(discovery.PIDocker)},
+			http.StatusServiceUnavailable, Health{Status: "failed", Generation: 1, Mappers: 0,
+				Providers: []ProviderStatus{{Provider: "file", Error: "list failed"}, {Provider: "docker", Error: "list failed"}}}},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			svc := discovery.NewService(tt.providers)
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			go func() {
+				_ = svc.Run(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			port := rand.Intn(10000) + 40000
+			srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port), Informer: svc}
+			go func() {
+				_ = srv.Run(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/health")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+
+			res := Health{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+			assert.Equal(t, tt.health, res)
+		})
+	}
+}
+
+func TestServer_Match(t *testing.T) {
+	svc := discovery.NewService([]discovery.Provider{&provider.Static{Rules: []string{
+		"*,^/api/(.*),http://127.0.0.1:8080/$1,",
+		"example.com,/web/,http://127.0.0.2:8080,",
+	}, NoDefaultPing: true}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port), Informer: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = srv.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		query  string
+		status int
+		res    MatchResult
+	}{
+		{"server=example.com&path=/web/index.html", http.StatusOK, MatchResult{Matched: true,
+			Dest: "http://127.0.0.2:8080/index.html", Route: &Route{ID: "614e767189f59193", Server: "example.com", Route: "^/web/(.*)",
+				Dest: "http://127.0.0.2:8080/$1", Provider: "static", Alive: true}}},
+		{"server=other.com&path=/api/v1/user%3Fid%3D1", http.StatusOK, MatchResult{Matched: true,
+			Dest: "http://127.0.0.1:8080/v1/user?id=1", Route: &Route{ID: "b5a3b8660d6dc67b", Server: "*", Route: "^/api/(.*)",
+				Dest: "http://127.0.0.1:8080/$1", Provider: "static", Alive: true}}},
+		{"server=other.com&path=/web/index.html", http.StatusOK, MatchResult{Matched: false, Dest: "/web/index.html"}},
+		{"server=example.com", http.StatusBadRequest, MatchResult{}},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.query, func(t *testing.T) {
+			resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/match?" + tt.query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.status, resp.StatusCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+			res := MatchResult{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestServer_Vars(t *testing.T) {
+	svc := discovery.NewService([]discovery.Provider{&provider.Static{Rules: []string{
+		"*,^/api/(.*),http://127.0.0.1:8080/$1,",
+	}}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port), Informer: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = srv.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/debug/vars")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res := struct {
+		Reloads       int            `json:"reproxy_reloads"`
+		Mappers       int            `json:"reproxy_mappers"`
+		ProviderRules map[string]int `json:"reproxy_provider_rules"`
+	}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.True(t, res.Reloads > 0)
+	assert.Equal(t, 1, res.Mappers)
+	assert.Equal(t, map[string]int{"static": 1}, res.ProviderRules)
+}
+
+func TestServer_Recheck(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	srv := Server{Listen: fmt.Sprintf("127.0.0.1:%d", port)}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/123/ping" {
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"localhost,^/api/(.*),http://127.0.0.1:8080/123/$1," + ps.URL + "/123/ping",
+			"127.0.0.1,^/api/(.*),http://127.0.0.1:8080/567/$1," + ps.URL + "/567/ping",
+		},
+		}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+
+	srv.Informer = svc
+	go func() {
+		_ = srv.Run(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	client := http.Client{}
+	{
+		resp, err := client.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/health/recheck", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusExpectationFailed, resp.StatusCode)
+
+		res := struct {
+			Status  string                   `json:"status"`
+			Passed  int                      `json:"passed"`
+			Failed  int                      `json:"failed"`
+			Results []discovery.HealthResult `json:"results"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		require.NoError(t, err)
+		assert.Equal(t, "failed", res.Status)
+		assert.Equal(t, 1, res.Passed)
+		assert.Equal(t, 1, res.Failed)
+		require.Equal(t, 2, len(res.Results))
+		assert.Equal(t, ps.URL+"/123/ping", res.Results[0].PingURL)
+		assert.True(t, res.Results[0].Alive)
+		assert.False(t, res.Results[1].Alive)
+		assert.Contains(t, res.Results[1].Error, "400 Bad Request")
+	}
+	{
+		resp, err := client.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/health/recheck?server=localhost", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		res := map[string]interface{}{}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", res["status"])
+		assert.Equal(t, 1., res["passed"])
+		assert.Equal(t, 0., res["failed"])
+	}
+	{
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/health/recheck")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "only POST allowed")
+	}
+}
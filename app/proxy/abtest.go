@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// abCookieTTL defines how long the assigned A/B variant kept by the client
+const abCookieTTL = 30 * 24 * time.Hour
+
+// abDestination picks A/B test variant for the request and returns destination for it.
+// The variant stored in the route's cookie and honored on return. New users assigned by the hash
+// of ABKey cookie or header, i.e. the same user id always resolves to the same variant.
+// Users without id assigned randomly and kept on the variant by the cookie only.
+func (h *Http) abDestination(w http.ResponseWriter, r *http.Request, m discovery.URLMapper, dest string) string {
+	cookieName := abCookieName(m)
+	variant := ""
+	if c, err := r.Cookie(cookieName); err == nil && (c.Value == "a" || c.Value == "b") {
+		variant = c.Value
+	}
+
+	if variant == "" {
+		variant = abVariant(abUserID(r, m.ABKey), m.ABWeight)
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Value: variant, Path: "/",
+			MaxAge: int(abCookieTTL.Seconds()), HttpOnly: true})
+	}
+
+	if variant == "b" {
+		return m.Rewrite(requestURI(r), m.ABDst)
+	}
+	return dest
+}
+
+// abVariant returns "b" for weight percent of ids, "a" otherwise. Empty id assigned randomly
+func abVariant(id string, weight int) string {
+	bucket := rand.Intn(100) //nolint gosec
+	if id != "" {
+		hh := fnv.New32a()
+		_, _ = hh.Write([]byte(id))
+		bucket = int(hh.Sum32() % 100)
+	}
+	if bucket < weight {
+		return "b"
+	}
+	return "a"
+}
+
+// abUserID gets user id from the cookie or header named by key
+func abUserID(r *http.Request, key string) string {
+	if key == "" {
+		return ""
+	}
+	if c, err := r.Cookie(key); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.Header.Get(key)
+}
+
+// abCookieName makes cookie name unique for the route, to keep variants of different tests apart
+func abCookieName(m discovery.URLMapper) string {
+	hh := fnv.New32a()
+	_, _ = hh.Write([]byte(m.Server + m.SrcMatch.String()))
+	return fmt.Sprintf("reproxy-ab-%08x", hh.Sum32())
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestAbVariant(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		id := "user-" + strconv.Itoa(i)
+		v := abVariant(id, 30)
+		for j := 0; j < 10; j++ {
+			assert.Equal(t, v, abVariant(id, 30), "same id resolves to the same variant")
+		}
+		assert.Equal(t, "a", abVariant(id, 0))
+		assert.Equal(t, "b", abVariant(id, 100))
+	}
+
+	bs := 0
+	for i := 0; i < 10000; i++ {
+		if abVariant("user-"+strconv.Itoa(i), 30) == "b" {
+			bs++
+		}
+	}
+	assert.InDelta(t, 3000, bs, 300, "weight respected")
+}
+
+func TestHttp_DoWithABTest(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	dsA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "A %s", r.URL.Path)
+	}))
+	dsB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "B %s", r.URL.Path)
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: dsA.URL + "/a/$1",
+					ABDst: dsB.URL + "/b/$1", ABWeight: 50, ABKey: "X-User-ID"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	get := func(userID string, cookies ...*http.Cookie) (string, []*http.Cookie) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+		require.NoError(t, err)
+		if userID != "" {
+			req.Header.Set("X-User-ID", userID)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Cookies()
+	}
+
+	variants := map[string]int{}
+	for i := 0; i < 20; i++ {
+		userID := "user-" + strconv.Itoa(i)
+		body, cookies := get(userID)
+		require.Equal(t, 1, len(cookies))
+		assert.Regexp(t, "^reproxy-ab-", cookies[0].Name)
+		if abVariant(userID, 50) == "b" {
+			assert.Equal(t, "B /b/something", body)
+			assert.Equal(t, "b", cookies[0].Value)
+		} else {
+			assert.Equal(t, "A /a/something", body)
+			assert.Equal(t, "a", cookies[0].Value)
+		}
+		variants[body]++
+
+		again, _ := get(userID)
+		assert.Equal(t, body, again, "same user gets the same variant")
+	}
+	assert.Equal(t, 2, len(variants), "both variants used")
+
+	// variant from the cookie honored regardless of the user id
+	_, cookies := get("user-1")
+	flipped := &http.Cookie{Name: cookies[0].Name, Value: "a"}
+	if cookies[0].Value == "a" {
+		flipped.Value = "b"
+	}
+	body, cookies := get("user-1", flipped)
+	assert.Equal(t, 0, len(cookies), "no cookie set for assigned variant")
+	assert.Equal(t, map[string]string{"a": "A /a/something", "b": "B /b/something"}[flipped.Value], body)
+}
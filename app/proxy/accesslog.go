@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/gorilla/handlers"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// access log formats
+const (
+	AccessLogCombined = "combined" // apache combined log format, default
+	AccessLogText     = "text"     // concise text with matched route details
+	AccessLogJSON     = "json"     // json with matched route details
+)
+
+// accessInfo collects details of the matched route for the access log, filled by proxy handler
+type accessInfo struct {
+	mapper discovery.URLMapper
+	dest   string
+}
+
+// accessRecord is a single line of the access log
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Size     int64     `json:"size"`
+	Latency  float64   `json:"latency_ms"`
+	Server   string    `json:"server,omitempty"`
+	Route    string    `json:"route,omitempty"`
+	Dest     string    `json:"dest,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	ReqID    string    `json:"request_id,omitempty"`
+}
+
+func (h *Http) accessLogHandler(wr io.Writer) func(next http.Handler) http.Handler {
+	if h.AccessLogFormat != AccessLogText && h.AccessLogFormat != AccessLogJSON {
+		return func(next http.Handler) http.Handler {
+			return handlers.CombinedLoggingHandler(wr, next)
+		}
+	}
+
+	var lock sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st := time.Now()
+			info := &accessInfo{}
+			cw := &countingWriter{ResponseWriter: w}
+			next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), contextKey("access"), info)))
+
+			rec := accessRecord{Time: st, Remote: r.RemoteAddr, Method: r.Method, Host: r.Host, Path: requestURI(r),
+				Status: cw.status, Size: cw.count, Latency: float64(time.Since(st).Microseconds()) / 1000,
+				Server: info.mapper.Server, Dest: info.dest, Provider: string(info.mapper.ProviderID),
+				ReqID: RequestIDFromContext(r.Context())}
+			if rec.Status == 0 {
+				rec.Status = http.StatusOK
+			}
+			if ip := ClientIP(r); ip != "" {
+				rec.Remote = ip
+			}
+			if info.dest != "" {
+				rec.Route = info.mapper.SrcMatch.String()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err := rec.write(wr, h.AccessLogFormat); err != nil {
+				log.Printf("[WARN] can't write access log, %v", err)
+			}
+		})
+	}
+}
+
+// setAccessInfo keeps matched route details for the access log, if enabled
+func setAccessInfo(r *http.Request, m discovery.URLMapper, dest string) {
+	if info, ok := r.Context().Value(contextKey("access")).(*accessInfo); ok {
+		info.mapper, info.dest = m, dest
+	}
+}
+
+func (a accessRecord) write(wr io.Writer, format string) error {
+	if format == AccessLogJSON {
+		return json.NewEncoder(wr).Encode(a)
+	}
+	_, err := fmt.Fprintf(wr, "%s %s %s %s%s %d %d %.2fms", a.Time.Format(time.RFC3339), a.Remote, a.Method,
+		a.Host, a.Path, a.Status, a.Size, a.Latency)
+	if err != nil {
+		return err
+	}
+	if a.Dest != "" {
+		_, err = fmt.Fprintf(wr, " -> %s, %s rule %s %s", a.Dest, a.Provider, a.Server, a.Route)
+		if err != nil {
+			return err
+		}
+	}
+	if a.ReqID != "" {
+		if _, err = fmt.Fprintf(wr, " [%s]", a.ReqID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(wr)
+	return err
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestHttp_DoWithAccessLog(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("response"))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/567/$1,"}},
+	})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, format := range []string{AccessLogText, AccessLogJSON} {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			port := rand.Intn(10000) + 40000
+			accessLog := &lockedBuffer{}
+			h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+				AccessLog: accessLog, AccessLogFormat: format, Matcher: svc}
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			go func() {
+				_ = h.Run(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something?k=v")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			resp.Body.Close()
+			time.Sleep(10 * time.Millisecond)
+
+			lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+			require.Equal(t, 1, len(lines))
+			t.Log(lines[0])
+			if format == AccessLogText {
+				assert.Contains(t, lines[0], " 127.0.0.1 GET 127.0.0.1:"+strconv.Itoa(port)+"/api/something?k=v 201 8 ")
+				assert.Contains(t, lines[0], "-> "+ds.URL+"/567/something?k=v, static rule * ^/api/(.*)")
+				return
+			}
+
+			rec := accessRecord{}
+			require.NoError(t, json.Unmarshal([]byte(lines[0]), &rec))
+			assert.Equal(t, "127.0.0.1", rec.Remote)
+			assert.Equal(t, "GET", rec.Method)
+			assert.Equal(t, "/api/something?k=v", rec.Path)
+			assert.Equal(t, http.StatusCreated, rec.Status)
+			assert.Equal(t, int64(8), rec.Size)
+			assert.Equal(t, "*", rec.Server)
+			assert.Equal(t, "^/api/(.*)", rec.Route)
+			assert.Equal(t, ds.URL+"/567/something?k=v", rec.Dest)
+			assert.Equal(t, "static", rec.Provider)
+			assert.Equal(t, resp.Header.Get("X-Request-ID"), rec.ReqID)
+		})
+	}
+}
+
+func TestAccessRecord_write(t *testing.T) {
+	ts := time.Date(2021, 5, 1, 10, 20, 30, 0, time.UTC)
+	rec := accessRecord{Time: ts, Remote: "127.0.0.1", Method: "GET", Host: "example.com", Path: "/not-found",
+		Status: 502, Size: 13, Latency: 1.234}
+	buf := bytes.Buffer{}
+	require.NoError(t, rec.write(&buf, AccessLogText))
+	assert.Equal(t, "2021-05-01T10:20:30Z 127.0.0.1 GET example.com/not-found 502 13 1.23ms\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, rec.write(&buf, AccessLogJSON))
+	assert.Equal(t, `{"time":"2021-05-01T10:20:30Z","remote":"127.0.0.1","method":"GET","host":"example.com",`+
+		`"path":"/not-found","status":502,"size":13,"latency_ms":1.234}`+"\n", buf.String())
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// assetsFileServer serves static files of location directory under webRoot url prefix.
+// Directories without index.html not listed. With spa enabled, unknown paths served with the root's index.html
+func assetsFileServer(webRoot, location string, spa bool) http.Handler {
+	prefix := strings.TrimSuffix(webRoot, "/")
+	fs := http.StripPrefix(prefix, http.FileServer(noListingFS{http.Dir(location)}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spa {
+			name := filepath.Join(location, filepath.FromSlash(path.Clean("/"+strings.TrimPrefix(r.URL.Path, prefix))))
+			if _, err := os.Stat(name); os.IsNotExist(err) {
+				http.ServeFile(w, r, filepath.Join(location, "index.html"))
+				return
+			}
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// noListingFS disables directory listing for directories without index.html
+type noListingFS struct {
+	fs http.FileSystem
+}
+
+func (n noListingFS) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if st.IsDir() {
+		idx, err := n.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		_ = idx.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithStaticMapper(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "api %s", r.URL.Path)
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/"), Dst: "testdata/spa", MatchType: discovery.MTStatic,
+					AssetsWebRoot: "/", AssetsSPA: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/web/"), Dst: "testdata", MatchType: discovery.MTStatic,
+					AssetsWebRoot: "/web/"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api/something", http.StatusOK, "api /something"},
+		{"/static/app.js", http.StatusOK, "console.log(\"app\");\n"},
+		{"/", http.StatusOK, "<html>spa index</html>\n"},
+		{"/some/spa/route", http.StatusOK, "<html>spa index</html>\n"},
+		{"/web/1.html", http.StatusOK, "test html"},
+		{"/web/nothing.html", http.StatusNotFound, "404 page not found\n"},
+		{"/web/spa/static/", http.StatusNotFound, "404 page not found\n"},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
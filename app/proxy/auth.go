@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash compared with the password of unknown users, to make the response time the same as for known ones
+const dummyHash = "$2a$10$bLq35GTXuhs6Od9Z6HV7i.NJ0tM4.DeNpxQAltm1GwBEztLsslQgi"
+
+// basicAuthHandler challenges requests to servers protected by BasicAuth with 401.
+// Credentials of the server used if defined, "*" credentials protect all other servers.
+// Requests to servers without credentials passed as is.
+func (h *Http) basicAuthHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			users, ok := h.basicAuthUsers(serverName(r))
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if user, passwd, ok := r.BasicAuth(); ok && checkPasswd(users, user, passwd) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="reproxy", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// basicAuthUsers returns users allowed to access the server, case-insensitive
+func (h *Http) basicAuthUsers(server string) (map[string]string, bool) {
+	if len(h.BasicAuth) == 0 {
+		return nil, false
+	}
+	for srv, users := range h.BasicAuth {
+		if strings.EqualFold(srv, server) {
+			return users, true
+		}
+	}
+	users, ok := h.BasicAuth["*"]
+	return users, ok
+}
+
+// checkPasswd compares password with user's bcrypt hash
+func checkPasswd(users map[string]string, user, passwd string) bool {
+	hash, ok := users[user]
+	if !ok {
+		hash = dummyHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd))
+	return ok && err == nil
+}
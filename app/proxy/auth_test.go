@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHttp_basicAuthHandler(t *testing.T) {
+	hash := func(passwd string) string {
+		res, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.MinCost)
+		require.NoError(t, err)
+		return string(res)
+	}
+
+	h := Http{BasicAuth: map[string]map[string]string{
+		"protected.example.com": {"user1": hash("passwd1"), "user2": hash("passwd2")},
+	}}
+	handler := h.basicAuthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		host, user, passwd string
+		status             int
+	}{
+		{"protected.example.com", "user1", "passwd1", http.StatusOK},
+		{"Protected.Example.com:8080", "user2", "passwd2", http.StatusOK},
+		{"protected.example.com", "user1", "passwd2", http.StatusUnauthorized},
+		{"protected.example.com", "user3", "passwd1", http.StatusUnauthorized},
+		{"protected.example.com", "", "", http.StatusUnauthorized},
+		{"open.example.com", "", "", http.StatusOK},
+		{"open.example.com", "user1", "bad", http.StatusOK},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.host+" "+tt.user, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/api/something", nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.passwd)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			if tt.status == http.StatusUnauthorized {
+				assert.Equal(t, `Basic realm="reproxy", charset="UTF-8"`, rr.Header().Get("WWW-Authenticate"))
+				return
+			}
+			assert.Equal(t, "ok", rr.Body.String())
+		})
+	}
+}
+
+func TestHttp_basicAuthHandlerWildcard(t *testing.T) {
+	adminHash, err := bcrypt.GenerateFromPassword([]byte("admin-passwd"), bcrypt.MinCost)
+	require.NoError(t, err)
+	userHash, err := bcrypt.GenerateFromPassword([]byte("user-passwd"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	h := Http{BasicAuth: map[string]map[string]string{
+		"*":                {"admin": string(adminHash)},
+		"user.example.com": {"user": string(userHash)},
+	}}
+	handler := h.basicAuthHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tbl := []struct {
+		host, user, passwd string
+		status             int
+	}{
+		{"any.example.com", "admin", "admin-passwd", http.StatusOK},
+		{"any.example.com", "", "", http.StatusUnauthorized},
+		{"user.example.com", "user", "user-passwd", http.StatusOK},
+		{"user.example.com", "admin", "admin-passwd", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tbl {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.passwd)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, tt.status, rr.Code, tt)
+	}
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// errBodyTooLarge reported by request bodies exceeded the route's limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitBody limits request body to maxSize bytes. Requests with larger declared content length
+// rejected right away, false returned in this case and 413 sent to the client
+func limitBody(w http.ResponseWriter, r *http.Request, maxSize int64) bool {
+	if r.ContentLength > maxSize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = &maxBodyReader{ReadCloser: http.MaxBytesReader(w, r.Body, maxSize), limit: maxSize}
+	return true
+}
+
+// maxBodyReader wraps http.MaxBytesReader to report overflow with errBodyTooLarge,
+// passed by reverse proxy to the error handler as is
+type maxBodyReader struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.read += int64(n)
+	if err != nil && err != io.EOF && m.read >= m.limit {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithMaxBodySize(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("got " + strconv.Itoa(len(body))))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/limited/(.*)"), Dst: ds.URL + "/$1", MaxBodySize: 10},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		path    string
+		size    int
+		chunked bool
+		status  int
+	}{
+		{"/limited/something", 10, false, http.StatusOK},
+		{"/limited/something", 11, false, http.StatusRequestEntityTooLarge},
+		{"/limited/something", 10, true, http.StatusOK},
+		{"/limited/something", 100, true, http.StatusRequestEntityTooLarge},
+		{"/api/something", 100, false, http.StatusOK},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(fmt.Sprintf("%s %d %v", tt.path, tt.size, tt.chunked), func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+			if tt.chunked {
+				body = io.MultiReader(body) // unknown length, sent chunked
+			}
+			req, err := http.NewRequest("POST", "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, body)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusOK {
+				b, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "got "+strconv.Itoa(tt.size), string(b))
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache keeps GET and HEAD responses of routes with enabled cache in memory.
+// Responses cached for max-age (or s-maxage) of Cache-Control, or for the default ttl if not set.
+// The least recently used responses evicted once total size of bodies reaches maxSize
+type responseCache struct {
+	ttl     time.Duration
+	maxSize int64
+
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, maxSize int64) *responseCache {
+	return &responseCache{ttl: ttl, maxSize: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// handler serves cached response of the request or caches response of next if allowed
+func (c *responseCache) handler(dest string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || isWebsocket(r) ||
+			r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := strings.Join([]string{r.Method, r.Host, requestURI(r), dest, r.Header.Get("Accept-Encoding")}, " ")
+		if e, ok := c.get(key, time.Now()); ok {
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(e.status)
+			_, _ = w.Write(e.body)
+			return
+		}
+
+		pre := w.Header().Clone() // headers set by middlewares before proxying, i.e. request id, not cached
+		cw := &cacheWriter{ResponseWriter: w, limit: c.maxSize}
+		next.ServeHTTP(cw, r)
+		if ttl, ok := c.cacheable(cw); ok {
+			c.put(&cacheEntry{key: key, status: cw.status, header: upstreamHeader(pre, cw.Header()),
+				body: cw.body.Bytes(), expires: time.Now().Add(ttl)})
+		}
+	})
+}
+
+// cacheable checks if the response can be cached and returns ttl for it
+func (c *responseCache) cacheable(cw *cacheWriter) (time.Duration, bool) {
+	if cw.status != http.StatusOK || cw.overflow || cw.Header().Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	for _, v := range cw.Header().Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !strings.EqualFold(h, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+
+	ttl, sharedTTL := c.ttl, time.Duration(-1)
+	for _, v := range cw.Header().Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			switch {
+			case d == "no-store" || d == "no-cache" || d == "private":
+				return 0, false
+			case strings.HasPrefix(d, "max-age="):
+				if secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+					ttl = time.Duration(secs) * time.Second
+				}
+			case strings.HasPrefix(d, "s-maxage="):
+				if secs, err := strconv.Atoi(strings.TrimPrefix(d, "s-maxage=")); err == nil {
+					sharedTTL = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	if sharedTTL >= 0 {
+		ttl = sharedTTL // s-maxage overrides max-age for shared caches
+	}
+	return ttl, ttl > 0
+}
+
+// upstreamHeader returns headers of the response changed since pre
+func upstreamHeader(pre, resp http.Header) http.Header {
+	res := http.Header{}
+	for k, v := range resp {
+		if strings.Join(pre[k], "\n") != strings.Join(v, "\n") {
+			res[k] = append([]string{}, v...)
+		}
+	}
+	return res
+}
+
+func (c *responseCache) get(key string, now time.Time) (*cacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += int64(len(e.body))
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= int64(len(e.body))
+}
+
+// cacheWriter passes response through and keeps a copy of it, up to limit bytes of the body
+type cacheWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (c *cacheWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow {
+		if int64(c.body.Len()+len(p)) > c.limit {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher to keep streaming responses working
+func (c *cacheWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
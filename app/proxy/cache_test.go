@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithCache(t *testing.T) {
+	var hits int32
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/cookie":
+			w.Header().Set("Set-Cookie", "session=123")
+		case "/short":
+			w.Header().Set("Cache-Control", "public, max-age=1")
+		}
+		w.Header().Set("X-Backend", "value")
+		fmt.Fprintf(w, "response %s %d", r.URL.Path, n)
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/cached/(.*)"), Dst: ds.URL + "/$1", Cache: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, CacheTTL: time.Minute, CacheMaxSize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	get := func(method, path string) (body string, resp *http.Response) {
+		req, err := http.NewRequest(method, "http://127.0.0.1:"+strconv.Itoa(port)+path, nil)
+		require.NoError(t, err)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b), resp
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		body, resp := get("GET", "/cached/something?k=v")
+		assert.Equal(t, "response /something 1", body)
+		assert.Equal(t, "", resp.Header.Get("X-Cache"))
+		reqID := resp.Header.Get("X-Request-ID")
+
+		body, resp = get("GET", "/cached/something?k=v")
+		assert.Equal(t, "response /something 1", body, "served from cache")
+		assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+		assert.Equal(t, "value", resp.Header.Get("X-Backend"))
+		assert.NotEqual(t, reqID, resp.Header.Get("X-Request-ID"), "request id not cached")
+
+		body, _ = get("GET", "/cached/something?k=other")
+		assert.Equal(t, "response /something 2", body, "different query")
+		_, resp = get("HEAD", "/cached/something?k=v")
+		assert.Equal(t, int32(3), atomic.LoadInt32(&hits), "head cached separately")
+		assert.Equal(t, "", resp.Header.Get("X-Cache"))
+		_, _ = get("POST", "/cached/something?k=v")
+		assert.Equal(t, int32(4), atomic.LoadInt32(&hits), "post never cached")
+	})
+
+	t.Run("not cacheable", func(t *testing.T) {
+		tbl := []struct{ path, resp string }{
+			{"/cached/no-store", "response /no-store"},
+			{"/cached/cookie", "response /cookie"},
+			{"/api/something", "response /something"},
+		}
+		for _, tt := range tbl {
+			atomic.StoreInt32(&hits, 0)
+			body, _ := get("GET", tt.path)
+			assert.Equal(t, tt.resp+" 1", body)
+			body, resp := get("GET", tt.path)
+			assert.Equal(t, tt.resp+" 2", body)
+			assert.Equal(t, "", resp.Header.Get("X-Cache"), tt.path)
+		}
+	})
+
+	t.Run("max-age", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		body, _ := get("GET", "/cached/short")
+		assert.Equal(t, "response /short 1", body)
+		body, _ = get("GET", "/cached/short")
+		assert.Equal(t, "response /short 1", body)
+		time.Sleep(1100 * time.Millisecond)
+		body, _ = get("GET", "/cached/short")
+		assert.Equal(t, "response /short 2", body, "expired")
+	})
+}
+
+func TestResponseCache_cacheable(t *testing.T) {
+	tbl := []struct {
+		status int
+		header http.Header
+		ttl    time.Duration
+		ok     bool
+	}{
+		{200, http.Header{}, time.Minute, true},
+		{404, http.Header{}, 0, false},
+		{200, http.Header{"Cache-Control": {"max-age=10"}}, 10 * time.Second, true},
+		{200, http.Header{"Cache-Control": {"public, max-age=10, s-maxage=20"}}, 20 * time.Second, true},
+		{200, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{200, http.Header{"Cache-Control": {"No-Store"}}, 0, false},
+		{200, http.Header{"Cache-Control": {"private, max-age=10"}}, 0, false},
+		{200, http.Header{"Set-Cookie": {"a=b"}}, 0, false},
+		{200, http.Header{"Vary": {"Accept-Encoding"}}, time.Minute, true},
+		{200, http.Header{"Vary": {"Accept-Encoding, Cookie"}}, 0, false},
+	}
+	c := newResponseCache(time.Minute, 1024)
+	for i, tt := range tbl {
+		rec := httptest.NewRecorder()
+		for k, v := range tt.header {
+			rec.Header()[k] = v
+		}
+		ttl, ok := c.cacheable(&cacheWriter{ResponseWriter: rec, status: tt.status})
+		assert.Equal(t, tt.ok, ok, strconv.Itoa(i))
+		assert.Equal(t, tt.ttl, ttl, strconv.Itoa(i))
+	}
+}
+
+func TestResponseCache_evict(t *testing.T) {
+	c := newResponseCache(time.Minute, 10)
+	now := time.Now()
+	c.put(&cacheEntry{key: "k1", body: []byte("12345"), expires: now.Add(time.Minute)})
+	c.put(&cacheEntry{key: "k2", body: []byte("12345"), expires: now.Add(time.Minute)})
+	_, ok := c.get("k1", now) // k1 used recently, k2 evicted first
+	assert.True(t, ok)
+	c.put(&cacheEntry{key: "k3", body: []byte("123"), expires: now.Add(time.Minute)})
+
+	_, ok = c.get("k2", now)
+	assert.False(t, ok)
+	_, ok = c.get("k1", now)
+	assert.True(t, ok)
+	_, ok = c.get("k3", now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(8), c.size)
+
+	_, ok = c.get("k1", now.Add(2*time.Minute))
+	assert.False(t, ok, "expired")
+	assert.Equal(t, int64(3), c.size)
+}
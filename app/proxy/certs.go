@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// CertPair is a certificate with its key, both pem files
+type CertPair struct {
+	Cert string
+	Key  string
+}
+
+// certStore keeps certificates of static ssl mode and picks one by SNI server name.
+// The first pair is the default one, used for unknown names and clients without SNI
+type certStore struct {
+	pairs []CertPair
+
+	lock   sync.RWMutex
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate // lower-cased dns names, wildcard names as is, i.e. *.example.com
+	mtimes map[string]time.Time        // modification time of loaded files
+}
+
+func newCertStore(pairs []CertPair) (*certStore, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	res := &certStore{pairs: pairs}
+	if err := res.load(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetCertificate picks certificate by the server name, case-insensitive, the same way as servers of rules matched.
+// Falls back to the default certificate
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return c.def, nil
+}
+
+// run checks files of certificates every interval and reloads all if any changed. Blocking until ctx canceled
+func (c *certStore) run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+			if err := c.load(); err != nil {
+				log.Printf("[WARN] can't reload certificates, previous kept, %v", err)
+				continue
+			}
+			log.Printf("[INFO] certificates reloaded")
+		}
+	}
+}
+
+// load reads all pairs and replaces certificates
+func (c *certStore) load() error {
+	mtimes := map[string]time.Time{}
+	byName := map[string]*tls.Certificate{}
+	var def *tls.Certificate
+	for _, p := range c.pairs {
+		for _, f := range []string{p.Cert, p.Key} {
+			st, err := os.Stat(f)
+			if err != nil {
+				return errors.Wrapf(err, "can't stat %s", f)
+			}
+			mtimes[f] = st.ModTime()
+		}
+		cert, err := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if err != nil {
+			return errors.Wrapf(err, "can't load certificate %s", p.Cert)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Wrapf(err, "can't parse certificate %s", p.Cert)
+		}
+		cert.Leaf = leaf
+		if def == nil {
+			def = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			n = strings.ToLower(n)
+			if _, ok := byName[n]; !ok { // the first pair with the name wins
+				byName[n] = &cert
+			}
+		}
+	}
+
+	c.lock.Lock()
+	c.def, c.byName, c.mtimes = def, byName, mtimes
+	c.lock.Unlock()
+	return nil
+}
+
+// changed checks if any file of certificates modified since the last load
+func (c *certStore) changed() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for f, mt := range c.mtimes {
+		st, err := os.Stat(f)
+		if err != nil || !st.ModTime().Equal(mt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertStore_GetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reproxy-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	def := writeTestCert(t, dir, "default", "example.com", "www.example.com")
+	api := writeTestCert(t, dir, "api", "api.example.com", "*.svc.example.com")
+
+	certs, err := newCertStore([]CertPair{def, api})
+	require.NoError(t, err)
+	cfg := (&Http{}).makeTLSConfig()
+	cfg.GetCertificate = certs.GetCertificate
+
+	tbl := []struct {
+		name, cn string
+	}{
+		{"example.com", "default"},
+		{"WWW.Example.com", "default"},
+		{"api.example.com", "api"},
+		{"api.example.com.", "api"},
+		{"one.svc.example.com", "api"},
+		{"deep.one.svc.example.com", "default"},
+		{"unknown.com", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tbl {
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.name})
+		require.NoError(t, err)
+		assert.Equal(t, tt.cn, cert.Leaf.Subject.CommonName, tt.name)
+	}
+}
+
+func TestCertStore_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reproxy-certs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	def := writeTestCert(t, dir, "default", "example.com")
+	certs, err := newCertStore([]CertPair{def})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.run(ctx, 10*time.Millisecond)
+
+	cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, cert.Leaf.DNSNames)
+
+	writeTestCert(t, dir, "default", "example.com", "new.example.com")
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(def.Cert, future, future))
+	time.Sleep(50 * time.Millisecond)
+
+	cert, err = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "new.example.com"}, cert.Leaf.DNSNames)
+
+	require.NoError(t, ioutil.WriteFile(def.Cert, []byte("bad"), 0600))
+	require.NoError(t, os.Chtimes(def.Cert, future.Add(time.Minute), future.Add(time.Minute)))
+	time.Sleep(50 * time.Millisecond)
+	cert, err = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "new.example.com"}, cert.Leaf.DNSNames, "previous kept on error")
+}
+
+func TestNewCertStore_Errors(t *testing.T) {
+	_, err := newCertStore(nil)
+	assert.EqualError(t, err, "no certificates")
+
+	_, err = newCertStore([]CertPair{{Cert: "/tmp/no-such-cert.pem", Key: "/tmp/no-such-key.pem"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't stat /tmp/no-such-cert.pem")
+}
+
+// writeTestCert writes self-signed certificate with cn subject and dns names to dir
+func writeTestCert(t *testing.T, dir, cn string, names ...string) CertPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	res := CertPair{Cert: filepath.Join(dir, cn+".crt"), Key: filepath.Join(dir, cn+".key")}
+	require.NoError(t, ioutil.WriteFile(res.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(res.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return res
+}
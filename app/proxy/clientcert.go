@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// clientCNAllowed checks if the request has verified tls client certificate with subject common name matching cn.
+// Only the leaf of verified chain checked, certificates not verified by client CAs ignored
+func clientCNAllowed(r *http.Request, cn *regexp.Regexp) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	return cn.MatchString(r.TLS.VerifiedChains[0][0].Subject.CommonName)
+}
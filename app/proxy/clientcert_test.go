@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestClientCNAllowed(t *testing.T) {
+	cert := func(cn string) *x509.Certificate { return &x509.Certificate{Subject: pkix.Name{CommonName: cn}} }
+	cn := regexp.MustCompile(`^client\d+\.example\.com$`)
+
+	tbl := []struct {
+		name  string
+		state *tls.ConnectionState
+		res   bool
+	}{
+		{"no tls", nil, false},
+		{"no cert", &tls.ConnectionState{}, false},
+		{"matched", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert("client1.example.com")}}}, true},
+		{"not matched", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert("other.example.com")}}}, false},
+		{"unverified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert("client1.example.com")}}, false},
+	}
+	for _, tt := range tbl {
+		req := httptest.NewRequest("GET", "https://example.com/something", nil)
+		req.TLS = tt.state
+		assert.Equal(t, tt.res, clientCNAllowed(req, cn), tt.name)
+	}
+}
+
+func TestHttp_makeTLSConfigClientCA(t *testing.T) {
+	cfg := (&Http{}).makeTLSConfig()
+	assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+	assert.Nil(t, cfg.ClientCAs)
+
+	dir, err := ioutil.TempDir("", "reproxy-client-ca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := writeTestCert(t, dir, "ca", "ca.example.com")
+
+	cfg = (&Http{SSLConfig: SSLConfig{ClientCA: ca.Cert}}).makeTLSConfig()
+	assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+	require.NotNil(t, cfg.ClientCAs)
+	assert.Equal(t, 1, len(cfg.ClientCAs.Subjects())) //nolint staticcheck
+}
+
+func TestHttp_DoWithClientCN(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response " + r.URL.Path))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/secure/(.*)"), Dst: ds.URL + "/$1",
+					ClientCN: regexp.MustCompile(`^client\d+\.example\.com$`)},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = svc.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	h := Http{TimeOut: 200 * time.Millisecond, AccessLog: io.Discard, Matcher: svc}
+	handler := h.proxyHandler()
+
+	tbl := []struct {
+		path, cn string
+		status   int
+	}{
+		{"/secure/something", "client1.example.com", http.StatusOK},
+		{"/secure/something", "other.example.com", http.StatusForbidden},
+		{"/secure/something", "", http.StatusForbidden},
+		{"/api/something", "", http.StatusOK},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path+" "+tt.cn, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://example.com"+tt.path, nil)
+			if tt.cn != "" {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.cn}}}}
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			if tt.status == http.StatusOK {
+				assert.Equal(t, "response /something", rr.Body.String())
+			}
+		})
+	}
+}
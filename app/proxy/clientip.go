@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// ClientIP returns ip of the client set by client ip middleware, see clientIPHandler.
+// Falls back to the ip of the peer if not set
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(contextKey("client-ip")).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns ip of the immediate peer, the client or proxy connected to reproxy
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// clientIPHandler detects ip of the client once per request and keeps it in request's context.
+// X-Forwarded-For honored only if the request came from one of TrustedProxies, so clients connected
+// directly can't spoof their ip
+func (h *Http) clientIPHandler() func(next http.Handler) http.Handler {
+	trusted := parseTrustedProxies(h.TrustedProxies)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r, trusted)
+			if !isTrusted(peerIP(r), trusted) {
+				r.Header.Del("X-Forwarded-For") // not passed to upstream, reverse proxy sets it to the peer's ip
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey("client-ip"), ip)))
+		})
+	}
+}
+
+// clientIP returns ip of the client. X-Forwarded-For used only if the request came from trusted proxy,
+// the last ip not belonging to trusted proxies is the client's one
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := peerIP(r)
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+	fwd := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		v := strings.TrimSpace(fwd[i])
+		if v == "" {
+			continue
+		}
+		ip = v
+		if !isTrusted(v, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAllowed checks if ip belongs to one of allowed ips or cidrs. Invalid elements of the list skipped,
+// nothing allowed if none of them is valid
+func ipAllowed(ip string, allowed []string) bool {
+	nets := make([]*net.IPNet, 0, len(allowed))
+	for _, a := range allowed {
+		if n, err := parseNet(a); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return isTrusted(ip, nets)
+}
+
+// parseTrustedProxies parses list of ips and cidrs, invalid ones skipped
+func parseTrustedProxies(proxies []string) (res []*net.IPNet) {
+	for _, p := range proxies {
+		n, err := parseNet(p)
+		if err != nil {
+			log.Printf("[WARN] invalid trusted proxy %q, %v", p, err)
+			continue
+		}
+		res = append(res, n)
+	}
+	return res
+}
+
+// parseNet parses cidr or a single ip, the latter makes network of this ip only
+func parseNet(s string) (*net.IPNet, error) {
+	cidr := strings.TrimSpace(s)
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	return n, err
+}
@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "bad"})
+	assert.Equal(t, 2, len(trusted))
+
+	tbl := []struct {
+		remote, fwd, ip string
+	}{
+		{"172.16.0.1:1234", "", "172.16.0.1"},
+		{"172.16.0.1:1234", "1.2.3.4", "172.16.0.1"},
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"192.168.1.1:1234", "5.6.7.8, 1.2.3.4, 10.0.0.5", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, tt := range tbl {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			req.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		assert.Equal(t, tt.ip, clientIP(req, trusted), tt)
+	}
+}
+
+func TestHttp_clientIPHandler(t *testing.T) {
+	h := Http{TrustedProxies: []string{"10.0.0.0/8"}}
+	var ip, fwd string
+	handler := h.clientIPHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, fwd = ClientIP(r), r.Header.Get("X-Forwarded-For")
+	}))
+
+	tbl := []struct {
+		remote, fwd, ip, resFwd string
+	}{
+		{"172.16.0.1:1234", "", "172.16.0.1", ""},
+		{"172.16.0.1:1234", "1.2.3.4", "172.16.0.1", ""}, // spoofed by untrusted peer, dropped
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "10.0.0.1", ""},
+	}
+	for _, tt := range tbl {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.fwd != "" {
+			req.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, tt.ip, ip, tt)
+		assert.Equal(t, tt.resFwd, fwd, tt)
+	}
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "172.16.0.1:1234"
+	assert.Equal(t, "172.16.0.1", ClientIP(req), "peer ip without middleware")
+}
+
+func TestHttp_DoWithTrustedProxies(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Real-IP") + "|" + r.Header.Get("X-Forwarded-For")))
+	}))
+	defer ds.Close()
+
+	tbl := []struct {
+		trusted []string
+		res     string
+	}{
+		{nil, "127.0.0.1|127.0.0.1"},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1|127.0.0.1"},
+		{[]string{"127.0.0.1"}, "1.2.3.4|1.2.3.4, 127.0.0.1"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(fmt.Sprintf("%v", tt.trusted), func(t *testing.T) {
+			port := rand.Intn(10000) + 40000
+			h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+				TrustedProxies: tt.trusted}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			svc := discovery.NewService([]discovery.Provider{
+				&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}},
+			})
+			go func() {
+				_ = svc.Run(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+			h.Matcher = svc
+			go func() {
+				_ = h.Run(ctx)
+			}()
+			time.Sleep(10 * time.Millisecond)
+
+			req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Forwarded-For", "1.2.3.4")
+			req.Header.Set("X-Real-IP", "5.6.7.8")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(body))
+		})
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	tbl := []struct {
+		ip      string
+		allowed []string
+		res     bool
+	}{
+		{"10.1.2.3", []string{"10.0.0.0/8"}, true},
+		{"192.168.1.1", []string{"10.0.0.0/8", "192.168.1.1"}, true},
+		{"192.168.1.2", []string{"10.0.0.0/8", "192.168.1.1"}, false},
+		{"::1", []string{"::1"}, true},
+		{"10.1.2.3", []string{"bad"}, false},
+		{"bad", []string{"10.0.0.0/8"}, false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, ipAllowed(tt.ip, tt.allowed), tt)
+	}
+}
+
+func TestHttp_DoWithAllowIPs(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response " + r.URL.Path))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/internal/(.*)"), Dst: ds.URL + "/$1",
+					AllowIPs: []string{"10.0.0.0/8", "192.168.1.1"}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, TrustedProxies: []string{"127.0.0.1"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		path, fwd string
+		status    int
+	}{
+		{"/internal/something", "10.1.2.3", http.StatusOK},
+		{"/internal/something", "192.168.1.1", http.StatusOK},
+		{"/internal/something", "192.168.1.2", http.StatusForbidden},
+		{"/internal/something", "", http.StatusForbidden}, // direct request from 127.0.0.1
+		{"/internal/something", "10.1.2.3, 1.2.3.4", http.StatusForbidden},
+		{"/api/something", "1.2.3.4", http.StatusOK},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path+" "+tt.fwd, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, nil)
+			require.NoError(t, err)
+			if tt.fwd != "" {
+				req.Header.Set("X-Forwarded-For", tt.fwd)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusOK {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "response /something", string(body))
+			}
+		})
+	}
+}
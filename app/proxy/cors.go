@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSMethods allowed if CORSConfig.Methods not set
+var defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// CORSConfig holds cross-origin resource sharing params
+type CORSConfig struct {
+	Enabled     bool
+	Origins     []string      // allowed origins, "*" allows all
+	Methods     []string      // allowed methods, defaultCORSMethods if empty
+	Headers     []string      // allowed request headers, requested headers allowed if empty
+	Credentials bool          // allow credentials, the request's origin reflected instead of "*"
+	MaxAge      time.Duration // how long preflight results can be cached
+	Servers     []string      // servers with CORS enabled, all servers if empty
+}
+
+// corsHandler adds Access-Control-* headers to the responses for allowed origins.
+// Preflight requests answered with 204 right away and never proxied.
+func (h *Http) corsHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if !h.CORS.Enabled || origin == "" || !h.CORS.matchServer(serverName(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			w.Header().Add("Vary", "Origin")
+			if !h.CORS.allowOrigin(origin) {
+				if preflight {
+					http.Error(w, "Origin not allowed", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowOrigin := origin
+			if h.CORS.anyOrigin() && !h.CORS.Credentials {
+				allowOrigin = "*"
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if h.CORS.Credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			methods := h.CORS.Methods
+			if len(methods) == 0 {
+				methods = defaultCORSMethods
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			headers := r.Header.Get("Access-Control-Request-Headers")
+			if len(h.CORS.Headers) > 0 {
+				headers = strings.Join(h.CORS.Headers, ", ")
+			}
+			if headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if h.CORS.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(h.CORS.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func (c CORSConfig) allowOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) anyOrigin() bool {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) matchServer(server string) bool {
+	if len(c.Servers) == 0 {
+		return true
+	}
+	for _, s := range c.Servers {
+		if strings.EqualFold(s, server) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttp_corsHandlerPreflight(t *testing.T) {
+	h := Http{CORS: CORSConfig{Enabled: true, Origins: []string{"https://app.example.com"},
+		Methods: []string{"GET", "POST"}, Credentials: true, MaxAge: 10 * time.Minute}}
+	proxied := false
+	handler := h.corsHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proxied = true }))
+
+	req := httptest.NewRequest("OPTIONS", "http://api.example.com/api/something", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.False(t, proxied, "preflight not proxied")
+	assert.Equal(t, "https://app.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET, POST", rr.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type, X-Token", rr.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rr.Header().Get("Access-Control-Max-Age"))
+
+	req.Header.Set("Origin", "https://evil.example.com")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.False(t, proxied)
+}
+
+func TestHttp_corsHandlerSimple(t *testing.T) {
+	h := Http{CORS: CORSConfig{Enabled: true, Origins: []string{"*"}, Servers: []string{"api.example.com"}}}
+	handler := h.corsHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		url, origin, allowOrigin string
+	}{
+		{"http://api.example.com/api/something", "https://app.example.com", "*"},
+		{"http://API.example.com:8080/api/something", "https://other.example.com", "*"},
+		{"http://api.example.com/api/something", "", ""},
+		{"http://other.example.com/api/something", "https://app.example.com", ""},
+	}
+
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.url+" "+tt.origin, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, "ok", rr.Body.String())
+			assert.Equal(t, tt.allowOrigin, rr.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, "", rr.Header().Get("Access-Control-Allow-Methods"))
+		})
+	}
+
+	h.CORS.Enabled = false
+	req := httptest.NewRequest("GET", "http://api.example.com/api/something", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "", rr.Header().Get("Access-Control-Allow-Origin"), "disabled")
+}
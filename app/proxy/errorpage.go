@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// ErrorPage is a custom response of proxy errors, i.e. of 502 for unreachable destination.
+// Template executed with the error's Status, StatusText, Server, Path and RequestID
+type ErrorPage struct {
+	ContentType string
+	Template    *template.Template
+}
+
+// errorPageData passed to the template of error page
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Server     string
+	Path       string
+	RequestID  string
+}
+
+// NewErrorPage makes error page with the template text. Content type detected by the name's extension,
+// i.e. 502.html, or by the text itself if the name has no known extension
+func NewErrorPage(name, text string) (ErrorPage, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return ErrorPage{}, errors.Wrapf(err, "can't parse error page %s", name)
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType([]byte(text))
+		if trimmed := strings.TrimSpace(text); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			contentType = "application/json"
+		}
+	}
+	return ErrorPage{ContentType: contentType, Template: tmpl}, nil
+}
+
+// withErrorPageData keeps the server and path of the request for error pages,
+// the request passed to the reverse proxy's error handler has the destination's host and path
+func withErrorPageData(r *http.Request, server string) *http.Request {
+	data := errorPageData{Server: server, Path: requestURI(r)}
+	return r.WithContext(context.WithValue(r.Context(), contextKey("error-page"), data))
+}
+
+// sendError responds with the custom error page of the status, the page of the requested server used before
+// the page of all servers ("*"). Without a page msg sent as text, if not empty, status only otherwise
+func (h *Http) sendError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	data, ok := r.Context().Value(contextKey("error-page")).(errorPageData)
+	if !ok {
+		data = errorPageData{Server: serverName(r), Path: requestURI(r)}
+	}
+	page, ok := h.errorPage(data.Server, status)
+	if !ok {
+		if msg == "" {
+			w.WriteHeader(status)
+			return
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	data.Status, data.StatusText, data.RequestID = status, http.StatusText(status), RequestIDFromContext(r.Context())
+	buf := bytes.Buffer{}
+	if err := page.Template.Execute(&buf, data); err != nil {
+		log.Printf("[WARN] can't make error page %d for %s, %v", status, data.Server, err)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", page.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("[WARN] can't send error page %d for %s, %v", status, data.Server, err)
+	}
+}
+
+// errorPage returns the error page of the status for server, matched case-insensitive, or for all servers
+func (h *Http) errorPage(server string, status int) (ErrorPage, bool) {
+	for srv, pages := range h.ErrorPages {
+		if srv == "*" || !strings.EqualFold(srv, server) {
+			continue
+		}
+		if page, ok := pages[status]; ok {
+			return page, true
+		}
+	}
+	page, ok := h.ErrorPages["*"][status]
+	return page, ok
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestNewErrorPage(t *testing.T) {
+	tbl := []struct {
+		name, text, contentType string
+	}{
+		{"502.html", "<html><body>{{.Status}}</body></html>", "text/html; charset=utf-8"},
+		{"502.json", `{"error": "{{.StatusText}}"}`, "application/json"},
+		{"502", `{"error": "{{.StatusText}}"}`, "application/json"},
+		{"502", "<h1>{{.StatusText}}</h1>", "text/html; charset=utf-8"},
+		{"502", "bad gateway", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name+" "+tt.text, func(t *testing.T) {
+			page, err := NewErrorPage(tt.name, tt.text)
+			require.NoError(t, err)
+			assert.Equal(t, tt.contentType, page.ContentType)
+		})
+	}
+
+	_, err := NewErrorPage("502.html", "{{.Status")
+	assert.Error(t, err)
+}
+
+func TestHttp_DoWithErrorPages(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ds.Close() // dead backend, connection refused
+
+	all, err := NewErrorPage("502.html", "<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Server}}{{.Path}}</p>")
+	require.NoError(t, err)
+	api, err := NewErrorPage("502", `{"error": "{{.StatusText}}", "status": {{.Status}}}`)
+	require.NoError(t, err)
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, ErrorPages: map[string]map[int]ErrorPage{"*": {502: all}, "api.example.com": {502: api}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		host, path  string
+		contentType string
+		body        string
+	}{
+		{"example.com", "/api/something?k=v", "text/html; charset=utf-8", "<h1>502 Bad Gateway</h1><p>example.com/api/something?k=v</p>"},
+		{"API.example.com", "/api/something", "application/json", `{"error": "Bad Gateway", "status": 502}`},
+		{"example.com", "/not-matched", "text/html; charset=utf-8", "<h1>502 Bad Gateway</h1><p>example.com/not-matched</p>"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, http.NoBody)
+			require.NoError(t, err)
+			req.Host = tt.host
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "original status kept")
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+
+	h.ErrorPages = nil
+	rr := httptest.NewRecorder()
+	h.sendError(rr, httptest.NewRequest("GET", "http://example.com/api/something", http.NoBody), http.StatusBadGateway, "")
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, "", rr.Body.String(), "no page, status only")
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// responseHeadersHandler sets ResponseHeaders of all servers ("*") and of the requested one, matched
+// case-insensitive. Headers of the server set after global ones and override them.
+func (h *Http) responseHeadersHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(h.ResponseHeaders) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			setResponseHeaders(w, h.ResponseHeaders["*"])
+			server := serverName(r)
+			for srv, headers := range h.ResponseHeaders {
+				if srv != "*" && strings.EqualFold(srv, server) {
+					setResponseHeaders(w, headers)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setResponseHeaders sets "key:value" headers of the response, the value may have ":" in
+func setResponseHeaders(w http.ResponseWriter, headers []string) {
+	for _, hdr := range headers {
+		elems := strings.SplitN(hdr, ":", 2)
+		if len(elems) != 2 {
+			continue
+		}
+		w.Header().Set(strings.TrimSpace(elems[0]), strings.TrimSpace(elems[1]))
+	}
+}
+
+// dropHeadersHandler removes DropHeaders from responses and sets Server header to ServerHeader, if defined.
+// Headers changed right before sent to the client, after proxied response copied and all handlers done with it
+func (h *Http) dropHeadersHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(h.DropHeaders) == 0 && h.ServerHeader == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&dropHeadersWriter{ResponseWriter: w, drop: h.DropHeaders, server: h.ServerHeader}, r)
+		})
+	}
+}
+
+// dropHeadersWriter wraps http.ResponseWriter, removes headers and sets Server header on the first write
+type dropHeadersWriter struct {
+	http.ResponseWriter
+	drop    []string
+	server  string
+	applied bool
+}
+
+func (d *dropHeadersWriter) apply() {
+	if d.applied {
+		return
+	}
+	d.applied = true
+	for _, hdr := range d.drop {
+		d.Header().Del(strings.TrimSpace(hdr))
+	}
+	if d.server != "" {
+		d.Header().Set("Server", d.server)
+	}
+}
+
+func (d *dropHeadersWriter) WriteHeader(status int) {
+	d.apply()
+	d.ResponseWriter.WriteHeader(status)
+}
+
+func (d *dropHeadersWriter) Write(p []byte) (int, error) {
+	d.apply()
+	return d.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher to keep streaming responses working
+func (d *dropHeadersWriter) Flush() {
+	d.apply()
+	if f, ok := d.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker to keep protocol upgrades working, i.e. websockets.
+// Upgrade responses written to the hijacked connection as is
+func (d *dropHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := d.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestHttp_responseHeadersHandler(t *testing.T) {
+	h := Http{ResponseHeaders: map[string][]string{
+		"*":               {"X-Frame-Options:DENY", "X-Global:all"},
+		"api.example.com": {"Strict-Transport-Security: max-age=31536000; includeSubDomains", "X-Frame-Options:SAMEORIGIN"},
+	}}
+	handler := h.responseHeadersHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	tbl := []struct {
+		host, hsts, frame string
+	}{
+		{"api.example.com", "max-age=31536000; includeSubDomains", "SAMEORIGIN"},
+		{"API.example.com:8080", "max-age=31536000; includeSubDomains", "SAMEORIGIN"},
+		{"other.example.com", "", "DENY"},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.host, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tt.host+"/api/something", nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.hsts, rr.Header().Get("Strict-Transport-Security"))
+			assert.Equal(t, tt.frame, rr.Header().Get("X-Frame-Options"), "server's header overrides global")
+			assert.Equal(t, "all", rr.Header().Get("X-Global"), "global header set for all servers")
+		})
+	}
+
+	h = Http{}
+	handler = h.responseHeadersHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://api.example.com/api/something", nil))
+	assert.Equal(t, 0, len(rr.Header()), "no headers")
+}
+
+func TestHttp_dropHeadersHandler(t *testing.T) {
+	h := Http{DropHeaders: []string{"X-Powered-By", " server "}}
+	handler := h.dropHeadersHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "PHP/7.4")
+		w.Header().Set("Server", "nginx/1.19")
+		w.Header().Set("X-Other", "value")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/api/something", nil))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "ok", rr.Body.String())
+	assert.Empty(t, rr.Header().Get("X-Powered-By"))
+	assert.Empty(t, rr.Header().Get("Server"))
+	assert.Equal(t, "value", rr.Header().Get("X-Other"))
+
+	h = Http{ServerHeader: "reproxy"}
+	handler = h.dropHeadersHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx/1.19")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "http://example.com/api/something", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "reproxy", rr.Header().Get("Server"), "server header overridden on implicit write")
+}
+
+func TestHttp_DoWithDropHeaders(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "Express")
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Backend", "svc1")
+		_, _ = w.Write([]byte("response " + r.URL.Path))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, DropHeaders: []string{"X-Powered-By"}, ServerHeader: "reproxy"}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "response /something", string(body))
+	assert.Empty(t, resp.Header.Get("X-Powered-By"))
+	assert.Equal(t, "reproxy", resp.Header.Get("Server"))
+	assert.Equal(t, "svc1", resp.Header.Get("X-Backend"))
+	assert.Equal(t, "reproxy", resp.Header.Get("App-Name"), "signature headers kept")
+}
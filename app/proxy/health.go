@@ -25,7 +25,7 @@ func (h *Http) healthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func (h *Http) healthHandler(w http.ResponseWriter, _ *http.Request) {
+func (h *Http) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 	// runs pings in parallel
 	check := func(mappers []discovery.URLMapper) (ok bool, valid int, total int, errs []string) {
@@ -41,19 +41,12 @@ func (h *Http) healthHandler(w http.ResponseWriter, _ *http.Request) {
 				defer wg.Done()
 
 				atomic.AddInt32(&pinged, 1)
-				client := http.Client{Timeout: 100 * time.Millisecond}
-				resp, err := client.Get(m.PingURL)
-				if err != nil {
+				if err := discovery.Ping(r.Context(), h.PingClient(m), m, 100*time.Millisecond); err != nil {
 					errMsg := strings.Replace(err.Error(), "\"", "", -1)
 					log.Printf("[WARN] failed to ping for health %s, %s", m.PingURL, errMsg)
 					outCh <- fmt.Errorf("%s, %v", m.PingURL, errMsg)
 					return
 				}
-				if resp.StatusCode != http.StatusOK {
-					log.Printf("[WARN] failed ping status for health %s (%s)", m.PingURL, resp.Status)
-					outCh <- fmt.Errorf("%s, %s", m.PingURL, resp.Status)
-					return
-				}
 			}(m)
 		}
 
@@ -3,10 +3,15 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"testing"
 	"time"
@@ -71,3 +76,148 @@ func TestHttp_healthHandler(t *testing.T) {
 	assert.Equal(t, 1., res["failed"])
 	assert.Contains(t, res["errors"].([]interface{})[0], "400 Bad Request")
 }
+
+func TestHttp_healthMiddlewareRecheckProxied(t *testing.T) {
+	h := Http{}
+	var proxied bool
+	handler := h.healthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { proxied = true }))
+	req := httptest.NewRequest("POST", "/api/health/recheck", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, proxied, "recheck served by management server only")
+}
+
+func TestHttp_healthHandlerExpected(t *testing.T) {
+	ps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/204/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"degraded"}`))
+	}))
+	defer ps.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/a/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					PingURL: ps.URL + "/204/ping", PingStatus: http.StatusNoContent},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/b/(.*)"), Dst: "http://127.0.0.1:8080/$1",
+					PingURL: ps.URL + "/json/ping", PingBody: `"status":"ok"`},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	h := Http{Matcher: svc}
+	rr := httptest.NewRecorder()
+	h.healthHandler(rr, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusExpectationFailed, rr.Code)
+	res := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	assert.Equal(t, 1., res["passed"], "expected status of ping checked")
+	assert.Equal(t, 1., res["failed"])
+	require.Equal(t, 1, len(res["errors"].([]interface{})))
+	assert.Contains(t, res["errors"].([]interface{})[0], "/json/ping", "expected body of ping checked")
+}
+
+func TestHttp_healthHandlerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ps := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ps.Listener.Close()
+	ps.Listener = l
+	ps.Start()
+	defer ps.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "unix:" + socket + "/$1",
+					PingURL: "unix:" + socket + "/ping"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	h := Http{Matcher: svc}
+	rr := httptest.NewRecorder()
+	h.healthHandler(rr, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `{"status": "ok", "services": 1}`, rr.Body.String())
+}
+
+func TestHttp_healthHandlerTLS(t *testing.T) {
+	ps := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ps.Close()
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caCert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ps.Certificate().Raw}), 0o600))
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/a/(.*)"), Dst: ps.URL + "/$1",
+					PingURL: ps.URL + "/ping?insecure", InsecureSkipVerify: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/b/(.*)"), Dst: ps.URL + "/$1",
+					PingURL: ps.URL + "/ping?ca-cert", CACert: caCert, TLSServerName: "example.com"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/c/(.*)"), Dst: ps.URL + "/$1",
+					PingURL: ps.URL + "/ping?system-ca"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+	h := Http{Matcher: svc, TimeOut: time.Second}
+	svc.PingClient = h.PingClient
+	svc.HealthCheckTimeout = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = svc.Run(ctx)
+
+	alive := map[string]bool{}
+	for _, r := range svc.CheckHealth(context.Background(), "") {
+		alive[r.PingURL] = r.Alive
+	}
+	assert.Equal(t, map[string]bool{ps.URL + "/ping?insecure": true, ps.URL + "/ping?ca-cert": true,
+		ps.URL + "/ping?system-ca": false}, alive, "pinged with tls options of the routes")
+
+	// pings of health handler reuse connections of the background check, made by the same transports
+	rr := httptest.NewRecorder()
+	h.healthHandler(rr, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusExpectationFailed, rr.Code)
+	res := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&res))
+	assert.Equal(t, 2., res["passed"])
+	assert.Equal(t, 1., res["failed"])
+	require.Equal(t, 1, len(res["errors"].([]interface{})))
+	assert.Contains(t, res["errors"].([]interface{})[0], "/ping?system-ca")
+}
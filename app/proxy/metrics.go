@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sizeBuckets defines upper bounds (in bytes) of request and response size histograms
+var sizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// durationBuckets defines upper bounds (in seconds) of request duration histograms
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics collects per-route stats and renders them in prometheus text format.
+// Routes identified by matched server and source rule, not by the raw path, to keep cardinality bounded.
+type metrics struct {
+	lock      sync.Mutex
+	reqSize   map[routeKey]*histogram
+	respSize  map[routeKey]*histogram
+	requests  map[statusKey]uint64
+	duration  map[providerKey]*histogram
+	unmatched uint64
+}
+
+// routeKey identifies route by the matched rule
+type routeKey struct {
+	server string
+	route  string
+}
+
+// providerKey identifies matched rule's server and provider
+type providerKey struct {
+	server   string
+	provider string
+}
+
+// statusKey identifies response status of the matched rule's server and provider
+type statusKey struct {
+	providerKey
+	status int
+}
+
+// histogram is a simple cumulative histogram with fixed buckets
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// metricsMiddleware serves GET /metrics if metrics enabled
+func (h *Http) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.metrics != nil && r.Method == "GET" && strings.EqualFold(r.URL.Path, "/metrics") {
+			h.metrics.handler(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newMetrics() *metrics {
+	return &metrics{reqSize: map[routeKey]*histogram{}, respSize: map[routeKey]*histogram{},
+		requests: map[statusKey]uint64{}, duration: map[providerKey]*histogram{}}
+}
+
+// observeRequest records status and duration of the proxied request
+func (m *metrics) observeRequest(key providerKey, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK // nothing written by the handler
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[statusKey{providerKey: key, status: status}]++
+	if _, ok := m.duration[key]; !ok {
+		m.duration[key] = newHistogram(durationBuckets)
+	}
+	m.duration[key].observe(duration.Seconds())
+}
+
+// observeUnmatched counts requests not matched to any rule
+func (m *metrics) observeUnmatched() {
+	m.lock.Lock()
+	m.unmatched++
+	m.lock.Unlock()
+}
+
+// observeSize records request and response body sizes for the route
+func (m *metrics) observeSize(key routeKey, in, out int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.reqSize[key]; !ok {
+		m.reqSize[key] = newHistogram(sizeBuckets)
+		m.respSize[key] = newHistogram(sizeBuckets)
+	}
+	m.reqSize[key].observe(float64(in))
+	m.respSize[key].observe(float64(out))
+}
+
+// handler renders all collected metrics in prometheus text exposition format
+func (m *metrics) handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	writeHistograms(w, "reproxy_request_size_bytes", "size of proxied request bodies", m.reqSize)
+	writeHistograms(w, "reproxy_response_size_bytes", "size of proxied response bodies", m.respSize)
+	m.writeRequests(w)
+}
+
+// writeRequests renders request counters and duration histograms
+func (m *metrics) writeRequests(w io.Writer) {
+	labels := func(k providerKey) string {
+		return fmt.Sprintf(`server="%s",provider="%s"`, labelEscaper.Replace(k.server), labelEscaper.Replace(k.provider))
+	}
+	less := func(a, b providerKey) bool {
+		if a.server == b.server {
+			return a.provider < b.provider
+		}
+		return a.server < b.server
+	}
+
+	statuses := make([]statusKey, 0, len(m.requests))
+	for k := range m.requests {
+		statuses = append(statuses, k)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].providerKey == statuses[j].providerKey {
+			return statuses[i].status < statuses[j].status
+		}
+		return less(statuses[i].providerKey, statuses[j].providerKey)
+	})
+	fmt.Fprint(w, "# HELP reproxy_requests_total number of proxied requests\n# TYPE reproxy_requests_total counter\n")
+	for _, k := range statuses {
+		fmt.Fprintf(w, "reproxy_requests_total{%s,status=\"%d\"} %d\n", labels(k.providerKey), k.status, m.requests[k])
+	}
+
+	keys := make([]providerKey, 0, len(m.duration))
+	for k := range m.duration {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	name := "reproxy_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s duration of proxied requests\n# TYPE %s histogram\n", name, name)
+	for _, k := range keys {
+		writeHistogram(w, name, labels(k), m.duration[k])
+	}
+
+	fmt.Fprint(w, "# HELP reproxy_unmatched_requests_total number of requests not matched to any rule\n")
+	fmt.Fprintf(w, "# TYPE reproxy_unmatched_requests_total counter\nreproxy_unmatched_requests_total %d\n", m.unmatched)
+}
+
+func writeHistograms(w io.Writer, name, help string, hists map[routeKey]*histogram) {
+	keys := make([]routeKey, 0, len(hists))
+	for k := range hists {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].server == keys[j].server {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].server < keys[j].server
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, k := range keys {
+		labels := fmt.Sprintf(`server="%s",route="%s"`, labelEscaper.Replace(k.server), labelEscaper.Replace(k.route))
+		writeHistogram(w, name, labels, hists[k])
+	}
+}
+
+func writeHistogram(w io.Writer, name, labels string, hist *histogram) {
+	for i, b := range hist.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, b, hist.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, hist.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, hist.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, hist.count)
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// labelEscaper makes label value safe for prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// countingReader wraps request body and counts bytes read
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// countingWriter wraps http.ResponseWriter, counts bytes written and keeps response status
+type countingWriter struct {
+	http.ResponseWriter
+	count  int64
+	status int
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err = c.ResponseWriter.Write(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher to keep streaming responses working
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker to keep protocol upgrades working, i.e. websockets
+func (c *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	if c.status == 0 {
+		c.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestMetrics_observeSize(t *testing.T) {
+	m := newMetrics()
+	key := routeKey{server: "example.com", route: "^/api/(.*)"}
+	m.observeSize(key, 50, 2000)
+	m.observeSize(key, 150, 20)
+
+	assert.Equal(t, uint64(2), m.reqSize[key].count)
+	assert.Equal(t, float64(200), m.reqSize[key].sum)
+	assert.Equal(t, []uint64{1, 2, 2, 2, 2, 2}, m.reqSize[key].counts)
+	assert.Equal(t, float64(2020), m.respSize[key].sum)
+	assert.Equal(t, []uint64{1, 1, 2, 2, 2, 2}, m.respSize[key].counts)
+
+	rr := httptest.NewRecorder()
+	m.handler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	t.Log(body)
+	assert.Contains(t, body, `reproxy_request_size_bytes_bucket{server="example.com",route="^/api/(.*)",le="100"} 1`)
+	assert.Contains(t, body, `reproxy_request_size_bytes_sum{server="example.com",route="^/api/(.*)"} 200`)
+	assert.Contains(t, body, `reproxy_response_size_bytes_count{server="example.com",route="^/api/(.*)"} 2`)
+}
+
+func TestMetrics_observeRequest(t *testing.T) {
+	m := newMetrics()
+	key := providerKey{server: "example.com", provider: "docker"}
+	m.observeRequest(key, 200, 20*time.Millisecond)
+	m.observeRequest(key, 200, 200*time.Millisecond)
+	m.observeRequest(key, 502, time.Millisecond)
+	m.observeRequest(providerKey{server: "*", provider: "file"}, 0, time.Millisecond)
+	m.observeUnmatched()
+
+	rr := httptest.NewRecorder()
+	m.handler(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	t.Log(body)
+	assert.Contains(t, body, `reproxy_requests_total{server="example.com",provider="docker",status="200"} 2`)
+	assert.Contains(t, body, `reproxy_requests_total{server="example.com",provider="docker",status="502"} 1`)
+	assert.Contains(t, body, `reproxy_requests_total{server="*",provider="file",status="200"} 1`)
+	assert.Contains(t, body, `reproxy_request_duration_seconds_bucket{server="example.com",provider="docker",le="0.025"} 2`)
+	assert.Contains(t, body, `reproxy_request_duration_seconds_bucket{server="example.com",provider="docker",le="0.25"} 3`)
+	assert.Contains(t, body, `reproxy_request_duration_seconds_count{server="example.com",provider="docker"} 3`)
+	assert.Contains(t, body, "reproxy_unmatched_requests_total 1")
+}
+
+func TestHttp_DoWithMetrics(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, MetricsEnabled: true, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("1234567890"))
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,",
+		},
+		}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post("http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", "text/plain",
+			strings.NewReader("abcde"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/not-matched")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	t.Log(string(body))
+
+	assert.Contains(t, string(body), `reproxy_request_size_bytes_sum{server="127.0.0.1",route="^/api/(.*)"} 10`)
+	assert.Contains(t, string(body), `reproxy_request_size_bytes_count{server="127.0.0.1",route="^/api/(.*)"} 2`)
+	assert.Contains(t, string(body), `reproxy_response_size_bytes_sum{server="127.0.0.1",route="^/api/(.*)"} 20`)
+	assert.Contains(t, string(body), `reproxy_response_size_bytes_count{server="127.0.0.1",route="^/api/(.*)"} 2`)
+	assert.Contains(t, string(body), `reproxy_requests_total{server="127.0.0.1",provider="static",status="200"} 2`)
+	assert.Contains(t, string(body), `reproxy_request_duration_seconds_count{server="127.0.0.1",provider="static"} 2`)
+	assert.Contains(t, string(body), "reproxy_unmatched_requests_total 1")
+}
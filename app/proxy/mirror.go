@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+const (
+	maxMirrorBodySize = 1024 * 1024      // max size of request body mirrored, requests with larger bodies not mirrored
+	maxMirrors        = 100              // max number of mirrored requests in progress, others dropped
+	mirrorTimeout     = 30 * time.Second // timeout of mirrored request if route's timeout not set
+)
+
+// mirror sends copies of proxied requests to mirror destinations in background. Mirrored requests limited by
+// maxMirrors and dropped if over it, so slow mirrors never hold the client's response or pile up
+type mirror struct {
+	transport http.RoundTripper
+	sem       chan struct{}
+}
+
+func newMirror(transport http.RoundTripper) *mirror {
+	return &mirror{transport: transport, sem: make(chan struct{}, maxMirrors)}
+}
+
+// mirrorRequest keeps copy of the request to send it to the mirror. Body of the request captured while read
+// by the proxy, up to maxMirrorBodySize
+type mirrorRequest struct {
+	method string
+	dest   string
+	header http.Header
+	body   *mirrorBody
+	opts   transportOpts // transport options of the route, host and socket set by the mirror's destination
+}
+
+// route captures the request for the route's mirror, the returned func sends it. Requests of routes without mirror
+// and upgraded connections not mirrored, the func does nothing in this case
+func (mr *mirror) route(r *http.Request, m discovery.URLMapper) func() {
+	if m.MirrorDst == "" || isWebsocket(r) {
+		return func() {}
+	}
+	req := mr.capture(r, m, m.Rewrite(requestURI(r), m.MirrorDst))
+	return func() { mr.send(req) }
+}
+
+// capture makes mirrorRequest of the route's request to dest, request's body replaced by the capturing one
+func (mr *mirror) capture(r *http.Request, m discovery.URLMapper, dest string) *mirrorRequest {
+	res := &mirrorRequest{method: r.Method, dest: dest, header: r.Header.Clone(), opts: routeTransportOpts(m, "", "")}
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 { // body of zero length never read by proxy
+		res.body = &mirrorBody{ReadCloser: r.Body}
+		r.Body = res.body
+	}
+	return res
+}
+
+// send sends the captured request to the mirror in background with the route's timeout and transport options,
+// response discarded. Requests with body not read completely or larger than maxMirrorBodySize skipped
+func (mr *mirror) send(req *mirrorRequest) {
+	var body []byte
+	if req.body != nil {
+		var ok bool
+		if body, ok = req.body.bytes(); !ok {
+			log.Printf("[DEBUG] request to %s not mirrored, body not read completely or too large", req.dest)
+			return
+		}
+	}
+
+	select {
+	case mr.sem <- struct{}{}:
+	default:
+		log.Printf("[WARN] request to %s not mirrored, too many mirrored requests in progress", req.dest)
+		return
+	}
+
+	go func() {
+		defer func() { <-mr.sem }()
+		timeout := req.opts.timeout
+		if timeout <= 0 {
+			timeout = mirrorTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		uu, socket, err := parseDestination(req.dest)
+		if err != nil {
+			log.Printf("[WARN] invalid mirror destination %s, %v", req.dest, err)
+			return
+		}
+		opts := req.opts
+		opts.host, opts.socket = uu.Host, socket
+		ctx = context.WithValue(ctx, contextKey("transport"), opts)
+		mreq, err := http.NewRequestWithContext(ctx, req.method, uu.String(), bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[WARN] can't make mirrored request to %s, %v", req.dest, err)
+			return
+		}
+		mreq.Header = req.header
+		resp, err := mr.transport.RoundTrip(mreq)
+		if err != nil {
+			log.Printf("[WARN] mirrored request to %s failed, %v", req.dest, err)
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		log.Printf("[DEBUG] mirrored request to %s, status %d", req.dest, resp.StatusCode)
+	}()
+}
+
+// mirrorBody captures request body read by the proxy
+type mirrorBody struct {
+	io.ReadCloser
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	complete  bool // body read till EOF
+	truncated bool // body larger than maxMirrorBodySize
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.truncated {
+		if b.buf.Len()+n > maxMirrorBodySize {
+			b.truncated = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+// bytes returns the captured body, false if it's not complete
+func (b *mirrorBody) bytes() ([]byte, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.complete || b.truncated {
+		return nil, false
+	}
+	return b.buf.Bytes(), true
+}
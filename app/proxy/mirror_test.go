@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithMirror(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("primary " + r.URL.Path + " " + string(body)))
+	}))
+	defer ds.Close()
+
+	mirrored := make(chan string, 10)
+	release := make(chan struct{})
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body) + " " + r.Header.Get("X-Test")
+		<-release // slow mirror, never holds the client's response
+		_, _ = w.Write([]byte("mirror"))
+	}))
+	defer ms.Close()
+	defer close(release)
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1",
+					MirrorDst: ms.URL + "/mirror/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/other/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	send := func(method, path, body string) string {
+		req, err := http.NewRequest(method, "http://127.0.0.1:"+strconv.Itoa(port)+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Test", "value")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	assert.Equal(t, "primary /something data", send("POST", "/api/something", "data"))
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "POST /mirror/something data value", m)
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	assert.Equal(t, "primary /xyz ", send("GET", "/api/xyz", ""), "response not held by the blocked mirror")
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "GET /mirror/xyz  value", m)
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	assert.Equal(t, "primary /xyz ", send("GET", "/other/xyz", ""))
+	select {
+	case m := <-mirrored:
+		t.Fatalf("unexpected mirrored request %s", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHttp_DoWithMirrorTLS(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("primary " + r.URL.Path))
+	}))
+	defer ds.Close()
+
+	mirrored := make(chan string, 10)
+	ms := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Method + " " + r.URL.Path
+	}))
+	defer ms.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1",
+					MirrorDst: ms.URL + "/mirror/$1", InsecureSkipVerify: true}, // self-signed mirror's certificate
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "GET /mirror/something", m, "route's tls options used by mirror")
+	case <-time.After(time.Second):
+		t.Fatal("request not mirrored")
+	}
+}
+
+func TestMirrorBody(t *testing.T) {
+	b := &mirrorBody{ReadCloser: io.NopCloser(strings.NewReader("some body"))}
+	_, ok := b.bytes()
+	assert.False(t, ok, "not read yet")
+	data, err := io.ReadAll(b)
+	require.NoError(t, err)
+	assert.Equal(t, "some body", string(data))
+	res, ok := b.bytes()
+	assert.True(t, ok)
+	assert.Equal(t, "some body", string(res))
+
+	b = &mirrorBody{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", maxMirrorBodySize+1)))}
+	data, err = io.ReadAll(b)
+	require.NoError(t, err)
+	assert.Equal(t, maxMirrorBodySize+1, len(data), "proxied body not limited")
+	_, ok = b.bytes()
+	assert.False(t, ok, "too large")
+}
@@ -10,6 +10,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -20,6 +22,8 @@ import (
 	"github.com/umputun/reproxy/app/discovery"
 )
 
+const hopsHeader = "X-Reproxy-Hops"
+
 // Http is a proxy server for both http and https
 type Http struct { //nolint golint
 	Matcher
@@ -27,19 +31,60 @@ type Http struct { //nolint golint
 	TimeOut          time.Duration
 	AssetsLocation   string
 	AssetsWebRoot    string
+	AssetsSPA        bool
 	MaxBodySize      int64
 	GzEnabled        bool
 	ProxyHeaders     []string
 	SSLConfig        SSLConfig
+	CORS             CORSConfig
 	Version          string
 	AccessLog        io.Writer
+	AccessLogFormat  string // combined (default), text or json
 	DisableSignature bool
+	MaxHops          int
+	MetricsEnabled   bool
+	BasicAuth        map[string]map[string]string // server -> user -> bcrypt hash of password, "*" for all servers
+	RateLimits       map[string]RateLimit         // per client ip limits by server, "*" for all servers
+	TrustedProxies   []string                     // ips or cidrs of proxies allowed to set X-Forwarded-For
+	ResponseHeaders  map[string][]string          // "key:value" headers of responses by server, "*" for all servers
+	FlushInterval    time.Duration                // periodic flush of proxied responses, streaming ones flushed on write
+	CacheTTL         time.Duration                // default ttl of cached responses, for routes with enabled cache
+	CacheMaxSize     int64                        // max total size of cached responses, cache disabled if zero
+	ShutdownTimeout  time.Duration                // max time of in-flight requests to complete on shutdown
+	Transport        TransportConfig              // pooling of upstream connections
+	Server           ServerConfig                 // timeouts of client connections
+	RewriteBodyTypes []string                     // content types of responses rewritten for routes with RewriteBody
+	DropHeaders      []string                     // headers removed from responses, i.e. X-Powered-By of backends
+	ServerHeader     string                       // value of Server header of all responses, backend's one kept if empty
+	ErrorPages       map[string]map[int]ErrorPage // custom pages of proxy errors by server and status, "*" for all servers
+
+	metrics      *metrics
+	cache        *responseCache
+	upstream     *upstreamTransport // shared by proxied requests and pings, see upstreamTransport
+	upstreamOnce sync.Once
+}
+
+// ServerConfig defines timeouts of client connections of http and https servers, protecting the proxy from
+// slow clients holding connections open. Defaults used if zero, reading of request body not limited by default
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration // max time to read request headers, defaultReadHeaderTimeout if zero
+	ReadTimeout       time.Duration // max time to read the entire request, including body, no timeout if zero
+	WriteTimeout      time.Duration // max time from the end of request headers to the end of response write
+	IdleTimeout       time.Duration // max time to wait for the next request of keep-alive connection
 }
 
+// default timeouts of client connections, see ServerConfig
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 30 * time.Second
+)
+
 // Matcher source info (server and route) to the destination url
 // If no match found return ok=false
 type Matcher interface {
-	Match(srv, src string) (string, bool)
+	Match(srv, src, method string) (string, bool)
+	MatchRequest(srv, src string, r *http.Request) (discovery.URLMapper, string, bool)
 	Servers() (servers []string)
 	Mappers() (mappers []discovery.URLMapper)
 }
@@ -51,61 +96,97 @@ func (h *Http) Run(ctx context.Context) error {
 		log.Printf("[DEBUG] assets file server enabled for %s, webroot %s", h.AssetsLocation, h.AssetsWebRoot)
 	}
 
+	if h.MetricsEnabled {
+		h.metrics = newMetrics()
+	}
+
+	if h.CacheMaxSize > 0 {
+		h.cache = newResponseCache(h.CacheTTL, h.CacheMaxSize)
+	}
+
 	var httpServer, httpsServer *http.Server
+	stopped := make(chan struct{})
 
-	go func() {
-		<-ctx.Done()
-		if httpServer != nil {
-			if err := httpServer.Close(); err != nil {
-				log.Printf("[ERROR] failed to close proxy http server, %v", err)
+	// shutdown started once servers made, so the servers never changed while read by the goroutine
+	shutdown := func() {
+		go func() {
+			defer close(stopped)
+			<-ctx.Done()
+			// stop accepting connections and let in-flight requests complete, up to ShutdownTimeout for all servers
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), h.ShutdownTimeout)
+			defer cancel()
+			if httpServer != nil {
+				if err := httpServer.Shutdown(shutdownCtx); err != nil {
+					log.Printf("[WARN] proxy http server forced to close, %v", err)
+					_ = httpServer.Close()
+				}
 			}
-		}
-		if httpsServer != nil {
-			if err := httpsServer.Close(); err != nil {
-				log.Printf("[ERROR] failed to close proxy https server, %v", err)
+			if httpsServer != nil {
+				if err := httpsServer.Shutdown(shutdownCtx); err != nil {
+					log.Printf("[WARN] proxy https server forced to close, %v", err)
+					_ = httpsServer.Close()
+				}
 			}
-		}
-	}()
+		}()
+	}
 
 	handler := R.Wrap(h.proxyHandler(),
 		R.Recoverer(log.Default()),
+		h.requestIDHandler,
+		h.clientIPHandler(),
+		h.dropHeadersHandler(),
 		h.signatureHandler(),
+		h.responseHeadersHandler(),
 		R.Ping,
 		h.healthMiddleware,
+		h.metricsMiddleware,
 		h.accessLogHandler(h.AccessLog),
-		R.SizeLimit(h.MaxBodySize),
+		h.rateLimitHandler(),
+		h.corsHandler(),
+		h.basicAuthHandler(),
+		h.loopDetectHandler(),
+		h.sizeLimitHandler(),
 		R.Headers(h.ProxyHeaders...),
 		h.gzipHandler(),
 	)
 
-	if len(h.SSLConfig.FQDNs) == 0 {
-		h.SSLConfig.FQDNs = h.Servers() // fill all discovered if nothing defined
-	}
-
 	switch h.SSLConfig.SSLMode {
 	case SSLNone:
 		log.Printf("[INFO] activate http proxy server on %s", h.Address)
 		httpServer = h.makeHTTPServer(h.Address, handler)
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
-		return httpServer.ListenAndServe()
+		shutdown()
+		return waitShutdown(httpServer.ListenAndServe(), stopped)
 	case SSLStatic:
 		log.Printf("[INFO] activate https server in 'static' mode on %s", h.Address)
 
+		certs, err := newCertStore(append([]CertPair{{Cert: h.SSLConfig.Cert, Key: h.SSLConfig.Key}}, h.SSLConfig.Certs...))
+		if err != nil {
+			return errors.Wrap(err, "can't load certificates")
+		}
+		go certs.run(ctx, h.SSLConfig.CertsCheckInterval)
+
 		httpsServer = h.makeHTTPSServer(h.Address, handler)
+		httpsServer.TLSConfig.GetCertificate = certs.GetCertificate
 		httpsServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
 
-		httpServer = h.makeHTTPServer(h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort), h.httpToHTTPSRouter())
+		httpServer = h.makeHTTPServer(h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort), h.httpToHTTPSRouter(handler))
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
+		shutdown()
 
 		go func() {
 			log.Printf("[INFO] activate http redirect server on %s", h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort))
 			err := httpServer.ListenAndServe()
 			log.Printf("[WARN] http redirect server terminated, %s", err)
 		}()
-		return httpServer.ListenAndServeTLS(h.SSLConfig.Cert, h.SSLConfig.Key)
+		return waitShutdown(httpsServer.ListenAndServeTLS("", ""), stopped)
 	case SSLAuto:
 		log.Printf("[INFO] activate https server in 'auto' mode on %s", h.Address)
-		log.Printf("[DEBUG] FQDNs %v", h.SSLConfig.FQDNs)
+		if len(h.SSLConfig.FQDNs) > 0 {
+			log.Printf("[DEBUG] FQDNs %v", h.SSLConfig.FQDNs)
+		} else {
+			log.Printf("[DEBUG] FQDNs not set, certificates issued for discovered servers")
+		}
 
 		m := h.makeAutocertManager()
 		httpsServer = h.makeHTTPSAutocertServer(h.Address, handler, m)
@@ -113,6 +194,7 @@ func (h *Http) Run(ctx context.Context) error {
 
 		httpServer = h.makeHTTPServer(h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort), h.httpChallengeRouter(m))
 		httpServer.ErrorLog = log.ToStdLogger(log.Default(), "WARN")
+		shutdown()
 
 		go func() {
 			log.Printf("[INFO] activate http challenge server on port %s", h.toHTTP(h.Address, h.SSLConfig.RedirHTTPPort))
@@ -120,48 +202,64 @@ func (h *Http) Run(ctx context.Context) error {
 			log.Printf("[WARN] http challenge server terminated, %s", err)
 		}()
 
-		return httpsServer.ListenAndServeTLS("", "")
+		return waitShutdown(httpsServer.ListenAndServeTLS("", ""), stopped)
 	}
 	return errors.Errorf("unknown SSL type %v", h.SSLConfig.SSLMode)
 }
 
-func (h *Http) proxyHandler() http.HandlerFunc {
-	type contextKey string
+// waitShutdown waits for graceful shutdown of the server closed on ctx cancellation, nil returned in this case.
+// Errors of servers failed to start or serve returned as is
+func waitShutdown(err error, stopped <-chan struct{}) error {
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-stopped
+	return nil
+}
 
+func (h *Http) proxyHandler() http.HandlerFunc {
+	transport := h.upstreamTransport()
+	mirrors := newMirror(transport)
 	reverseProxy := &httputil.ReverseProxy{
+		// hop-by-hop headers (RFC 7230, section 6.1), as well as headers listed in Connection,
+		// removed from the upstream request by reverse proxy after the director call
 		Director: func(r *http.Request) {
 			ctx := r.Context()
 			uu := ctx.Value(contextKey("url")).(*url.URL)
 			r.URL.Path = uu.Path
+			r.URL.RawQuery = uu.RawQuery
 			r.URL.Host = uu.Host
-			r.URL.Scheme = uu.Scheme
+			r.URL.Scheme = httpScheme(uu.Scheme)
 			r.Header.Add("X-Forwarded-Host", uu.Host)
 			r.Header.Add("X-Origin-Host", r.Host)
+			if host, ok := ctx.Value(contextKey("host")).(string); ok {
+				r.Host = host
+			}
 			h.setXRealIP(r)
 		},
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: h.TimeOut,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+		Transport:     transport,
+		FlushInterval: h.FlushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			if err := h.rewriteBody(resp); err != nil {
+				return err
+			}
+			return detectStream(resp)
 		},
+		ErrorHandler: h.proxyErrorHandler,
 	}
 
 	// default assetsHandler disabled, returns error on missing matches
 	assetsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[WARN] mo match for %s", r.URL)
-		http.Error(w, "Server error", http.StatusBadGateway)
+		h.sendError(w, r, http.StatusBadGateway, "Server error")
 	})
 
 	if h.AssetsLocation != "" && h.AssetsWebRoot != "" {
 		fs, err := R.FileServer(h.AssetsWebRoot, h.AssetsLocation)
 		if err == nil {
+			if h.AssetsSPA {
+				fs = assetsFileServer(h.AssetsWebRoot, h.AssetsLocation, true)
+			}
 			assetsHandler = func(w http.ResponseWriter, r *http.Request) {
 				fs.ServeHTTP(w, r)
 			}
@@ -170,24 +268,187 @@ func (h *Http) proxyHandler() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		server := r.URL.Hostname()
-		if server == "" {
-			server = strings.Split(r.Host, ":")[0]
-		}
-		u, ok := h.Match(server, r.URL.Path)
+		server := serverName(r)
+		m, u, ok := h.MatchRequest(server, requestURI(r), r)
 		if !ok {
+			if h.metrics != nil {
+				h.metrics.observeUnmatched()
+			}
 			assetsHandler.ServeHTTP(w, r)
 			return
 		}
 
-		uu, err := url.Parse(u)
+		if !h.accessAllowed(w, r, m, u, server) {
+			return
+		}
+
+		if m.MatchType == discovery.MTStatic {
+			setAccessInfo(r, m, u)
+			assetsFileServer(m.AssetsWebRoot, m.Dst, m.AssetsSPA).ServeHTTP(w, r)
+			return
+		}
+
+		if m.MatchType == discovery.MTRedirect {
+			setAccessInfo(r, m, u)
+			log.Printf("[DEBUG] redirect %s%s to %s with %d, matched %s rule %s %s", server, r.URL.Path, u,
+				m.RedirectCode, m.ProviderID, m.Server, m.SrcMatch.String())
+			http.Redirect(w, r, u, m.RedirectCode)
+			return
+		}
+
+		u = h.routeDestination(w, r, m, u)
+		setAccessInfo(r, m, u)
+		log.Printf("[DEBUG] proxy %s%s to %s, matched %s rule %s %s", server, r.URL.Path, u, m.ProviderID,
+			m.Server, m.SrcMatch.String())
+
+		uu, socket, err := parseDestination(u)
 		if err != nil {
 			http.Error(w, "Server error", http.StatusBadGateway)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), contextKey("url"), uu) // set destination url in request's context
-		reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+		if m.MaxBodySize > 0 && !limitBody(w, r, m.MaxBodySize) {
+			return
+		}
+		setRouteHeaders(r, m.Headers)
+		ctx, cancel := upstreamContext(r, m, uu, socket)
+		defer cancel()
+		upstream := h.upstreamHandler(reverseProxy, m, u)
+		defer mirrors.route(r, m)() // sent once the response served, client's latency unaffected
+
+		r = r.WithContext(ctx)
+		if len(h.ErrorPages) > 0 {
+			r = withErrorPageData(r, server)
+		}
+		if m.RewriteBody {
+			r = withBodyRewrite(r, uu)
+		}
+		w, r = withStreamWriter(w, r)
+		h.serveUpstream(w, r, m, upstream)
+	}
+}
+
+// proxyErrorHandler responds to errors of upstream requests, 413 for bodies over the route's limit,
+// 504 on timeouts and 502 otherwise
+func (h *Http) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[WARN] proxy error for %s, %v", r.URL, err)
+	// bodies over the limit detected while streamed to the upstream, i.e. chunked or sent after 100-continue
+	if errors.Is(err, errBodyTooLarge) || strings.Contains(err.Error(), "http: request body too large") {
+		h.sendError(w, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		h.sendError(w, r, http.StatusGatewayTimeout, "")
+		return
+	}
+	h.sendError(w, r, http.StatusBadGateway, "")
+}
+
+// accessAllowed checks client's ip and certificate against the route's allowed ips and client cn.
+// Responds with 403 and returns false if access denied
+func (h *Http) accessAllowed(w http.ResponseWriter, r *http.Request, m discovery.URLMapper, u, server string) bool {
+	if len(m.AllowIPs) > 0 && !ipAllowed(ClientIP(r), m.AllowIPs) {
+		setAccessInfo(r, m, u)
+		log.Printf("[INFO] access to %s%s denied for %s, matched %s rule %s %s", server, r.URL.Path, ClientIP(r),
+			m.ProviderID, m.Server, m.SrcMatch.String())
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if m.ClientCN != nil && !clientCNAllowed(r, m.ClientCN) {
+		setAccessInfo(r, m, u)
+		log.Printf("[INFO] access to %s%s denied for %s without client certificate matching %s, matched %s rule %s %s",
+			server, r.URL.Path, ClientIP(r), m.ClientCN.String(), m.ProviderID, m.Server, m.SrcMatch.String())
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// routeDestination returns destination of the route's a/b variant and sets sticky cookie of the route's destination
+func (h *Http) routeDestination(w http.ResponseWriter, r *http.Request, m discovery.URLMapper, u string) string {
+	if m.ABDst != "" {
+		u = h.abDestination(w, r, m, u)
+	}
+	if m.Sticky && m.StickyKey == "" {
+		setStickyCookie(w, r, m)
+	}
+	return u
+}
+
+// upstreamContext makes context of the upstream request with destination url, host and transport options of the route.
+// Context limited by the route's timeout, except upgraded connections
+func upstreamContext(r *http.Request, m discovery.URLMapper, uu *url.URL, socket string) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(r.Context(), contextKey("url"), uu) // set destination url in request's context
+	ctx = context.WithValue(ctx, contextKey("host"), upstreamHost(r, m, uu))
+	ctx = context.WithValue(ctx, contextKey("transport"), routeTransportOpts(m, uu.Host, socket))
+	if m.Retries > 0 {
+		ctx = context.WithValue(ctx, contextKey("retries"), m.Retries)
+	}
+	if m.Timeout > 0 && !isWebsocket(r) {
+		return context.WithTimeout(ctx, m.Timeout) // per-route request deadline, not for upgraded connections
+	}
+	return ctx, func() {}
+}
+
+// upstreamHandler returns handler of the route's upstream requests, cached for routes with cache enabled
+func (h *Http) upstreamHandler(reverseProxy http.Handler, m discovery.URLMapper, u string) http.Handler {
+	if m.Cache && h.cache != nil {
+		return h.cache.handler(u, reverseProxy)
+	}
+	return reverseProxy
+}
+
+// serveUpstream serves the request by upstream, counting request and response bodies for size metrics if enabled
+func (h *Http) serveUpstream(w http.ResponseWriter, r *http.Request, m discovery.URLMapper, upstream http.Handler) {
+	if h.metrics == nil {
+		upstream.ServeHTTP(w, r)
+		return
+	}
+
+	st := time.Now()
+	reqBody := &countingReader{ReadCloser: r.Body}
+	r.Body = reqBody
+	cw := &countingWriter{ResponseWriter: w}
+	upstream.ServeHTTP(cw, r)
+	h.metrics.observeSize(routeKey{server: m.Server, route: m.SrcMatch.String()},
+		atomic.LoadInt64(&reqBody.count), atomic.LoadInt64(&cw.count))
+	h.metrics.observeRequest(providerKey{server: m.Server, provider: string(m.ProviderID)}, cw.status, time.Since(st))
+}
+
+// parseDestination parses destination url. Destinations with unix scheme, i.e. unix:/var/run/app.sock/api/something,
+// requested as http://localhost/api/something via the returned socket
+func parseDestination(dst string) (uu *url.URL, socket string, err error) {
+	if sock, uri, ok := discovery.UnixSocket(dst); ok {
+		uu, err = url.Parse("http://localhost" + uri)
+		return uu, sock, err
+	}
+	uu, err = url.Parse(dst)
+	return uu, "", err
+}
+
+// upstreamHost returns Host header of the upstream request, the destination host unless the route
+// preserves the client's Host or overrides it
+func upstreamHost(r *http.Request, m discovery.URLMapper, uu *url.URL) string {
+	if m.HostHeader != "" {
+		return m.HostHeader
+	}
+	if m.PreserveHost {
+		return r.Host
+	}
+	return uu.Host
+}
+
+// setRouteHeaders sets "key:value" headers of the matched route, passed to the upstream request by reverse proxy.
+// Route headers override global proxy headers with the same key
+func setRouteHeaders(r *http.Request, headers []string) {
+	for _, hdr := range headers {
+		elems := strings.SplitN(hdr, ":", 2)
+		if len(elems) != 2 {
+			continue
+		}
+		r.Header.Set(strings.TrimSpace(elems[0]), strings.TrimSpace(elems[1]))
 	}
 }
 
@@ -208,6 +469,51 @@ func (h *Http) gzipHandler() func(next http.Handler) http.Handler {
 	}
 }
 
+// loopDetectHandler counts self-forwards with X-Reproxy-Hops header and rejects requests
+// exceeded MaxHops with 508 Loop Detected. Disabled if MaxHops is 0
+func (h *Http) loopDetectHandler() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if h.MaxHops <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			hops, err := strconv.Atoi(r.Header.Get(hopsHeader))
+			if err != nil {
+				hops = 0
+			}
+			if hops >= h.MaxHops {
+				log.Printf("[WARN] loop detected for %s%s, %d hops", r.Host, r.URL.Path, hops)
+				http.Error(w, "Loop detected", http.StatusLoopDetected)
+				return
+			}
+			r.Header.Set(hopsHeader, strconv.Itoa(hops+1)) // passed to the upstream request by reverse proxy
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sizeLimitHandler rejects requests with bodies larger than MaxBodySize.
+// Bodies of "Expect: 100-continue" requests are not read ahead but limited while streamed to the upstream.
+// This way the interim "100 Continue" sent to the client only after the upstream asked for the body,
+// and oversized requests rejected by Content-Length before the client sends the body.
+func (h *Http) sizeLimitHandler() func(next http.Handler) http.Handler {
+	sizeLimit := R.SizeLimit(h.MaxBodySize)
+	return func(next http.Handler) http.Handler {
+		limited := sizeLimit(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+				limited.ServeHTTP(w, r)
+				return
+			}
+			if !limitBody(w, r, h.MaxBodySize) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (h *Http) signatureHandler() func(next http.Handler) http.Handler {
 	if h.DisableSignature {
 		return func(next http.Handler) http.Handler {
@@ -219,37 +525,44 @@ func (h *Http) signatureHandler() func(next http.Handler) http.Handler {
 	return R.AppInfo("reproxy", "umputun", h.Version)
 }
 
-func (h *Http) accessLogHandler(wr io.Writer) func(next http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return handlers.CombinedLoggingHandler(wr, next)
-	}
-}
-
 func (h *Http) makeHTTPServer(addr string, router http.Handler) *http.Server {
+	timeout := func(v, def time.Duration) time.Duration {
+		if v > 0 {
+			return v
+		}
+		return def
+	}
 	return &http.Server{
 		Addr:              addr,
 		Handler:           router,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       30 * time.Second,
+		ReadHeaderTimeout: timeout(h.Server.ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       h.Server.ReadTimeout,
+		WriteTimeout:      timeout(h.Server.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       timeout(h.Server.IdleTimeout, defaultIdleTimeout),
 	}
 }
 
-func (h *Http) setXRealIP(r *http.Request) {
-
-	remoteIP := r.Header.Get("X-Forwarded-For")
-	if remoteIP == "" {
-		remoteIP = r.RemoteAddr
+// serverName returns server (host) of the request without port
+func serverName(r *http.Request) string {
+	if server := r.URL.Hostname(); server != "" {
+		return server
 	}
+	return strings.Split(r.Host, ":")[0]
+}
 
-	ip, _, err := net.SplitHostPort(remoteIP)
-	if err != nil {
-		return
+// requestURI returns unescaped path of the request with the raw query, if any
+func requestURI(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return r.URL.Path
 	}
+	return r.URL.Path + "?" + r.URL.RawQuery
+}
 
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
+// setXRealIP sets X-Real-IP of the upstream request to the client ip, replacing the one sent by client
+func (h *Http) setXRealIP(r *http.Request) {
+	ip := ClientIP(r)
+	if net.ParseIP(ip) == nil {
 		return
 	}
-	r.Header.Add("X-Real-IP", ip)
+	r.Header.Set("X-Real-IP", ip)
 }
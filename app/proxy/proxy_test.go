@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -156,6 +164,330 @@ func TestHttp_DoWithAssets(t *testing.T) {
 
 }
 
+func TestHttp_DoWithLoop(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, MaxHops: 3}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var hops []string
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops = append(hops, r.Header.Get("X-Reproxy-Hops"))
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+
+	// /loop/* routed back to reproxy itself, /api/* to the real backend
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"127.0.0.1,^/loop/(.*),http://127.0.0.1:" + strconv.Itoa(port) + "/loop/$1,",
+			"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,",
+		},
+		}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{}
+
+	{
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/loop/something")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusLoopDetected, resp.StatusCode)
+	}
+
+	{
+		resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "response /567/something", string(body))
+		assert.Equal(t, []string{"1"}, hops)
+	}
+}
+
+func TestHttp_DoWithExpectContinue(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+		AccessLog: io.Discard, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/reject") {
+			w.WriteHeader(http.StatusForbidden) // reject without reading the body
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError) // truncated by proxy's size limit
+			return
+		}
+		fmt.Fprintf(w, "accepted %s", string(body))
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"127.0.0.1,^/api/(.*)," + ds.URL + "/$1,",
+		},
+		}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	send := func(path string, body *trackingReader, size int64) *http.Response {
+		req, err := http.NewRequest("POST", "http://127.0.0.1:"+strconv.Itoa(port)+path, body)
+		require.NoError(t, err)
+		req.ContentLength = size
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	{
+		body := &trackingReader{r: strings.NewReader("something")}
+		resp := send("/api/accept", body, 9)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		rb, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "accepted something", string(rb))
+		assert.True(t, body.isRead(), "body sent after 100-continue")
+	}
+
+	{
+		body := &trackingReader{r: strings.NewReader("something")}
+		resp := send("/api/reject", body, 9)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.False(t, body.isRead(), "body not sent, rejected by upstream")
+	}
+
+	{
+		body := &trackingReader{r: strings.NewReader(strings.Repeat("x", 2048))}
+		resp := send("/api/accept", body, 2048)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.False(t, body.isRead(), "body not sent, rejected by size")
+	}
+
+	{
+		body := &trackingReader{r: strings.NewReader(strings.Repeat("x", 2048))}
+		resp := send("/api/accept", body, -1) // chunked, size unknown until streamed
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
+
+func TestHttp_DoWithResolve(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("req: %v", r)
+		fmt.Fprintf(w, "response %s, host %s, fwd %s", r.URL.String(), r.Host, r.Header.Get("X-Forwarded-Host"))
+	}))
+	dsPort := ds.Listener.Addr().(*net.TCPAddr).Port
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+					Dst:     fmt.Sprintf("http://backend.local:%d/567/$1", dsPort),
+					Resolve: map[string]string{"backend.local": "127.0.0.1"}},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{}
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+	require.NoError(t, err)
+	req.Host = "example.com"
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("response /567/something, host backend.local:%d, fwd backend.local:%d", dsPort, dsPort),
+		string(body), "destination host sent, not the resolved ip")
+}
+
+func TestHttp_DoWithResolveSameHost(t *testing.T) {
+	ds1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ds1 %s", r.URL.Path)
+	}))
+	defer ds1.Close()
+	dsPort := ds1.Listener.Addr().(*net.TCPAddr).Port
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.2:%d", dsPort))
+	if err != nil {
+		t.Skipf("can't listen on 127.0.0.2:%d, %v", dsPort, err)
+	}
+	ds2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ds2 %s", r.URL.Path)
+	}))
+	ds2.Listener.Close()
+	ds2.Listener = l
+	ds2.Start()
+	defer ds2.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/a/(.*)"), Dst: fmt.Sprintf("http://backend.local:%d/$1", dsPort),
+					Resolve: map[string]string{"backend.local": "127.0.0.1"}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/b/(.*)"), Dst: fmt.Sprintf("http://backend.local:%d/$1", dsPort),
+					Resolve: map[string]string{"backend.local": "127.0.0.2"}},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	get := func(path string) string {
+		resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	for i := 0; i < 3; i++ { // idle connection of one route never reused by another
+		assert.Equal(t, "ds1 /x", get("/a/x"))
+		assert.Equal(t, "ds2 /x", get("/b/x"))
+	}
+}
+
+func TestHttp_DoHopByHopHeaders(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var lock sync.Mutex
+	var upstreamHeaders []http.Header
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		upstreamHeaders = append(upstreamHeaders, r.Header.Clone())
+		lock.Unlock()
+		fmt.Fprintf(w, "response %s", r.URL.String())
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,"}}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// send raw request and read the whole response till connection closed by the server
+	rawRequest := func(req string) string {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+		_, err = conn.Write([]byte(req))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(resp)
+	}
+
+	t.Run("hop-by-hop headers", func(t *testing.T) {
+		resp := rawRequest("GET /api/something HTTP/1.1\r\nHost: 127.0.0.1\r\n" +
+			"Connection: close, X-Custom-Hop\r\nX-Custom-Hop: 1\r\nKeep-Alive: timeout=5\r\n" +
+			"Proxy-Connection: keep-alive\r\nUpgrade: something\r\nTE: gzip\r\nTrailer: X-Trailer\r\n" +
+			"X-End-To-End: 2\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK"), resp)
+		assert.Contains(t, resp, "response /567/something")
+
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal(t, 1, len(upstreamHeaders))
+		hdrs := upstreamHeaders[0]
+		for _, k := range []string{"Connection", "X-Custom-Hop", "Keep-Alive", "Proxy-Connection", "Upgrade", "Te", "Trailer"} {
+			assert.Empty(t, hdrs.Get(k), "header %s should be removed", k)
+		}
+		assert.Equal(t, "2", hdrs.Get("X-End-To-End"))
+	})
+
+	t.Run("http/1.0 client", func(t *testing.T) {
+		resp := rawRequest("GET /api/something HTTP/1.0\r\nHost: 127.0.0.1\r\nX-End-To-End: 3\r\n\r\n")
+		assert.True(t, strings.HasPrefix(resp, "HTTP/1.0 200 OK"), resp)
+		assert.NotContains(t, resp, "Transfer-Encoding: chunked")
+		assert.NotContains(t, resp, "Connection: keep-alive")
+		assert.Contains(t, resp, "response /567/something")
+
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal(t, 2, len(upstreamHeaders))
+		assert.Empty(t, upstreamHeaders[1].Get("Connection"))
+		assert.Equal(t, "3", upstreamHeaders[1].Get("X-End-To-End"))
+	})
+}
+
 func TestHttp_toHttp(t *testing.T) {
 
 	tbl := []struct {
@@ -177,3 +509,687 @@ func TestHttp_toHttp(t *testing.T) {
 	}
 
 }
+
+// trackingReader reports if anything was read from it
+type trackingReader struct {
+	r    io.Reader
+	lock sync.Mutex
+	read bool
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	t.lock.Lock()
+	t.read = true
+	t.lock.Unlock()
+	return t.r.Read(p)
+}
+
+func (t *trackingReader) isRead() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.read
+}
+
+func TestHttp_DoGzipPassthrough(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	gzBody := bytes.Buffer{}
+	gzw := gzip.NewWriter(&gzBody)
+	_, err := gzw.Write([]byte("some compressed response"))
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("req: %v", r)
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write([]byte("plain response"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(gzBody.Len()))
+		_, _ = w.Write(gzBody.Bytes())
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{
+			"127.0.0.1,^/api/(.*)," + ds.URL + "/567/$1,",
+		},
+		}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	{
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "gzip, br", resp.Header.Get("X-Accept-Encoding"), "client's accept-encoding untouched")
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.Equal(t, strconv.Itoa(gzBody.Len()), resp.Header.Get("Content-Length"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, gzBody.Bytes(), body, "compressed body passed as-is")
+	}
+
+	{
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("X-Accept-Encoding"), "no accept-encoding added to upstream request")
+		assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "plain response", string(body))
+	}
+}
+
+func TestHttp_DoWithRouteTimeout(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 500 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "response %s", r.URL.Path)
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/short/(.*)"), Dst: ds.URL + "/$1",
+					Timeout: 50 * time.Millisecond},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/default/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIStatic },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		path   string
+		status int
+	}{
+		{"/short/fast", http.StatusOK},
+		{"/short/slow", http.StatusGatewayTimeout},
+		{"/default/slow", http.StatusOK},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			st := time.Now()
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.status == http.StatusGatewayTimeout {
+				assert.True(t, time.Since(st) < 90*time.Millisecond, time.Since(st))
+			}
+		})
+	}
+}
+
+func TestHttp_DoWithQuery(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response %s", r.URL.RequestURI())
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{&provider.Static{Rules: []string{
+		`*,^/api/v1/items\?id=(\d+)$,` + ds.URL + "/items?item_id=$1,",
+		"*,^/api/(.*)," + ds.URL + "/$1,",
+	}}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		req, resp string
+	}{
+		{"/api/v1/items?id=5", "response /items?item_id=5"},
+		{"/api/v1/items?id=abc", "response /v1/items?id=abc"},
+		{"/api/something?k=v&x=1", "response /something?k=v&x=1"},
+		{"/api/something", "response /something"},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.req, func(t *testing.T) {
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.resp, string(body))
+		})
+	}
+}
+
+func TestHttp_DoWithRouteHeaders(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		ProxyHeaders: []string{"X-Global:global", "X-Backend:global"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Auth-Token"), r.Header.Get("X-Backend"), r.Header.Get("X-Global"))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/private/(.*)"), Dst: ds.URL + "/$1",
+					Headers: []string{"X-Auth-Token:secret", "X-Backend:private"}},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/public/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		req, resp string
+	}{
+		{"/private/something", "secret|private|global"},
+		{"/public/something", "|global|global"},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.req, func(t *testing.T) {
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.resp, string(body))
+		})
+	}
+}
+
+func TestHttp_DoWithHost(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Host, r.Header.Get("X-Origin-Host"))
+	}))
+	defer ds.Close()
+	dsHost := strings.TrimPrefix(ds.URL, "http://")
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/dest/(.*)"), Dst: ds.URL + "/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/preserve/(.*)"), Dst: ds.URL + "/$1", PreserveHost: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/override/(.*)"), Dst: ds.URL + "/$1", PreserveHost: true,
+					HostHeader: "svc.internal"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		req, resp string
+	}{
+		{"/dest/something", dsHost + "|example.com"},
+		{"/preserve/something", "example.com|example.com"},
+		{"/override/something", "svc.internal|example.com"},
+	}
+
+	client := http.Client{}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.req, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+tt.req, http.NoBody)
+			require.NoError(t, err)
+			req.Host = "example.com"
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.resp, string(body))
+		})
+	}
+}
+
+func TestHttp_DoWithUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Host, r.URL.String())
+	}))
+	ds.Listener = l
+	ds.Start()
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "unix:" + socket + "/blah/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/root/(.*)"), Dst: "unix://" + socket},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/bad/(.*)"), Dst: "unix:" + socket + ".bad/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard, Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		req    string
+		status int
+		resp   string
+	}{
+		{"/api/something?k=v", http.StatusOK, "localhost|/blah/something?k=v"},
+		{"/root/something", http.StatusOK, "localhost|/"},
+		{"/bad/something", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.req, func(t *testing.T) {
+			resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			if tt.status != http.StatusOK {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.resp, string(body))
+		})
+	}
+}
+
+func TestHttp_DoWithInsecure(t *testing.T) {
+	cert, _ := makeTestCert(t, "backend.example.com")
+	ds := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response " + r.URL.Path))
+	}))
+	ds.TLS = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint gosec
+	ds.StartTLS()
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/insecure/(.*)"), Dst: ds.URL + "/$1", InsecureSkipVerify: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/secure/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard, Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/insecure/something")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "response /something", string(body))
+
+	resp, err = http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/secure/something")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "self-signed certificate not verified")
+}
+
+func TestHttp_DoWithRedirects(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response " + r.URL.String()))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/old/(.*)"), Dst: "https://example.com/new/$1",
+					MatchType: discovery.MTRedirect, RedirectCode: http.StatusMovedPermanently},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/tmp/(\\w+)/(\\d+)$"), Dst: "/items/$2?kind=$1",
+					MatchType: discovery.MTRedirect, RedirectCode: http.StatusTemporaryRedirect},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	tbl := []struct {
+		path, location string
+		status         int
+	}{
+		{"/old/something?foo=bar", "https://example.com/new/something?foo=bar", http.StatusMovedPermanently},
+		{"/tmp/book/12", "/items/12?kind=book", http.StatusTemporaryRedirect},
+		{"/api/something", "", http.StatusOK},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, tt.location, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestHttp_DoWithHeaderMatch(t *testing.T) {
+	v1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("v1 " + r.URL.Path))
+	}))
+	defer v1.Close()
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("v2 " + r.URL.Path))
+	}))
+	defer v2.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: v1.URL + "/$1"},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: v2.URL + "/$1",
+					HeaderMatch: map[string]*regexp.Regexp{"X-Api-Version": regexp.MustCompile("^2$")}},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	svc.MatchCacheSize = 10
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, tt := range []struct{ version, res string }{
+		{"2", "v2 /something"},
+		{"1", "v1 /something"},
+		{"", "v1 /something"},
+	} {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+		require.NoError(t, err)
+		if tt.version != "" {
+			req.Header.Set("X-Api-Version", tt.version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, tt.res, string(body), "version %q", tt.version)
+	}
+}
+
+func TestHttp_RunGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("slow response"))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}},
+	})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: time.Second, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, ShutdownTimeout: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/slow")
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	_, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+	require.Error(t, err, "new requests refused")
+
+	select {
+	case err = <-runErr:
+		t.Fatalf("run returned before in-flight request completed, %v", err)
+	default:
+	}
+
+	res := <-inFlight
+	require.NoError(t, res.err)
+	assert.Equal(t, "slow response", res.body, "in-flight request completed")
+	assert.NoError(t, <-runErr, "run returns after shutdown")
+}
+
+func TestHttp_makeHTTPServer(t *testing.T) {
+	srv := (&Http{}).makeHTTPServer("127.0.0.1:8080", http.NotFoundHandler())
+	assert.Equal(t, "127.0.0.1:8080", srv.Addr)
+	assert.Equal(t, 5*time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), srv.ReadTimeout, "body read not limited by default")
+	assert.Equal(t, 30*time.Second, srv.WriteTimeout)
+	assert.Equal(t, 30*time.Second, srv.IdleTimeout)
+
+	h := Http{Server: ServerConfig{ReadHeaderTimeout: time.Second, ReadTimeout: 10 * time.Second,
+		WriteTimeout: time.Minute, IdleTimeout: 2 * time.Minute}}
+	srv = h.makeHTTPServer("127.0.0.1:8443", http.NotFoundHandler())
+	assert.Equal(t, time.Second, srv.ReadHeaderTimeout)
+	assert.Equal(t, 10*time.Second, srv.ReadTimeout)
+	assert.Equal(t, time.Minute, srv.WriteTimeout)
+	assert.Equal(t, 2*time.Minute, srv.IdleTimeout)
+}
+
+func TestHttp_SlowClient(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: discovery.NewService(nil), Server: ServerConfig{ReadHeaderTimeout: 50 * time.Millisecond}}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = h.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", h.Address)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n")) // headers never completed
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	st := time.Now()
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err, "connection closed by server")
+	assert.Less(t, int64(time.Since(st)), int64(500*time.Millisecond))
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// RateLimit defines token bucket limiting requests of a single client
+type RateLimit struct {
+	Rate  float64 // requests per second
+	Burst int     // max number of requests allowed at once
+}
+
+// rateLimiter keeps token buckets by key
+type rateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPurge time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+// rateLimitPurgeInterval defines how often idle buckets removed
+const rateLimitPurgeInterval = time.Minute
+
+// rateLimitHandler limits requests per client ip with RateLimits of the server or "*" limits for all other servers.
+// Client ip taken from X-Forwarded-For only if the request came from one of TrustedProxies, see ClientIP.
+// Requests over the limit rejected with 429 and Retry-After header.
+func (h *Http) rateLimitHandler() func(next http.Handler) http.Handler {
+	limiter := &rateLimiter{buckets: map[string]*tokenBucket{}, lastPurge: time.Now()}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scope, limit, ok := h.rateLimit(serverName(r))
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ip := ClientIP(r)
+			if allowed, retry := limiter.allow(scope+"|"+ip, limit, time.Now()); !allowed {
+				log.Printf("[DEBUG] rate limit exceeded for %s on %s", ip, scope)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimit returns limit of the server, case-insensitive, along with the key it defined by
+func (h *Http) rateLimit(server string) (string, RateLimit, bool) {
+	if len(h.RateLimits) == 0 {
+		return "", RateLimit{}, false
+	}
+	for srv, limit := range h.RateLimits {
+		if srv != "*" && strings.EqualFold(srv, server) {
+			return srv, limit, true
+		}
+	}
+	limit, ok := h.RateLimits["*"]
+	return "*", limit, ok
+}
+
+// allow takes a token from the key's bucket, returns time to wait for the next token if bucket is empty
+func (l *rateLimiter) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPurge) > rateLimitPurgeInterval {
+		l.purge(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if limit.Rate <= 0 {
+		return false, rateLimitPurgeInterval
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// purge removes full buckets, they are the same as new ones
+func (l *rateLimiter) purge(now time.Time) {
+	for k, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastPurge = now
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttp_rateLimitHandler(t *testing.T) {
+	h := Http{RateLimits: map[string]RateLimit{"*": {Rate: 10, Burst: 2}, "fast.example.com": {Rate: 100, Burst: 5}}}
+	handler := h.rateLimitHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	get := func(host, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+"/api/something", nil)
+		req.RemoteAddr = remote
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get("example.com", "192.168.1.1:1234").Code)
+	assert.Equal(t, http.StatusOK, get("example.com", "192.168.1.1:1235").Code)
+	rr := get("example.com", "192.168.1.1:1236")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code, "bucket exhausted")
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusOK, get("example.com", "192.168.1.2:1234").Code, "other client not limited")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, get("fast.example.com", "192.168.1.1:1234").Code, "server's own limit")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, get("fast.example.com", "192.168.1.1:1234").Code)
+
+	time.Sleep(110 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, get("example.com", "192.168.1.1:1234").Code, "refilled")
+	assert.Equal(t, http.StatusTooManyRequests, get("example.com", "192.168.1.1:1234").Code)
+}
+
+func TestHttp_rateLimitHandlerDisabled(t *testing.T) {
+	h := Http{RateLimits: map[string]RateLimit{"limited.example.com": {Rate: 1, Burst: 1}}}
+	handler := h.rateLimitHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/api/something", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+}
+
+func TestRateLimiter_allow(t *testing.T) {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}, lastPurge: time.Now()}
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("k1", limit, now)
+		assert.True(t, ok)
+	}
+	ok, retry := l.allow("k1", limit, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retry)
+
+	ok, _ = l.allow("k1", limit, now.Add(500*time.Millisecond))
+	assert.True(t, ok, "one token refilled")
+	ok, _ = l.allow("k1", limit, now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+
+	l.allow("k2", limit, now)
+	l.purge(now.Add(time.Hour))
+	assert.Equal(t, 0, len(l.buckets), "full buckets purged")
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen limits length of the incoming request id, longer ones replaced by generated id
+const maxRequestIDLen = 128
+
+// RequestIDFromContext returns request id set by request id middleware, empty string if not set
+func RequestIDFromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(contextKey("request-id")).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// requestIDHandler keeps X-Request-ID of the incoming request or generates a new one if absent.
+// The id set in request's context, passed to upstream and returned in response header.
+func (h *Http) requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLen || !printable(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey("request-id"), id)))
+	})
+}
+
+// newRequestID makes short random hex token
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("[WARN] can't generate request id, %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func printable(s string) bool {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
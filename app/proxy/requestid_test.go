@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestHttp_requestIDHandler(t *testing.T) {
+	h := Http{}
+	var ctxID, hdrID string
+	handler := h.requestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctxID, hdrID = RequestIDFromContext(r.Context()), r.Header.Get("X-Request-ID")
+	}))
+
+	req := httptest.NewRequest("GET", "/api/something", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "abc-123", rr.Header().Get("X-Request-ID"), "existing id passed through")
+	assert.Equal(t, "abc-123", ctxID)
+	assert.Equal(t, "abc-123", hdrID)
+
+	req = httptest.NewRequest("GET", "/api/something", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	id := rr.Header().Get("X-Request-ID")
+	assert.Equal(t, 16, len(id), "new id generated")
+	assert.Equal(t, id, ctxID)
+	assert.Equal(t, id, hdrID)
+
+	req = httptest.NewRequest("GET", "/api/something", nil)
+	req.Header.Set("X-Request-ID", strings.Repeat("x", 200))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, 16, len(rr.Header().Get("X-Request-ID")), "too long id replaced")
+	assert.NotEqual(t, id, ctxID, "ids unique")
+
+	assert.Equal(t, "", RequestIDFromContext(context.Background()))
+}
+
+func TestHttp_DoWithRequestID(t *testing.T) {
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}))
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}},
+	})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.Matcher = svc
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := http.Client{}
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+"/api/something", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Request-ID", "req-12345")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "req-12345", string(body), "upstream got request id")
+	assert.Equal(t, "req-12345", resp.Header.Get("X-Request-ID"))
+
+	resp, err = client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/api/something")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 16, len(body), "generated id passed to upstream")
+	assert.Equal(t, string(body), resp.Header.Get("X-Request-ID"))
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// defaultRetryBackoff is the delay before the first retry of upstream request
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// retry sends request up to retries more times with exponential backoff while upstream fails
+// with connection error or responds with 502, 503 or 504. The last response or error returned as is
+func (t *upstreamTransport) retry(tr http.RoundTripper, req *http.Request, retries int) (*http.Response, error) {
+	backoff := t.backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := tr.RoundTrip(req)
+		if attempt >= retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		log.Printf("[DEBUG] retry %d of %s %s in %v, status %d, %v", attempt+1, req.Method, req.URL, backoff,
+			statusCode(resp), err)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			body, e := req.GetBody()
+			if e != nil {
+				return nil, e
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// retryable checks if request method is idempotent and its body, if any, can be sent again
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// shouldRetry checks if upstream failed to connect or responded as unavailable.
+// Requests canceled by client or timed out by route's deadline not retried
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
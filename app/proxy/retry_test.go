@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithRetries(t *testing.T) {
+	var hits int32
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("response " + r.Method))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/retry/(.*)"), Dst: ds.URL + "/$1", Retries: 2},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/once/(.*)"), Dst: ds.URL + "/$1", Retries: 1},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc, MaxBodySize: 1024}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	tbl := []struct {
+		method, path string
+		status, hits int
+	}{
+		{"GET", "/retry/something", http.StatusOK, 3},
+		{"GET", "/once/something", http.StatusServiceUnavailable, 2},
+		{"GET", "/api/something", http.StatusServiceUnavailable, 1},
+		{"POST", "/retry/something", http.StatusServiceUnavailable, 1},
+		{"PUT", "/retry/something", http.StatusServiceUnavailable, 1}, // body of incoming request can't be rewound
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.method+tt.path, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			var body io.Reader
+			if tt.method == "POST" || tt.method == "PUT" {
+				body = strings.NewReader("body")
+			}
+			req, err := http.NewRequest(tt.method, "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, body)
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode)
+			assert.Equal(t, int32(tt.hits), atomic.LoadInt32(&hits))
+		})
+	}
+}
+
+func TestUpstreamTransport_RetryConnection(t *testing.T) {
+	// reserve a port and start backend on it after the first attempt failed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("got "), body...))
+	}))
+	defer backend.Close()
+	ut := &upstreamTransport{makeTransport: (&Http{TimeOut: time.Second}).makeTransport, backoff: 50 * time.Millisecond}
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		time.Sleep(20 * time.Millisecond)
+		ln, e := net.Listen("tcp", addr)
+		if e != nil {
+			return
+		}
+		backend.Listener.Close()
+		backend.Listener = ln
+		backend.Start()
+	}()
+	defer func() { <-started }()
+
+	req, err := http.NewRequest("PUT", "http://"+addr+"/something", bytes.NewBufferString("data"))
+	require.NoError(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), contextKey("retries"), 3))
+	resp, err := ut.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "got data", string(body), "rewindable body sent again")
+}
+
+func TestRetryable(t *testing.T) {
+	tbl := []struct {
+		method string
+		body   io.Reader
+		res    bool
+	}{
+		{"GET", nil, true},
+		{"HEAD", nil, true},
+		{"DELETE", nil, true},
+		{"PUT", bytes.NewBufferString("data"), true},
+		{"POST", nil, false},
+		{"PATCH", bytes.NewBufferString("data"), false},
+	}
+	for _, tt := range tbl {
+		req, err := http.NewRequest(tt.method, "http://example.com", tt.body)
+		require.NoError(t, err)
+		assert.Equal(t, tt.res, retryable(req), tt.method)
+	}
+
+	req, err := http.NewRequest("PUT", "http://example.com", ioutil.NopCloser(strings.NewReader("data")))
+	require.NoError(t, err)
+	assert.False(t, retryable(req), "body can't be rewound")
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// maxRewriteBodySize is the max size of response body rewritten, larger bodies passed as is
+const maxRewriteBodySize = 10 * 1024 * 1024
+
+// defaultRewriteTypes are content types of rewritten responses, used if Http.RewriteBodyTypes not set
+var defaultRewriteTypes = []string{"text/html", "application/json"}
+
+// bodyRewrite replaces base url of the backend with the external one in response bodies of the route
+type bodyRewrite struct {
+	from, to string
+}
+
+// withBodyRewrite sets rewrite of the backend's base url in responses to the request, to the scheme and host
+// requested by client. Compression of the response disabled, the backend asked for uncompressed body
+func withBodyRewrite(r *http.Request, uu *url.URL) *http.Request {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	rw := bodyRewrite{from: httpScheme(uu.Scheme) + "://" + uu.Host, to: scheme + "://" + r.Host}
+	r.Header.Del("Accept-Encoding")
+	return r.WithContext(context.WithValue(r.Context(), contextKey("rewrite-body"), rw))
+}
+
+// rewriteBody replaces the backend's base url in the response body, if the request has body rewrite set
+// and content type of the response is one of rewritten. Content-Length updated to the size of new body
+func (h *Http) rewriteBody(resp *http.Response) error {
+	rw, ok := resp.Request.Context().Value(contextKey("rewrite-body")).(bodyRewrite)
+	if !ok || !h.rewriteType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRewriteBodySize+1))
+	if err != nil {
+		return errors.Wrap(err, "can't read response body to rewrite")
+	}
+	if len(body) > maxRewriteBodySize {
+		log.Printf("[WARN] response body of %s larger than %d, not rewritten", resp.Request.URL, maxRewriteBodySize)
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	_ = resp.Body.Close()
+	body = bytes.ReplaceAll(body, []byte(rw.from), []byte(rw.to))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+	return nil
+}
+
+// rewriteType checks if responses of the content type rewritten
+func (h *Http) rewriteType(contentType string) bool {
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := h.RewriteBodyTypes
+	if len(types) == 0 {
+		types = defaultRewriteTypes
+	}
+	for _, t := range types {
+		if strings.EqualFold(strings.TrimSpace(t), ct) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiReadCloser reads the already consumed part of body and the rest of it, closing the original body
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+func TestHttp_DoWithRewriteBody(t *testing.T) {
+	var ds *httptest.Server
+	ds = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = w.Write([]byte(`<a href="` + ds.URL + `/page">` + ds.URL + `</a>`))
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} {
+			res := make(chan struct{}, 1)
+			res <- struct{}{}
+			return res
+		},
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/rewrite/(.*)"), Dst: ds.URL + "/$1", RewriteBody: true},
+				{Server: "*", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: ds.URL + "/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	port := rand.Intn(10000) + 40000
+	h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port), AccessLog: io.Discard,
+		Matcher: svc}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	go func() {
+		_ = h.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	rewritten := `<a href="http://example.com/page">http://example.com</a>`
+	original := `<a href="` + ds.URL + `/page">` + ds.URL + `</a>`
+	tbl := []struct {
+		path, res string
+	}{
+		{"/rewrite/something?type=text/html%3B+charset=utf-8", rewritten},
+		{"/rewrite/something?type=application/json", rewritten},
+		{"/rewrite/something?type=text/plain", original},
+		{"/api/something?type=text/html", original},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, nil)
+			require.NoError(t, err)
+			req.Host = "example.com"
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, string(body))
+			assert.Equal(t, strconv.Itoa(len(tt.res)), resp.Header.Get("Content-Length"))
+		})
+	}
+}
+
+func TestHttp_rewriteType(t *testing.T) {
+	h := Http{}
+	assert.True(t, h.rewriteType("text/html; charset=utf-8"))
+	assert.True(t, h.rewriteType("Application/JSON"))
+	assert.False(t, h.rewriteType("text/plain"))
+	assert.False(t, h.rewriteType(""))
+
+	h.RewriteBodyTypes = []string{"text/plain"}
+	assert.True(t, h.rewriteType("text/plain"))
+	assert.False(t, h.rewriteType("text/html"))
+}
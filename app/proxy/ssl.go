@@ -1,17 +1,24 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/acme/autocert"
 
 	R "github.com/go-pkgz/rest"
 )
 
+// acmeChallengePath is the url prefix of ACME "http-01" challenges
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
 // sslMode defines ssl mode for rest server
 type sslMode int8
 
@@ -35,13 +42,26 @@ type SSLConfig struct {
 	ACMEEmail     string
 	FQDNs         []string
 	RedirHTTPPort int
+
+	Certs              []CertPair    // additional certificates of static mode picked by SNI, Cert/Key is the default
+	CertsCheckInterval time.Duration // interval of checking certificate files for changes, disabled if zero
+
+	ClientCA string // PEM file with CAs verifying client certificates, client certificates not requested if empty
 }
 
 // httpToHTTPSRouter creates new router which does redirect from http to https server
-// with default middlewares. Used in 'static' ssl mode.
-func (h *Http) httpToHTTPSRouter() http.Handler {
+// with default middlewares. Used in 'static' ssl mode. ACME "http-01" challenges passed to the handler as is,
+// for certificates obtained by external clients with challenge responses served by proxied servers.
+func (h *Http) httpToHTTPSRouter(handler http.Handler) http.Handler {
 	log.Printf("[DEBUG] create https-to-http redirect routes")
-	return R.Wrap(h.redirectHandler(), R.Recoverer(log.Default()))
+	redirect := h.redirectHandler()
+	return R.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		redirect.ServeHTTP(w, r)
+	}), R.Recoverer(log.Default()))
 }
 
 // httpChallengeRouter creates new router which performs ACME "http-01" challenge response
@@ -53,26 +73,60 @@ func (h *Http) httpChallengeRouter(m *autocert.Manager) http.Handler {
 	return R.Wrap(m.HTTPHandler(h.redirectHandler()), R.Recoverer(log.Default()))
 }
 
+// redirectHandler redirects to the same host and path of https server, with 308 to keep the method and body.
+// The host is the discovered server matching the requested one, see redirectHost
 func (h *Http) redirectHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		server := strings.Split(r.Host, ":")[0]
-		newURL := fmt.Sprintf("https://%s:443%s", server, r.URL.Path)
+		newURL := fmt.Sprintf("https://%s:443%s", h.redirectHost(r.Host), r.URL.Path)
 		if r.URL.RawQuery != "" {
 			newURL += "?" + r.URL.RawQuery
 		}
-		http.Redirect(w, r, newURL, http.StatusTemporaryRedirect)
+		http.Redirect(w, r, newURL, http.StatusPermanentRedirect)
 	})
 }
 
+// redirectHost returns name of the discovered server matching the host case-insensitive, without the port.
+// Hosts not discovered, i.e. with catch-all servers only, returned as is
+func (h *Http) redirectHost(host string) string {
+	if hh, _, err := net.SplitHostPort(host); err == nil {
+		host = hh
+	}
+	if h.Matcher == nil {
+		return host
+	}
+	for _, srv := range h.Servers() {
+		if strings.EqualFold(srv, host) {
+			return srv
+		}
+	}
+	return host
+}
+
 func (h *Http) makeAutocertManager() *autocert.Manager {
 	return &autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
 		Cache:      autocert.DirCache(h.SSLConfig.ACMELocation),
-		HostPolicy: autocert.HostWhitelist(h.SSLConfig.FQDNs...),
+		HostPolicy: h.hostPolicy(),
 		Email:      h.SSLConfig.ACMEEmail,
 	}
 }
 
+// hostPolicy allows certificates for FQDNs, if set, or for servers discovered by providers.
+// Discovered servers checked on each request, so servers appeared after reload eligible without restart
+func (h *Http) hostPolicy() autocert.HostPolicy {
+	if len(h.SSLConfig.FQDNs) > 0 {
+		return autocert.HostWhitelist(h.SSLConfig.FQDNs...)
+	}
+	return func(_ context.Context, host string) error {
+		for _, srv := range h.Servers() {
+			if strings.EqualFold(srv, host) {
+				return nil
+			}
+		}
+		return errors.Errorf("acme/autocert: host %q not discovered", host)
+	}
+}
+
 // makeHTTPSAutoCertServer makes https server with autocert mode (LE support)
 func (h *Http) makeHTTPSAutocertServer(address string, router http.Handler, m *autocert.Manager) *http.Server {
 	server := h.makeHTTPServer(address, router)
@@ -90,7 +144,7 @@ func (h *Http) makeHTTPSServer(address string, router http.Handler) *http.Server
 }
 
 func (h *Http) makeTLSConfig() *tls.Config {
-	return &tls.Config{
+	res := &tls.Config{
 		PreferServerCipherSuites: true,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
@@ -105,4 +159,10 @@ func (h *Http) makeTLSConfig() *tls.Config {
 			tls.CurveP384,
 		},
 	}
+	if h.SSLConfig.ClientCA != "" {
+		// certificate is optional, required by routes with client cn only
+		res.ClientAuth = tls.VerifyClientCertIfGiven
+		res.ClientCAs = loadCACert(h.SSLConfig.ClientCA)
+	}
+	return res
 }
@@ -7,17 +7,39 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
 )
 
 func TestSSL_Redirect(t *testing.T) {
-	p := Http{}
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return make(chan struct{}) },
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			return []discovery.URLMapper{
+				{Server: "example.com", SrcMatch: *regexp.MustCompile("^/api/(.*)"), Dst: "http://127.0.0.2/$1"},
+			}, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = svc.Run(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
 
-	ts := httptest.NewServer(p.httpToHTTPSRouter())
+	p := Http{Matcher: svc}
+	ts := httptest.NewServer(p.httpToHTTPSRouter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("challenge " + r.URL.Path))
+	})))
 	defer ts.Close()
 
 	client := http.Client{
@@ -36,8 +58,27 @@ func TestSSL_Redirect(t *testing.T) {
 	resp, err := client.Get(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1) + "/blah?param=1")
 	require.NoError(t, err)
 	defer resp.Body.Close()
-	assert.Equal(t, 307, resp.StatusCode)
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
 	assert.Equal(t, "https://localhost:443/blah?param=1", resp.Header.Get("Location"))
+
+	// redirect of post keeps the method with 308
+	req, err := http.NewRequest("POST", ts.URL+"/api/something", strings.NewReader("data"))
+	require.NoError(t, err)
+	req.Host = "Example.COM:8080"
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
+	assert.Equal(t, "https://example.com:443/api/something", resp.Header.Get("Location"), "discovered server used")
+
+	// acme challenge passed through
+	resp, err = client.Get(ts.URL + "/.well-known/acme-challenge/token123")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "challenge /.well-known/acme-challenge/token123", string(body))
 }
 
 func TestSSL_ACME_HTTPChallengeRouter(t *testing.T) {
@@ -66,7 +107,7 @@ func TestSSL_ACME_HTTPChallengeRouter(t *testing.T) {
 	resp, err := client.Get(lh + "/blah?param=1")
 	require.NoError(t, err)
 	defer resp.Body.Close()
-	assert.Equal(t, 307, resp.StatusCode)
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode)
 	assert.Equal(t, "https://localhost:443/blah?param=1", resp.Header.Get("Location"))
 
 	// check acme http challenge
@@ -89,3 +130,51 @@ func TestSSL_ACME_HTTPChallengeRouter(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "token", string(body))
 }
+
+func TestSSL_ACME_HostPolicy(t *testing.T) {
+	servers := []string{"example.com"}
+	var lock sync.Mutex
+	events := make(chan struct{}, 1)
+	svc := discovery.NewService([]discovery.Provider{&discovery.ProviderMock{
+		EventsFunc: func(ctx context.Context) <-chan struct{} { return events },
+		ListFunc: func(context.Context) ([]discovery.URLMapper, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			res := []discovery.URLMapper{{Server: "*", SrcMatch: *regexp.MustCompile("^/(.*)"), Dst: "http://127.0.0.1/$1"}}
+			for _, srv := range servers {
+				res = append(res, discovery.URLMapper{Server: srv, SrcMatch: *regexp.MustCompile("^/api/(.*)"),
+					Dst: "http://127.0.0.2/$1"})
+			}
+			return res, nil
+		},
+		IDFunc: func() discovery.ProviderID { return discovery.PIFile },
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = svc.Run(ctx)
+	}()
+	events <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+
+	p := Http{Matcher: svc, SSLConfig: SSLConfig{ACMELocation: "acme"}}
+	m := p.makeAutocertManager()
+	defer os.RemoveAll(p.SSLConfig.ACMELocation)
+
+	assert.NoError(t, m.HostPolicy(ctx, "example.com"))
+	assert.NoError(t, m.HostPolicy(ctx, "Example.COM"), "case-insensitive")
+	assert.EqualError(t, m.HostPolicy(ctx, "new.example.com"), `acme/autocert: host "new.example.com" not discovered`)
+	assert.Error(t, m.HostPolicy(ctx, "*"), "catch-all server is not a host")
+
+	lock.Lock()
+	servers = append(servers, "new.example.com")
+	lock.Unlock()
+	events <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, m.HostPolicy(ctx, "new.example.com"), "eligible after reload")
+
+	p.SSLConfig.FQDNs = []string{"fqdn.example.com"}
+	m = p.makeAutocertManager()
+	assert.NoError(t, m.HostPolicy(ctx, "fqdn.example.com"))
+	assert.Error(t, m.HostPolicy(ctx, "example.com"), "only fqdns allowed if set")
+}
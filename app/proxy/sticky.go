@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+// stickyCookieTTL defines how long the client bound to the destination of sticky pool
+const stickyCookieTTL = 24 * time.Hour
+
+// setStickyCookie binds the client to the matched destination of the sticky route, with the route's cookie.
+// The cookie refreshed if the client bound to another destination, i.e. to the dead one
+func setStickyCookie(w http.ResponseWriter, r *http.Request, m discovery.URLMapper) {
+	name, id := m.StickyCookie(), m.StickyID()
+	if c, err := r.Cookie(name); err == nil && c.Value == id {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: id, Path: "/", MaxAge: int(stickyCookieTTL.Seconds()), HttpOnly: true})
+}
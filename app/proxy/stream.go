@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// streamWriter flushes every write of streaming responses, i.e. server-sent events and chunked responses,
+// so clients get the data as soon as upstream sent it, regardless of proxy's FlushInterval
+type streamWriter struct {
+	http.ResponseWriter
+	stream bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	if s.stream {
+		s.Flush()
+	}
+	return n, err
+}
+
+// Flush implements http.Flusher
+func (s *streamWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker for protocol upgrades handled by reverse proxy, i.e. websockets.
+// Deadlines of server's connection cleared, upgraded connections are long-lived
+func (s *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, nil, errors.Wrap(err, "can't reset deadline of hijacked connection")
+	}
+	return conn, rw, nil
+}
+
+// withStreamWriter wraps w to flush streaming responses, the wrapper kept in the request's context
+// to be switched on by reverse proxy's ModifyResponse
+func withStreamWriter(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	sw := &streamWriter{ResponseWriter: w}
+	return sw, r.WithContext(context.WithValue(r.Context(), contextKey("stream"), sw))
+}
+
+// detectStream switches stream writer of the request on for streaming responses
+func detectStream(resp *http.Response) error {
+	sw, ok := resp.Request.Context().Value(contextKey("stream")).(*streamWriter)
+	if !ok {
+		return nil
+	}
+	sw.stream = isStreaming(resp)
+	return nil
+}
+
+// isStreaming checks if response is server-sent events or chunked without known content length
+func isStreaming(resp *http.Response) bool {
+	if ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && ct == "text/event-stream" {
+		return true
+	}
+	if resp.ContentLength != -1 {
+		return false
+	}
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	return false
+}
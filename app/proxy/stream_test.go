@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestHttp_DoStreaming(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{
+		&provider.Static{Rules: []string{"*,^/api/(.*)," + ds.URL + "/$1,"}},
+	})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, metrics := range []bool{false, true} {
+		metrics := metrics
+		for _, path := range []string{"/api/events", "/api/chunked"} {
+			path := path
+			t.Run(fmt.Sprintf("%s metrics=%v", path, metrics), func(t *testing.T) {
+				port := rand.Intn(10000) + 40000
+				h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+					AccessLog: io.Discard, Matcher: svc, MetricsEnabled: metrics, FlushInterval: time.Minute}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				go func() {
+					_ = h.Run(ctx)
+				}()
+				time.Sleep(10 * time.Millisecond)
+
+				st := time.Now()
+				resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + path)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				rd := bufio.NewReader(resp.Body)
+				line, err := rd.ReadString('\n')
+				require.NoError(t, err)
+				assert.Equal(t, "data: event 0\n", line)
+				assert.Less(t, int64(time.Since(st)), int64(150*time.Millisecond), "first event received right away")
+
+				rest, err := io.ReadAll(rd)
+				require.NoError(t, err)
+				assert.Equal(t, 2, strings.Count(string(rest), "data: event"))
+				assert.GreaterOrEqual(t, int64(time.Since(st)), int64(300*time.Millisecond))
+			})
+		}
+	}
+}
+
+func TestIsStreaming(t *testing.T) {
+	tbl := []struct {
+		resp http.Response
+		res  bool
+	}{
+		{http.Response{Header: http.Header{"Content-Type": []string{"text/event-stream"}}, ContentLength: -1}, true},
+		{http.Response{Header: http.Header{"Content-Type": []string{"text/event-stream; charset=utf-8"}}}, true},
+		{http.Response{Header: http.Header{}, ContentLength: -1, TransferEncoding: []string{"chunked"}}, true},
+		{http.Response{Header: http.Header{}, ContentLength: -1}, false},
+		{http.Response{Header: http.Header{"Content-Type": []string{"text/plain"}}, ContentLength: 10}, false},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, isStreaming(&tt.resp), strconv.Itoa(i))
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/reproxy/app/discovery"
+)
+
+type contextKey string
+
+// TransportConfig defines pooling of keep-alive connections to upstream hosts, routes can override it
+type TransportConfig struct {
+	MaxIdleConnsPerHost int           // max idle connections kept per host, http.DefaultMaxIdleConnsPerHost if zero
+	MaxConnsPerHost     int           // max connections per host, including active ones, unlimited if zero
+	IdleConnTimeout     time.Duration // how long idle connection kept open, 90s if zero
+}
+
+// transportOpts defines per-route options of the upstream transport
+type transportOpts struct {
+	host          string // destination host, each host has own transport and pool of connections
+	socket        string // unix socket dialed instead of the host, if set
+	resolve       string // host to ip overrides of the route, made by resolveOpt
+	tlsServerName string
+	insecure      bool          // skip verification of upstream's certificate
+	caCert        string        // path of CAs verifying upstream's certificate, system's CAs if empty
+	timeout       time.Duration // response header timeout, proxy's default if zero
+
+	maxIdleConnsPerHost int // pooling overrides of the route, proxy's TransportConfig used if zero
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+}
+
+// upstreamTransport passes upstream requests to http.Transport made for the destination host and
+// the route's transport options. Transports created on demand and shared by all routes with the same
+// host and options. This way connections dialed with different TLS server names never reused by the wrong
+// route, and busy hosts can't exhaust pooled connections of others.
+type upstreamTransport struct {
+	makeTransport func(opts transportOpts) *http.Transport
+	backoff       time.Duration // initial delay of retries, doubled on each retry, defaultRetryBackoff if zero
+
+	lock       sync.Mutex
+	transports map[transportOpts]*http.Transport
+}
+
+// RoundTrip implements http.RoundTripper, picks transport by options set in request's context
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	opts, _ := req.Context().Value(contextKey("transport")).(transportOpts)
+	tr := t.transport(opts)
+	if retries, ok := req.Context().Value(contextKey("retries")).(int); ok && retries > 0 && retryable(req) {
+		return t.retry(tr, req, retries)
+	}
+	return tr.RoundTrip(req)
+}
+
+func (t *upstreamTransport) transport(opts transportOpts) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.transports == nil {
+		t.transports = map[transportOpts]*http.Transport{}
+	}
+	if tr, ok := t.transports[opts]; ok {
+		return tr
+	}
+	tr := t.makeTransport(opts)
+	t.transports[opts] = tr
+	return tr
+}
+
+// upstreamTransport returns transport of upstream requests, shared by proxied requests and pings of destinations
+func (h *Http) upstreamTransport() *upstreamTransport {
+	h.upstreamOnce.Do(func() { h.upstream = &upstreamTransport{makeTransport: h.makeTransport} })
+	return h.upstream
+}
+
+// PingClient makes client pinging the mapper's destination with transport options of its route, the same way
+// as proxied requests. This way destinations behind self-signed certificates or unix sockets checked by health
+// checks with the route's insecure, ca-cert, tls server name and resolve options
+func (h *Http) PingClient(m discovery.URLMapper) *http.Client {
+	host := ""
+	uu, socket, err := parseDestination(m.PingURL)
+	if err == nil {
+		host = uu.Host
+	}
+	return &http.Client{Transport: h.upstreamTransport().transport(routeTransportOpts(m, host, socket))}
+}
+
+// routeTransportOpts makes transport options of the mapper's request to the host, or to the unix socket if set
+func routeTransportOpts(m discovery.URLMapper, host, socket string) transportOpts {
+	return transportOpts{host: host, socket: socket, resolve: resolveOpt(m.Resolve),
+		tlsServerName: m.TLSServerName, insecure: m.InsecureSkipVerify, caCert: m.CACert, timeout: m.Timeout,
+		maxIdleConnsPerHost: m.MaxIdleConnsPerHost, maxConnsPerHost: m.MaxConnsPerHost, idleConnTimeout: m.IdleConnTimeout}
+}
+
+// resolveOpt makes canonical form of host to ip overrides, the same for equal maps, to be a part of transportOpts.
+// Routes with different overrides of the same host get different transports and never share connections
+func resolveOpt(resolve map[string]string) string {
+	pairs := make([]string, 0, len(resolve))
+	for host, ip := range resolve {
+		pairs = append(pairs, host+"="+ip)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// makeTransport makes upstream transport for given options
+func (h *Http) makeTransport(opts transportOpts) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	timeout := h.TimeOut
+	if opts.timeout > 0 {
+		timeout = opts.timeout
+	}
+
+	maxIdlePerHost, maxPerHost, idleTimeout := h.Transport.MaxIdleConnsPerHost, h.Transport.MaxConnsPerHost, h.Transport.IdleConnTimeout
+	if opts.maxIdleConnsPerHost > 0 {
+		maxIdlePerHost = opts.maxIdleConnsPerHost
+	}
+	if opts.maxConnsPerHost > 0 {
+		maxPerHost = opts.maxConnsPerHost
+	}
+	if opts.idleConnTimeout > 0 {
+		idleTimeout = opts.idleConnTimeout
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = 90 * time.Second
+	}
+
+	resolve := map[string]string{}
+	for _, pair := range strings.Split(opts.resolve, ",") {
+		if elems := strings.SplitN(pair, "=", 2); len(elems) == 2 {
+			resolve[elems[0]] = elems[1]
+		}
+	}
+
+	res := &http.Transport{
+		ResponseHeaderTimeout: timeout,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opts.socket != "" {
+				return dialer.DialContext(ctx, "unix", opts.socket)
+			}
+			// dial static ip if destination host overridden by the matched route
+			if host, port, err := net.SplitHostPort(addr); err == nil {
+				if ip, found := resolve[host]; found {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		// pass compressed responses and client's Accept-Encoding through as-is, without transparent decompression
+		DisableCompression:    true,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		MaxConnsPerHost:       maxPerHost,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if opts.tlsServerName != "" || opts.insecure || opts.caCert != "" {
+		// verify upstream certificate against the name instead of the dialed host, i.e. container's ip
+		res.TLSClientConfig = &tls.Config{ServerName: opts.tlsServerName, InsecureSkipVerify: opts.insecure} //nolint gosec
+	}
+	if opts.caCert != "" {
+		res.TLSClientConfig.RootCAs = loadCACert(opts.caCert)
+	}
+	return res
+}
+
+// loadCACert loads pool of CAs from PEM file. Empty pool returned if the file can't be loaded,
+// upstream's certificate never verified by system's CAs instead of the route's ones
+func loadCACert(fname string) *x509.CertPool {
+	res := x509.NewCertPool()
+	data, err := os.ReadFile(fname) //nolint gosec
+	if err != nil {
+		log.Printf("[WARN] can't load ca cert %s, %v", fname, err)
+		return res
+	}
+	if !res.AppendCertsFromPEM(data) {
+		log.Printf("[WARN] no certificates in ca cert %s", fname)
+	}
+	return res
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamTransport_TLSServerName(t *testing.T) {
+	cert, pool := makeTestCert(t, "backend.example.com")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure response"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint gosec
+	ts.StartTLS()
+	defer ts.Close()
+
+	h := Http{TimeOut: 200 * time.Millisecond}
+	ut := &upstreamTransport{makeTransport: func(opts transportOpts) *http.Transport {
+		tr := h.makeTransport(opts)
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{} //nolint gosec
+		}
+		tr.TLSClientConfig.RootCAs = pool
+		return tr
+	}}
+	client := http.Client{Transport: ut}
+
+	{ // dialed by ip, certificate issued for the name only
+		req, err := http.NewRequest("GET", ts.URL+"/something", nil)
+		require.NoError(t, err)
+		_, err = client.Do(req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "certificate")
+	}
+
+	{ // dialed by ip, verified by server name override
+		req, err := http.NewRequest("GET", ts.URL+"/something", nil)
+		require.NoError(t, err)
+		ctx := context.WithValue(req.Context(), contextKey("transport"),
+			transportOpts{tlsServerName: "backend.example.com"})
+		resp, err := client.Do(req.WithContext(ctx))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "secure response", string(body))
+	}
+
+	assert.Equal(t, 2, len(ut.transports), "separate transports for different options")
+}
+
+func TestUpstreamTransport_Verification(t *testing.T) {
+	cert, _ := makeTestCert(t, "backend.example.com")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure response"))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}} //nolint gosec
+	ts.StartTLS()
+	defer ts.Close()
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	badCert := filepath.Join(t.TempDir(), "bad.pem")
+	require.NoError(t, os.WriteFile(badCert, []byte("not a cert"), 0o600))
+
+	h := Http{TimeOut: 200 * time.Millisecond}
+	client := http.Client{Transport: &upstreamTransport{makeTransport: h.makeTransport}}
+
+	tbl := []struct {
+		name string
+		opts transportOpts
+		ok   bool
+	}{
+		{"default", transportOpts{}, false},
+		{"insecure", transportOpts{insecure: true}, true},
+		{"ca cert", transportOpts{caCert: caCert, tlsServerName: "backend.example.com"}, true},
+		{"ca cert and wrong name", transportOpts{caCert: caCert, tlsServerName: "other.example.com"}, false},
+		{"bad ca cert", transportOpts{caCert: badCert, tlsServerName: "backend.example.com"}, false},
+		{"missing ca cert", transportOpts{caCert: "/no-such-file.pem", tlsServerName: "backend.example.com"}, false},
+	}
+	for _, tt := range tbl {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+"/something", nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req.WithContext(context.WithValue(req.Context(), contextKey("transport"), tt.opts)))
+			if !tt.ok {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "certificate")
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "secure response", string(body))
+		})
+	}
+}
+
+func TestUpstreamTransport_PerHost(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("response")) })
+	ts1, ts2 := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer ts1.Close()
+	defer ts2.Close()
+
+	h := Http{TimeOut: 200 * time.Millisecond, Transport: TransportConfig{MaxIdleConnsPerHost: 5, IdleConnTimeout: time.Minute}}
+	ut := &upstreamTransport{makeTransport: h.makeTransport}
+	client := http.Client{Transport: ut}
+
+	get := func(dst string, opts transportOpts) {
+		u, err := url.Parse(dst)
+		require.NoError(t, err)
+		opts.host = u.Host
+		req, err := http.NewRequest("GET", dst, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req.WithContext(context.WithValue(req.Context(), contextKey("transport"), opts)))
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	get(ts1.URL+"/something", transportOpts{})
+	get(ts1.URL+"/other", transportOpts{})
+	get(ts2.URL+"/something", transportOpts{})
+	override := transportOpts{maxIdleConnsPerHost: 20, maxConnsPerHost: 50, idleConnTimeout: time.Second}
+	get(ts1.URL+"/something", override)
+	require.Equal(t, 3, len(ut.transports), "transport per host and route's options")
+
+	u1, err := url.Parse(ts1.URL)
+	require.NoError(t, err)
+	tr := ut.transports[transportOpts{host: u1.Host}]
+	require.NotNil(t, tr)
+	assert.Equal(t, 5, tr.MaxIdleConnsPerHost, "proxy's default")
+	assert.Equal(t, 0, tr.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+
+	override.host = u1.Host
+	tr = ut.transports[override]
+	require.NotNil(t, tr)
+	assert.Equal(t, 20, tr.MaxIdleConnsPerHost, "route's override")
+	assert.Equal(t, 50, tr.MaxConnsPerHost)
+	assert.Equal(t, time.Second, tr.IdleConnTimeout)
+
+	assert.Equal(t, 90*time.Second, (&Http{}).makeTransport(transportOpts{}).IdleConnTimeout, "default idle timeout")
+}
+
+func BenchmarkUpstreamTransport_Reuse(b *testing.B) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response"))
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(b, err)
+
+	for _, maxIdle := range []int{1, 100} {
+		b.Run(fmt.Sprintf("max-idle-%d", maxIdle), func(b *testing.B) {
+			ut := &upstreamTransport{makeTransport: (&Http{TimeOut: time.Second}).makeTransport}
+			ctx := context.WithValue(context.Background(), contextKey("transport"),
+				transportOpts{host: u.Host, maxIdleConnsPerHost: maxIdle})
+			atomic.StoreInt32(&conns, 0)
+			b.SetParallelism(10)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/something", nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					resp, err := ut.RoundTrip(req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+			b.ReportMetric(float64(atomic.LoadInt32(&conns))/float64(b.N), "conns/op")
+			ut.transport(transportOpts{host: u.Host, maxIdleConnsPerHost: maxIdle}).CloseIdleConnections()
+		})
+	}
+}
+
+// makeTestCert makes self-signed certificate for the name, without any ip addresses
+func makeTestCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	crt, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(crt)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestResolveOpt(t *testing.T) {
+	assert.Equal(t, "", resolveOpt(nil))
+	assert.Equal(t, "a.local=10.0.0.1,b.local=10.0.0.2",
+		resolveOpt(map[string]string{"b.local": "10.0.0.2", "a.local": "10.0.0.1"}), "sorted by host")
+	assert.NotEqual(t, resolveOpt(map[string]string{"a.local": "10.0.0.1"}), resolveOpt(map[string]string{"a.local": "10.0.0.2"}))
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isWebsocket checks if request asks for websocket upgrade
+func isWebsocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// httpScheme returns http scheme of ws and wss destinations, upgrade requests sent over http(s)
+func httpScheme(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "ws":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	return scheme
+}
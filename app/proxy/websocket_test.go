@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint gosec
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/reproxy/app/discovery"
+	"github.com/umputun/reproxy/app/discovery/provider"
+)
+
+func TestHttp_DoWebsocket(t *testing.T) {
+	ds := httptest.NewServer(http.HandlerFunc(wsEchoHandler(t)))
+	defer ds.Close()
+
+	svc := discovery.NewService([]discovery.Provider{&provider.Static{Rules: []string{
+		"*,^/api/(.*)," + ds.URL + "/$1,",
+		"*,^/ws/(.*)," + strings.Replace(ds.URL, "http://", "ws://", 1) + "/$1,",
+	}}})
+	go func() {
+		_ = svc.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, metrics := range []bool{false, true} {
+		for _, path := range []string{"/api/echo", "/ws/echo"} {
+			metrics, path := metrics, path
+			t.Run(fmt.Sprintf("%s metrics=%v", path, metrics), func(t *testing.T) {
+				port := rand.Intn(10000) + 40000
+				h := Http{TimeOut: 200 * time.Millisecond, Address: fmt.Sprintf("127.0.0.1:%d", port),
+					AccessLog: io.Discard, AccessLogFormat: AccessLogText, Matcher: svc, MetricsEnabled: metrics}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				go func() {
+					_ = h.Run(ctx)
+				}()
+				time.Sleep(10 * time.Millisecond)
+
+				conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+				require.NoError(t, err)
+				defer conn.Close()
+				_, err = fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: 127.0.0.1\r\nUpgrade: websocket\r\n"+
+					"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+					"Sec-WebSocket-Version: 13\r\n\r\n", path)
+				require.NoError(t, err)
+
+				rd := bufio.NewReader(conn)
+				resp, err := http.ReadResponse(rd, nil)
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+				assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+				for _, msg := range []string{"hello", "world"} {
+					require.NoError(t, wsWriteFrame(conn, []byte(msg), true))
+					reply, err := wsReadFrame(rd)
+					require.NoError(t, err)
+					assert.Equal(t, msg, string(reply))
+				}
+			})
+		}
+	}
+}
+
+func TestIsWebsocket(t *testing.T) {
+	tbl := []struct {
+		upgrade, connection string
+		res                 bool
+	}{
+		{"websocket", "Upgrade", true},
+		{"WebSocket", "keep-alive, upgrade", true},
+		{"websocket", "keep-alive", false},
+		{"h2c", "Upgrade", false},
+		{"", "", false},
+	}
+	for i, tt := range tbl {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Upgrade", tt.upgrade)
+		r.Header.Set("Connection", tt.connection)
+		assert.Equal(t, tt.res, isWebsocket(r), strconv.Itoa(i))
+	}
+}
+
+// wsEchoHandler accepts websocket upgrade and echoes text frames back
+func wsEchoHandler(t *testing.T) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) || r.URL.Path != "/echo" {
+			http.Error(w, "not a websocket", http.StatusBadRequest)
+			return
+		}
+		h := sha1.New() //nolint gosec
+		_, _ = h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, _ = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		_ = rw.Flush()
+		for {
+			msg, err := wsReadFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			if err = wsWriteFrame(rw, msg, false); err != nil {
+				return
+			}
+			_ = rw.Flush()
+		}
+	}
+}
+
+// wsWriteFrame writes a short text frame, masked as client frames should be
+func wsWriteFrame(w io.Writer, payload []byte, masked bool) error {
+	frame := []byte{0x81, byte(len(payload))}
+	data := append([]byte{}, payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// wsReadFrame reads a short frame and returns unmasked payload
+func wsReadFrame(rd *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return nil, err
+	}
+	var mask []byte
+	if hdr[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(rd, mask); err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, hdr[1]&0x7f)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		return nil, err
+	}
+	for i := range data {
+		if mask != nil {
+			data[i] ^= mask[i%4]
+		}
+	}
+	return data, nil
+}
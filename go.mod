@@ -7,6 +7,7 @@ require (
 	github.com/go-pkgz/lgr v0.10.4
 	github.com/go-pkgz/rest v1.8.1
 	github.com/gorilla/handlers v1.5.1
+	github.com/lib/pq v1.10.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
 	github.com/umputun/go-flags v1.5.1